@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Defaults of the SLO hints
+const (
+	defaultMaxRestarts = 3
+	defaultMaxPending  = 1000
+	// ratio of max_connections in use before PostgresConnectionsNearLimit fires
+	postgresConnectionsThreshold = 0.8
+)
+
+// defaultErrorBudgets is the ratio of 5xx responses allowed on the routers of each tier
+var defaultErrorBudgets = map[string]float64{"critical": 0.01, "best-effort": 0.05}
+
+// alertRulesDir is the directory of the rule files, mounted into Prometheus
+const alertRulesDir = "rules"
+
+// alertRulesFile is the rule file written by deployment monitoring
+const alertRulesFile = "alerts.yml"
+
+var prometheusAlertName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// PrometheusRuleFile represents a Prometheus rule file
+type PrometheusRuleFile struct {
+	Groups []PrometheusRuleGroup `yaml:"groups"`
+}
+
+// PrometheusRuleGroup is a group of rules evaluated together
+type PrometheusRuleGroup struct {
+	Name     string           `yaml:"name"`
+	Interval string           `yaml:"interval,omitempty"`
+	Rules    []PrometheusRule `yaml:"rules"`
+}
+
+// PrometheusRule is an alerting or recording rule
+type PrometheusRule struct {
+	Alert       string            `yaml:"alert,omitempty"`
+	Record      string            `yaml:"record,omitempty"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// sloSettings returns the SLO hints of a service with their defaults applied
+func sloSettings(service ServiceConfig) SLOConfig {
+	var slo SLOConfig
+	if service.SLO != nil {
+		slo = *service.SLO
+	}
+	slo.Tier = valueOrDefault(slo.Tier, "best-effort")
+	if slo.MaxRestarts == 0 {
+		slo.MaxRestarts = defaultMaxRestarts
+	}
+	if slo.MaxPending == 0 {
+		slo.MaxPending = defaultMaxPending
+	}
+	if slo.ErrorBudget == 0 {
+		slo.ErrorBudget = defaultErrorBudgets[slo.Tier]
+	}
+
+	return slo
+}
+
+// alertSeverity maps a tier to the severity label and the for duration of its alerts
+func alertSeverity(tier string) (string, string) {
+	if tier == "critical" {
+		return "critical", "2m"
+	}
+	return "warning", "10m"
+}
+
+// validateSLOConfig reports invalid SLO hints
+func validateSLOConfig(config Config) []string {
+	var problems []string
+	for _, service := range getAllServiceConfigs(config) {
+		if service.SLO == nil {
+			continue
+		}
+		slo := service.SLO
+		if slo.Tier != "" && slo.Tier != "critical" && slo.Tier != "best-effort" {
+			problems = append(problems, fmt.Sprintf("service %s: slo tier must be critical or best-effort, not %q", service.Name, slo.Tier))
+		}
+		if slo.Replicas < 0 || slo.MaxRestarts < 0 || slo.MaxPending < 0 {
+			problems = append(problems, fmt.Sprintf("service %s: slo replicas, max_restarts and max_pending cannot be negative", service.Name))
+		}
+		if slo.ErrorBudget < 0 || slo.ErrorBudget >= 1 {
+			problems = append(problems, fmt.Sprintf("service %s: slo error_budget must be a ratio between 0 and 1, like 0.01", service.Name))
+		}
+		if slo.StaleAfter != "" && !promqlDuration.MatchString(slo.StaleAfter) {
+			problems = append(problems, fmt.Sprintf("service %s: slo stale_after %q is not a duration like 6h", service.Name, slo.StaleAfter))
+		}
+	}
+
+	return problems
+}
+
+// getTemplateRouters returns the Traefik routers declared by each service of the template
+func getTemplateRouters(templateFile string) map[string][]string {
+	routers := make(map[string][]string)
+
+	templateBytes, err := os.ReadFile(templateFile)
+	if err != nil {
+		fmt.Printf("Warning: unable to read template file %s for routers: %v\n", templateFile, err)
+		return routers
+	}
+
+	var dockerCompose DockerComposeConfig
+	if err := yaml.Unmarshal(templateBytes, &dockerCompose); err != nil {
+		fmt.Printf("Warning: unable to parse template file %s for routers: %v\n", templateFile, err)
+		return routers
+	}
+
+	for serviceName, service := range dockerCompose.Services {
+		if names := serviceRouters(serviceLabels(service)); len(names) > 0 {
+			routers[serviceName] = names
+		}
+	}
+
+	return routers
+}
+
+// buildAlertRules derives the alert rules of the services from their SLO hints: targets down, missing replicas,
+// restarts, 5xx ratio of their Traefik routers, NATS consumer lag and stale crawlers, plus Postgres connections.
+func buildAlertRules(config Config, routers map[string][]string, environment string) (PrometheusRuleFile, []string) {
+	var warnings []string
+	services := PrometheusRuleGroup{Name: "services"}
+	traefik := PrometheusRuleGroup{Name: "traefik"}
+	infrastructure := PrometheusRuleGroup{Name: "infrastructure"}
+	messaging := PrometheusRuleGroup{Name: "messaging"}
+
+	exporters := boolValue(monitoringSettings(config).Exporters, true)
+	traefikMetrics := false
+	if _, ok := getTraefikService(config); ok {
+		settings := traefikSettingsForEnvironment(config, environment)
+		traefikMetrics = boolValue(settings.Metrics, settings.Profile != "dev")
+	}
+
+	for _, service := range config.Services {
+		slo := sloSettings(service)
+		severity, duration := alertSeverity(slo.Tier)
+		labels := map[string]string{"severity": severity, "service": service.Name, "tier": slo.Tier}
+
+		if service.Metrics != nil {
+			job := fmt.Sprintf(`job="%s"`, service.Name)
+			services.Rules = append(services.Rules,
+				PrometheusRule{
+					Alert:  "ServiceDown",
+					Expr:   fmt.Sprintf("up{%s} == 0", job),
+					For:    duration,
+					Labels: labels,
+					Annotations: map[string]string{
+						"summary":     fmt.Sprintf("%s is down", service.Name),
+						"description": "Prometheus cannot scrape {{ $labels.instance }} of " + service.Name + ".",
+					},
+				},
+				PrometheusRule{
+					Alert:  "ServiceRestarting",
+					Expr:   fmt.Sprintf("changes(process_start_time_seconds{%s}[1h]) > %d", job, slo.MaxRestarts),
+					Labels: labels,
+					Annotations: map[string]string{
+						"summary":     fmt.Sprintf("%s restarts too often", service.Name),
+						"description": fmt.Sprintf("{{ $labels.instance }} restarted {{ $value }} times in the last hour, more than %d.", slo.MaxRestarts),
+					},
+				},
+			)
+			if slo.Replicas > 1 {
+				services.Rules = append(services.Rules, PrometheusRule{
+					Alert:  "ServiceReplicasMissing",
+					Expr:   fmt.Sprintf("(count(up{%s} == 1) or vector(0)) < %d", job, slo.Replicas),
+					For:    duration,
+					Labels: labels,
+					Annotations: map[string]string{
+						"summary":     fmt.Sprintf("%s runs fewer than %d replicas", service.Name, slo.Replicas),
+						"description": fmt.Sprintf("Only {{ $value }} of the %d expected replicas of %s are up.", slo.Replicas, service.Name),
+					},
+				})
+			}
+		} else if service.SLO != nil && (service.SLO.Replicas > 0 || service.SLO.MaxRestarts > 0) {
+			warnings = append(warnings, fmt.Sprintf("service %s has replicas or max_restarts hints but no metrics section, no rule is generated for them", service.Name))
+		}
+
+		if serviceRouterNames := routers[service.Name]; len(serviceRouterNames) > 0 {
+			if !traefikMetrics {
+				if service.SLO != nil && service.SLO.ErrorBudget > 0 {
+					warnings = append(warnings, fmt.Sprintf("Traefik metrics are disabled in the %s environment, no error budget rule for service %s", environment, service.Name))
+				}
+			} else {
+				for _, router := range serviceRouterNames {
+					selector := fmt.Sprintf(`router=~"%s@.*"`, router)
+					traefik.Rules = append(traefik.Rules, PrometheusRule{
+						Alert: "RouterErrorBudgetBurn",
+						Expr: fmt.Sprintf(`sum(rate(traefik_router_requests_total{%s,code=~"5.."}[5m])) / sum(rate(traefik_router_requests_total{%s}[5m])) > %s`,
+							selector, selector, strconv.FormatFloat(slo.ErrorBudget, 'f', -1, 64)),
+						For:    "5m",
+						Labels: map[string]string{"severity": severity, "service": service.Name, "tier": slo.Tier, "router": router},
+						Annotations: map[string]string{
+							"summary":     fmt.Sprintf("Router %s returns too many 5xx responses", router),
+							"description": fmt.Sprintf("{{ $value | humanizePercentage }} of the requests to %s failed over 5 minutes, the error budget is %s.", router, strconv.FormatFloat(slo.ErrorBudget*100, 'f', -1, 64)+"%"),
+						},
+					})
+				}
+			}
+		}
+	}
+
+	if exporters {
+		for _, exporter := range infraExporters {
+			service, ok := infraServiceOfKind(config, exporter.Kind)
+			if !ok {
+				continue
+			}
+			infrastructure.Rules = append(infrastructure.Rules, PrometheusRule{
+				Alert:  "ServiceDown",
+				Expr:   fmt.Sprintf(`up{job="%s"} == 0`, service.Name),
+				For:    "2m",
+				Labels: map[string]string{"severity": "critical", "service": service.Name, "tier": "critical"},
+				Annotations: map[string]string{
+					"summary":     fmt.Sprintf("%s exporter is down", service.Name),
+					"description": fmt.Sprintf("Prometheus cannot scrape the %s exporter, %s may be down.", exporter.Kind, service.Name),
+				},
+			})
+		}
+
+		if service, ok := infraServiceOfKind(config, "postgres"); ok {
+			infrastructure.Rules = append(infrastructure.Rules, PrometheusRule{
+				Alert:  "PostgresConnectionsNearLimit",
+				Expr:   fmt.Sprintf("sum(pg_stat_database_numbackends) / scalar(max(pg_settings_max_connections)) > %s", strconv.FormatFloat(postgresConnectionsThreshold, 'f', -1, 64)),
+				For:    "5m",
+				Labels: map[string]string{"severity": "warning", "service": service.Name},
+				Annotations: map[string]string{
+					"summary":     "Postgres connections near max_connections",
+					"description": "{{ $value | humanizePercentage }} of max_connections are in use, new connections will soon be refused.",
+				},
+			})
+		}
+
+		if _, ok := infraServiceOfKind(config, "nats"); ok {
+			for _, service := range messagingServices(config) {
+				slo := sloSettings(service)
+				severity, duration := alertSeverity(slo.Tier)
+				for _, consumer := range service.Nats.Consumers {
+					messaging.Rules = append(messaging.Rules, PrometheusRule{
+						Alert:  "NatsConsumerLagging",
+						Expr:   fmt.Sprintf(`max(jetstream_consumer_num_pending{stream_name="%s",consumer_name="%s"}) > %d`, consumer.Stream, consumer.Name, slo.MaxPending),
+						For:    duration,
+						Labels: map[string]string{"severity": severity, "service": service.Name, "tier": slo.Tier, "consumer": consumer.Name},
+						Annotations: map[string]string{
+							"summary":     fmt.Sprintf("Consumer %s of %s is lagging", consumer.Name, service.Name),
+							"description": fmt.Sprintf("{{ $value }} messages of stream %s are pending for consumer %s, more than %d.", consumer.Stream, consumer.Name, slo.MaxPending),
+						},
+					})
+				}
+
+				if slo.StaleAfter == "" {
+					continue
+				}
+				var streams []string
+				for _, streamOwner := range messagingServices(config) {
+					for _, stream := range streamOwner.Nats.Streams {
+						for _, subject := range service.Nats.Publish {
+							if anySubjectOverlaps(subject, stream.Subjects) && !slices.Contains(streams, stream.Name) {
+								streams = append(streams, stream.Name)
+							}
+						}
+					}
+				}
+				if len(streams) == 0 {
+					warnings = append(warnings, fmt.Sprintf("service %s has a stale_after hint but publishes to no declared stream", service.Name))
+					continue
+				}
+				sort.Strings(streams)
+				for _, stream := range streams {
+					messaging.Rules = append(messaging.Rules, PrometheusRule{
+						Alert:  "CrawlerStale",
+						Expr:   fmt.Sprintf(`changes(jetstream_stream_last_seq{stream_name="%s"}[%s]) == 0`, stream, slo.StaleAfter),
+						Labels: map[string]string{"severity": severity, "service": service.Name, "tier": slo.Tier, "stream": stream},
+						Annotations: map[string]string{
+							"summary":     fmt.Sprintf("%s published nothing for %s", service.Name, slo.StaleAfter),
+							"description": fmt.Sprintf("Stream %s received no message in %s, %s may be stuck or its source unavailable.", stream, slo.StaleAfter, service.Name),
+						},
+					})
+				}
+			}
+		}
+	} else if service, ok := infraServiceOfKind(config, "nats"); ok && len(messagingServices(config)) > 0 {
+		warnings = append(warnings, fmt.Sprintf("exporters are disabled, no consumer lag or staleness rule for %s", service.Name))
+	}
+
+	var rules PrometheusRuleFile
+	for _, group := range []PrometheusRuleGroup{services, traefik, infrastructure, messaging} {
+		if len(group.Rules) > 0 {
+			rules.Groups = append(rules.Groups, group)
+		}
+	}
+
+	return rules, warnings
+}
+
+// checkRuleFile reports the problems of a rule file: unknown fields, invalid names, durations, labels, templates
+// and the syntax and types of every expression
+func checkRuleFile(content []byte) []string {
+	var rules PrometheusRuleFile
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&rules); err != nil {
+		return []string{fmt.Sprintf("invalid rule file: %v", err)}
+	}
+
+	var problems []string
+	groups := make(map[string]bool)
+	for _, group := range rules.Groups {
+		if group.Name == "" {
+			problems = append(problems, "group without a name")
+		} else if groups[group.Name] {
+			problems = append(problems, fmt.Sprintf("group %s is defined twice", group.Name))
+		}
+		groups[group.Name] = true
+		if group.Interval != "" && !promqlDuration.MatchString(group.Interval) {
+			problems = append(problems, fmt.Sprintf("group %s: invalid interval %q", group.Name, group.Interval))
+		}
+
+		for i, rule := range group.Rules {
+			name := valueOrDefault(rule.Alert, rule.Record)
+			where := fmt.Sprintf("group %s, rule %d (%s)", group.Name, i+1, name)
+
+			switch {
+			case rule.Alert != "" && rule.Record != "":
+				problems = append(problems, where+": a rule is either an alert or a record")
+			case rule.Alert == "" && rule.Record == "":
+				problems = append(problems, where+": rule needs an alert or record name")
+			case rule.Alert != "" && !prometheusAlertName.MatchString(rule.Alert):
+				problems = append(problems, fmt.Sprintf("%s: invalid alert name %q", where, rule.Alert))
+			case rule.Record != "" && !promqlMetricName.MatchString(rule.Record):
+				problems = append(problems, fmt.Sprintf("%s: invalid record name %q", where, rule.Record))
+			}
+			if rule.Record != "" && (rule.For != "" || len(rule.Annotations) > 0) {
+				problems = append(problems, where+": recording rules take no for or annotations")
+			}
+			if rule.For != "" && !promqlDuration.MatchString(rule.For) {
+				problems = append(problems, fmt.Sprintf("%s: invalid for duration %q", where, rule.For))
+			}
+			if err := checkPromQL(rule.Expr); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", where, err))
+			}
+			for label := range rule.Labels {
+				if !promqlLabelName.MatchString(label) || strings.HasPrefix(label, "__") {
+					problems = append(problems, fmt.Sprintf("%s: invalid label name %q", where, label))
+				}
+			}
+			for annotation, text := range rule.Annotations {
+				if strings.Count(text, "{{") != strings.Count(text, "}}") {
+					problems = append(problems, fmt.Sprintf("%s: unbalanced template braces in annotation %s", where, annotation))
+				}
+			}
+		}
+	}
+
+	return problems
+}
+
+// CheckAlertRules checks every rule file of the rules directory, exiting with an error when one has problems
+func CheckAlertRules(outputDir string) {
+	scriptDir, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("Error getting current directory: %v\n", err)
+		return
+	}
+	rulesDir := filepath.Join(resolveFilePath(outputDir, scriptDir, scriptDir), alertRulesDir)
+
+	files, _ := filepath.Glob(filepath.Join(rulesDir, "*.yml"))
+	yamlFiles, _ := filepath.Glob(filepath.Join(rulesDir, "*.yaml"))
+	files = append(files, yamlFiles...)
+	if len(files) == 0 {
+		fmt.Printf("No rule files in %s, nothing to check.\n", rulesDir)
+		return
+	}
+
+	failed := 0
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Printf("Error reading %s: %v\n", file, err)
+			failed++
+			continue
+		}
+		problems := checkRuleFile(content)
+		for _, problem := range problems {
+			fmt.Printf("ERROR    %-30s %s\n", filepath.Base(file), problem)
+		}
+		if len(problems) > 0 {
+			failed++
+		}
+	}
+
+	fmt.Printf("Checked %d rule files: %d with errors\n", len(files), failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckRuleFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		problem string // part of the expected problem, empty when the file is valid
+	}{
+		{"valid", `groups:
+  - name: services
+    interval: 30s
+    rules:
+      - alert: ServiceDown
+        expr: up{job="api"} == 0
+        for: 2m
+        labels: {severity: critical}
+        annotations: {summary: "{{ $labels.instance }} is down"}
+      - record: job:http_requests:rate5m
+        expr: sum by (job) (rate(http_requests_total[5m]))
+`, ""},
+		{"unknown field", "groups:\n  - name: services\n    rules:\n      - alert: Down\n        expression: up == 0\n", "invalid rule file"},
+		{"duplicate group", "groups:\n  - name: a\n  - name: a\n", "defined twice"},
+		{"invalid interval", "groups:\n  - name: a\n    interval: 30 seconds\n", "invalid interval"},
+		{"alert and record", "groups:\n  - name: a\n    rules:\n      - {alert: Down, record: down, expr: up}\n", "either an alert or a record"},
+		{"unnamed rule", "groups:\n  - name: a\n    rules:\n      - {expr: up}\n", "needs an alert or record name"},
+		{"invalid alert name", "groups:\n  - name: a\n    rules:\n      - {alert: service-down, expr: up == 0}\n", "invalid alert name"},
+		{"recording rule with for", "groups:\n  - name: a\n    rules:\n      - {record: job:up, expr: up, for: 5m}\n", "take no for"},
+		{"invalid for", "groups:\n  - name: a\n    rules:\n      - {alert: Down, expr: up == 0, for: soon}\n", "invalid for duration"},
+		{"invalid expression", "groups:\n  - name: a\n    rules:\n      - {alert: Down, expr: rate(up) > 0}\n", "range vector"},
+		{"reserved label", "groups:\n  - name: a\n    rules:\n      - {alert: Down, expr: up == 0, labels: {__name__: x}}\n", "invalid label name"},
+		{"unbalanced template", "groups:\n  - name: a\n    rules:\n      - {alert: Down, expr: up == 0, annotations: {summary: \"{{ $labels.job down\"}}\n", "unbalanced template braces"},
+	}
+	for _, test := range tests {
+		problems := checkRuleFile([]byte(test.content))
+		if test.problem == "" {
+			if len(problems) > 0 {
+				t.Errorf("%s: problems = %v, want none", test.name, problems)
+			}
+			continue
+		}
+		if len(problems) != 1 || !strings.Contains(problems[0], test.problem) {
+			t.Errorf("%s: problems = %v, want one about %q", test.name, problems, test.problem)
+		}
+	}
+}
+
+func TestBuildAlertRulesPassCheckRuleFile(t *testing.T) {
+	config := Config{
+		CommonServices: []ServiceConfig{
+			{Name: "postgres", Prefix: "POSTGRES_"},
+			{Name: "redis", Prefix: "REDIS_"},
+			{Name: "nats", Prefix: "NATS_"},
+			{Name: "traefik", Prefix: "TRAEFIK_"},
+		},
+		Services: []ServiceConfig{
+			{
+				Name: "api", Prefix: "API_",
+				Metrics: &MetricsConfig{Port: "8080"},
+				SLO:     &SLOConfig{Tier: "critical", Replicas: 2, ErrorBudget: 0.01},
+				Nats:    &NatsConfig{Streams: []NatsStreamConfig{{Name: "JOBS", Subjects: []string{"jobs.>"}}}},
+			},
+			{
+				Name: "crawler", Prefix: "CRAWLER_",
+				SLO:  &SLOConfig{StaleAfter: "6h", MaxPending: 500},
+				Nats: &NatsConfig{Publish: []string{"jobs.crawl"}, Consumers: []NatsConsumerConfig{{Name: "worker", Stream: "JOBS"}}},
+			},
+		},
+		Traefik: TraefikConfig{TraefikSettings: TraefikSettings{Profile: "prod"}},
+	}
+	routers := map[string][]string{"api": {"api", "api-admin"}}
+
+	rules, warnings := buildAlertRules(config, routers, "prod")
+	if len(warnings) > 0 {
+		t.Errorf("warnings = %v", warnings)
+	}
+	alerts := make(map[string]bool)
+	for _, group := range rules.Groups {
+		for _, rule := range group.Rules {
+			alerts[rule.Alert] = true
+		}
+	}
+	for _, alert := range []string{"ServiceDown", "ServiceReplicasMissing", "ServiceRestarting", "RouterErrorBudgetBurn", "NatsConsumerLagging", "CrawlerStale", "PostgresConnectionsNearLimit"} {
+		if !alerts[alert] {
+			t.Errorf("alert %s missing from %v", alert, alerts)
+		}
+	}
+
+	content, err := marshalYAML(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := checkRuleFile(content); len(problems) > 0 {
+		t.Errorf("generated rules fail the check:\n  %s\n%s", strings.Join(problems, "\n  "), content)
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultBakeCacheDir holds the local build cache of the bake targets
+const defaultBakeCacheDir = ".buildx-cache"
+
+// bakeVariableReference matches a compose variable reference like ${IMAGE_TAG} or ${IMAGE_TAG:-latest}
+var bakeVariableReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?::?-([^}]*))?\}`)
+
+// BakeFile represents docker-bake.json, docker-bake.hcl is rendered from the same structure
+type BakeFile struct {
+	Variable map[string]BakeVariable `json:"variable,omitempty"`
+	Group    map[string]BakeGroup    `json:"group"`
+	Target   map[string]BakeTarget   `json:"target"`
+}
+
+// BakeVariable is a variable of the bake file, overridden by the environment variable of the same name
+type BakeVariable struct {
+	Default string `json:"default"`
+}
+
+// BakeGroup builds several targets at once
+type BakeGroup struct {
+	Targets []string `json:"targets"`
+}
+
+// BakeTarget is the build of the image of a service
+type BakeTarget struct {
+	Context    string            `json:"context"`
+	Dockerfile string            `json:"dockerfile"`
+	Tags       []string          `json:"tags,omitempty"`
+	Args       map[string]string `json:"args,omitempty"`
+	Platforms  []string          `json:"platforms,omitempty"`
+	CacheFrom  []string          `json:"cache-from,omitempty"`
+	CacheTo    []string          `json:"cache-to,omitempty"`
+}
+
+// bakeSettings returns the bake settings of an environment, its platforms and cache replacing the base ones
+func bakeSettings(config Config, environment string) BakeSettings {
+	settings := config.Bake.BakeSettings
+	override := config.Bake.Environments[environment]
+	if len(override.Platforms) > 0 {
+		settings.Platforms = override.Platforms
+	}
+	settings.Cache = valueOrDefault(override.Cache, settings.Cache)
+	settings.CacheDir = valueOrDefault(override.CacheDir, settings.CacheDir)
+
+	return settings
+}
+
+// bakeValue escapes the interpolation of bake in a value. With variables, the compose references of the value
+// become bake variables and their defaults are collected, without it the value is kept literally.
+func bakeValue(value string, variables map[string]BakeVariable) string {
+	escape := func(literal string) string {
+		literal = strings.ReplaceAll(literal, "${", "$${")
+		return strings.ReplaceAll(literal, "%{", "%%{")
+	}
+	if variables == nil {
+		return escape(value)
+	}
+
+	var result strings.Builder
+	last := 0
+	for _, match := range bakeVariableReference.FindAllStringSubmatchIndex(value, -1) {
+		result.WriteString(escape(value[last:match[0]]))
+		name := value[match[2]:match[3]]
+		if _, ok := variables[name]; !ok {
+			variable := BakeVariable{}
+			if match[4] >= 0 {
+				variable.Default = value[match[4]:match[5]]
+			}
+			variables[name] = variable
+		}
+		result.WriteString("${" + name + "}")
+		last = match[1]
+	}
+	result.WriteString(escape(value[last:]))
+
+	return result.String()
+}
+
+// bakeCache returns the cache-from and cache-to entries of a target
+func bakeCache(settings BakeSettings, name string, image string) ([]string, []string, error) {
+	switch settings.Cache {
+	case "", "none":
+		return nil, nil, nil
+	case "registry":
+		// The tag may hold a variable with a default like ${IMAGE_TAG:-latest}, cut at the first colon of the name
+		repository := image
+		slash := strings.LastIndex(repository, "/")
+		if colon := strings.Index(repository[slash+1:], ":"); colon >= 0 {
+			repository = repository[:slash+1+colon]
+		}
+		ref := repository + ":buildcache"
+		return []string{"type=registry,ref=" + ref}, []string{"type=registry,ref=" + ref + ",mode=max"}, nil
+	case "gha":
+		return []string{"type=gha,scope=" + name}, []string{"type=gha,scope=" + name + ",mode=max"}, nil
+	case "local":
+		dir := filepath.ToSlash(filepath.Join(valueOrDefault(settings.CacheDir, defaultBakeCacheDir), name))
+		return []string{"type=local,src=" + dir}, []string{"type=local,dest=" + dir + ",mode=max"}, nil
+	}
+
+	return nil, nil, fmt.Errorf("unknown bake cache %s (use registry, gha, local or none)", settings.Cache)
+}
+
+// bakeArgs returns the build args of a service: its variables of the consolidated env without the prefix, leaving
+// out the secrets, the URLs holding a password and the variables of services with a longer prefix
+func bakeArgs(config Config, serviceConfig ServiceConfig, envVars map[string]string) map[string]string {
+	args := make(map[string]string)
+	if serviceConfig.Prefix == "" {
+		return args
+	}
+	var selected []string
+	if serviceConfig.Build != nil {
+		selected = serviceConfig.Build.Args
+	}
+
+	for key, value := range envVars {
+		name, ok := strings.CutPrefix(key, serviceConfig.Prefix)
+		if !ok || name == "" {
+			continue
+		}
+		if len(selected) > 0 && !slices.Contains(selected, name) {
+			continue
+		}
+		// INDONESIA_CRAWLER_AI_SUMMARIZATION_NATS_URL belongs to the summarization service, not to the crawler
+		if slices.ContainsFunc(getAllServiceConfigs(config), func(other ServiceConfig) bool {
+			return len(other.Prefix) > len(serviceConfig.Prefix) && strings.HasPrefix(key, other.Prefix)
+		}) {
+			continue
+		}
+		if isSecretVariable(serviceConfig, key) || auditURLPassword.MatchString(value) {
+			continue
+		}
+		args[name] = bakeValue(value, nil)
+	}
+
+	return args
+}
+
+// buildBakeFile creates a target for every service built from its source, in the template or with a build section,
+// and a group for every service group
+func buildBakeFile(config Config, template DockerComposeConfig, envVars map[string]string, environment string, projectDir string) (BakeFile, []string, error) {
+	bake := BakeFile{
+		Variable: make(map[string]BakeVariable),
+		Group:    make(map[string]BakeGroup),
+		Target:   make(map[string]BakeTarget),
+	}
+	settings := bakeSettings(config, environment)
+
+	serviceConfigs := make(map[string]ServiceConfig)
+	for _, serviceConfig := range getAllServiceConfigs(config) {
+		serviceConfigs[serviceConfig.Name] = serviceConfig
+	}
+	var names []string
+	for name, service := range template.Services {
+		if service.Build != nil || serviceConfigs[name].Build != nil {
+			names = append(names, name)
+		}
+	}
+	for name, serviceConfig := range serviceConfigs {
+		if _, inTemplate := template.Services[name]; !inTemplate && serviceConfig.Build != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var warnings []string
+	groups := make(map[string][]string)
+	for _, name := range names {
+		serviceConfig, configured := serviceConfigs[name]
+		if !configured {
+			serviceConfig = ServiceConfig{Name: name}
+		}
+		build := ServiceBuild{}
+		if serviceConfig.Build != nil {
+			build = *serviceConfig.Build
+		}
+
+		context := serviceBuildContext(serviceConfig, template.Services[name])
+		dockerfile := valueOrDefault(build.Dockerfile, defaultDockerfile)
+		if _, err := os.Stat(filepath.Join(projectDir, context, dockerfile)); err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %s not found in %s, set build.dockerfile", name, dockerfile, context))
+		}
+
+		image, err := productionImage(config, serviceConfig, environment)
+		if err != nil {
+			return bake, warnings, err
+		}
+		cacheFrom, cacheTo, err := bakeCache(settings, name, image)
+		if err != nil {
+			return bake, warnings, err
+		}
+		for i := range cacheFrom {
+			cacheFrom[i], cacheTo[i] = bakeValue(cacheFrom[i], bake.Variable), bakeValue(cacheTo[i], bake.Variable)
+		}
+		platforms := settings.Platforms
+		if len(build.Platforms) > 0 {
+			platforms = build.Platforms
+		}
+
+		bake.Target[name] = BakeTarget{
+			Context:    context,
+			Dockerfile: dockerfile,
+			Tags:       []string{bakeValue(image, bake.Variable)},
+			Args:       bakeArgs(config, serviceConfig, envVars),
+			Platforms:  platforms,
+			CacheFrom:  cacheFrom,
+			CacheTo:    cacheTo,
+		}
+		for _, group := range serviceConfig.Groups {
+			groups[group] = append(groups[group], name)
+		}
+	}
+
+	bake.Group["default"] = BakeGroup{Targets: names}
+	for group, targets := range groups {
+		if group == "default" {
+			warnings = append(warnings, "the default group builds every target, the services of the default service group are not grouped")
+			continue
+		}
+		bake.Group[group] = BakeGroup{Targets: targets}
+	}
+
+	return bake, warnings, nil
+}
+
+// hclString quotes a string for HCL, the interpolation is escaped by bakeValue beforehand
+func hclString(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+
+	return `"` + value + `"`
+}
+
+// hclList renders a list of strings on one line
+func hclList(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = hclString(value)
+	}
+
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// renderBakeHCL renders the bake file as docker-bake.hcl: variables, the default group, the service groups, then
+// the targets
+func renderBakeHCL(bake BakeFile) []byte {
+	var builder strings.Builder
+	for _, name := range sortedKeys(bake.Variable) {
+		fmt.Fprintf(&builder, "variable %s {\n  default = %s\n}\n\n", hclString(name), hclString(bake.Variable[name].Default))
+	}
+
+	groups := sortedKeys(bake.Group)
+	slices.SortStableFunc(groups, func(a string, b string) int {
+		// default first, it is the group built by a plain docker buildx bake
+		switch {
+		case a == "default":
+			return -1
+		case b == "default":
+			return 1
+		}
+		return 0
+	})
+	for _, name := range groups {
+		fmt.Fprintf(&builder, "group %s {\n  targets = %s\n}\n\n", hclString(name), hclList(bake.Group[name].Targets))
+	}
+
+	for _, name := range sortedKeys(bake.Target) {
+		target := bake.Target[name]
+		fmt.Fprintf(&builder, "target %s {\n", hclString(name))
+		fmt.Fprintf(&builder, "  context    = %s\n", hclString(target.Context))
+		fmt.Fprintf(&builder, "  dockerfile = %s\n", hclString(target.Dockerfile))
+		fmt.Fprintf(&builder, "  tags       = %s\n", hclList(target.Tags))
+		if len(target.Platforms) > 0 {
+			fmt.Fprintf(&builder, "  platforms  = %s\n", hclList(target.Platforms))
+		}
+		if len(target.CacheFrom) > 0 {
+			fmt.Fprintf(&builder, "  cache-from = %s\n", hclList(target.CacheFrom))
+			fmt.Fprintf(&builder, "  cache-to   = %s\n", hclList(target.CacheTo))
+		}
+		if len(target.Args) > 0 {
+			builder.WriteString("  args = {\n")
+			for _, arg := range sortedKeys(target.Args) {
+				fmt.Fprintf(&builder, "    %s = %s\n", arg, hclString(target.Args[arg]))
+			}
+			builder.WriteString("  }\n")
+		}
+		builder.WriteString("}\n\n")
+	}
+
+	return []byte(strings.TrimSuffix(builder.String(), "\n"))
+}
+
+// GenerateBake writes docker-bake.hcl (or docker-bake.json) building the images of every service from its source
+// with the tags, build args, platforms and cache of an environment
+func GenerateBake(configFile string, templateFile string, consolidatedEnvFile string, outputFile string, format string, environment string, forceOverwrite bool) {
+	scriptDir, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("Error getting current directory: %v\n", err)
+		return
+	}
+	if format != "hcl" && format != "json" {
+		fmt.Printf("Unknown output format: %s (use hcl or json)\n", format)
+		return
+	}
+	if outputFile == "" {
+		outputFile = "docker-bake." + format
+	}
+
+	configFile = resolveFilePath(configFile, scriptDir, scriptDir)
+	templateFile = resolveFilePath(templateFile, scriptDir, scriptDir)
+	consolidatedEnvFile = resolveFilePath(consolidatedEnvFile, scriptDir, scriptDir)
+	outputFile = resolveFilePath(outputFile, scriptDir, scriptDir)
+	environment = resolveEnvironment(environment)
+	config := getConfig(configFile)
+
+	if _, err := os.Stat(consolidatedEnvFile); err != nil {
+		fmt.Printf("Consolidated env file not found: %s, run deployment env first\n", consolidatedEnvFile)
+		return
+	}
+	templateBytes, err := os.ReadFile(templateFile)
+	if err != nil {
+		fmt.Printf("Error reading template file: %v\n", err)
+		return
+	}
+	var template DockerComposeConfig
+	if err := yaml.Unmarshal(templateBytes, &template); err != nil {
+		fmt.Printf("Error parsing template file: %v\n", err)
+		return
+	}
+
+	bake, warnings, err := buildBakeFile(config, template, readEnvVars(consolidatedEnvFile), environment, scriptDir)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	for _, warning := range warnings {
+		fmt.Printf("Warning: %s\n", warning)
+	}
+
+	var content []byte
+	if format == "json" {
+		// Keep the & of the cache and tag values readable instead of \u0026
+		var buffer bytes.Buffer
+		encoder := json.NewEncoder(&buffer)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(bake); err != nil {
+			fmt.Printf("Error rendering %s: %v\n", outputFile, err)
+			return
+		}
+		content = buffer.Bytes()
+	} else {
+		header := fmt.Sprintf("# Image builds of the %s environment, generated by deployment bake from services-config.yaml\n", environment)
+		header += "# DO NOT EDIT THIS FILE DIRECTLY - Edit the build and bake sections of services-config.yaml instead\n\n"
+		content = append([]byte(header), renderBakeHCL(bake)...)
+	}
+
+	if !writeGeneratedFile(outputFile, content, forceOverwrite) {
+		return
+	}
+	fmt.Printf("Generated %d targets in %d groups for the %s environment, written to %s\n", len(bake.Target), len(bake.Group), environment, outputFile)
+	fmt.Printf("  Build with docker buildx bake -f %s [group or target]\n", filepath.Base(outputFile))
+}
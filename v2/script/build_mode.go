@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Modes of `deployment update`: build the services from their source, or run their images
+const (
+	buildModeDevelopment = "dev"
+	buildModeProduction  = "prod"
+)
+
+// Defaults of the build section of a service and of the prod mode
+const (
+	defaultDevDockerfile = "dev.Dockerfile"
+	defaultDockerfile    = "Dockerfile"
+	defaultSourcePath    = "/app"
+	defaultProdImageTag  = "latest"
+	defaultRestartPolicy = "unless-stopped"
+)
+
+// resolveBuildMode returns the mode of update: the flag, the mode of the environment in images.modes, then dev
+func resolveBuildMode(mode string, config Config, environment string) (string, error) {
+	if mode == "" {
+		mode = valueOrDefault(config.Images.Modes[environment], buildModeDevelopment)
+	}
+	if mode != buildModeDevelopment && mode != buildModeProduction {
+		return "", fmt.Errorf("unknown mode %s (use dev or prod)", mode)
+	}
+
+	return mode, nil
+}
+
+// serviceBuildContext returns the source directory of a service: its build section, the context of the template,
+// then ./<name>
+func serviceBuildContext(serviceConfig ServiceConfig, service DockerComposeService) string {
+	if serviceConfig.Build != nil && serviceConfig.Build.Context != "" {
+		return serviceConfig.Build.Context
+	}
+	if context := buildContext(service.Build); context != "" {
+		return context
+	}
+
+	return "./" + serviceConfig.Name
+}
+
+// productionImage returns the image a service runs in prod mode: its declared image for the environment, or
+// <registry>/<stack_name or name>:<tag> from the images section
+func productionImage(config Config, serviceConfig ServiceConfig, environment string) (string, error) {
+	if image, ok := serviceImage(serviceConfig, environment); ok {
+		return image.String(), nil
+	}
+	if config.Images.Registry == "" {
+		return "", fmt.Errorf("service %s: set images.registry or declare the image of the service to run it in prod mode", serviceConfig.Name)
+	}
+
+	return fmt.Sprintf("%s/%s:%s", strings.TrimSuffix(config.Images.Registry, "/"), stackServiceName(serviceConfig),
+		valueOrDefault(config.Images.Tag, defaultProdImageTag)), nil
+}
+
+// withoutSourceMounts removes the volumes mounting the source directory or a path inside it
+func withoutSourceMounts(volumes any, context string) any {
+	list, ok := volumes.([]any)
+	if !ok || context == "" {
+		return volumes
+	}
+
+	context = filepath.Clean(context)
+	var kept []any
+	for _, volume := range list {
+		host, _, _ := strings.Cut(fmt.Sprint(volume), ":")
+		host = filepath.Clean(host)
+		if host != context && !strings.HasPrefix(host, context+string(filepath.Separator)) {
+			kept = append(kept, volume)
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+
+	return kept
+}
+
+// hasSourceMount reports whether a volume mounts the source directory
+func hasSourceMount(volumes any, context string) bool {
+	list, _ := volumes.([]any)
+	for _, volume := range list {
+		host, _, _ := strings.Cut(fmt.Sprint(volume), ":")
+		if filepath.Clean(host) == filepath.Clean(context) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// watchRules returns the develop.watch rules of a service: the source synced into the container, the dev
+// Dockerfile and the rebuild files of the build section rebuilding the image
+func watchRules(build ServiceBuild, context string) []any {
+	rules := []any{map[string]any{
+		"action": "sync",
+		"path":   context,
+		"target": valueOrDefault(build.Source, defaultSourcePath),
+		"ignore": []any{".git"},
+	}}
+	rebuild := append([]string{valueOrDefault(build.DevDockerfile, defaultDevDockerfile)}, build.Rebuild...)
+	for _, file := range rebuild {
+		rules = append(rules, map[string]any{
+			"action": "rebuild",
+			"path":   strings.TrimSuffix(context, "/") + "/" + file,
+		})
+	}
+
+	return rules
+}
+
+// applyDevelopmentBuild builds a service declaring a build section from its source with the dev Dockerfile,
+// mounting the source or syncing it with develop.watch
+func applyDevelopmentBuild(service *DockerComposeService, build ServiceBuild, context string) {
+	settings, _ := service.Build.(map[string]any)
+	copied := map[string]any{}
+	for key, value := range settings {
+		copied[key] = value
+	}
+	copied["context"] = context
+	copied["dockerfile"] = valueOrDefault(build.DevDockerfile, defaultDevDockerfile)
+	service.Build = copied
+
+	if build.Watch {
+		// The synced files would be hidden by a bind mount of the same directory
+		service.Volumes = withoutSourceMounts(service.Volumes, context)
+		if service.ExtraFields == nil {
+			service.ExtraFields = make(map[string]any)
+		}
+		service.ExtraFields["develop"] = map[string]any{"watch": watchRules(build, context)}
+		return
+	}
+	if !hasSourceMount(service.Volumes, context) {
+		volumes, _ := service.Volumes.([]any)
+		service.Volumes = append(volumes, context+":"+valueOrDefault(build.Source, defaultSourcePath))
+	}
+}
+
+// applyBuildMode switches the services between building from their source (dev) and running their image (prod).
+// In prod mode the built services get their image and lose the build section and the source mounts, and every
+// service without a restart policy gets one.
+func applyBuildMode(dockerCompose *DockerComposeConfig, configFile string, environment string, mode string) error {
+	config := getConfig(configFile)
+	serviceConfigs := make(map[string]ServiceConfig)
+	for _, serviceConfig := range getAllServiceConfigs(config) {
+		serviceConfigs[serviceConfig.Name] = serviceConfig
+	}
+
+	changed := 0
+	for name, service := range dockerCompose.Services {
+		serviceConfig, configured := serviceConfigs[name]
+		if !configured {
+			serviceConfig = ServiceConfig{Name: name}
+		}
+		built := service.Build != nil || serviceConfig.Build != nil
+		context := serviceBuildContext(serviceConfig, service)
+
+		switch {
+		case mode == buildModeDevelopment && serviceConfig.Build != nil:
+			applyDevelopmentBuild(&service, *serviceConfig.Build, context)
+			changed++
+		case mode == buildModeProduction && built:
+			image, err := productionImage(config, serviceConfig, environment)
+			if err != nil {
+				return err
+			}
+			service.Image = image
+			service.Build = nil
+			service.Volumes = withoutSourceMounts(service.Volumes, context)
+			delete(service.ExtraFields, "develop")
+			changed++
+		}
+		if mode == buildModeProduction && service.Restart == "" {
+			service.Restart = valueOrDefault(config.Images.Restart, defaultRestartPolicy)
+		}
+		dockerCompose.Services[name] = service
+	}
+
+	if changed > 0 {
+		fmt.Printf("  Applied the %s mode to %d built services\n", mode, changed)
+	}
+
+	return nil
+}
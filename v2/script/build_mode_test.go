@@ -0,0 +1,191 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const testBuildModeConfig = `images:
+  registry: ghcr.io/lexicon/
+  tag: "2.1"
+  modes:
+    prod: prod
+common_services:
+  - name: postgres
+    prefix: POSTGRES_
+services:
+  - name: api
+    prefix: API_
+    build:
+      dockerfile: Dockerfile
+  - name: scheduler
+    prefix: SCHEDULER_
+    build:
+      source: /srv
+  - name: crawler
+    prefix: CRAWLER_
+    stack_name: bo-crawler
+    build:
+      context: ./crawlers/crawler
+      source: /src
+      watch: true
+      rebuild: [go.mod]
+  - name: frontend
+    prefix: FRONTEND_
+    image:
+      repository: ghcr.io/lexicon/frontend
+      tag: 3.0.0
+`
+
+const testBuildModeCompose = `services:
+  api:
+    build:
+      context: ./api
+      dockerfile: dev.Dockerfile
+      args: {GO_VERSION: "1.24"}
+    volumes: [api-cache:/cache]
+  scheduler:
+    build: ./scheduler
+    volumes: ["./scheduler/:/srv"]
+  crawler:
+    build: ./crawler
+    volumes: [./crawlers/crawler/data:/data, crawler-tmp:/tmp]
+    develop:
+      watch: []
+  frontend:
+    build: ./frontend
+    volumes: [./frontend:/app]
+  legacy:
+    build: ./legacy
+  postgres:
+    image: postgres:17.4
+    restart: always
+`
+
+// testBuildMode applies a mode to the test compose file with the test configuration
+func testBuildMode(t *testing.T, mode string) DockerComposeConfig {
+	t.Helper()
+	configFile := filepath.Join(t.TempDir(), "services-config.yaml")
+	if err := os.WriteFile(configFile, []byte(testBuildModeConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var dockerCompose DockerComposeConfig
+	if err := yaml.Unmarshal([]byte(testBuildModeCompose), &dockerCompose); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyBuildMode(&dockerCompose, configFile, "prod", mode); err != nil {
+		t.Fatal(err)
+	}
+
+	return dockerCompose
+}
+
+func TestResolveBuildMode(t *testing.T) {
+	config := Config{Images: ImagesConfig{Modes: map[string]string{"prod": "prod"}}}
+	tests := []struct {
+		flag        string
+		environment string
+		want        string
+	}{
+		{"", "prod", buildModeProduction},
+		{"", "staging", buildModeDevelopment},
+		{"dev", "prod", buildModeDevelopment},
+		{"release", "prod", ""},
+	}
+	for _, test := range tests {
+		mode, err := resolveBuildMode(test.flag, config, test.environment)
+		if mode != test.want || (err != nil) != (test.want == "") {
+			t.Errorf("resolveBuildMode(%q, %s) = %s, %v, want %s", test.flag, test.environment, mode, err, test.want)
+		}
+	}
+}
+
+func TestApplyBuildModeDevelopment(t *testing.T) {
+	services := testBuildMode(t, buildModeDevelopment).Services
+
+	api := services["api"]
+	wantBuild := map[string]any{"context": "./api", "dockerfile": "dev.Dockerfile", "args": map[string]any{"GO_VERSION": "1.24"}}
+	if !reflect.DeepEqual(api.Build, wantBuild) {
+		t.Errorf("api build = %v, want %v", api.Build, wantBuild)
+	}
+	if !reflect.DeepEqual(api.Volumes, []any{"api-cache:/cache", "./api:/app"}) {
+		t.Errorf("api volumes = %v, want the source mounted at /app", api.Volumes)
+	}
+	if volumes := services["scheduler"].Volumes; !reflect.DeepEqual(volumes, []any{"./scheduler/:/srv"}) {
+		t.Errorf("scheduler volumes = %v, want the source mount of the template kept once", volumes)
+	}
+
+	// Watched services sync their source instead of mounting it
+	crawler := services["crawler"]
+	if context := crawler.Build.(map[string]any)["context"]; context != "./crawlers/crawler" {
+		t.Errorf("crawler context = %v", context)
+	}
+	if !reflect.DeepEqual(crawler.Volumes, []any{"crawler-tmp:/tmp"}) {
+		t.Errorf("crawler volumes = %v, want the mounts of the source removed", crawler.Volumes)
+	}
+	wantWatch := map[string]any{"watch": []any{
+		map[string]any{"action": "sync", "path": "./crawlers/crawler", "target": "/src", "ignore": []any{".git"}},
+		map[string]any{"action": "rebuild", "path": "./crawlers/crawler/dev.Dockerfile"},
+		map[string]any{"action": "rebuild", "path": "./crawlers/crawler/go.mod"},
+	}}
+	if !reflect.DeepEqual(crawler.ExtraFields["develop"], wantWatch) {
+		t.Errorf("crawler develop = %v\nwant %v", crawler.ExtraFields["develop"], wantWatch)
+	}
+
+	// Services without a build section and the restart policies are left alone
+	if frontend := services["frontend"]; frontend.Build != "./frontend" || frontend.Image != "" {
+		t.Errorf("frontend = %+v, want the template kept", frontend)
+	}
+	for name, service := range services {
+		if name != "postgres" && service.Restart != "" {
+			t.Errorf("%s restart = %s, want none in dev mode", name, service.Restart)
+		}
+	}
+}
+
+func TestApplyBuildModeProduction(t *testing.T) {
+	services := testBuildMode(t, buildModeProduction).Services
+
+	tests := []struct {
+		service string
+		image   string
+		volumes any
+		restart string
+	}{
+		{"api", "ghcr.io/lexicon/api:2.1", []any{"api-cache:/cache"}, "unless-stopped"},
+		{"scheduler", "ghcr.io/lexicon/scheduler:2.1", nil, "unless-stopped"},
+		{"crawler", "ghcr.io/lexicon/bo-crawler:2.1", []any{"crawler-tmp:/tmp"}, "unless-stopped"},
+		{"frontend", "ghcr.io/lexicon/frontend:3.0.0", nil, "unless-stopped"},
+		{"legacy", "ghcr.io/lexicon/legacy:2.1", nil, "unless-stopped"},
+		{"postgres", "postgres:17.4", nil, "always"},
+	}
+	for _, test := range tests {
+		service := services[test.service]
+		if service.Image != test.image || service.Build != nil || service.Restart != test.restart || !reflect.DeepEqual(service.Volumes, test.volumes) {
+			t.Errorf("%s = image %s, build %v, volumes %v, restart %s\nwant image %s, volumes %v, restart %s",
+				test.service, service.Image, service.Build, service.Volumes, service.Restart, test.image, test.volumes, test.restart)
+		}
+	}
+	if _, ok := services["crawler"].ExtraFields["develop"]; ok {
+		t.Error("the develop section of the crawler was kept in prod mode")
+	}
+}
+
+func TestApplyBuildModeProductionNeedsAnImage(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "services-config.yaml")
+	config := strings.Replace(testBuildModeConfig, "  registry: ghcr.io/lexicon/\n", "", 1)
+	if err := os.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dockerCompose := DockerComposeConfig{Services: map[string]DockerComposeService{"api": {Build: "./api"}}}
+
+	err := applyBuildMode(&dockerCompose, configFile, "prod", buildModeProduction)
+	if err == nil || !strings.Contains(err.Error(), "service api: set images.registry") {
+		t.Errorf("error = %v, want the missing registry reported", err)
+	}
+}
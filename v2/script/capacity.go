@@ -0,0 +1,428 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// StackFile holds the parts of a Swarm stack file the capacity report reads
+type StackFile struct {
+	Services map[string]struct {
+		Deploy struct {
+			Mode      string `yaml:"mode"`
+			Replicas  *int   `yaml:"replicas"`
+			Placement struct {
+				Constraints []string `yaml:"constraints"`
+			} `yaml:"placement"`
+			Resources struct {
+				Limits       ResourceValues `yaml:"limits"`
+				Reservations ResourceValues `yaml:"reservations"`
+			} `yaml:"resources"`
+		} `yaml:"deploy"`
+	} `yaml:"services"`
+}
+
+// capacityService is a service of the report with its resources parsed
+type capacityService struct {
+	Name             string
+	Source           string // the profile, "explicit", "stack file" or "none"
+	Replicas         int
+	Global           bool
+	Constraints      []string
+	ReservedCPUs     float64
+	ReservedMemory   int64
+	LimitCPUs        float64
+	LimitMemory      int64
+	UnlimitedCPUs    bool
+	UnlimitedMemory  bool
+	HasReservations  bool
+	UnplacedReplicas int
+}
+
+// capacityNode is a Swarm node with the tasks placed on it
+type capacityNode struct {
+	Name           string
+	Role           string
+	CPUs           float64
+	Memory         int64
+	ReservedCPUs   float64
+	ReservedMemory int64
+	LimitCPUs      float64
+	LimitMemory    int64
+	Tasks          int
+}
+
+// parseResourceValues parses a cpus and memory pair, an empty value parses as zero
+func parseResourceValues(values ResourceValues) (float64, int64, error) {
+	var cpus float64
+	var memory int64
+	var err error
+	if values.CPUs != "" {
+		if cpus, err = parseCPUs(values.CPUs); err != nil {
+			return 0, 0, err
+		}
+	}
+	if values.Memory != "" {
+		if memory, err = parseMemory(values.Memory); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return cpus, memory, nil
+}
+
+// newCapacityService parses the resolved resources of a service
+func newCapacityService(name string, source string, replicas int, settings ResourceSettings) (capacityService, error) {
+	service := capacityService{Name: name, Source: source, Replicas: replicas}
+	var err error
+	if service.ReservedCPUs, service.ReservedMemory, err = parseResourceValues(settings.Reservations); err != nil {
+		return service, fmt.Errorf("service %s: %v", name, err)
+	}
+	if service.LimitCPUs, service.LimitMemory, err = parseResourceValues(settings.Limits); err != nil {
+		return service, fmt.Errorf("service %s: %v", name, err)
+	}
+	service.UnlimitedCPUs = settings.Limits.CPUs == ""
+	service.UnlimitedMemory = settings.Limits.Memory == ""
+	service.HasReservations = settings.Reservations != (ResourceValues{})
+
+	return service, nil
+}
+
+// resourceSource describes where the resources of a service come from
+func resourceSource(settings ResourceSettings) string {
+	if settings.Profile != "" {
+		return settings.Profile
+	}
+	if settings.Limits == (ResourceValues{}) && settings.Reservations == (ResourceValues{}) {
+		return "none"
+	}
+
+	return "explicit"
+}
+
+// capacityServices lists the services of the stack file with the resources of their configuration, or of the stack
+// file when they are not configured. Without a stack file the configured services run once, as with docker compose.
+func capacityServices(config Config, stackFile string, environment string) ([]capacityService, error) {
+	configured := make(map[string]ServiceConfig)
+	for _, service := range getAllServiceConfigs(config) {
+		configured[stackServiceName(service)] = service
+	}
+
+	var services []capacityService
+	content, err := os.ReadFile(stackFile)
+	if os.IsNotExist(err) {
+		for _, serviceConfig := range getAllServiceConfigs(config) {
+			settings, _, err := serviceResources(config, serviceConfig, environment)
+			if err != nil {
+				return nil, err
+			}
+			replicas := 1
+			if serviceConfig.SLO != nil && serviceConfig.SLO.Replicas > 0 {
+				replicas = serviceConfig.SLO.Replicas
+			}
+			service, err := newCapacityService(serviceConfig.Name, resourceSource(settings), replicas, settings)
+			if err != nil {
+				return nil, err
+			}
+			services = append(services, service)
+		}
+		return services, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", stackFile, err)
+	}
+
+	var stack StackFile
+	if err := yaml.Unmarshal(content, &stack); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", stackFile, err)
+	}
+	for name, stackService := range stack.Services {
+		deploy := stackService.Deploy
+		settings := ResourceSettings{Limits: deploy.Resources.Limits, Reservations: deploy.Resources.Reservations}
+		source := "stack file"
+		if serviceConfig, ok := configured[name]; ok {
+			resolved, declared, err := serviceResources(config, serviceConfig, environment)
+			if err != nil {
+				return nil, err
+			}
+			if declared {
+				settings, source = resolved, resourceSource(resolved)
+			}
+		}
+		if source == "stack file" && resourceSource(settings) == "none" {
+			source = "none"
+		}
+
+		replicas := 1
+		if deploy.Replicas != nil {
+			replicas = *deploy.Replicas
+		}
+		service, err := newCapacityService(name, source, replicas, settings)
+		if err != nil {
+			return nil, err
+		}
+		service.Global = deploy.Mode == "global"
+		service.Constraints = deploy.Placement.Constraints
+		services = append(services, service)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+
+	return services, nil
+}
+
+// capacityNodes expands the declared nodes, a node with a count becomes that many numbered nodes
+func capacityNodes(nodes []NodeConfig) []*capacityNode {
+	var expanded []*capacityNode
+	for _, node := range nodes {
+		cpus, _ := parseCPUs(node.CPUs)
+		memory, _ := parseMemory(node.Memory)
+		count := max(node.Count, 1)
+		for i := 1; i <= count; i++ {
+			name := node.Name
+			if count > 1 {
+				name = fmt.Sprintf("%s-%d", node.Name, i)
+			}
+			expanded = append(expanded, &capacityNode{Name: name, Role: valueOrDefault(node.Role, "worker"), CPUs: cpus, Memory: memory})
+		}
+	}
+
+	return expanded
+}
+
+// nodeMatchesConstraints evaluates the node.role and node.hostname constraints, other constraints match any node
+func nodeMatchesConstraints(node *capacityNode, constraints []string) bool {
+	for _, constraint := range constraints {
+		operator := "=="
+		if strings.Contains(constraint, "!=") {
+			operator = "!="
+		}
+		field, value, ok := strings.Cut(constraint, operator)
+		if !ok {
+			continue
+		}
+
+		var actual string
+		switch strings.TrimSpace(field) {
+		case "node.role":
+			actual = node.Role
+		case "node.hostname":
+			actual = node.Name
+		default:
+			continue
+		}
+		if (actual == strings.TrimSpace(value)) != (operator == "==") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// placeReplica reserves a replica on the eligible node with the most free memory that can hold it
+func placeReplica(service *capacityService, nodes []*capacityNode) bool {
+	var best *capacityNode
+	for _, node := range nodes {
+		freeCPUs, freeMemory := node.CPUs-node.ReservedCPUs, node.Memory-node.ReservedMemory
+		if service.ReservedCPUs > freeCPUs+1e-9 || service.ReservedMemory > freeMemory {
+			continue
+		}
+		if best == nil || freeMemory > best.Memory-best.ReservedMemory {
+			best = node
+		}
+	}
+	if best == nil {
+		return false
+	}
+
+	assignReplica(service, best)
+	return true
+}
+
+// assignReplica adds the reservations and limits of a replica to a node
+func assignReplica(service *capacityService, node *capacityNode) {
+	node.ReservedCPUs += service.ReservedCPUs
+	node.ReservedMemory += service.ReservedMemory
+	node.LimitCPUs += service.LimitCPUs
+	node.LimitMemory += service.LimitMemory
+	node.Tasks++
+}
+
+// planCapacity places the replicas of the services on the nodes the way the Swarm scheduler would: a replica needs
+// a node with enough unreserved CPU and memory, and the largest replicas are placed first.
+// Global services run one task on every eligible node.
+func planCapacity(services []capacityService, nodes []*capacityNode) []TopologyIssue {
+	var issues []TopologyIssue
+	order := make([]int, len(services))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		first, second := services[order[a]], services[order[b]]
+		if first.Global != second.Global {
+			return first.Global
+		}
+		return first.ReservedMemory > second.ReservedMemory
+	})
+
+	for _, index := range order {
+		service := &services[index]
+		var eligible []*capacityNode
+		for _, node := range nodes {
+			if nodeMatchesConstraints(node, service.Constraints) {
+				eligible = append(eligible, node)
+			}
+		}
+		if len(eligible) == 0 {
+			issues = append(issues, TopologyIssue{Severity: "error", Service: service.Name, Message: fmt.Sprintf("no declared node matches the constraints %s", strings.Join(service.Constraints, ", "))})
+			continue
+		}
+
+		if service.Global {
+			service.Replicas = 0
+			for _, node := range eligible {
+				service.Replicas++
+				if node.CPUs-node.ReservedCPUs+1e-9 < service.ReservedCPUs || node.Memory-node.ReservedMemory < service.ReservedMemory {
+					service.UnplacedReplicas++
+					continue
+				}
+				assignReplica(service, node)
+			}
+		} else {
+			for range service.Replicas {
+				if !placeReplica(service, eligible) {
+					service.UnplacedReplicas++
+				}
+			}
+		}
+
+		if service.UnplacedReplicas > 0 {
+			issues = append(issues, TopologyIssue{Severity: "error", Service: service.Name, Message: fmt.Sprintf("%d of %d replicas do not fit, reserving %s CPUs and %s each", service.UnplacedReplicas, service.Replicas, formatCPUs(service.ReservedCPUs), formatMemory(service.ReservedMemory))})
+		}
+		switch {
+		case !service.HasReservations && service.UnlimitedCPUs && service.UnlimitedMemory:
+			issues = append(issues, TopologyIssue{Severity: "warning", Service: service.Name, Message: "no reservations or limits, it is not budgeted and a peak can starve the other tasks of its node"})
+		case !service.HasReservations:
+			issues = append(issues, TopologyIssue{Severity: "warning", Service: service.Name, Message: "no reservations, the scheduler does not budget for it"})
+		case service.UnlimitedCPUs || service.UnlimitedMemory:
+			issues = append(issues, TopologyIssue{Severity: "warning", Service: service.Name, Message: "no CPU or memory limit, a peak can starve the other tasks of its node"})
+		}
+	}
+
+	for _, node := range nodes {
+		if node.LimitMemory > node.Memory {
+			issues = append(issues, TopologyIssue{Severity: "warning", Service: node.Name, Message: fmt.Sprintf("memory limits of %s overcommit the %s of the node, tasks may be killed when they all peak", formatMemory(node.LimitMemory), formatMemory(node.Memory))})
+		}
+		if node.LimitCPUs > node.CPUs+1e-9 {
+			issues = append(issues, TopologyIssue{Severity: "warning", Service: node.Name, Message: fmt.Sprintf("CPU limits of %s overcommit the %s CPUs of the node, tasks are throttled when they all peak", formatCPUs(node.LimitCPUs), formatCPUs(node.CPUs))})
+		}
+	}
+
+	return issues
+}
+
+// formatUsage renders a used amount against a capacity with its percentage
+func formatUsage(used string, total string, ratio float64) string {
+	return fmt.Sprintf("%s/%s (%d%%)", used, total, int(ratio*100+0.5))
+}
+
+// ReportCapacity sums the reservations and limits of the stack per node against the declared nodes of the
+// environment, and exits with an error when the reservations do not fit. With write, the resources of the
+// configured services are written into the stack file first.
+func ReportCapacity(configFile string, stackFile string, environment string, write bool) {
+	scriptDir, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("Error getting current directory: %v\n", err)
+		return
+	}
+	config := getConfig(resolveFilePath(configFile, scriptDir, scriptDir))
+	stackFile = resolveFilePath(stackFile, scriptDir, scriptDir)
+	environment = resolveEnvironment(environment)
+
+	if problems := validateResourcesConfig(config); len(problems) > 0 {
+		fmt.Printf("Invalid resources configuration:\n  %s\n", strings.Join(problems, "\n  "))
+		os.Exit(1)
+	}
+	if write {
+		if err := updateStackResources(stackFile, config, environment); err != nil {
+			fmt.Printf("Error updating %s: %v\n", stackFile, err)
+			os.Exit(1)
+		}
+	}
+
+	services, err := capacityServices(config, stackFile, environment)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	nodes := capacityNodes(resourceNodes(config, environment))
+	var issues []TopologyIssue
+	if len(nodes) > 0 {
+		issues = planCapacity(services, nodes)
+	}
+
+	fmt.Printf("Resources of the %s environment:\n", environment)
+	fmt.Printf("  %-42s %-10s %8s %14s %14s %14s %14s\n", "SERVICE", "PROFILE", "REPLICAS", "RESERVED CPUS", "RESERVED MEM", "LIMIT CPUS", "LIMIT MEM")
+	var totalReservedCPUs, totalLimitCPUs float64
+	var totalReservedMemory, totalLimitMemory int64
+	for _, service := range services {
+		limitCPUs, limitMemory := formatCPUs(service.LimitCPUs), formatMemory(service.LimitMemory)
+		if service.UnlimitedCPUs {
+			limitCPUs = "-"
+		}
+		if service.UnlimitedMemory {
+			limitMemory = "-"
+		}
+		replicas := fmt.Sprint(service.Replicas)
+		if service.Global {
+			replicas += " (global)"
+		}
+		fmt.Printf("  %-42s %-10s %8s %14s %14s %14s %14s\n", service.Name, service.Source, replicas,
+			formatCPUs(service.ReservedCPUs), formatMemory(service.ReservedMemory), limitCPUs, limitMemory)
+
+		replicaCount := float64(service.Replicas)
+		totalReservedCPUs += service.ReservedCPUs * replicaCount
+		totalReservedMemory += service.ReservedMemory * int64(service.Replicas)
+		totalLimitCPUs += service.LimitCPUs * replicaCount
+		totalLimitMemory += service.LimitMemory * int64(service.Replicas)
+	}
+	fmt.Printf("  %-42s %-10s %8s %14s %14s %14s %14s\n", "TOTAL", "", "", formatCPUs(totalReservedCPUs), formatMemory(totalReservedMemory), formatCPUs(totalLimitCPUs), formatMemory(totalLimitMemory))
+
+	if len(nodes) == 0 {
+		fmt.Println("\nNo nodes declared for this environment, add a resources.nodes section to check the stack fits.")
+		return
+	}
+
+	fmt.Println("\nNodes:")
+	fmt.Printf("  %-20s %-8s %6s %24s %24s %24s %24s\n", "NODE", "ROLE", "TASKS", "RESERVED CPUS", "RESERVED MEM", "LIMIT CPUS", "LIMIT MEM")
+	for _, node := range nodes {
+		fmt.Printf("  %-20s %-8s %6d %24s %24s %24s %24s\n", node.Name, node.Role, node.Tasks,
+			formatUsage(formatCPUs(node.ReservedCPUs), formatCPUs(node.CPUs), node.ReservedCPUs/node.CPUs),
+			formatUsage(formatMemory(node.ReservedMemory), formatMemory(node.Memory), float64(node.ReservedMemory)/float64(node.Memory)),
+			formatUsage(formatCPUs(node.LimitCPUs), formatCPUs(node.CPUs), node.LimitCPUs/node.CPUs),
+			formatUsage(formatMemory(node.LimitMemory), formatMemory(node.Memory), float64(node.LimitMemory)/float64(node.Memory)))
+	}
+
+	errors, warnings := 0, 0
+	if len(issues) > 0 {
+		fmt.Println()
+	}
+	for _, issue := range issues {
+		fmt.Printf("%-8s %-42s %s\n", strings.ToUpper(issue.Severity), issue.Service, issue.Message)
+		if issue.Severity == "error" {
+			errors++
+		} else {
+			warnings++
+		}
+	}
+
+	fmt.Printf("\nChecked %d services on %d nodes: %d errors, %d warnings\n", len(services), len(nodes), errors, warnings)
+	if errors > 0 {
+		fmt.Println("The stack does not fit the declared nodes.")
+		os.Exit(1)
+	}
+}
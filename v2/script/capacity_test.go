@@ -0,0 +1,211 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testCapacityService returns a replicated service reserving and limited to the given values
+func testCapacityService(t *testing.T, name string, replicas int, reserved ResourceValues, limits ResourceValues) capacityService {
+	t.Helper()
+	service, err := newCapacityService(name, "explicit", replicas, ResourceSettings{Limits: limits, Reservations: reserved})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return service
+}
+
+func TestCapacityNodes(t *testing.T) {
+	nodes := capacityNodes([]NodeConfig{
+		{Name: "manager", Role: "manager", CPUs: "2", Memory: "4G"},
+		{Name: "worker", CPUs: "4", Memory: "8G", Count: 2},
+	})
+
+	var names []string
+	for _, node := range nodes {
+		names = append(names, node.Name+":"+node.Role)
+	}
+	if got := strings.Join(names, " "); got != "manager:manager worker-1:worker worker-2:worker" {
+		t.Errorf("nodes = %s", got)
+	}
+	if nodes[1].CPUs != 4 || nodes[1].Memory != 8<<30 {
+		t.Errorf("worker-1 = %+v, want 4 CPUs and 8G", nodes[1])
+	}
+}
+
+func TestNodeMatchesConstraints(t *testing.T) {
+	node := &capacityNode{Name: "worker-1", Role: "worker"}
+	tests := []struct {
+		constraints []string
+		matches     bool
+	}{
+		{nil, true},
+		{[]string{"node.role == worker"}, true},
+		{[]string{"node.role==manager"}, false},
+		{[]string{"node.role != manager"}, true},
+		{[]string{"node.hostname == worker-1"}, true},
+		{[]string{"node.role == worker", "node.hostname != worker-1"}, false},
+		{[]string{"node.labels.zone == eu"}, true},
+	}
+	for _, test := range tests {
+		if matches := nodeMatchesConstraints(node, test.constraints); matches != test.matches {
+			t.Errorf("nodeMatchesConstraints(%v) = %v, want %v", test.constraints, matches, test.matches)
+		}
+	}
+}
+
+func TestPlanCapacity(t *testing.T) {
+	tests := []struct {
+		name     string
+		services func(t *testing.T) []capacityService
+		nodes    []NodeConfig
+		issues   []string // expected issues as "severity service: part of the message"
+	}{
+		{
+			name: "replicas fit",
+			services: func(t *testing.T) []capacityService {
+				return []capacityService{testCapacityService(t, "api", 3, ResourceValues{CPUs: "0.5", Memory: "1G"}, ResourceValues{CPUs: "1", Memory: "2G"})}
+			},
+			nodes: []NodeConfig{{Name: "worker", CPUs: "2", Memory: "4G", Count: 2}},
+		},
+		{
+			name: "replicas that do not fit",
+			services: func(t *testing.T) []capacityService {
+				return []capacityService{testCapacityService(t, "api", 5, ResourceValues{CPUs: "0.5", Memory: "1G"}, ResourceValues{CPUs: "0.5", Memory: "1G"})}
+			},
+			nodes:  []NodeConfig{{Name: "worker", CPUs: "2", Memory: "2G", Count: 2}},
+			issues: []string{"error api: 1 of 5 replicas do not fit, reserving 0.5 CPUs and 1G each"},
+		},
+		{
+			name: "global service on the eligible nodes",
+			services: func(t *testing.T) []capacityService {
+				agent := testCapacityService(t, "agent", 1, ResourceValues{CPUs: "0.1", Memory: "64M"}, ResourceValues{CPUs: "0.2", Memory: "128M"})
+				agent.Global, agent.Constraints = true, []string{"node.role == worker"}
+				return []capacityService{agent}
+			},
+			nodes: []NodeConfig{{Name: "manager", Role: "manager", CPUs: "1", Memory: "1G"}, {Name: "worker", CPUs: "1", Memory: "1G", Count: 3}},
+		},
+		{
+			name: "constraints matching no node",
+			services: func(t *testing.T) []capacityService {
+				postgres := testCapacityService(t, "postgres", 1, ResourceValues{CPUs: "1", Memory: "1G"}, ResourceValues{CPUs: "1", Memory: "1G"})
+				postgres.Constraints = []string{"node.role == manager"}
+				return []capacityService{postgres}
+			},
+			nodes:  []NodeConfig{{Name: "worker", CPUs: "4", Memory: "8G"}},
+			issues: []string{"error postgres: no declared node matches the constraints node.role == manager"},
+		},
+		{
+			name: "services without reservations or limits",
+			services: func(t *testing.T) []capacityService {
+				return []capacityService{
+					testCapacityService(t, "worker", 1, ResourceValues{}, ResourceValues{}),
+					testCapacityService(t, "crawler", 1, ResourceValues{}, ResourceValues{CPUs: "0.5", Memory: "256M"}),
+					testCapacityService(t, "api", 1, ResourceValues{CPUs: "0.5", Memory: "256M"}, ResourceValues{Memory: "512M"}),
+				}
+			},
+			nodes: []NodeConfig{{Name: "node", CPUs: "4", Memory: "8G"}},
+			issues: []string{
+				"warning api: no CPU or memory limit",
+				"warning worker: no reservations or limits",
+				"warning crawler: no reservations, the scheduler",
+			},
+		},
+		{
+			name: "limits overcommitting a node",
+			services: func(t *testing.T) []capacityService {
+				return []capacityService{testCapacityService(t, "api", 2, ResourceValues{CPUs: "0.5", Memory: "512M"}, ResourceValues{CPUs: "2", Memory: "1G"})}
+			},
+			nodes: []NodeConfig{{Name: "node", CPUs: "2", Memory: "1536M"}},
+			issues: []string{
+				"warning node: memory limits of 2G overcommit the 1.5G of the node",
+				"warning node: CPU limits of 4 overcommit the 2 CPUs of the node",
+			},
+		},
+	}
+	for _, test := range tests {
+		services := test.services(t)
+		issues := planCapacity(services, capacityNodes(test.nodes))
+		if len(issues) != len(test.issues) {
+			t.Errorf("%s: issues = %v, want %v", test.name, issues, test.issues)
+			continue
+		}
+		for i, issue := range issues {
+			if got := issue.Severity + " " + issue.Service + ": " + issue.Message; !strings.HasPrefix(got, test.issues[i]) {
+				t.Errorf("%s: issue %d = %s, want %s", test.name, i, got, test.issues[i])
+			}
+		}
+	}
+}
+
+func TestPlanCapacityGlobalReplicas(t *testing.T) {
+	agent := testCapacityService(t, "agent", 1, ResourceValues{CPUs: "0.1", Memory: "64M"}, ResourceValues{CPUs: "0.2", Memory: "128M"})
+	agent.Global, agent.Constraints = true, []string{"node.role == worker"}
+	services := []capacityService{agent}
+	nodes := capacityNodes([]NodeConfig{{Name: "manager", Role: "manager", CPUs: "1", Memory: "1G"}, {Name: "worker", CPUs: "1", Memory: "1G", Count: 3}})
+
+	planCapacity(services, nodes)
+
+	if services[0].Replicas != 3 || services[0].UnplacedReplicas != 0 {
+		t.Errorf("global service = %+v, want one replica per worker", services[0])
+	}
+	if nodes[0].Tasks != 0 || nodes[1].Tasks != 1 || nodes[1].ReservedMemory != 64<<20 {
+		t.Errorf("nodes = %+v %+v, want the task on the workers only", nodes[0], nodes[1])
+	}
+}
+
+func TestCapacityServices(t *testing.T) {
+	config := Config{Services: []ServiceConfig{
+		{Name: "api", Prefix: "API_", Resources: &ServiceResources{
+			ResourceSettings: ResourceSettings{Profile: "small"},
+			Environments:     map[string]ResourceSettings{"prod": {Profile: "large"}},
+		}, SLO: &SLOConfig{Replicas: 2}},
+		{Name: "worker", Prefix: "WORKER_"},
+	}}
+
+	// Without a stack file the configured services run with the replicas of their SLO
+	services, err := capacityServices(config, filepath.Join(t.TempDir(), "docker-stack.yml"), "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 || services[0].Source != "large" || services[0].Replicas != 2 || services[0].ReservedMemory != 256<<20 || services[1].Source != "none" {
+		t.Errorf("services without a stack file = %+v", services)
+	}
+
+	// The stack file provides the replicas and placement, the configuration the resources
+	stackFile := filepath.Join(t.TempDir(), "docker-stack.yml")
+	stack := `services:
+  api:
+    deploy:
+      replicas: 4
+      resources:
+        limits: {cpus: "8", memory: 8G}
+  cadvisor:
+    deploy:
+      mode: global
+      placement:
+        constraints: [node.role == worker]
+      resources:
+        reservations: {cpus: "0.1", memory: 64M}
+`
+	if err := os.WriteFile(stackFile, []byte(stack), 0644); err != nil {
+		t.Fatal(err)
+	}
+	services, err = capacityServices(config, stackFile, "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 2 {
+		t.Fatalf("services = %+v, want the services of the stack file", services)
+	}
+	api, cadvisor := services[0], services[1]
+	if api.Source != "small" || api.Replicas != 4 || api.LimitMemory != 128<<20 {
+		t.Errorf("api = %+v, want the small profile with 4 replicas", api)
+	}
+	if cadvisor.Source != "stack file" || !cadvisor.Global || len(cadvisor.Constraints) != 1 || cadvisor.ReservedMemory != 64<<20 {
+		t.Errorf("cadvisor = %+v, want the resources and placement of the stack file", cadvisor)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// defaultDevHostnames are covered by the development certificate when the config declares none
+var defaultDevHostnames = []string{"bo.localhost", "api.bo.localhost"}
+
+// devCAValidity and devCertValidity bound the lifetime of the local CA and of the issued certificate.
+// 825 days is the longest validity accepted by Apple platforms for server certificates
+const (
+	devCAValidity   = 10 * 365 * 24 * time.Hour
+	devCertValidity = 825 * 24 * time.Hour
+	devCertRenewal  = 30 * 24 * time.Hour
+)
+
+// devHostnames returns the hostnames and addresses the development certificate covers, always
+// including localhost and the loopback addresses
+func devHostnames(config Config) []string {
+	hostnames := []string{"localhost", "127.0.0.1", "::1"}
+	configured := config.Traefik.DevHostnames
+	if len(configured) == 0 {
+		configured = defaultDevHostnames
+	}
+	for _, hostname := range configured {
+		hostname = strings.ToLower(strings.TrimSpace(hostname))
+		if hostname != "" && !slices.Contains(hostnames, hostname) {
+			hostnames = append(hostnames, hostname)
+		}
+	}
+
+	return hostnames
+}
+
+// newSerialNumber returns a random certificate serial number
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+}
+
+// encodePrivateKey encodes a private key as a PKCS#8 PEM block
+func encodePrivateKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// readCertificate parses the first certificate of a PEM file
+func readCertificate(path string) (*x509.Certificate, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s does not contain a PEM certificate", path)
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// readPrivateKey parses a PKCS#8 PEM private key
+func readPrivateKey(path string) (crypto.Signer, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM private key", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain a signing key", path)
+	}
+
+	return signer, nil
+}
+
+// createDevCA creates a self-signed CA restricted to issuing server certificates
+func createDevCA() (*x509.Certificate, crypto.Signer, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Beneficial Ownership development CA"}, CommonName: "Beneficial Ownership dev CA " + hostname},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(devCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return certificate, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// issueDevCertificate issues a server certificate for the hostnames, signed by the CA
+func issueDevCertificate(ca *x509.Certificate, caKey crypto.Signer, hostnames []string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"Beneficial Ownership development"}, CommonName: hostnames[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(devCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, hostname := range hostnames {
+		if ip := net.ParseIP(hostname); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, hostname)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := encodePrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM, nil
+}
+
+// devCertificateCurrent reports whether an issued certificate is signed by the CA, covers exactly the
+// hostnames and does not expire soon, so it can be kept
+func devCertificateCurrent(certificate *x509.Certificate, ca *x509.Certificate, hostnames []string) bool {
+	if certificate.CheckSignatureFrom(ca) != nil || time.Until(certificate.NotAfter) < devCertRenewal {
+		return false
+	}
+
+	var covered []string
+	covered = append(covered, certificate.DNSNames...)
+	for _, ip := range certificate.IPAddresses {
+		covered = append(covered, ip.String())
+	}
+	if len(covered) != len(hostnames) {
+		return false
+	}
+	for _, hostname := range hostnames {
+		if ip := net.ParseIP(hostname); ip != nil {
+			hostname = ip.String()
+		}
+		if !slices.Contains(covered, hostname) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// renderTraefikTLSConfig renders the file provider config serving the development certificate by default
+func renderTraefikTLSConfig(certFile string, keyFile string) ([]byte, error) {
+	certificate := map[string]any{
+		"certFile": traefikCertsMountPath + "/" + certFile,
+		"keyFile":  traefikCertsMountPath + "/" + keyFile,
+	}
+	dynamic := map[string]any{
+		"tls": map[string]any{
+			"certificates": []any{certificate},
+			"stores": map[string]any{
+				"default": map[string]any{"defaultCertificate": certificate},
+			},
+		},
+	}
+
+	return marshalYAML(dynamic)
+}
+
+// hostsEntries returns the hosts file line pointing the dev hostnames at the loopback address. Wildcards
+// and addresses cannot be listed in a hosts file and are left out
+func hostsEntries(hostnames []string) string {
+	var names []string
+	for _, hostname := range hostnames {
+		if hostname == "localhost" || strings.Contains(hostname, "*") || net.ParseIP(hostname) != nil {
+			continue
+		}
+		names = append(names, hostname)
+	}
+	if len(names) == 0 {
+		return ""
+	}
+
+	return "127.0.0.1 " + strings.Join(names, " ")
+}
+
+// loadOrCreateDevCA reuses the CA in caDir, or creates it when missing or when renewal is requested
+func loadOrCreateDevCA(caDir string, renew bool) (*x509.Certificate, crypto.Signer, bool, error) {
+	certPath := filepath.Join(caDir, "ca.pem")
+	keyPath := filepath.Join(caDir, "ca-key.pem")
+
+	if !renew {
+		certificate, certErr := readCertificate(certPath)
+		key, keyErr := readPrivateKey(keyPath)
+		if certErr == nil && keyErr == nil {
+			if time.Until(certificate.NotAfter) < devCertValidity {
+				fmt.Printf("Warning: the development CA expires on %s, renew it with -renew-ca\n", certificate.NotAfter.Format("2006-01-02"))
+			}
+			return certificate, key, false, nil
+		}
+		if !errors.Is(certErr, os.ErrNotExist) || !errors.Is(keyErr, os.ErrNotExist) {
+			return nil, nil, false, fmt.Errorf("unable to load the development CA from %s (%v, %v), recreate it with -renew-ca", caDir, certErr, keyErr)
+		}
+	}
+
+	certificate, key, certPEM, err := createDevCA()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	keyPEM, err := encodePrivateKey(key)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if err := os.MkdirAll(caDir, 0700); err != nil {
+		return nil, nil, false, err
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return nil, nil, false, err
+	}
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return nil, nil, false, err
+	}
+
+	return certificate, key, true, nil
+}
+
+// GenerateDevCerts creates the local development CA if needed, issues a certificate for the dev hostnames
+// and writes the Traefik TLS config serving it. Everything happens offline.
+func GenerateDevCerts(configFile string, caDir string, outputDir string, dynamicDir string, printHosts bool, renewCA bool, forceIssue bool) {
+	config := getConfig(configFile)
+	hostnames := devHostnames(config)
+
+	ca, caKey, created, err := loadOrCreateDevCA(caDir, renewCA)
+	if err != nil {
+		fmt.Printf("Error preparing the development CA: %v\n", err)
+		return
+	}
+	caFile := filepath.Join(caDir, "ca.pem")
+	if created {
+		fmt.Printf("Created development CA %s\n", caFile)
+	} else {
+		fmt.Printf("Using development CA %s\n", caFile)
+	}
+
+	certFile := filepath.Join(outputDir, "dev.pem")
+	keyFile := filepath.Join(outputDir, "dev-key.pem")
+	existing, err := readCertificate(certFile)
+	if err == nil && !forceIssue && !created && devCertificateCurrent(existing, ca, hostnames) {
+		fmt.Printf("Certificate %s is up to date for %s\n", certFile, strings.Join(hostnames, ", "))
+	} else {
+		certPEM, keyPEM, err := issueDevCertificate(ca, caKey, hostnames)
+		if err != nil {
+			fmt.Printf("Error issuing the development certificate: %v\n", err)
+			return
+		}
+		if err := os.MkdirAll(outputDir, 0755); err != nil {
+			fmt.Printf("Error creating output directory: %v\n", err)
+			return
+		}
+		if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			fmt.Printf("Error writing %s: %v\n", keyFile, err)
+			return
+		}
+		if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+			fmt.Printf("Error writing %s: %v\n", certFile, err)
+			return
+		}
+		fmt.Printf("Issued %s for %s\n", certFile, strings.Join(hostnames, ", "))
+	}
+
+	tlsConfig, err := renderTraefikTLSConfig(filepath.Base(certFile), filepath.Base(keyFile))
+	if err != nil {
+		fmt.Printf("Error marshalling TLS config: %v\n", err)
+		return
+	}
+	tlsFile := filepath.Join(dynamicDir, "certs.yml")
+	header := "# Development certificate served by Traefik, generated by deployment certs\n\n"
+	if !writeGeneratedFile(tlsFile, append([]byte(header), tlsConfig...), true) {
+		return
+	}
+	fmt.Printf("Traefik TLS config written to %s\n", tlsFile)
+
+	if created {
+		fmt.Println("\nTrust the development CA once so browsers accept the certificate:")
+		fmt.Printf("  macOS:  sudo security add-trusted-cert -d -r trustRoot -k /Library/Keychains/System.keychain %s\n", caFile)
+		fmt.Printf("  Linux:  sudo cp %s /usr/local/share/ca-certificates/beneficial-ownership-dev-ca.crt && sudo update-ca-certificates\n", caFile)
+		fmt.Println("  Firefox keeps its own store: Settings > Privacy & Security > Certificates > Import")
+	}
+
+	if printHosts {
+		if entry := hostsEntries(hostnames); entry != "" {
+			fmt.Println("\nAdd to /etc/hosts if your resolver does not map *.localhost to the loopback address:")
+			fmt.Printf("  %s\n", entry)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDevHostnames(t *testing.T) {
+	if got := devHostnames(Config{}); !slices.Equal(got, []string{"localhost", "127.0.0.1", "::1", "bo.localhost", "api.bo.localhost"}) {
+		t.Errorf("default hostnames = %v", got)
+	}
+
+	config := Config{Traefik: TraefikConfig{DevHostnames: []string{" App.Localhost ", "localhost", "", "*.app.localhost"}}}
+	if got := devHostnames(config); !slices.Equal(got, []string{"localhost", "127.0.0.1", "::1", "app.localhost", "*.app.localhost"}) {
+		t.Errorf("configured hostnames = %v", got)
+	}
+}
+
+func TestDevCertificateIsSignedByTheCA(t *testing.T) {
+	ca, caKey, caPEM, err := createDevCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostnames := []string{"localhost", "127.0.0.1", "::1", "bo.localhost"}
+	certPEM, keyPEM, err := issueDevCertificate(ca, caKey, hostnames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		t.Fatalf("certificate and key do not match: %v", err)
+	}
+
+	block, _ := pem.Decode(certPEM)
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	for _, hostname := range []string{"bo.localhost", "127.0.0.1", "::1"} {
+		if _, err := certificate.Verify(x509.VerifyOptions{DNSName: hostname, Roots: roots}); err != nil {
+			t.Errorf("certificate not valid for %s: %v", hostname, err)
+		}
+	}
+
+	renewed, _, _, err := createDevCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		ca        *x509.Certificate
+		hostnames []string
+		current   bool
+	}{
+		{"same hostnames", ca, hostnames, true},
+		{"hostnames in another order", ca, []string{"bo.localhost", "::1", "localhost", "127.0.0.1"}, true},
+		{"added hostname", ca, append(slices.Clone(hostnames), "api.bo.localhost"), false},
+		{"removed hostname", ca, hostnames[:3], false},
+		{"renewed CA", renewed, hostnames, false},
+	}
+	for _, test := range tests {
+		if got := devCertificateCurrent(certificate, test.ca, test.hostnames); got != test.current {
+			t.Errorf("%s: current = %v, want %v", test.name, got, test.current)
+		}
+	}
+
+	// A certificate close to its expiry is issued again
+	certificate.NotAfter = time.Now().Add(devCertRenewal / 2)
+	if devCertificateCurrent(certificate, ca, hostnames) {
+		t.Error("certificate expiring soon reported as current")
+	}
+}
+
+func TestLoadOrCreateDevCA(t *testing.T) {
+	caDir := filepath.Join(t.TempDir(), "ca")
+
+	created, _, isNew, err := loadOrCreateDevCA(caDir, false)
+	if err != nil || !isNew {
+		t.Fatalf("first run: new = %v, err = %v", isNew, err)
+	}
+	if info, err := os.Stat(filepath.Join(caDir, "ca-key.pem")); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("CA key mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	loaded, _, isNew, err := loadOrCreateDevCA(caDir, false)
+	if err != nil || isNew || !loaded.Equal(created) {
+		t.Errorf("second run did not reuse the CA: new = %v, err = %v", isNew, err)
+	}
+
+	renewed, _, isNew, err := loadOrCreateDevCA(caDir, true)
+	if err != nil || !isNew || renewed.Equal(created) {
+		t.Errorf("renewal did not create a new CA: new = %v, err = %v", isNew, err)
+	}
+
+	// A damaged CA is not silently replaced, the certificates it signed would stop being trusted
+	if err := os.WriteFile(filepath.Join(caDir, "ca.pem"), []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := loadOrCreateDevCA(caDir, false); err == nil {
+		t.Error("loading a damaged CA did not fail")
+	}
+}
+
+func TestHostsEntries(t *testing.T) {
+	tests := []struct {
+		hostnames []string
+		want      string
+	}{
+		{[]string{"localhost", "127.0.0.1", "::1", "bo.localhost", "*.bo.localhost", "api.bo.localhost"}, "127.0.0.1 bo.localhost api.bo.localhost"},
+		{[]string{"localhost", "::1"}, ""},
+	}
+	for _, test := range tests {
+		if got := hostsEntries(test.hostnames); got != test.want {
+			t.Errorf("hostsEntries(%v) = %q, want %q", test.hostnames, got, test.want)
+		}
+	}
+}
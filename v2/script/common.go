@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -11,15 +12,408 @@ import (
 
 // ServiceConfig represents the structure of a service in the config file
 type ServiceConfig struct {
-	Name    string `yaml:"name"`
-	EnvFile string `yaml:"env_file"`
-	Prefix  string `yaml:"prefix"`
+	Name        string             `yaml:"name"`
+	EnvFile     string             `yaml:"env_file"`
+	Prefix      string             `yaml:"prefix"`
+	Domain      string             `yaml:"domain,omitempty"`
+	Kind        string             `yaml:"kind,omitempty"`
+	Groups      []string           `yaml:"groups,omitempty"`
+	Healthcheck *HealthcheckConfig `yaml:"healthcheck,omitempty"`
+	Variables   []VariableConfig   `yaml:"variables,omitempty"`
+	Nats        *NatsConfig        `yaml:"nats,omitempty"`
+	Postgres    *PostgresConfig    `yaml:"postgres,omitempty"`
+	Redis       *RedisClientConfig `yaml:"redis,omitempty"`
+	Middlewares []string           `yaml:"middlewares,omitempty"`
+	Metrics     *MetricsConfig     `yaml:"metrics,omitempty"`
+	SLO         *SLOConfig         `yaml:"slo,omitempty"`
+	Telemetry   *ServiceTelemetry  `yaml:"telemetry,omitempty"`
+	Resources   *ServiceResources  `yaml:"resources,omitempty"`
+	StackName   string             `yaml:"stack_name,omitempty"` // name of the service in docker-stack.yml when it differs
+	Image       *ServiceImage      `yaml:"image,omitempty"`
+	Build       *ServiceBuild      `yaml:"build,omitempty"`
+}
+
+// NatsConfig represents the NATS subjects, streams and consumers used by a service
+type NatsConfig struct {
+	Publish     []string             `yaml:"publish,omitempty"`
+	Subscribe   []string             `yaml:"subscribe,omitempty"`
+	Streams     []NatsStreamConfig   `yaml:"streams,omitempty"`
+	Consumers   []NatsConsumerConfig `yaml:"consumers,omitempty"`
+	UserVar     string               `yaml:"user_var,omitempty"`
+	PasswordVar string               `yaml:"password_var,omitempty"`
+	InboxVar    string               `yaml:"inbox_var,omitempty"` // variable receiving the inbox prefix of the service
+}
+
+// NatsStreamConfig represents a JetStream stream owned by a service
+type NatsStreamConfig struct {
+	Name      string   `yaml:"name"`
+	Subjects  []string `yaml:"subjects"`
+	Retention string   `yaml:"retention,omitempty"` // limits (default), interest or workqueue
+	Storage   string   `yaml:"storage,omitempty"`   // file (default) or memory
+	MaxAge    string   `yaml:"max_age,omitempty"`   // e.g. 72h or 7d, unlimited when empty
+	MaxMsgs   int64    `yaml:"max_msgs,omitempty"`
+	MaxBytes  int64    `yaml:"max_bytes,omitempty"`
+	Replicas  int      `yaml:"replicas,omitempty"`
+}
+
+// NatsConsumerConfig represents a durable JetStream consumer used by a service
+type NatsConsumerConfig struct {
+	Name          string `yaml:"name"`
+	Stream        string `yaml:"stream"`
+	FilterSubject string `yaml:"filter_subject,omitempty"`
+	DeliverPolicy string `yaml:"deliver_policy,omitempty"` // all (default), last, new or last_per_subject
+	AckPolicy     string `yaml:"ack_policy,omitempty"`     // explicit (default), all or none
+	AckWait       string `yaml:"ack_wait,omitempty"`       // e.g. 30s
+	MaxDeliver    int    `yaml:"max_deliver,omitempty"`
+}
+
+// PostgresConfig represents the Postgres role of a service and the databases it may access
+type PostgresConfig struct {
+	Role        string                `yaml:"role,omitempty"`
+	Grants      []PostgresGrantConfig `yaml:"grants"`
+	UserVar     string                `yaml:"user_var,omitempty"`
+	PasswordVar string                `yaml:"password_var,omitempty"`
+}
+
+// PostgresGrantConfig represents the access of a service role to one database
+type PostgresGrantConfig struct {
+	Database    string `yaml:"database"`
+	Access      string `yaml:"access"`                 // read-only, read-write or owner
+	DatabaseVar string `yaml:"database_var,omitempty"` // variable receiving the database name
+}
+
+// RedisClientConfig represents the KeyDB ACL user of a service
+type RedisClientConfig struct {
+	User        string   `yaml:"user,omitempty"`
+	Keys        []string `yaml:"keys"`               // key patterns such as crawler:*
+	Channels    []string `yaml:"channels,omitempty"` // pub/sub channel patterns
+	Commands    string   `yaml:"commands,omitempty"` // ACL command rules, default: +@all -@dangerous
+	UserVar     string   `yaml:"user_var,omitempty"`
+	PasswordVar string   `yaml:"password_var,omitempty"`
+}
+
+// VariableConfig represents the declared schema of a variable in a service .env file
+type VariableConfig struct {
+	Name        string `yaml:"name"`
+	Type        string `yaml:"type,omitempty"`
+	Required    bool   `yaml:"required,omitempty"`
+	Secret      bool   `yaml:"secret,omitempty"`
+	Pattern     string `yaml:"pattern,omitempty"`
+	Description string `yaml:"description,omitempty"`
+}
+
+// HealthcheckConfig represents the health probe declared for a service in the config file
+type HealthcheckConfig struct {
+	Type        string `yaml:"type"`
+	Port        string `yaml:"port,omitempty"`
+	Path        string `yaml:"path,omitempty"`
+	Command     string `yaml:"command,omitempty"`
+	Interval    string `yaml:"interval,omitempty"`
+	Timeout     string `yaml:"timeout,omitempty"`
+	Retries     int    `yaml:"retries,omitempty"`
+	StartPeriod string `yaml:"start_period,omitempty"`
 }
 
 // Config represents the structure of the services configuration file
 type Config struct {
-	CommonServices []ServiceConfig `yaml:"common_services"`
-	Services       []ServiceConfig `yaml:"services"`
+	DefaultGroups  []string           `yaml:"default_groups,omitempty"`
+	Messaging      MessagingConfig    `yaml:"messaging,omitempty"`
+	Databases      []DatabaseConfig   `yaml:"databases,omitempty"`
+	Redis          RedisServerConfig  `yaml:"redis,omitempty"`
+	Traefik        TraefikConfig      `yaml:"traefik,omitempty"`
+	Middlewares    []MiddlewareConfig `yaml:"middlewares,omitempty"`
+	Monitoring     MonitoringConfig   `yaml:"monitoring,omitempty"`
+	Telemetry      TelemetryConfig    `yaml:"telemetry,omitempty"`
+	Resources      ResourcesConfig    `yaml:"resources,omitempty"`
+	Audit          AuditConfig        `yaml:"audit,omitempty"`
+	Policies       []PolicyConfig     `yaml:"policies,omitempty"`
+	Images         ImagesConfig       `yaml:"images,omitempty"`
+	Bake           BakeConfig         `yaml:"bake,omitempty"`
+	CommonServices []ServiceConfig    `yaml:"common_services"`
+	Services       []ServiceConfig    `yaml:"services"`
+}
+
+// MessagingConfig represents the catalog of NATS subjects used by the pipeline
+type MessagingConfig struct {
+	Subjects []SubjectConfig `yaml:"subjects,omitempty"`
+}
+
+// SubjectConfig represents a declared NATS subject
+type SubjectConfig struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description,omitempty"`
+}
+
+// DatabaseConfig represents a Postgres database created for the services
+type DatabaseConfig struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description,omitempty"`
+}
+
+// RedisServerConfig represents the KeyDB server settings, with overrides per environment
+type RedisServerConfig struct {
+	RedisSettings `yaml:",inline"`
+	Environments  map[string]RedisSettings `yaml:"environments,omitempty"`
+}
+
+// RedisSettings represents the memory and persistence settings of the KeyDB server
+type RedisSettings struct {
+	Persistence     string   `yaml:"persistence,omitempty"` // none, rdb, aof or both
+	Save            []string `yaml:"save,omitempty"`        // RDB snapshot rules such as "900 1"
+	AppendFsync     string   `yaml:"appendfsync,omitempty"` // always, everysec or no
+	MaxMemory       string   `yaml:"maxmemory,omitempty"`
+	MaxMemoryPolicy string   `yaml:"maxmemory_policy,omitempty"`
+}
+
+// TraefikConfig represents the settings of the Traefik static configuration, with overrides per environment
+type TraefikConfig struct {
+	TraefikSettings `yaml:",inline"`
+	Environments    map[string]TraefikSettings `yaml:"environments,omitempty"`
+	DevHostnames    []string                   `yaml:"dev_hostnames,omitempty"` // covered by the certificate of deployment certs
+}
+
+// TraefikSettings represents the entrypoints, certificates, dashboard and observability settings of Traefik
+type TraefikSettings struct {
+	Profile         string   `yaml:"profile,omitempty"`  // dev or production
+	Provider        string   `yaml:"provider,omitempty"` // docker labels (default) or file for the file provider
+	LogLevel        string   `yaml:"log_level,omitempty"`
+	ACMEEmail       string   `yaml:"acme_email,omitempty"`
+	ACMECAServer    string   `yaml:"acme_ca_server,omitempty"` // CA directory URL, or staging for Let's Encrypt staging
+	DashboardDomain string   `yaml:"dashboard_domain,omitempty"`
+	DashboardUser   string   `yaml:"dashboard_user,omitempty"`
+	TrustedIPs      []string `yaml:"trusted_ips,omitempty"` // proxies allowed to set X-Forwarded-* headers
+	AccessLog       *bool    `yaml:"access_log,omitempty"`
+	Metrics         *bool    `yaml:"metrics,omitempty"`
+}
+
+// MetricsConfig represents the Prometheus endpoint of a service
+type MetricsConfig struct {
+	Port     string `yaml:"port"`               // port number or variable of the service env file, like healthchecks
+	Path     string `yaml:"path,omitempty"`     // default /metrics
+	Interval string `yaml:"interval,omitempty"` // scrape interval, default the global one
+}
+
+// SLOConfig represents the service level hints the generated alert rules are derived from
+type SLOConfig struct {
+	Tier        string  `yaml:"tier,omitempty"`         // critical or best-effort (default)
+	Replicas    int     `yaml:"replicas,omitempty"`     // replicas expected to be up
+	MaxRestarts int     `yaml:"max_restarts,omitempty"` // restarts per hour before alerting, default 3
+	ErrorBudget float64 `yaml:"error_budget,omitempty"` // ratio of 5xx responses allowed on the routers, like 0.01
+	MaxPending  int     `yaml:"max_pending,omitempty"`  // pending messages of the consumers before alerting, default 1000
+	StaleAfter  string  `yaml:"stale_after,omitempty"`  // alert when the streams the service publishes to stop growing for this long
+}
+
+// MonitoringConfig represents the settings of the generated monitoring stack
+type MonitoringConfig struct {
+	ScrapeInterval     string `yaml:"scrape_interval,omitempty"`
+	EvaluationInterval string `yaml:"evaluation_interval,omitempty"`
+	Retention          string `yaml:"retention,omitempty"`   // Prometheus TSDB retention
+	AppNetwork         string `yaml:"app_network,omitempty"` // external network of the application services
+	Exporters          *bool  `yaml:"exporters,omitempty"`   // postgres, redis and nats exporters, default true
+	Cadvisor           *bool  `yaml:"cadvisor,omitempty"`    // cAdvisor container metrics on every node, default true
+
+	// Resource profiles of the monitoring services, by tool name or exporters, instead of the variables of monitoring/.env
+	Resources map[string]string `yaml:"resources,omitempty"`
+	// Images of the monitoring services replacing the built-in versions, by service name like prometheus or redis-exporter
+	Images map[string]string `yaml:"images,omitempty"`
+}
+
+// TelemetryConfig represents the OpenTelemetry and logging settings injected into the application services,
+// with overrides per environment
+type TelemetryConfig struct {
+	TelemetrySettings `yaml:",inline"`
+	Environments      map[string]TelemetrySettings `yaml:"environments,omitempty"`
+}
+
+// TelemetrySettings represents where the services send their traces and how their logs reach Loki
+type TelemetrySettings struct {
+	Enabled    *bool             `yaml:"enabled,omitempty"`    // inject the OTEL_* variables, default false
+	Endpoint   string            `yaml:"endpoint,omitempty"`   // OTLP endpoint, default http://tempo:4318
+	Protocol   string            `yaml:"protocol,omitempty"`   // http/protobuf (default) or grpc
+	Logging    string            `yaml:"logging,omitempty"`    // none (default), loki or json
+	LokiURL    string            `yaml:"loki_url,omitempty"`   // push URL of the loki logging driver
+	Attributes map[string]string `yaml:"attributes,omitempty"` // extra resource attributes
+}
+
+// ServiceTelemetry represents the telemetry overrides of a service
+type ServiceTelemetry struct {
+	Enabled     *bool             `yaml:"enabled,omitempty"`
+	ServiceName string            `yaml:"service_name,omitempty"` // OTEL_SERVICE_NAME, default the service name
+	Logging     string            `yaml:"logging,omitempty"`
+	Attributes  map[string]string `yaml:"attributes,omitempty"`
+}
+
+// ServiceResources represents the resources of a service, with overrides per environment
+type ServiceResources struct {
+	ResourceSettings `yaml:",inline"`
+	Environments     map[string]ResourceSettings `yaml:"environments,omitempty"`
+}
+
+// ResourceSettings represents a resource profile with explicit values overriding it
+type ResourceSettings struct {
+	Profile      string         `yaml:"profile,omitempty"` // small, medium, large or a profile of the resources section
+	Limits       ResourceValues `yaml:"limits,omitempty"`
+	Reservations ResourceValues `yaml:"reservations,omitempty"`
+}
+
+// ResourceValues represents an amount of CPU and memory, in the docker compose notation
+type ResourceValues struct {
+	CPUs   string `yaml:"cpus,omitempty"`   // like 0.5
+	Memory string `yaml:"memory,omitempty"` // like 256M or 1G
+}
+
+// ServiceImage represents the image of a service, with overrides per environment
+type ServiceImage struct {
+	ImageSettings `yaml:",inline"`
+	Environments  map[string]ImageSettings `yaml:"environments,omitempty"`
+}
+
+// ImageSettings represents an image reference split into its repository and tag
+type ImageSettings struct {
+	Repository string `yaml:"repository,omitempty"` // like postgres or ghcr.io/lexicon/bo-api
+	Tag        string `yaml:"tag,omitempty"`
+}
+
+// ServiceBuild represents how a service is built from its source in dev mode, the image it runs in prod mode
+// comes from its image section or the images registry
+type ServiceBuild struct {
+	Context       string   `yaml:"context,omitempty"`        // source directory, ./<name> by default
+	Dockerfile    string   `yaml:"dockerfile,omitempty"`     // Dockerfile of the prod image, Dockerfile by default
+	DevDockerfile string   `yaml:"dev_dockerfile,omitempty"` // dev.Dockerfile by default
+	Source        string   `yaml:"source,omitempty"`         // path of the source in the dev container, /app by default
+	Watch         bool     `yaml:"watch,omitempty"`          // Compose develop.watch rules instead of the bind mount
+	Rebuild       []string `yaml:"rebuild,omitempty"`        // files of the context rebuilding the image when watched, like go.mod
+	Args          []string `yaml:"args,omitempty"`           // variables passed as bake build args, every non-secret one by default
+	Platforms     []string `yaml:"platforms,omitempty"`      // target platforms replacing those of the bake section
+}
+
+// ImagesConfig represents the compose and stack files checked by `deployment images check` and the images of
+// the prod mode of `deployment update`
+type ImagesConfig struct {
+	// Environment of each file, by path relative to the project. Other compose and stack files are found in the
+	// project, files named like *stack* are prod and the others dev.
+	Files map[string]string `yaml:"files,omitempty"`
+	// Mode of `deployment update` by environment, dev (build from source) or prod (run the images)
+	Modes    map[string]string `yaml:"modes,omitempty"`
+	Registry string            `yaml:"registry,omitempty"` // registry and namespace of the prod images, like ghcr.io/lexicon
+	Tag      string            `yaml:"tag,omitempty"`      // tag of the prod images without a declared image, latest by default
+	Restart  string            `yaml:"restart,omitempty"`  // restart policy added in prod mode, unless-stopped by default
+}
+
+// BakeConfig represents the build settings of docker-bake.hcl, with overrides per environment
+type BakeConfig struct {
+	BakeSettings `yaml:",inline"`
+	Environments map[string]BakeSettings `yaml:"environments,omitempty"`
+}
+
+// BakeSettings represents the platforms and the build cache of the bake targets
+type BakeSettings struct {
+	Platforms []string `yaml:"platforms,omitempty"` // like linux/amd64, the platform of the builder by default
+	Cache     string   `yaml:"cache,omitempty"`     // registry, gha, local or none (default)
+	CacheDir  string   `yaml:"cache_dir,omitempty"` // directory of the local cache, .buildx-cache by default
+}
+
+// ResourcesConfig represents the resource profiles and the hosts the stack is deployed on
+type ResourcesConfig struct {
+	Profiles     map[string]ResourceSettings     `yaml:"profiles,omitempty"` // added to or overriding small, medium and large
+	Nodes        []NodeConfig                    `yaml:"nodes,omitempty"`
+	Environments map[string]ResourcesEnvironment `yaml:"environments,omitempty"`
+}
+
+// ResourcesEnvironment represents the hosts of one environment
+type ResourcesEnvironment struct {
+	Nodes []NodeConfig `yaml:"nodes,omitempty"`
+}
+
+// NodeConfig represents a Swarm node, or several identical ones
+type NodeConfig struct {
+	Name   string `yaml:"name"`
+	Role   string `yaml:"role,omitempty"` // manager or worker (default)
+	CPUs   string `yaml:"cpus"`
+	Memory string `yaml:"memory"`
+	Count  int    `yaml:"count,omitempty"` // identical nodes, default 1
+}
+
+// AuditConfig represents the files checked by `deployment audit` and the accepted findings
+type AuditConfig struct {
+	Files        []string           `yaml:"files,omitempty"` // default: docker-compose.yml, docker-stack.yml and monitoring/monitoring-stack.yml
+	Suppressions []AuditSuppression `yaml:"suppressions,omitempty"`
+}
+
+// AuditSuppression accepts the findings of a rule, optionally only for a service or a file
+type AuditSuppression struct {
+	Rule    string `yaml:"rule"`
+	Service string `yaml:"service,omitempty"`
+	File    string `yaml:"file,omitempty"`
+	Reason  string `yaml:"reason"`
+}
+
+// PolicyConfig represents a house rule checked against the rendered services and their Traefik routers
+type PolicyConfig struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description,omitempty"`
+	For         string `yaml:"for,omitempty"`      // service (default) or router
+	When        string `yaml:"when,omitempty"`     // expression selecting the services or routers the rule applies to
+	Require     string `yaml:"require"`            // expression that must be true
+	Severity    string `yaml:"severity,omitempty"` // error (default) or warning
+}
+
+// MiddlewareConfig represents a named Traefik middleware that services attach to their routers
+type MiddlewareConfig struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"` // basicauth, forwardauth, ratelimit, ipallowlist, cors, headers, compress, stripprefix, addprefix or replacepathregex
+
+	// basicauth: users whose passwords are generated into the consolidated env
+	Users []string `yaml:"users,omitempty"`
+
+	// forwardauth
+	Address             string   `yaml:"address,omitempty"`
+	TrustForwardHeader  bool     `yaml:"trust_forward_header,omitempty"`
+	AuthResponseHeaders []string `yaml:"auth_response_headers,omitempty"`
+
+	// ratelimit
+	Average int    `yaml:"average,omitempty"`
+	Burst   int    `yaml:"burst,omitempty"`
+	Period  string `yaml:"period,omitempty"`
+
+	// ipallowlist
+	SourceRange []string `yaml:"source_range,omitempty"`
+
+	// cors
+	Origins          []string `yaml:"origins,omitempty"`
+	Methods          []string `yaml:"methods,omitempty"`
+	AllowHeaders     []string `yaml:"allow_headers,omitempty"`
+	AllowCredentials bool     `yaml:"allow_credentials,omitempty"`
+	MaxAge           int      `yaml:"max_age,omitempty"`
+
+	// headers: security headers with sensible defaults
+	STSSeconds            int               `yaml:"sts_seconds,omitempty"`
+	FrameOptions          string            `yaml:"frame_options,omitempty"`
+	ContentSecurityPolicy string            `yaml:"content_security_policy,omitempty"`
+	ReferrerPolicy        string            `yaml:"referrer_policy,omitempty"`
+	PermissionsPolicy     string            `yaml:"permissions_policy,omitempty"`
+	ResponseHeaders       map[string]string `yaml:"response_headers,omitempty"`
+
+	// stripprefix, addprefix and replacepathregex
+	Prefixes    []string `yaml:"prefixes,omitempty"`
+	Prefix      string   `yaml:"prefix,omitempty"`
+	Regex       string   `yaml:"regex,omitempty"`
+	Replacement string   `yaml:"replacement,omitempty"`
+}
+
+// defaultEnvironment is used when neither -environment nor DEPLOYMENT_ENVIRONMENT is set
+const defaultEnvironment = "dev"
+
+// resolveEnvironment returns the target environment, such as dev or prod
+func resolveEnvironment(environment string) string {
+	if environment != "" {
+		return environment
+	}
+	if environment := os.Getenv("DEPLOYMENT_ENVIRONMENT"); environment != "" {
+		return environment
+	}
+
+	return defaultEnvironment
 }
 
 // getServicePrefix retrieves the service prefix from services-config.yaml
@@ -124,3 +518,16 @@ func resolveFilePath(path string, scriptDir, projectRoot string) string {
 		return projectPath
 	}
 }
+
+// marshalYAML marshals a generated configuration with the two-space indentation of the hand-written files
+func marshalYAML(value any) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	encoder.Close()
+
+	return buffer.Bytes(), nil
+}
@@ -12,7 +12,7 @@ import (
 )
 
 // ConsolidateEnvFiles consolidates environment files from services into a single file
-func ConsolidateEnvFiles(outputFile string, forceOverwrite bool, configFile string, autoDiscover bool, serviceDir string) {
+func ConsolidateEnvFiles(outputFile string, forceOverwrite bool, configFile string, autoDiscover bool, serviceDir string, templateFile string, only string, exclude string) {
 	// Get script directory
 	scriptDir, err := os.Getwd()
 	if err != nil {
@@ -235,8 +235,27 @@ func ConsolidateEnvFiles(outputFile string, forceOverwrite bool, configFile stri
 		return
 	}
 
+	// Reduce the services to the selected ones and their dependencies
+	if only != "" || exclude != "" {
+		templateFile = resolveFilePath(templateFile, scriptDir, projectRoot)
+		dependencies := getTemplateDependencies(templateFile)
+
+		var serviceNames []string
+		for _, service := range append(append([]ServiceConfig{}, commonServices...), appServices...) {
+			serviceNames = append(serviceNames, service.Name)
+		}
+
+		selected := selectServices(serviceNames, getConfig(configFile), dependencies, parseSelector(only), parseSelector(exclude))
+		commonServices = filterServiceConfigs(commonServices, selected)
+		appServices = filterServiceConfigs(appServices, selected)
+	}
+
+	// Generated credentials keep the values of the previous consolidated file
+	config := getConfig(configFile)
+	generatedVars := getGeneratedVariables(append(append([]ServiceConfig{}, commonServices...), appServices...), config, readEnvVars(outputFile))
+
 	// Create consolidated file
-	outputFile, err = createConsolidatedFile(outputFile, commonServices, appServices)
+	outputFile, err = createConsolidatedFile(outputFile, commonServices, appServices, generatedVars)
 	if err != nil {
 		fmt.Printf("Error creating consolidated file: %v\n", err)
 		return
@@ -245,7 +264,7 @@ func ConsolidateEnvFiles(outputFile string, forceOverwrite bool, configFile stri
 	fmt.Printf("Consolidated .env file created at %s\n", outputFile)
 }
 
-func createConsolidatedFile(outputPath string, commonServices, appServices []ServiceConfig) (string, error) {
+func createConsolidatedFile(outputPath string, commonServices, appServices []ServiceConfig, generatedVars []GeneratedVariable) (string, error) {
 	// Create or truncate output file
 	file, err := os.Create(outputPath)
 	if err != nil {
@@ -310,10 +329,14 @@ func createConsolidatedFile(outputPath string, commonServices, appServices []Ser
 		}
 	}
 
+	// Process generated credentials
+	generatedCount := writeGeneratedVariables(file, generatedVars, processedVars)
+
 	fmt.Printf("Environment file consolidation completed.\n")
 	fmt.Printf("%d common infrastructure .env files processed with %d variables.\n", commonSuccessCount, commonVarCount)
 	fmt.Printf("%d application-specific .env files processed with %d variables.\n", appSuccessCount, appVarCount)
-	fmt.Printf("Consolidated %d unique environment variables.\n", commonVarCount+appVarCount)
+	fmt.Printf("%d generated credential variables added.\n", generatedCount)
+	fmt.Printf("Consolidated %d unique environment variables.\n", commonVarCount+appVarCount+generatedCount)
 
 	return outputPath, nil
 }
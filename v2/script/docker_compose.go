@@ -33,16 +33,26 @@ type DockerComposeService struct {
 	WorkingDir    string         `yaml:"working_dir,omitempty"`
 	Restart       string         `yaml:"restart,omitempty"`
 	Expose        any            `yaml:"expose,omitempty"`
+	Healthcheck   any            `yaml:"healthcheck,omitempty"`
+	Profiles      []string       `yaml:"profiles,omitempty"`
 	ExtraFields   map[string]any `yaml:",inline"`
 }
 
+// DockerComposeHealthcheck represents the healthcheck of a service in the docker-compose.yml file
+type DockerComposeHealthcheck struct {
+	Test        []string `yaml:"test"`
+	Interval    string   `yaml:"interval,omitempty"`
+	Timeout     string   `yaml:"timeout,omitempty"`
+	Retries     int      `yaml:"retries,omitempty"`
+	StartPeriod string   `yaml:"start_period,omitempty"`
+}
+
 // UpdateDockerCompose updates a docker-compose.yml file with environment variables from a consolidated .env file
-func UpdateDockerCompose(consolidatedEnvFile string, outputFile string, forceOverwrite bool, customTemplate string, discoverDir string, configFile string) {
+func UpdateDockerCompose(consolidatedEnvFile string, outputFile string, forceOverwrite bool, customTemplate string, discoverDir string, configFile string, only string, exclude string, environment string, mode string) error {
 	// Get script directory
 	scriptDir, err := os.Getwd()
 	if err != nil {
-		fmt.Printf("Error getting current directory: %v\n", err)
-		return
+		return fmt.Errorf("getting current directory: %v", err)
 	}
 
 	// Set project root - find the actual project root instead of just assuming it's one level up
@@ -84,8 +94,7 @@ func UpdateDockerCompose(consolidatedEnvFile string, outputFile string, forceOve
 		if _, err := os.Stat(templateFile); err == nil {
 			fmt.Printf("Using template file: %s\n", templateFile)
 		} else {
-			fmt.Printf("Template file is not specified")
-			return
+			return fmt.Errorf("template file is not specified")
 		}
 	}
 
@@ -111,14 +120,12 @@ func UpdateDockerCompose(consolidatedEnvFile string, outputFile string, forceOve
 
 	// Check if template file exists
 	if _, err := os.Stat(templateFile); err != nil {
-		fmt.Printf("Template file not found: %s\n", templateFile)
-		return
+		return fmt.Errorf("template file not found: %s", templateFile)
 	}
 
 	// Check if consolidated env file exists
 	if _, err := os.Stat(consolidatedEnvFile); err != nil {
-		fmt.Printf("Consolidated env file not found: %s\n", consolidatedEnvFile)
-		return
+		return fmt.Errorf("consolidated env file not found: %s", consolidatedEnvFile)
 	}
 
 	// Check if output file exists
@@ -127,30 +134,43 @@ func UpdateDockerCompose(consolidatedEnvFile string, outputFile string, forceOve
 		var answer string
 		fmt.Scanln(&answer)
 		if strings.ToLower(answer) != "y" {
-			fmt.Println("Operation cancelled.")
-			return
+			return fmt.Errorf("operation cancelled, %s was not written", outputFile)
 		}
 	}
 
 	// Read template file
 	templateBytes, err := os.ReadFile(templateFile)
 	if err != nil {
-		fmt.Printf("Error reading template file: %v\n", err)
-		return
+		return fmt.Errorf("reading template file: %v", err)
 	}
 
 	// Read consolidated env file
 	consolidatedEnvBytes, err := os.ReadFile(consolidatedEnvFile)
 	if err != nil {
-		fmt.Printf("Error reading consolidated env file: %v\n", err)
-		return
+		return fmt.Errorf("reading consolidated env file: %v", err)
 	}
 
 	// Parse template file
 	var dockerCompose DockerComposeConfig
 	if err := yaml.Unmarshal(templateBytes, &dockerCompose); err != nil {
-		fmt.Printf("Error parsing template file: %v\n", err)
-		return
+		return fmt.Errorf("parsing template file: %v", err)
+	}
+
+	// Reduce the stack to the selected services and their dependencies
+	if only != "" || exclude != "" {
+		serviceNames := make([]string, 0, len(dockerCompose.Services))
+		dependencies := make(map[string][]string)
+		for serviceName, service := range dockerCompose.Services {
+			serviceNames = append(serviceNames, serviceName)
+			dependencies[serviceName] = dependsOnNames(service.DependsOn)
+		}
+
+		selected := selectServices(serviceNames, getConfig(configFile), dependencies, parseSelector(only), parseSelector(exclude))
+		for serviceName := range dockerCompose.Services {
+			if !selected[serviceName] {
+				delete(dockerCompose.Services, serviceName)
+			}
+		}
 	}
 
 	// Get environment variables from consolidated env file
@@ -193,20 +213,103 @@ func UpdateDockerCompose(consolidatedEnvFile string, outputFile string, forceOve
 		dockerCompose.Services[serviceName] = service
 	}
 
+	// Expose generated credentials, mount the generated nats-server config, postgres init SQL and
+	// Traefik dynamic config, and write the KeyDB ACL users
+	applyGeneratedVariables(&dockerCompose, &envVars, configFile)
+	updateNatsService(&dockerCompose, configFile, filepath.Dir(outputFile))
+	updatePostgresService(&dockerCompose, configFile)
+	updateRedisService(&dockerCompose, envVars, configFile, filepath.Dir(outputFile))
+	updateTraefikService(&dockerCompose, configFile)
+
+	// Assign compose profiles from service groups
+	applyProfiles(&dockerCompose, configFile)
+
+	// Attach healthchecks once every service is known, then wait on them in depends_on
+	applyHealthchecks(&dockerCompose, &envVars, configFile)
+
+	// Build the services from their source in dev mode, run their images in prod mode
+	environment = resolveEnvironment(environment)
+	mode, err = resolveBuildMode(mode, getConfig(configFile), environment)
+	if err != nil {
+		return err
+	}
+	if err := applyBuildMode(&dockerCompose, configFile, environment, mode); err != nil {
+		return fmt.Errorf("applying the %s mode: %v", mode, err)
+	}
+
+	// Pin the declared image versions of the environment, before telemetry reads the tags as service versions
+	imageLock, err := readImageLock(filepath.Join(projectRoot, imageLockFile))
+	if err != nil {
+		return fmt.Errorf("reading image lock: %v", err)
+	}
+	if err := applyImages(&dockerCompose, configFile, environment, imageLock); err != nil {
+		return fmt.Errorf("applying images: %v", err)
+	}
+
+	// Tell the application services where to send traces and logs, before releases copy their environment
+	if err := applyTelemetry(&dockerCompose, envVars, configFile, environment, filepath.Dir(outputFile)); err != nil {
+		return fmt.Errorf("applying telemetry: %v", err)
+	}
+
+	// Resource limits and reservations of the environment, also copied to the release variants
+	if err := applyResources(&dockerCompose, configFile, environment); err != nil {
+		return fmt.Errorf("applying resources: %v", err)
+	}
+
+	// Split released services into their blue and green variants behind a Traefik weighted service
+	traefikDir := "traefik"
+	if traefikService, ok := getTraefikService(getConfig(configFile)); ok {
+		traefikDir = traefikService.Name
+	}
+	dynamicDir := filepath.Join(filepath.Dir(outputFile), traefikDir, "dynamic")
+	releaseState, err := readReleaseState(filepath.Join(projectRoot, releaseStateFile))
+	if err != nil {
+		return fmt.Errorf("reading release state: %v", err)
+	}
+	weighted := applyReleases(&dockerCompose, releaseState, traefikProvider(getConfig(configFile), environment))
+
+	for serviceName, service := range dockerCompose.Services {
+		updateServiceDependsOn(serviceName, &service, &dockerCompose)
+		dockerCompose.Services[serviceName] = service
+	}
+
+	// Chain the Traefik middlewares of the catalog on the service routers
+	middlewares, err := applyMiddlewares(&dockerCompose, envVars, configFile, dynamicDir)
+	if err != nil {
+		return fmt.Errorf("applying Traefik middlewares: %v", err)
+	}
+
+	// Check the house rules of the policies section, nothing is written before they pass
+	if !enforcePolicies(getConfig(configFile), dockerCompose) {
+		return fmt.Errorf("policy violations, %s was not written: fix the violations or the policies section", outputFile)
+	}
+
+	// Write the weighted services and the middlewares to the file provider, then move the routing into it when
+	// the environment does not expose docker.sock
+	if err := writeTraefikReleases(weighted, dynamicDir); err != nil {
+		return fmt.Errorf("writing the Traefik weighted services: %v", err)
+	}
+	if err := writeTraefikMiddlewares(middlewares, dynamicDir); err != nil {
+		return fmt.Errorf("writing the Traefik middlewares: %v", err)
+	}
+	if err := applyTraefikFileProvider(&dockerCompose, envVars, configFile, environment, dynamicDir, middlewares); err != nil {
+		return fmt.Errorf("writing the Traefik file provider config: %v", err)
+	}
+
 	// Write updated Docker compose file
 	updatedDockerComposeBytes, err := yaml.Marshal(dockerCompose)
 	if err != nil {
-		fmt.Printf("Error marshalling updated Docker compose: %v\n", err)
-		return
+		return fmt.Errorf("marshalling updated Docker compose: %v", err)
 	}
 
 	if err := os.WriteFile(outputFile, updatedDockerComposeBytes, 0644); err != nil {
-		fmt.Printf("Error writing updated Docker compose file: %v\n", err)
-		return
+		return fmt.Errorf("writing updated Docker compose file: %v", err)
 	}
 
 	fmt.Printf("Generated Docker compose file written to %s\n", outputFile)
 	fmt.Printf("Services will use environment variables from %s\n", relEnvPath)
+
+	return nil
 }
 
 func updateServiceEnvironment(serviceName string, service *DockerComposeService, envVars *map[string]string, serviceEnvVars *map[string]string, configFile string) {
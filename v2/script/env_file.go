@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// EnvFile keeps the raw lines of a service .env file so edits preserve comments and ordering
+type EnvFile struct {
+	Path  string
+	Lines []string
+}
+
+// loadEnvFile reads a .env file, returning an empty file when it does not exist yet
+func loadEnvFile(path string) (*EnvFile, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &EnvFile{Path: path}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	text := strings.TrimRight(string(content), "\n")
+	if text == "" {
+		return &EnvFile{Path: path}, nil
+	}
+
+	return &EnvFile{Path: path, Lines: strings.Split(text, "\n")}, nil
+}
+
+// parseEnvLine returns the key and value of an assignment line
+func parseEnvLine(line string) (string, string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(line, "=", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), true
+}
+
+// Keys returns the variable names in file order
+func (f *EnvFile) Keys() []string {
+	var keys []string
+	for _, line := range f.Lines {
+		if key, _, ok := parseEnvLine(line); ok {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// index returns the line index of a key, also matching its prefixed form
+func (f *EnvFile) index(key string, prefix string) int {
+	for i, line := range f.Lines {
+		current, _, ok := parseEnvLine(line)
+		if ok && (current == key || (prefix != "" && current == prefix+key)) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Get returns the value of a key
+func (f *EnvFile) Get(key string, prefix string) (string, bool) {
+	i := f.index(key, prefix)
+	if i < 0 {
+		return "", false
+	}
+
+	_, value, _ := parseEnvLine(f.Lines[i])
+	return value, true
+}
+
+// Set updates a key in place, or appends it at the end of the file
+func (f *EnvFile) Set(key string, prefix string, value string) {
+	i := f.index(key, prefix)
+	if i < 0 {
+		f.Lines = append(f.Lines, fmt.Sprintf("%s=%s", key, value))
+		return
+	}
+
+	current, _, _ := parseEnvLine(f.Lines[i])
+	indent := f.Lines[i][:len(f.Lines[i])-len(strings.TrimLeft(f.Lines[i], " \t"))]
+	f.Lines[i] = fmt.Sprintf("%s%s=%s", indent, current, value)
+}
+
+// Unset removes a key, returning whether it existed
+func (f *EnvFile) Unset(key string, prefix string) bool {
+	i := f.index(key, prefix)
+	if i < 0 {
+		return false
+	}
+
+	f.Lines = append(f.Lines[:i], f.Lines[i+1:]...)
+	return true
+}
+
+// Rename changes the name of a key in place, returning whether it existed
+func (f *EnvFile) Rename(key string, prefix string, newKey string) bool {
+	i := f.index(key, prefix)
+	if i < 0 {
+		return false
+	}
+
+	_, value, _ := parseEnvLine(f.Lines[i])
+	indent := f.Lines[i][:len(f.Lines[i])-len(strings.TrimLeft(f.Lines[i], " \t"))]
+	f.Lines[i] = fmt.Sprintf("%s%s=%s", indent, newKey, value)
+	return true
+}
+
+// Save writes the file back to disk
+func (f *EnvFile) Save() error {
+	content := strings.Join(f.Lines, "\n")
+	if content != "" {
+		content += "\n"
+	}
+
+	return os.WriteFile(f.Path, []byte(content), 0600)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestParseEnvLine(t *testing.T) {
+	tests := []struct {
+		line       string
+		key, value string
+		ok         bool
+	}{
+		{"PORT=8080", "PORT", "8080", true},
+		{"  URL = http://api?a=b  ", "URL", "http://api?a=b", true},
+		{"EMPTY=", "EMPTY", "", true},
+		{"# PORT=8080", "", "", false},
+		{"", "", "", false},
+		{"not an assignment", "", "", false},
+	}
+	for _, test := range tests {
+		key, value, ok := parseEnvLine(test.line)
+		if key != test.key || value != test.value || ok != test.ok {
+			t.Errorf("parseEnvLine(%q) = %q, %q, %v, want %q, %q, %v", test.line, key, value, ok, test.key, test.value, test.ok)
+		}
+	}
+}
+
+func TestEnvFileEditsKeepLayout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	content := "# API settings\nAPI_PORT=8080\n  API_URL=http://localhost\n\nSALT=abc\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := loadEnvFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := file.Keys(); !slices.Equal(keys, []string{"API_PORT", "API_URL", "SALT"}) {
+		t.Errorf("Keys() = %v", keys)
+	}
+	// Keys are found with or without the service prefix
+	if value, ok := file.Get("PORT", "API_"); !ok || value != "8080" {
+		t.Errorf("Get(PORT) = %q, %v", value, ok)
+	}
+
+	file.Set("URL", "API_", "http://api")
+	file.Set("TIMEOUT", "API_", "30s")
+	if !file.Rename("SALT", "", "API_SALT") {
+		t.Error("Rename(SALT) did not find the key")
+	}
+	if file.Unset("MISSING", "API_") {
+		t.Error("Unset of a missing key reported it existed")
+	}
+	if !file.Unset("PORT", "API_") {
+		t.Error("Unset(PORT) did not find the key")
+	}
+	if err := file.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# API settings\n  API_URL=http://api\n\nAPI_SALT=abc\nTIMEOUT=30s\n"
+	if string(saved) != want {
+		t.Errorf("saved file:\n%s\nwant:\n%s", saved, want)
+	}
+}
+
+func TestLoadMissingEnvFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	file, err := loadEnvFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(file.Lines) != 0 || file.Path != path {
+		t.Errorf("missing file loaded as %+v", file)
+	}
+
+	// A new file holds secrets, it is readable by its owner only
+	file.Set("PASSWORD", "", "secret")
+	if err := file.Save(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("new file mode = %v, want 0600", info.Mode().Perm())
+	}
+}
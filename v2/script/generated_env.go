@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// GeneratedVariable is a variable injected into the consolidated env file by a generator,
+// such as per-service credentials, rather than read from a service .env file
+type GeneratedVariable struct {
+	Name     string
+	Value    string
+	Bindings []VariableBinding
+}
+
+// VariableBinding exposes a generated variable to a service under the given name
+type VariableBinding struct {
+	Service  string
+	Variable string
+}
+
+// generateSecret returns a random hex string suitable for a password
+func generateSecret() string {
+	buffer := make([]byte, 24)
+	if _, err := rand.Read(buffer); err != nil {
+		panic(fmt.Sprintf("unable to generate secret: %v", err))
+	}
+
+	return hex.EncodeToString(buffer)
+}
+
+// existingOrNewSecret keeps a previously generated secret so regenerating does not rotate it
+func existingOrNewSecret(existing map[string]string, name string) string {
+	if value := existing[name]; value != "" {
+		return value
+	}
+
+	return generateSecret()
+}
+
+// getGeneratedVariables collects the variables every generator injects for the given services
+func getGeneratedVariables(services []ServiceConfig, config Config, existing map[string]string) []GeneratedVariable {
+	var variables []GeneratedVariable
+	variables = append(variables, natsGeneratedVariables(services, config, existing)...)
+	variables = append(variables, postgresGeneratedVariables(services, config, existing)...)
+	variables = append(variables, redisGeneratedVariables(services, config, existing)...)
+	variables = append(variables, traefikGeneratedVariables(services, config, existing)...)
+	variables = append(variables, traefikMiddlewareGeneratedVariables(services, config, existing)...)
+
+	return variables
+}
+
+// writeGeneratedVariables appends the generated variables to the consolidated file, skipping names already written
+func writeGeneratedVariables(file *os.File, variables []GeneratedVariable, processedVars map[string]bool) int {
+	if len(variables) == 0 {
+		return 0
+	}
+
+	file.WriteString("\n# === GENERATED CREDENTIALS ===\n\n")
+	count := 0
+	for _, variable := range variables {
+		if processedVars[variable.Name] {
+			fmt.Printf("Note: Variable %s is defined in a service .env file, keeping that value\n", variable.Name)
+			continue
+		}
+
+		file.WriteString(fmt.Sprintf("%s= %s\n", variable.Name, variable.Value))
+		processedVars[variable.Name] = true
+		count++
+	}
+	file.WriteString("\n")
+
+	return count
+}
+
+// applyGeneratedVariables exposes generated variables to the services bound to them in the compose file
+func applyGeneratedVariables(dockerCompose *DockerComposeConfig, envVars *map[string]string, configFile string) {
+	config := getConfig(configFile)
+	variables := getGeneratedVariables(getAllServiceConfigs(config), config, *envVars)
+
+	entries := make(map[string][]string)
+	for _, variable := range variables {
+		if _, ok := (*envVars)[variable.Name]; !ok {
+			fmt.Printf("  Warning: generated variable %s is missing from the consolidated env file, run deployment env first\n", variable.Name)
+			continue
+		}
+
+		for _, binding := range variable.Bindings {
+			entries[binding.Service] = append(entries[binding.Service], fmt.Sprintf("%s=${%s}", binding.Variable, variable.Name))
+		}
+	}
+
+	for serviceName, serviceEntries := range entries {
+		service, ok := dockerCompose.Services[serviceName]
+		if !ok {
+			continue
+		}
+
+		mergeServiceEnvironment(&service, serviceEntries)
+		dockerCompose.Services[serviceName] = service
+		fmt.Printf("  Added %d generated variables to service %s\n", len(serviceEntries), serviceName)
+	}
+}
+
+// mergeServiceEnvironment adds KEY=value entries to the environment list of a service, replacing existing keys
+func mergeServiceEnvironment(service *DockerComposeService, entries []string) {
+	var environment []string
+	switch current := service.Environment.(type) {
+	case []string:
+		environment = current
+	case []any:
+		for _, item := range current {
+			if s, ok := item.(string); ok && s != "" {
+				environment = append(environment, s)
+			}
+		}
+	case map[string]any:
+		for key, value := range current {
+			environment = append(environment, fmt.Sprintf("%s=%v", key, value))
+		}
+		sort.Strings(environment)
+	}
+
+	index := make(map[string]int)
+	for i, entry := range environment {
+		index[strings.SplitN(entry, "=", 2)[0]] = i
+	}
+
+	for _, entry := range entries {
+		key := strings.SplitN(entry, "=", 2)[0]
+		if i, ok := index[key]; ok {
+			environment[i] = entry
+			continue
+		}
+		index[key] = len(environment)
+		environment = append(environment, entry)
+	}
+
+	service.Environment = environment
+}
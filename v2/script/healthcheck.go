@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Default probe timings, matching the ones used in docker-stack.yml
+const (
+	defaultHealthcheckInterval    = "30s"
+	defaultHealthcheckTimeout     = "10s"
+	defaultHealthcheckRetries     = 3
+	defaultHealthcheckStartPeriod = "40s"
+)
+
+// natsMonitoringFlag matches the nats-server flags that enable the monitoring endpoint
+var natsMonitoringFlag = regexp.MustCompile(`(^|\s)(-m|--http_port)(\s|=)`)
+
+// getServiceKind returns the infrastructure kind of a service, falling back to its name for common services
+func getServiceKind(service ServiceConfig) string {
+	if service.Kind != "" {
+		return strings.ToLower(service.Kind)
+	}
+
+	switch service.Name {
+	case "postgres", "redis", "keydb", "nats", "traefik":
+		return service.Name
+	}
+
+	return ""
+}
+
+// applyHealthchecks attaches healthchecks to every service of the compose file that does not define one yet
+func applyHealthchecks(dockerCompose *DockerComposeConfig, envVars *map[string]string, configFile string) {
+	for serviceName, service := range dockerCompose.Services {
+		if service.Healthcheck != nil {
+			fmt.Printf("  Keeping healthcheck from template for service %s\n", serviceName)
+			continue
+		}
+
+		serviceConfig := getServiceConfig(serviceName, configFile)
+		healthcheck := buildHealthcheck(serviceConfig, &service, envVars)
+		if healthcheck == nil {
+			continue
+		}
+
+		service.Healthcheck = healthcheck
+		dockerCompose.Services[serviceName] = service
+		fmt.Printf("  Added healthcheck %v for service %s\n", healthcheck.Test, serviceName)
+	}
+}
+
+// buildHealthcheck creates a healthcheck from the declared probe, or from the infrastructure kind of the service
+func buildHealthcheck(serviceConfig ServiceConfig, service *DockerComposeService, envVars *map[string]string) *DockerComposeHealthcheck {
+	declared := serviceConfig.Healthcheck
+	if declared == nil {
+		declared = &HealthcheckConfig{}
+	}
+
+	var test []string
+	prefix := serviceConfig.Prefix
+
+	switch strings.ToLower(declared.Type) {
+	case "none":
+		return nil
+
+	case "http":
+		port := resolvePortReference(declared.Port, prefix, envVars)
+		if port == "" {
+			fmt.Printf("  Warning: http healthcheck for %s has no port, skipping\n", serviceConfig.Name)
+			return nil
+		}
+		path := declared.Path
+		if path == "" {
+			path = "/health"
+		}
+		url := fmt.Sprintf("http://localhost:%s%s", port, path)
+		test = []string{"CMD-SHELL", fmt.Sprintf("wget -q --spider %s || curl -fsS -o /dev/null %s || exit 1", url, url)}
+
+	case "tcp":
+		port := resolvePortReference(declared.Port, prefix, envVars)
+		if port == "" {
+			fmt.Printf("  Warning: tcp healthcheck for %s has no port, skipping\n", serviceConfig.Name)
+			return nil
+		}
+		test = []string{"CMD-SHELL", fmt.Sprintf("nc -z localhost %s || exit 1", port)}
+
+	case "cmd":
+		if declared.Command == "" {
+			fmt.Printf("  Warning: cmd healthcheck for %s has no command, skipping\n", serviceConfig.Name)
+			return nil
+		}
+		test = []string{"CMD-SHELL", declared.Command}
+
+	case "":
+		test = buildInfraHealthcheckTest(serviceConfig, service, envVars)
+		if test == nil {
+			return nil
+		}
+
+	default:
+		fmt.Printf("  Warning: unknown healthcheck type %q for %s, skipping\n", declared.Type, serviceConfig.Name)
+		return nil
+	}
+
+	healthcheck := &DockerComposeHealthcheck{
+		Test:        test,
+		Interval:    declared.Interval,
+		Timeout:     declared.Timeout,
+		Retries:     declared.Retries,
+		StartPeriod: declared.StartPeriod,
+	}
+	if healthcheck.Interval == "" {
+		healthcheck.Interval = defaultHealthcheckInterval
+	}
+	if healthcheck.Timeout == "" {
+		healthcheck.Timeout = defaultHealthcheckTimeout
+	}
+	if healthcheck.Retries == 0 {
+		healthcheck.Retries = defaultHealthcheckRetries
+	}
+	if healthcheck.StartPeriod == "" {
+		healthcheck.StartPeriod = defaultHealthcheckStartPeriod
+	}
+
+	return healthcheck
+}
+
+// buildInfraHealthcheckTest returns the probe for known infrastructure kinds
+func buildInfraHealthcheckTest(serviceConfig ServiceConfig, service *DockerComposeService, envVars *map[string]string) []string {
+	prefix := serviceConfig.Prefix
+
+	switch getServiceKind(serviceConfig) {
+	case "postgres":
+		command := "pg_isready"
+		if _, ok := (*envVars)[prefix+"USER"]; ok {
+			command += fmt.Sprintf(" -U ${%sUSER}", prefix)
+		}
+		if _, ok := (*envVars)[prefix+"PORT"]; ok {
+			command += fmt.Sprintf(" -p ${%sPORT}", prefix)
+		}
+		return []string{"CMD-SHELL", command}
+
+	case "redis", "keydb":
+		command := "redis-cli"
+		if _, ok := (*envVars)[prefix+"PORT"]; ok {
+			command += fmt.Sprintf(" -p ${%sPORT}", prefix)
+		}
+		if _, ok := (*envVars)[prefix+"PASSWORD"]; ok {
+			command += fmt.Sprintf(" -a ${%sPASSWORD} --no-auth-warning", prefix)
+		}
+		return []string{"CMD-SHELL", command + " ping | grep -q PONG"}
+
+	case "nats":
+		port := "8222"
+		if _, ok := (*envVars)[prefix+"PORT_MONITORING"]; ok {
+			port = fmt.Sprintf("${%sPORT_MONITORING}", prefix)
+		}
+		enableNatsMonitoring(service, port)
+		return []string{"CMD-SHELL", fmt.Sprintf("wget -q --spider http://localhost:%s/healthz || exit 1", port)}
+	}
+
+	return nil
+}
+
+// enableNatsMonitoring makes sure nats-server exposes the monitoring endpoint used by the healthcheck
+func enableNatsMonitoring(service *DockerComposeService, port string) {
+	switch command := service.Command.(type) {
+	case string:
+		if !natsMonitoringFlag.MatchString(command) {
+			service.Command = strings.TrimSpace(command + " --http_port " + port)
+		}
+	case []any:
+		for _, arg := range command {
+			if s, ok := arg.(string); ok && natsMonitoringFlag.MatchString(s+" ") {
+				return
+			}
+		}
+		service.Command = append(command, "--http_port", port)
+	case nil:
+		service.Command = "--http_port " + port
+	}
+}
+
+// resolvePortReference turns a declared port into a literal port or a reference to a consolidated variable
+func resolvePortReference(port string, prefix string, envVars *map[string]string) string {
+	if port == "" {
+		return ""
+	}
+	if _, err := strconv.Atoi(port); err == nil {
+		return port
+	}
+	if _, ok := (*envVars)[prefix+port]; ok {
+		return fmt.Sprintf("${%s%s}", prefix, port)
+	}
+	if _, ok := (*envVars)[port]; ok {
+		return fmt.Sprintf("${%s}", port)
+	}
+
+	fmt.Printf("  Warning: port variable %s not found in consolidated env file\n", port)
+	return ""
+}
+
+// updateServiceDependsOn rewrites depends_on to the long syntax, waiting for healthy dependencies
+func updateServiceDependsOn(serviceName string, service *DockerComposeService, dockerCompose *DockerComposeConfig) {
+	dependencies := dependsOnNames(service.DependsOn)
+	if len(dependencies) == 0 {
+		return
+	}
+
+	existing, _ := service.DependsOn.(map[string]any)
+	dependsOn := make(map[string]any)
+
+	for _, dependency := range dependencies {
+		dependencyService, defined := dockerCompose.Services[dependency]
+		if !defined {
+			fmt.Printf("  Warning: %s depends on undefined service %s, dropping it\n", serviceName, dependency)
+			continue
+		}
+
+		entry := map[string]any{}
+		if current, ok := existing[dependency].(map[string]any); ok {
+			entry = current
+		}
+
+		if _, ok := entry["condition"]; !ok {
+			if dependencyService.Healthcheck != nil {
+				entry["condition"] = "service_healthy"
+			} else {
+				entry["condition"] = "service_started"
+			}
+		}
+
+		dependsOn[dependency] = entry
+	}
+
+	service.DependsOn = dependsOn
+	fmt.Printf("  Rewrote depends_on for service %s with %d conditions\n", serviceName, len(dependsOn))
+}
+
+// dependsOnNames returns the names of the services listed in depends_on, in short or long syntax
+func dependsOnNames(dependsOn any) []string {
+	var names []string
+
+	switch value := dependsOn.(type) {
+	case []any:
+		for _, item := range value {
+			if name, ok := item.(string); ok && name != "" {
+				names = append(names, name)
+			}
+		}
+	case []string:
+		names = append(names, value...)
+	case map[string]any:
+		for name := range value {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
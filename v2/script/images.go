@@ -0,0 +1,734 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// imageFilePattern matches the compose and stack files checked by `deployment images check`
+var imageFilePattern = regexp.MustCompile(`^(docker-compose.*|compose.*|.*stack.*)\.ya?ml$`)
+
+// imageLockFile keeps the digest of every image reference of the project next to the compose file
+const imageLockFile = "images.lock"
+
+// monitoringStackFile is compared against the images of the monitoring generator instead of an environment
+const monitoringStackFile = "monitoring-stack.yml"
+
+// ImageLock represents images.lock, the digest of every image reference by the reference as written in the files
+type ImageLock struct {
+	Images map[string]string `yaml:"images"`
+}
+
+// ImageReference is an image split into its repository, tag and digest
+type ImageReference struct {
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// parseImageReference splits an image like registry:5000/org/name:tag@sha256:..., the registry port is not a tag
+func parseImageReference(image string) ImageReference {
+	var reference ImageReference
+	name := image
+	if at := strings.Index(name, "@"); at >= 0 {
+		name, reference.Digest = name[:at], name[at+1:]
+	}
+	slash := strings.LastIndex(name, "/")
+	if colon := strings.LastIndex(name, ":"); colon > slash {
+		name, reference.Tag = name[:colon], name[colon+1:]
+	}
+	reference.Repository = name
+
+	return reference
+}
+
+// String renders the reference as repository:tag, followed by the digest when there is one
+func (r ImageReference) String() string {
+	image := r.Repository
+	if r.Tag != "" {
+		image += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		image += "@" + r.Digest
+	}
+
+	return image
+}
+
+// serviceImage returns the image declared for a service in an environment, false when it declares none
+func serviceImage(service ServiceConfig, environment string) (ImageReference, bool) {
+	if service.Image == nil {
+		return ImageReference{}, false
+	}
+	settings := service.Image.ImageSettings
+	override := service.Image.Environments[environment]
+	settings.Repository = valueOrDefault(override.Repository, settings.Repository)
+	settings.Tag = valueOrDefault(override.Tag, settings.Tag)
+	if settings.Repository == "" {
+		return ImageReference{}, false
+	}
+
+	return ImageReference{Repository: settings.Repository, Tag: settings.Tag}, true
+}
+
+// validateImagesConfig checks that every declared image names a repository and pins a tag
+func validateImagesConfig(config Config) []string {
+	var problems []string
+	for _, service := range getAllServiceConfigs(config) {
+		if service.Image == nil {
+			continue
+		}
+		environments := []string{""}
+		for environment := range service.Image.Environments {
+			environments = append(environments, environment)
+		}
+		sort.Strings(environments)
+		for _, environment := range environments {
+			label := service.Name
+			if environment != "" {
+				label += " (" + environment + ")"
+			}
+			image, ok := serviceImage(service, environment)
+			switch {
+			case !ok:
+				problems = append(problems, fmt.Sprintf("service %s: image has no repository", label))
+			case image.Tag == "":
+				problems = append(problems, fmt.Sprintf("service %s: image %s has no tag, pin a version", label, image.Repository))
+			case strings.ContainsAny(image.Repository+image.Tag, "@ "):
+				problems = append(problems, fmt.Sprintf("service %s: invalid image %s", label, image))
+			}
+		}
+	}
+	for path, environment := range config.Images.Files {
+		if environment == "" {
+			problems = append(problems, fmt.Sprintf("images.files: %s has no environment", path))
+		}
+	}
+
+	return problems
+}
+
+// applyImages sets the declared image of the environment on the services that run an image, services that are
+// only built from their source are left alone. Images resolved in images.lock are pinned to their digest.
+func applyImages(dockerCompose *DockerComposeConfig, configFile string, environment string, lock ImageLock) error {
+	config := getConfig(configFile)
+	if problems := validateImagesConfig(config); len(problems) > 0 {
+		return fmt.Errorf("invalid images configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	applied := 0
+	for _, serviceConfig := range getAllServiceConfigs(config) {
+		service, ok := dockerCompose.Services[serviceConfig.Name]
+		if !ok || service.Image == "" {
+			continue
+		}
+		image, declared := serviceImage(serviceConfig, environment)
+		if !declared {
+			continue
+		}
+		service.Image = image.String()
+		dockerCompose.Services[serviceConfig.Name] = service
+		applied++
+	}
+
+	pinned := 0
+	for name, service := range dockerCompose.Services {
+		if image := pinImage(lock, service.Image); image != service.Image {
+			service.Image = image
+			dockerCompose.Services[name] = service
+			pinned++
+		}
+	}
+
+	if applied > 0 {
+		fmt.Printf("  Applied the declared images of %d services (%s environment)\n", applied, environment)
+	}
+	if pinned > 0 {
+		fmt.Printf("  Pinned %d images to the digests of %s\n", pinned, imageLockFile)
+	}
+
+	return nil
+}
+
+// readImageLock reads images.lock, an empty lock when the images were never locked
+func readImageLock(path string) (ImageLock, error) {
+	lock := ImageLock{Images: make(map[string]string)}
+
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return lock, nil
+	}
+	if err != nil {
+		return lock, err
+	}
+	if err := yaml.Unmarshal(content, &lock); err != nil {
+		return lock, fmt.Errorf("invalid image lock %s: %v", path, err)
+	}
+	if lock.Images == nil {
+		lock.Images = make(map[string]string)
+	}
+
+	return lock, nil
+}
+
+// writeImageLock saves images.lock with its entries sorted by image
+func writeImageLock(path string, lock ImageLock) error {
+	content, err := marshalYAML(lock)
+	if err != nil {
+		return err
+	}
+	header := "# Digests of the images of the project, managed by deployment images lock\n\n"
+
+	return os.WriteFile(path, append([]byte(header), content...), 0644)
+}
+
+// pinImage appends the locked digest of an image, images already pinned or not in the lock are returned as is
+func pinImage(lock ImageLock, image string) string {
+	if image == "" || strings.Contains(image, "@") {
+		return image
+	}
+	if digest, ok := lock.Images[image]; ok {
+		return image + "@" + digest
+	}
+
+	return image
+}
+
+// builtinMonitoringImages returns the images of the monitoring stack by service name, with the overrides of the
+// monitoring section
+func builtinMonitoringImages(config Config) map[string]string {
+	images := map[string]string{
+		"grafana":  monitoringImage(config, "grafana", grafanaImage),
+		"cadvisor": monitoringImage(config, "cadvisor", cadvisorImage),
+	}
+	for _, tool := range monitoringTools {
+		images[tool.Name] = monitoringImage(config, tool.Name, tool.Image)
+	}
+	for _, exporter := range infraExporters {
+		name := exporter.Kind + "-exporter"
+		images[name] = monitoringImage(config, name, exporter.Image)
+	}
+
+	return images
+}
+
+// imageFileEnvironment returns the environment a file is compared against: the images.files entry, monitoring for
+// the monitoring stack, prod for other stack files and dev for compose files
+func imageFileEnvironment(config Config, path string) string {
+	if environment, ok := config.Images.Files[filepath.ToSlash(path)]; ok {
+		return environment
+	}
+	name := filepath.Base(path)
+	switch {
+	case name == monitoringStackFile:
+		return "monitoring"
+	case strings.Contains(name, "stack"):
+		return "prod"
+	}
+
+	return "dev"
+}
+
+// findImageFiles returns the compose and stack files of the project and of the directories directly below it,
+// along with the files listed in images.files
+func findImageFiles(projectDir string, config Config) ([]string, error) {
+	found := make(map[string]bool)
+	err := filepath.WalkDir(projectDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, _ := filepath.Rel(projectDir, path)
+		if entry.IsDir() {
+			if path != projectDir && (strings.HasPrefix(entry.Name(), ".") || strings.Count(relative, string(filepath.Separator)) >= 1) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if imageFilePattern.MatchString(entry.Name()) {
+			found[filepath.ToSlash(relative)] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for path := range config.Images.Files {
+		found[filepath.ToSlash(path)] = true
+	}
+
+	files := make([]string, 0, len(found))
+	for path := range found {
+		files = append(files, path)
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// imageServiceConfig returns the configured service behind a service of a compose or stack file: by name or
+// stack_name, by the kind of an infrastructure image, then by the declared repository
+func imageServiceConfig(config Config, name string, image ImageReference) (ServiceConfig, bool) {
+	for _, color := range releaseColors {
+		name = strings.TrimSuffix(name, "-"+color)
+	}
+	services := getAllServiceConfigs(config)
+	for _, service := range services {
+		if service.Name == name || service.StackName == name {
+			return service, true
+		}
+	}
+	if kind := auditImageKind(image.Repository); kind != "" {
+		if kind == "keydb" {
+			kind = "redis"
+		}
+		if service, ok := infraServiceOfKind(config, kind); ok {
+			return service, true
+		}
+	}
+
+	var matches []ServiceConfig
+	for _, service := range services {
+		if service.Image != nil && service.Image.Repository == image.Repository {
+			matches = append(matches, service)
+		}
+	}
+	if len(matches) == 1 {
+		return matches[0], true
+	}
+
+	return ServiceConfig{}, false
+}
+
+// ImageDrift is an image of a file that differs from the version declared in services-config.yaml
+type ImageDrift struct {
+	File        string
+	Line        int
+	Service     string
+	Environment string
+	Current     string
+	Declared    string
+	node        *yaml.Node
+}
+
+// imageUsage is an image found in a file, used to report skew of the services without a declared version
+type imageUsage struct {
+	File  string
+	Line  int
+	Image string
+}
+
+// fileImage is the image of a service in a compose or stack file
+type fileImage struct {
+	Name string
+	Node *yaml.Node
+}
+
+// fileServiceImages returns the images of the services of a file, build-only services and images chosen by a
+// variable have no version and are left out
+func fileServiceImages(file *YAMLFile) []fileImage {
+	_, services := mappingEntry(file.Root, "services")
+	if services == nil || services.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	var images []fileImage
+	for i := 0; i+1 < len(services.Content); i += 2 {
+		_, imageNode := mappingEntry(services.Content[i+1], "image")
+		if imageNode == nil || imageNode.Kind != yaml.ScalarNode || imageNode.Value == "" || strings.Contains(imageNode.Value, "${") {
+			continue
+		}
+		images = append(images, fileImage{Name: services.Content[i].Value, Node: imageNode})
+	}
+
+	return images
+}
+
+// checkImageFile compares the images of a file with the declared versions of its environment
+func checkImageFile(config Config, lock ImageLock, file *YAMLFile, displayPath string, environment string, usages map[string][]imageUsage) []ImageDrift {
+	monitoringImages := builtinMonitoringImages(config)
+
+	var drifts []ImageDrift
+	for _, fileImage := range fileServiceImages(file) {
+		name, imageNode := fileImage.Name, fileImage.Node
+		current := parseImageReference(imageNode.Value)
+
+		var declared ImageReference
+		key := name
+		if environment == "monitoring" {
+			image, ok := monitoringImages[name]
+			if !ok {
+				continue
+			}
+			declared = parseImageReference(image)
+			key = "monitoring/" + name
+		} else {
+			serviceConfig, ok := imageServiceConfig(config, name, current)
+			if ok {
+				key = serviceConfig.Name
+				declared, ok = serviceImage(serviceConfig, environment)
+			}
+			if !ok {
+				// Compare the tags, a file pinned to the digest of the same tag runs the same version
+				version := ImageReference{Repository: current.Repository, Tag: current.Tag}
+				usages[key] = append(usages[key], imageUsage{File: displayPath, Line: imageNode.Line, Image: version.String()})
+				continue
+			}
+		}
+
+		// A digest pinning the declared tag is not drift, unless images.lock resolved the tag to another digest
+		declared.Digest = lock.Images[declared.String()]
+		if current.Repository == declared.Repository && current.Tag == declared.Tag &&
+			(current.Digest == "" || declared.Digest == "" || current.Digest == declared.Digest) {
+			continue
+		}
+		drifts = append(drifts, ImageDrift{
+			File:        displayPath,
+			Line:        imageNode.Line,
+			Service:     key,
+			Environment: environment,
+			Current:     current.String(),
+			Declared:    declared.String(),
+			node:        imageNode,
+		})
+	}
+
+	return drifts
+}
+
+// CheckImages compares the images of every compose and stack file with the versions declared in
+// services-config.yaml, reporting drift and optionally rewriting the files to the declared versions
+func CheckImages(configFile string, write bool) {
+	scriptDir, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("Error getting current directory: %v\n", err)
+		return
+	}
+	config := getConfig(resolveFilePath(configFile, scriptDir, scriptDir))
+	if problems := validateImagesConfig(config); len(problems) > 0 {
+		fmt.Printf("Invalid images configuration:\n  %s\n", strings.Join(problems, "\n  "))
+		os.Exit(1)
+	}
+
+	files, err := findImageFiles(scriptDir, config)
+	if err != nil {
+		fmt.Printf("Error finding compose and stack files: %v\n", err)
+		os.Exit(1)
+	}
+	lock, err := readImageLock(filepath.Join(scriptDir, imageLockFile))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	usages := make(map[string][]imageUsage)
+	var drifts []ImageDrift
+	var checked []string
+	for _, path := range files {
+		file, err := loadYAMLFile(filepath.Join(scriptDir, path))
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fileDrifts := checkImageFile(config, lock, file, path, imageFileEnvironment(config, path), usages)
+		checked = append(checked, path)
+		drifts = append(drifts, fileDrifts...)
+		if !write || len(fileDrifts) == 0 {
+			continue
+		}
+
+		// Replace from the end so the remaining nodes keep their positions
+		for i := len(fileDrifts) - 1; i >= 0; i-- {
+			if err := file.ReplaceScalar(fileDrifts[i].node, fileDrifts[i].Declared); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if err := file.Save(); err != nil {
+			fmt.Printf("Error writing %s: %v\n", path, err)
+			os.Exit(1)
+		}
+	}
+
+	for _, drift := range drifts {
+		location := fmt.Sprintf("%s:%d", drift.File, drift.Line)
+		fmt.Printf("DRIFT    %-36s %-34s %s -> %s (%s)\n", location, drift.Service, drift.Current, drift.Declared, drift.Environment)
+	}
+
+	// Services without a declared version may still run different images from one file to the next
+	names := make([]string, 0, len(usages))
+	for name := range usages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	skewed := 0
+	for _, name := range names {
+		images := make(map[string]bool)
+		for _, usage := range usages[name] {
+			images[usage.Image] = true
+		}
+		if len(images) < 2 {
+			continue
+		}
+		skewed++
+		var locations []string
+		for _, usage := range usages[name] {
+			locations = append(locations, fmt.Sprintf("%s in %s:%d", usage.Image, usage.File, usage.Line))
+		}
+		fmt.Printf("SKEW     %-34s %s\n", name, strings.Join(locations, ", "))
+	}
+	if skewed > 0 {
+		fmt.Println("Declare the image of the skewed services in services-config.yaml to check them")
+	}
+
+	fmt.Printf("Checked %s: %d drifted images, %d skewed services without a declared version\n", strings.Join(checked, ", "), len(drifts), skewed)
+	if write && len(drifts) > 0 {
+		fmt.Printf("Rewrote %d images to the declared versions\n", len(drifts))
+		return
+	}
+	if len(drifts) > 0 {
+		fmt.Println("Run deployment images check -write to rewrite the files, or update the declared versions")
+		os.Exit(1)
+	}
+}
+
+// projectImages returns the images of the compose and stack files, the declared images of every environment and the
+// monitoring images, as written without their digest
+func projectImages(config Config, projectDir string) ([]string, error) {
+	found := make(map[string]bool)
+	add := func(image string) {
+		reference := parseImageReference(image)
+		// An image pinned by digest alone has no tag to resolve again
+		if reference.Digest != "" && reference.Tag == "" {
+			return
+		}
+		reference.Digest = ""
+		found[reference.String()] = true
+	}
+
+	files, err := findImageFiles(projectDir, config)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range files {
+		file, err := loadYAMLFile(filepath.Join(projectDir, path))
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range fileServiceImages(file) {
+			add(image.Node.Value)
+		}
+	}
+	for _, service := range getAllServiceConfigs(config) {
+		if service.Image == nil {
+			continue
+		}
+		environments := []string{""}
+		for environment := range service.Image.Environments {
+			environments = append(environments, environment)
+		}
+		for _, environment := range environments {
+			if image, ok := serviceImage(service, environment); ok {
+				add(image.String())
+			}
+		}
+	}
+	for _, image := range builtinMonitoringImages(config) {
+		add(image)
+	}
+
+	images := make([]string, 0, len(found))
+	for image := range found {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+
+	return images, nil
+}
+
+// LockImages resolves every image of the project to the digest of its manifest and writes them to images.lock
+func LockImages(configFile string, outputFile string) {
+	scriptDir, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("Error getting current directory: %v\n", err)
+		return
+	}
+	config := getConfig(resolveFilePath(configFile, scriptDir, scriptDir))
+	outputFile = resolveFilePath(outputFile, scriptDir, scriptDir)
+
+	images, err := projectImages(config, scriptDir)
+	if err != nil {
+		fmt.Printf("Error collecting images: %v\n", err)
+		os.Exit(1)
+	}
+	previous, err := readImageLock(outputFile)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	client := newRegistryClient()
+	lock := ImageLock{Images: make(map[string]string)}
+	failed, changed := 0, 0
+	for _, image := range images {
+		digest, err := client.resolveDigest(image)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			failed++
+			// Keep the digest of the last successful lock rather than dropping the pin
+			if digest, ok := previous.Images[image]; ok {
+				lock.Images[image] = digest
+			}
+			continue
+		}
+		lock.Images[image] = digest
+
+		status := ""
+		switch old, ok := previous.Images[image]; {
+		case !ok:
+			status = " (new)"
+		case old != digest:
+			status = " (updated from " + old + ")"
+		}
+		if status != "" {
+			changed++
+		}
+		fmt.Printf("  %-56s %s%s\n", image, digest, status)
+	}
+
+	if err := writeImageLock(outputFile, lock); err != nil {
+		fmt.Printf("Error writing %s: %v\n", outputFile, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Locked %d images in %s, %d new or updated\n", len(lock.Images), outputFile, changed)
+	if failed > 0 {
+		fmt.Printf("%d images could not be resolved\n", failed)
+		os.Exit(1)
+	}
+	fmt.Println("Run deployment update and deployment monitoring to pin the generated files to the digests")
+}
+
+// tagNumber matches the numbers of a version tag
+var tagNumber = regexp.MustCompile(`\d+`)
+
+// tagPattern returns the pattern of a version tag with its numbers as wildcards, so 17.4-alpine matches 17.5-alpine
+// and not 17.5 or 17.5-bookworm, false for tags without numbers like latest
+func tagPattern(tag string) (*regexp.Regexp, bool) {
+	if !tagNumber.MatchString(tag) {
+		return nil, false
+	}
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	last := 0
+	for _, match := range tagNumber.FindAllStringIndex(tag, -1) {
+		pattern.WriteString(regexp.QuoteMeta(tag[last:match[0]]))
+		pattern.WriteString(`\d+`)
+		last = match[1]
+	}
+	pattern.WriteString(regexp.QuoteMeta(tag[last:]) + "$")
+
+	return regexp.MustCompile(pattern.String()), true
+}
+
+// compareTags compares the numbers of two tags of the same pattern
+func compareTags(a string, b string) int {
+	numbersA, numbersB := tagNumber.FindAllString(a, -1), tagNumber.FindAllString(b, -1)
+	for i := 0; i < len(numbersA) && i < len(numbersB); i++ {
+		x, _ := strconv.Atoi(numbersA[i])
+		y, _ := strconv.Atoi(numbersB[i])
+		if x != y {
+			return x - y
+		}
+	}
+
+	return len(numbersA) - len(numbersB)
+}
+
+// newerTags returns the tags matching the pattern of the current tag with a higher version, oldest first
+func newerTags(current string, tags []string) []string {
+	pattern, ok := tagPattern(current)
+	if !ok {
+		return nil
+	}
+	var newer []string
+	for _, tag := range tags {
+		if pattern.MatchString(tag) && compareTags(tag, current) > 0 {
+			newer = append(newer, tag)
+		}
+	}
+	sort.Slice(newer, func(i, j int) bool { return compareTags(newer[i], newer[j]) < 0 })
+
+	return newer
+}
+
+// maxNewerTags is the number of newer tags listed for an image by `deployment images outdated`
+const maxNewerTags = 5
+
+// OutdatedImages lists the tags of the registries newer than the images of the project, following the pattern of
+// the current tag so an alpine variant is only compared with alpine variants
+func OutdatedImages(configFile string) {
+	scriptDir, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("Error getting current directory: %v\n", err)
+		return
+	}
+	config := getConfig(resolveFilePath(configFile, scriptDir, scriptDir))
+
+	images, err := projectImages(config, scriptDir)
+	if err != nil {
+		fmt.Printf("Error collecting images: %v\n", err)
+		os.Exit(1)
+	}
+
+	client := newRegistryClient()
+	tagLists := make(map[string][]string)
+	var unversioned []string
+	outdated, failed := 0, 0
+	for _, image := range images {
+		reference := parseImageReference(image)
+		if _, ok := tagPattern(reference.Tag); !ok {
+			unversioned = append(unversioned, image)
+			continue
+		}
+		tags, ok := tagLists[reference.Repository]
+		if !ok {
+			tags, err = client.listTags(image)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				failed++
+				continue
+			}
+			tagLists[reference.Repository] = tags
+		}
+
+		newer := newerTags(reference.Tag, tags)
+		if len(newer) == 0 {
+			continue
+		}
+		outdated++
+		// List the most recent versions, the oldest ones are left out as a count
+		listed := newer
+		more := ""
+		if len(newer) > maxNewerTags {
+			listed = newer[len(newer)-maxNewerTags:]
+			more = fmt.Sprintf(" (and %d older)", len(newer)-maxNewerTags)
+		}
+		fmt.Printf("%-46s %-16s %s%s\n", reference.Repository, reference.Tag, strings.Join(listed, ", "), more)
+	}
+
+	if len(unversioned) > 0 {
+		fmt.Printf("Not versioned, pin a version tag to compare: %s\n", strings.Join(unversioned, ", "))
+	}
+	fmt.Printf("Checked %d images: %d outdated\n", len(images), outdated)
+	if failed > 0 {
+		fmt.Printf("%d images could not be checked\n", failed)
+		os.Exit(1)
+	}
+}
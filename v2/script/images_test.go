@@ -0,0 +1,142 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseImageReference(t *testing.T) {
+	tests := []struct {
+		image string
+		want  ImageReference
+	}{
+		{"postgres", ImageReference{Repository: "postgres"}},
+		{"postgres:17.4-alpine", ImageReference{Repository: "postgres", Tag: "17.4-alpine"}},
+		{"ghcr.io/lexicon/bo-api:latest", ImageReference{Repository: "ghcr.io/lexicon/bo-api", Tag: "latest"}},
+		{"registry:5000/org/api", ImageReference{Repository: "registry:5000/org/api"}},
+		{"registry:5000/org/api:1.2", ImageReference{Repository: "registry:5000/org/api", Tag: "1.2"}},
+		{"postgres:17.4@sha256:abc123", ImageReference{Repository: "postgres", Tag: "17.4", Digest: "sha256:abc123"}},
+		{"postgres@sha256:abc123", ImageReference{Repository: "postgres", Digest: "sha256:abc123"}},
+		{"localhost:5000/api@sha256:abc123", ImageReference{Repository: "localhost:5000/api", Digest: "sha256:abc123"}},
+	}
+	for _, test := range tests {
+		reference := parseImageReference(test.image)
+		if reference != test.want {
+			t.Errorf("parseImageReference(%s) = %+v, want %+v", test.image, reference, test.want)
+		}
+		if rendered := reference.String(); rendered != test.image {
+			t.Errorf("parseImageReference(%s).String() = %s", test.image, rendered)
+		}
+	}
+}
+
+func TestImageFileEnvironment(t *testing.T) {
+	config := Config{Images: ImagesConfig{Files: map[string]string{"docker-stack.staging.yml": "staging"}}}
+	tests := map[string]string{
+		"docker-compose.yml":              "dev",
+		"docker-compose.template.yml":     "dev",
+		"docker-stack.yml":                "prod",
+		"docker-stack.staging.yml":        "staging",
+		"monitoring/monitoring-stack.yml": "monitoring",
+	}
+	for path, want := range tests {
+		if environment := imageFileEnvironment(config, path); environment != want {
+			t.Errorf("imageFileEnvironment(%s) = %s, want %s", path, environment, want)
+		}
+	}
+}
+
+// testImagesConfig declares postgres, with another tag in prod, and the api, nats has no declared image
+func testImagesConfig() Config {
+	return Config{
+		CommonServices: []ServiceConfig{
+			{Name: "postgres", Prefix: "POSTGRES_", Image: &ServiceImage{
+				ImageSettings: ImageSettings{Repository: "postgres", Tag: "17.4-alpine"},
+				Environments:  map[string]ImageSettings{"prod": {Tag: "17.4"}},
+			}},
+			{Name: "nats", Prefix: "NATS_"},
+		},
+		Services: []ServiceConfig{
+			{Name: "api", Prefix: "API_", StackName: "bo-api", Image: &ServiceImage{ImageSettings: ImageSettings{Repository: "ghcr.io/lexicon/bo-api", Tag: "1.4.0"}}},
+		},
+	}
+}
+
+func TestCheckImageFile(t *testing.T) {
+	stack := testYAMLFile(t, `services:
+  postgresql:
+    image: postgres:14
+  bo-api-blue:
+    image: ghcr.io/lexicon/bo-api:1.4.0@sha256:aaa
+  bo-api-green:
+    image: ghcr.io/lexicon/bo-api:1.3.2
+  nats:
+    image: nats:2.9-jetstream
+  worker:
+    image: ${WORKER_IMAGE}
+  crawler:
+    build: ./crawler
+`)
+	usages := make(map[string][]imageUsage)
+
+	drifts := checkImageFile(testImagesConfig(), ImageLock{}, stack, "docker-stack.yml", "prod", usages)
+
+	var summary []string
+	for _, drift := range drifts {
+		summary = append(summary, drift.Service+" "+drift.Current+" -> "+drift.Declared)
+	}
+	want := []string{
+		"postgres postgres:14 -> postgres:17.4",
+		"api ghcr.io/lexicon/bo-api:1.3.2 -> ghcr.io/lexicon/bo-api:1.4.0",
+	}
+	if !slices.Equal(summary, want) {
+		t.Errorf("drifts = %v\nwant %v", summary, want)
+	}
+	if drifts[0].Line != 3 || drifts[0].File != "docker-stack.yml" || drifts[0].Environment != "prod" {
+		t.Errorf("postgres drift = %+v, want line 3 of docker-stack.yml in prod", drifts[0])
+	}
+	if len(usages) != 1 || len(usages["nats"]) != 1 || usages["nats"][0].Image != "nats:2.9-jetstream" {
+		t.Errorf("usages = %+v, want the undeclared nats image", usages)
+	}
+}
+
+func TestCheckImageFileLockedDigest(t *testing.T) {
+	compose := testYAMLFile(t, "services:\n  postgres:\n    image: postgres:17.4-alpine@sha256:old\n  nats:\n    image: nats:2.11-alpine@sha256:abc\n")
+	lock := ImageLock{Images: map[string]string{"postgres:17.4-alpine": "sha256:new"}}
+	usages := make(map[string][]imageUsage)
+
+	drifts := checkImageFile(testImagesConfig(), lock, compose, "docker-compose.yml", "dev", usages)
+
+	if len(drifts) != 1 || drifts[0].Current != "postgres:17.4-alpine@sha256:old" || drifts[0].Declared != "postgres:17.4-alpine@sha256:new" {
+		t.Errorf("drifts = %+v, want the digest resolved by images.lock", drifts)
+	}
+	// Skew is compared on the tags, a digest does not make another version
+	if usages["nats"][0].Image != "nats:2.11-alpine" {
+		t.Errorf("nats usage = %+v", usages["nats"])
+	}
+}
+
+func TestCheckImageFileMonitoring(t *testing.T) {
+	config := Config{Monitoring: MonitoringConfig{Images: map[string]string{"grafana": "grafana/grafana:10.4.2"}}}
+	stack := testYAMLFile(t, "services:\n  grafana:\n    image: grafana/grafana:9.0.3\n  cadvisor:\n    image: "+cadvisorImage+"\n  custom:\n    image: busybox:1.36\n")
+	usages := make(map[string][]imageUsage)
+
+	drifts := checkImageFile(config, ImageLock{}, stack, "monitoring/monitoring-stack.yml", "monitoring", usages)
+
+	if len(drifts) != 1 || drifts[0].Service != "monitoring/grafana" || drifts[0].Declared != "grafana/grafana:10.4.2" {
+		t.Errorf("drifts = %+v, want grafana compared with monitoring.images", drifts)
+	}
+	if len(usages) != 0 {
+		t.Errorf("usages = %+v, services unknown to the monitoring generator are not compared", usages)
+	}
+}
+
+func TestNewerTags(t *testing.T) {
+	tags := []string{"17.3-alpine", "17.5-alpine", "18.0-alpine", "17.5", "17.5-bookworm", "latest", "17.10-alpine"}
+	if newer := newerTags("17.4-alpine", tags); !slices.Equal(newer, []string{"17.5-alpine", "17.10-alpine", "18.0-alpine"}) {
+		t.Errorf("newerTags = %v", newer)
+	}
+	if newer := newerTags("latest", tags); newer != nil {
+		t.Errorf("newerTags(latest) = %v, want none", newer)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 )
 
 func main() {
@@ -23,9 +24,12 @@ func main() {
 		configFile := consolidateCmd.String("c", "services-config.yaml", "Path to services configuration file")
 		autoDiscover := consolidateCmd.Bool("d", false, "Auto-discover services in project directory")
 		serviceDir := consolidateCmd.String("dir", "", "Directory to discover services (default: current directory)")
+		templateFile := consolidateCmd.String("t", "docker-compose.template.yml", "Path to template file used to resolve dependencies for -only/-exclude")
+		only := consolidateCmd.String("only", "", "Comma separated services or groups to include, with their dependencies")
+		exclude := consolidateCmd.String("exclude", "", "Comma separated services or groups to exclude")
 
 		consolidateCmd.Parse(os.Args[2:])
-		ConsolidateEnvFiles(*outputFile, *forceOverwrite, *configFile, *autoDiscover, *serviceDir)
+		ConsolidateEnvFiles(*outputFile, *forceOverwrite, *configFile, *autoDiscover, *serviceDir, *templateFile, *only, *exclude)
 
 	case "update":
 		updateCmd := flag.NewFlagSet("update", flag.ExitOnError)
@@ -35,8 +39,339 @@ func main() {
 		templateFile := updateCmd.String("t", "", "Path to template file (default: docker-compose.template.yml in project root)")
 		discoverDir := updateCmd.String("dir", "", "Directory to discover services (default: current directory)")
 		configFile := updateCmd.String("c", "services-config.yaml", "Path to services configuration file")
+		only := updateCmd.String("only", "", "Comma separated services or groups to include, with their dependencies")
+		exclude := updateCmd.String("exclude", "", "Comma separated services or groups to exclude")
+		environment := updateCmd.String("environment", "", "Target environment, such as dev or prod (default: $DEPLOYMENT_ENVIRONMENT or dev)")
+		mode := updateCmd.String("mode", "", "dev builds the services from their source, prod runs their images (default: images.modes of the environment or dev)")
 		updateCmd.Parse(os.Args[2:])
-		UpdateDockerCompose(*consolidatedEnvFile, *outputFile, *forceOverwrite, *templateFile, *discoverDir, *configFile)
+		if err := UpdateDockerCompose(*consolidatedEnvFile, *outputFile, *forceOverwrite, *templateFile, *discoverDir, *configFile, *only, *exclude, *environment, *mode); err != nil {
+			fmt.Printf("Error updating docker compose: %v\n", err)
+			os.Exit(1)
+		}
+
+	case "add-service":
+		addCmd := flag.NewFlagSet("add-service", flag.ExitOnError)
+		name := addCmd.String("name", "", "Name of the service (prompted when empty)")
+		prefix := addCmd.String("prefix", "", "Environment variable prefix (default: derived from the name)")
+		groups := addCmd.String("groups", "", "Comma separated groups of the service")
+		domain := addCmd.String("domain", "", "Public domain of the service")
+		pathPrefix := addCmd.String("path", "", "Traefik path prefix to route to the service (default: not routed)")
+		portVar := addCmd.String("port-var", "PORT", "Variable holding the port the service listens on")
+		dependsOn := addCmd.String("depends", "postgres,redis,nats", "Comma separated services the new service depends on")
+		variables := addCmd.String("vars", "", "Comma separated variables to put in .env.example")
+		healthcheck := addCmd.String("healthcheck", "", "Healthcheck type: http, tcp or none")
+		interactive := addCmd.Bool("i", false, "Prompt for every option")
+		configFile := addCmd.String("c", "services-config.yaml", "Path to services configuration file")
+		templateFile := addCmd.String("t", "docker-compose.template.yml", "Path to template file")
+		serviceDir := addCmd.String("dir", "", "Directory containing the services (default: current directory)")
+		consolidatedEnvFile := addCmd.String("env", ".env", "Path to consolidated env file")
+		outputFile := addCmd.String("o", "", "Output file path (default: docker-compose.yml in project root)")
+		noRegenerate := addCmd.Bool("no-regen", false, "Do not regenerate the consolidated env and docker compose files")
+		addCmd.Parse(os.Args[2:])
+
+		options := ScaffoldOptions{
+			Name:        *name,
+			Prefix:      *prefix,
+			Groups:      parseSelector(*groups),
+			Domain:      *domain,
+			PathPrefix:  *pathPrefix,
+			DependsOn:   parseSelector(*dependsOn),
+			Variables:   parseSelector(*variables),
+			Healthcheck: *healthcheck,
+		}
+		if *pathPrefix != "" || *healthcheck == "http" || *healthcheck == "tcp" {
+			options.PortVar = *portVar
+		}
+		AddService(options, *interactive, *configFile, *templateFile, *serviceDir, *consolidatedEnvFile, *outputFile, !*noRegenerate)
+
+	case "remove-service":
+		removeCmd := flag.NewFlagSet("remove-service", flag.ExitOnError)
+		name := removeCmd.String("name", "", "Name of the service to remove")
+		purge := removeCmd.Bool("purge", false, "Delete the whole service directory, not only the scaffolded files")
+		assumeYes := removeCmd.Bool("y", false, "Do not ask for confirmation")
+		configFile := removeCmd.String("c", "services-config.yaml", "Path to services configuration file")
+		templateFile := removeCmd.String("t", "docker-compose.template.yml", "Path to template file")
+		serviceDir := removeCmd.String("dir", "", "Directory containing the services (default: current directory)")
+		consolidatedEnvFile := removeCmd.String("env", ".env", "Path to consolidated env file")
+		outputFile := removeCmd.String("o", "", "Output file path (default: docker-compose.yml in project root)")
+		noRegenerate := removeCmd.Bool("no-regen", false, "Do not regenerate the consolidated env and docker compose files")
+		removeCmd.Parse(os.Args[2:])
+		RemoveService(*name, *purge, *assumeYes, *configFile, *templateFile, *serviceDir, *consolidatedEnvFile, *outputFile, !*noRegenerate)
+
+	case "watch":
+		watchCmd := flag.NewFlagSet("watch", flag.ExitOnError)
+		configFile := watchCmd.String("c", "services-config.yaml", "Path to services configuration file")
+		templateFile := watchCmd.String("t", "docker-compose.template.yml", "Path to template file")
+		serviceDir := watchCmd.String("dir", "", "Directory containing the services (default: current directory)")
+		consolidatedEnvFile := watchCmd.String("env", ".env", "Path to consolidated env file")
+		outputFile := watchCmd.String("o", "", "Output file path (default: docker-compose.yml in project root)")
+		only := watchCmd.String("only", "", "Comma separated services or groups to include, with their dependencies")
+		exclude := watchCmd.String("exclude", "", "Comma separated services or groups to exclude")
+		environment := watchCmd.String("environment", "", "Target environment, such as dev or prod (default: $DEPLOYMENT_ENVIRONMENT or dev)")
+		interval := watchCmd.Duration("interval", 500*time.Millisecond, "How often to check the sources for changes")
+		debounce := watchCmd.Duration("debounce", time.Second, "Wait until the sources stop changing for this long")
+		hook := watchCmd.String("hook", "", "Command to run after regenerating, {services} is replaced by the affected services")
+		verbose := watchCmd.Bool("v", false, "Show the full output of the generators")
+		watchCmd.Parse(os.Args[2:])
+
+		Watch(WatchOptions{
+			ConfigFile:          *configFile,
+			TemplateFile:        *templateFile,
+			ServiceDir:          *serviceDir,
+			ConsolidatedEnvFile: *consolidatedEnvFile,
+			OutputFile:          *outputFile,
+			Only:                *only,
+			Exclude:             *exclude,
+			Environment:         *environment,
+			Interval:            *interval,
+			Debounce:            *debounce,
+			Hook:                *hook,
+			Verbose:             *verbose,
+		})
+
+	case "nats":
+		if len(os.Args) < 3 {
+			printUsage()
+			return
+		}
+		switch os.Args[2] {
+		case "config":
+			natsCmd := flag.NewFlagSet("nats config", flag.ExitOnError)
+			configFile := natsCmd.String("c", "services-config.yaml", "Path to services configuration file")
+			outputFile := natsCmd.String("o", "nats/nats-server.conf", "Output file path for the nats-server config")
+			forceOverwrite := natsCmd.Bool("f", false, "Force overwrite output file if it exists")
+			natsCmd.Parse(os.Args[3:])
+			GenerateNatsConfig(*configFile, *outputFile, *forceOverwrite)
+		case "provision":
+			provisionCmd := flag.NewFlagSet("nats provision", flag.ExitOnError)
+			configFile := provisionCmd.String("c", "services-config.yaml", "Path to services configuration file")
+			envFile := provisionCmd.String("env", ".env", "Consolidated env file providing the default server and credentials")
+			server := provisionCmd.String("s", "", "NATS server URL (default: nats://localhost:<NATS_PORT>)")
+			user := provisionCmd.String("user", "", "NATS user (default: NATS_USER from the consolidated env file)")
+			password := provisionCmd.String("password", "", "NATS password (default: NATS_PASSWORD from the consolidated env file)")
+			apply := provisionCmd.Bool("apply", false, "Apply the plan instead of only printing it")
+			prune := provisionCmd.Bool("prune", false, "Delete streams and consumers that no service declares")
+			forceApply := provisionCmd.Bool("f", false, "Apply without asking for confirmation")
+			timeout := provisionCmd.Duration("timeout", 10*time.Second, "Timeout for the connection and JetStream API calls")
+			provisionCmd.Parse(os.Args[3:])
+			ProvisionNats(ProvisionOptions{
+				ConfigFile:          *configFile,
+				ConsolidatedEnvFile: *envFile,
+				Server:              *server,
+				User:                *user,
+				Password:            *password,
+				Apply:               *apply,
+				Prune:               *prune,
+				ForceApply:          *forceApply,
+				Timeout:             *timeout,
+			})
+		default:
+			fmt.Printf("Unknown nats command: %s\n", os.Args[2])
+			printUsage()
+		}
+
+	case "traefik":
+		traefikCmd := flag.NewFlagSet("traefik", flag.ExitOnError)
+		configFile := traefikCmd.String("c", "services-config.yaml", "Path to services configuration file")
+		envFile := traefikCmd.String("env", ".env", "Consolidated env file providing the dashboard password")
+		outputFile := traefikCmd.String("o", "traefik/traefik.yml", "Output file path for the static config")
+		dynamicDir := traefikCmd.String("dynamic", "traefik/dynamic", "Directory for the generated dynamic config")
+		environment := traefikCmd.String("environment", "", "Target environment, such as dev or prod (default: $DEPLOYMENT_ENVIRONMENT or dev)")
+		forceOverwrite := traefikCmd.Bool("f", false, "Force overwrite output file if it exists")
+		traefikCmd.Parse(os.Args[2:])
+		GenerateTraefikConfig(*configFile, *envFile, *outputFile, *dynamicDir, *environment, *forceOverwrite)
+
+	case "release":
+		if len(os.Args) < 3 {
+			printUsage()
+			return
+		}
+		releaseCmd := flag.NewFlagSet("release "+os.Args[2], flag.ExitOnError)
+		serviceName := releaseCmd.String("service", "", "Service to release")
+		weight := releaseCmd.Int("weight", -1, "Percent of the traffic sent to the candidate color")
+		image := releaseCmd.String("image", "", "Image of the candidate color (default: the template build)")
+		stateFile := releaseCmd.String("state", releaseStateFile, "Path to the release state file")
+		configFile := releaseCmd.String("c", "services-config.yaml", "Path to services configuration file")
+		templateFile := releaseCmd.String("t", "", "Path to template file (default: docker-compose.template.yml in project root)")
+		consolidatedEnvFile := releaseCmd.String("env", ".env", "Path to consolidated env file")
+		outputFile := releaseCmd.String("o", "", "Output file path (default: docker-compose.yml in project root)")
+		environment := releaseCmd.String("environment", "", "Target environment, such as dev or prod (default: $DEPLOYMENT_ENVIRONMENT or dev)")
+		noRegenerate := releaseCmd.Bool("no-regen", false, "Only update the state file, do not regenerate the docker compose file")
+		releaseCmd.Parse(os.Args[3:])
+		Release(os.Args[2], *serviceName, *weight, *image, ReleaseOptions{
+			StateFile:           *stateFile,
+			ConfigFile:          *configFile,
+			TemplateFile:        *templateFile,
+			ConsolidatedEnvFile: *consolidatedEnvFile,
+			OutputFile:          *outputFile,
+			Environment:         *environment,
+			Regenerate:          !*noRegenerate,
+		})
+
+	case "certs":
+		certsCmd := flag.NewFlagSet("certs", flag.ExitOnError)
+		configFile := certsCmd.String("c", "services-config.yaml", "Path to services configuration file")
+		caDir := certsCmd.String("ca", "traefik/ca", "Directory of the local development CA")
+		outputDir := certsCmd.String("o", "traefik/certs", "Output directory for the issued certificate")
+		dynamicDir := certsCmd.String("dynamic", "traefik/dynamic", "Directory for the generated TLS config")
+		printHosts := certsCmd.Bool("hosts", false, "Print hosts file entries for the dev hostnames")
+		renewCA := certsCmd.Bool("renew-ca", false, "Create a new development CA, replacing the existing one")
+		forceIssue := certsCmd.Bool("f", false, "Issue a new certificate even if the current one is up to date")
+		certsCmd.Parse(os.Args[2:])
+		GenerateDevCerts(*configFile, *caDir, *outputDir, *dynamicDir, *printHosts, *renewCA, *forceIssue)
+
+	case "monitoring":
+		monitoringCmd := flag.NewFlagSet("monitoring", flag.ExitOnError)
+		configFile := monitoringCmd.String("c", "services-config.yaml", "Path to services configuration file")
+		consolidatedEnvFile := monitoringCmd.String("env", ".env", "Consolidated env file used to resolve the metrics ports")
+		outputDir := monitoringCmd.String("o", "monitoring", "Output directory for the monitoring configuration")
+		environment := monitoringCmd.String("environment", "", "Target environment (default: $DEPLOYMENT_ENVIRONMENT or dev)")
+		templateFile := monitoringCmd.String("t", "docker-compose.template.yml", "Path to template file declaring the Traefik routers")
+		forceOverwrite := monitoringCmd.Bool("f", false, "Force overwrite output files if they exist")
+		check := monitoringCmd.Bool("check", false, "Only check the rule files of the output directory")
+		monitoringCmd.Parse(os.Args[2:])
+		if *check {
+			CheckAlertRules(*outputDir)
+			return
+		}
+		GenerateMonitoring(*configFile, *templateFile, *consolidatedEnvFile, *outputDir, *environment, *forceOverwrite)
+
+	case "capacity":
+		capacityCmd := flag.NewFlagSet("capacity", flag.ExitOnError)
+		configFile := capacityCmd.String("c", "services-config.yaml", "Path to services configuration file")
+		stackFile := capacityCmd.String("stack", "docker-stack.yml", "Swarm stack file giving the replicas and placement of the services")
+		environment := capacityCmd.String("environment", "", "Target environment (default: $DEPLOYMENT_ENVIRONMENT or dev)")
+		write := capacityCmd.Bool("write", false, "Write the resources of the configured services into the stack file first")
+		capacityCmd.Parse(os.Args[2:])
+		ReportCapacity(*configFile, *stackFile, *environment, *write)
+
+	case "audit":
+		auditCmd := flag.NewFlagSet("audit", flag.ExitOnError)
+		configFile := auditCmd.String("c", "services-config.yaml", "Path to services configuration file")
+		files := auditCmd.String("files", "", "Comma separated compose and stack files to audit (default: audit.files or the generated files)")
+		format := auditCmd.String("format", "text", "Output format: text, json or sarif")
+		outputFile := auditCmd.String("o", "", "Output file for the report (default: stdout)")
+		strict := auditCmd.Bool("strict", false, "Fail on warnings as well as errors")
+		auditCmd.Parse(os.Args[2:])
+		AuditDeployment(*configFile, *files, *format, *outputFile, *strict)
+
+	case "redis":
+		if len(os.Args) < 3 {
+			printUsage()
+			return
+		}
+		switch os.Args[2] {
+		case "config":
+			redisCmd := flag.NewFlagSet("redis config", flag.ExitOnError)
+			configFile := redisCmd.String("c", "services-config.yaml", "Path to services configuration file")
+			outputFile := redisCmd.String("o", "redis/redis.conf", "Output file path for the redis config")
+			environment := redisCmd.String("environment", "", "Target environment, such as dev or prod (default: $DEPLOYMENT_ENVIRONMENT or dev)")
+			forceOverwrite := redisCmd.Bool("f", false, "Force overwrite output file if it exists")
+			redisCmd.Parse(os.Args[3:])
+			GenerateRedisConfig(*configFile, *outputFile, *environment, *forceOverwrite)
+		default:
+			fmt.Printf("Unknown redis command: %s\n", os.Args[2])
+			printUsage()
+		}
+
+	case "db":
+		if len(os.Args) < 3 {
+			printUsage()
+			return
+		}
+		switch os.Args[2] {
+		case "init":
+			dbCmd := flag.NewFlagSet("db init", flag.ExitOnError)
+			configFile := dbCmd.String("c", "services-config.yaml", "Path to services configuration file")
+			outputFile := dbCmd.String("o", "postgres/initdb/10-provision.sql", "Output file path for the init SQL")
+			forceOverwrite := dbCmd.Bool("f", false, "Force overwrite output file if it exists")
+			dbCmd.Parse(os.Args[3:])
+			GeneratePostgresInitSQL(*configFile, *outputFile, *forceOverwrite)
+		case "provision":
+			dbCmd := flag.NewFlagSet("db provision", flag.ExitOnError)
+			configFile := dbCmd.String("c", "services-config.yaml", "Path to services configuration file")
+			envFile := dbCmd.String("env", ".env", "Consolidated env file providing the superuser and the role passwords")
+			composeFile := dbCmd.String("compose", "docker-compose.yml", "Docker compose file running the postgres service")
+			dryRun := dbCmd.Bool("dry-run", false, "Print the provisioning SQL instead of running it")
+			dbCmd.Parse(os.Args[3:])
+			ProvisionPostgres(*configFile, *envFile, *composeFile, *dryRun)
+		default:
+			fmt.Printf("Unknown db command: %s\n", os.Args[2])
+			printUsage()
+		}
+
+	case "topology":
+		if len(os.Args) < 3 {
+			printUsage()
+			return
+		}
+		topologyCmd := flag.NewFlagSet("topology "+os.Args[2], flag.ExitOnError)
+		configFile := topologyCmd.String("c", "services-config.yaml", "Path to services configuration file")
+		templateFile := topologyCmd.String("t", "docker-compose.template.yml", "Path to template file for the dependency graph")
+		strict := topologyCmd.Bool("strict", false, "Fail on warnings as well as errors")
+		format := topologyCmd.String("format", "mermaid", "Graph format: mermaid or dot")
+		outputFile := topologyCmd.String("o", "", "Output file path for the graph (default: stdout)")
+		topologyCmd.Parse(os.Args[3:])
+
+		switch os.Args[2] {
+		case "check":
+			CheckTopology(*configFile, *strict)
+		case "graph":
+			RenderTopologyGraph(*configFile, *templateFile, *format, *outputFile)
+		default:
+			fmt.Printf("Unknown topology command: %s\n", os.Args[2])
+			printUsage()
+		}
+
+	case "policy":
+		if len(os.Args) < 3 || os.Args[2] != "check" {
+			printUsage()
+			return
+		}
+		policyCmd := flag.NewFlagSet("policy check", flag.ExitOnError)
+		configFile := policyCmd.String("c", "services-config.yaml", "Path to services configuration file")
+		composeFile := policyCmd.String("compose", "docker-compose.yml", "Rendered compose or stack file to check")
+		strict := policyCmd.Bool("strict", false, "Fail on warnings as well as errors")
+		policyCmd.Parse(os.Args[3:])
+		CheckPolicies(*configFile, *composeFile, *strict)
+
+	case "bake":
+		bakeCmd := flag.NewFlagSet("bake", flag.ExitOnError)
+		configFile := bakeCmd.String("c", "services-config.yaml", "Path to services configuration file")
+		templateFile := bakeCmd.String("t", "docker-compose.template.yml", "Path to template file")
+		consolidatedEnvFile := bakeCmd.String("env", ".env", "Path to consolidated env file")
+		outputFile := bakeCmd.String("o", "", "Output file path (default: docker-bake.hcl or docker-bake.json)")
+		format := bakeCmd.String("format", "hcl", "Output format: hcl or json")
+		environment := bakeCmd.String("environment", "", "Target environment, selects the tags, platforms and cache (default: $DEPLOYMENT_ENVIRONMENT or dev)")
+		forceOverwrite := bakeCmd.Bool("f", false, "Force overwrite output file if it exists")
+		bakeCmd.Parse(os.Args[2:])
+		GenerateBake(*configFile, *templateFile, *consolidatedEnvFile, *outputFile, *format, *environment, *forceOverwrite)
+
+	case "images":
+		if len(os.Args) < 3 {
+			printUsage()
+			return
+		}
+		imagesCmd := flag.NewFlagSet("images "+os.Args[2], flag.ExitOnError)
+		configFile := imagesCmd.String("c", "services-config.yaml", "Path to services configuration file")
+		write := imagesCmd.Bool("write", false, "Rewrite the drifted images to the declared versions")
+		outputFile := imagesCmd.String("o", imageLockFile, "Output file path for the image digests")
+		imagesCmd.Parse(os.Args[3:])
+
+		switch os.Args[2] {
+		case "check":
+			CheckImages(*configFile, *write)
+		case "lock":
+			LockImages(*configFile, *outputFile)
+		case "outdated":
+			OutdatedImages(*configFile)
+		default:
+			fmt.Printf("Unknown images command: %s\n", os.Args[2])
+			printUsage()
+		}
+
+	case "var":
+		VarCommand(os.Args[2:])
 
 	case "help":
 		printUsage()
@@ -51,6 +386,28 @@ func printUsage() {
 	fmt.Println("Usage:")
 	fmt.Println("  deployment env [options]  - Consolidate environment files")
 	fmt.Println("  deployment update [options]       - Update docker-compose.yml with consolidated env vars")
+	fmt.Println("  deployment add-service [options]  - Scaffold a new service in config, template and service directory")
+	fmt.Println("  deployment remove-service [options] - Remove a service added with add-service")
+	fmt.Println("  deployment watch [options]        - Regenerate .env and docker-compose.yml when sources change")
+	fmt.Println("  deployment nats config [options]  - Generate nats-server.conf with per-service users and permissions")
+	fmt.Println("  deployment nats provision [options] - Plan or apply the declared JetStream streams and consumers")
+	fmt.Println("  deployment traefik [options]      - Generate the Traefik static config for an environment")
+	fmt.Println("  deployment certs [options]        - Issue local HTTPS certificates for the dev hostnames from a local CA")
+	fmt.Println("  deployment monitoring [options]   - Generate the Prometheus config, alert rules, Grafana and monitoring stack from the services")
+	fmt.Println("  deployment capacity [options]     - Check the reservations and limits of the stack fit the declared nodes")
+	fmt.Println("  deployment audit [options]        - Check the rendered compose and stack files against the security rules")
+	fmt.Println("  deployment release <command> [options] - Blue/green and canary releases: start, shift, promote, rollback, stop, status")
+	fmt.Println("  deployment redis config [options] - Generate redis.conf for an environment with per-service ACL users")
+	fmt.Println("  deployment db init [options]      - Generate the postgres init SQL creating databases, roles and grants")
+	fmt.Println("  deployment db provision [options] - Reconcile databases, roles and grants on the running postgres service")
+	fmt.Println("  deployment topology check [options] - Validate NATS producers, consumers and streams")
+	fmt.Println("  deployment topology graph [options] - Render the dependency graph and messaging data flow")
+	fmt.Println("  deployment policy check [options] - Evaluate the policies of services-config.yaml against a rendered compose file")
+	fmt.Println("  deployment bake [options]         - Generate docker-bake.hcl building the image of every service from its source")
+	fmt.Println("  deployment images check [options] - Compare the images of every compose and stack file with the declared versions")
+	fmt.Println("  deployment images lock [options]  - Resolve every image to its digest through the registry API into images.lock")
+	fmt.Println("  deployment images outdated [options] - List newer tags of the images following the pattern of their current tag")
+	fmt.Println("  deployment var <command> [options] - List, get, set, unset, move and search service variables")
 	fmt.Println("  deployment help                   - Show this help message")
 	fmt.Println("\nConsolidate options:")
 	fmt.Println("  -o string   Output file path for consolidated env file (default: .env)")
@@ -59,6 +416,9 @@ func printUsage() {
 	fmt.Println("  -d          Auto-discover services in project directory")
 	fmt.Println("  -dir string Directory to discover services (default: current directory)")
 	fmt.Println("              Use this to specify a different directory for service discovery")
+	fmt.Println("  -t string   Path to template file used to resolve dependencies (default: docker-compose.template.yml)")
+	fmt.Println("  -only string    Comma separated services or groups to include, with their dependencies")
+	fmt.Println("  -exclude string Comma separated services or groups to exclude")
 	fmt.Println("\nUpdate options:")
 	fmt.Println("  -dc string    Path to docker-compose.yml file (default: docker-compose.yml)")
 	fmt.Println("  -t string  Path to template file (default: docker-compose.template.yml in project root)")
@@ -68,8 +428,154 @@ func printUsage() {
 	fmt.Println("  -f            Force overwrite output file if it exists")
 	fmt.Println("  -dir string   Directory to discover services (default: current directory)")
 	fmt.Println("  -c string     Path to services configuration file (default: services-config.yaml)")
+	fmt.Println("  -only string  Comma separated services or groups to include, with their dependencies")
+	fmt.Println("  -exclude string Comma separated services or groups to exclude")
+	fmt.Println("  -environment string Target environment, selects the Traefik provider mode, telemetry settings and resources (default: $DEPLOYMENT_ENVIRONMENT or dev)")
+	fmt.Println("  -mode string  dev builds the services from their source, prod runs their images without source mounts (default: images.modes of the environment or dev)")
+	fmt.Println("\nAdd-service options:")
+	fmt.Println("  -name string      Name of the service (prompted when empty)")
+	fmt.Println("  -prefix string    Environment variable prefix (default: derived from the name)")
+	fmt.Println("  -groups string    Comma separated groups of the service")
+	fmt.Println("  -domain string    Public domain of the service")
+	fmt.Println("  -path string      Traefik path prefix to route to the service (default: not routed)")
+	fmt.Println("  -port-var string  Variable holding the port the service listens on (default: PORT)")
+	fmt.Println("  -depends string   Comma separated dependencies (default: postgres,redis,nats)")
+	fmt.Println("  -vars string      Comma separated variables to put in .env.example")
+	fmt.Println("  -healthcheck string Healthcheck type: http, tcp or none")
+	fmt.Println("  -i                Prompt for every option")
+	fmt.Println("  -no-regen         Do not regenerate the consolidated env and docker compose files")
+	fmt.Println("  -c, -t, -dir, -env, -o  Same as for env and update")
+	fmt.Println("\nRemove-service options:")
+	fmt.Println("  -name string      Name of the service to remove")
+	fmt.Println("  -purge            Delete the whole service directory, not only the scaffolded files")
+	fmt.Println("  -y                Do not ask for confirmation")
+	fmt.Println("  -no-regen         Do not regenerate the consolidated env and docker compose files")
+	fmt.Println("  -c, -t, -dir, -env, -o  Same as for env and update")
+	fmt.Println("\nWatch options:")
+	fmt.Println("  -interval duration  How often to check the sources for changes (default: 500ms)")
+	fmt.Println("  -debounce duration  Wait until the sources stop changing for this long (default: 1s)")
+	fmt.Println("  -hook string        Command to run after regenerating, {services} is replaced by the affected services")
+	fmt.Println("  -v                  Show the full output of the generators")
+	fmt.Println("  -c, -t, -dir, -env, -o, -only, -exclude, -environment  Same as for env and update")
+	fmt.Println("\nNats config options:")
+	fmt.Println("  -o string   Output file path (default: nats/nats-server.conf)")
+	fmt.Println("  -f          Force overwrite output file if it exists")
+	fmt.Println("  -c string   Path to services configuration file (default: services-config.yaml)")
+	fmt.Println("\nNats provision options:")
+	fmt.Println("  -apply          Apply the plan (default: only print it)")
+	fmt.Println("  -f              Apply without asking for confirmation")
+	fmt.Println("  -prune          Delete streams and consumers that no service declares")
+	fmt.Println("  -s string       NATS server URL (default: nats://localhost:<NATS_PORT>)")
+	fmt.Println("  -user string    NATS user (default: NATS_USER from the consolidated env file)")
+	fmt.Println("  -password string NATS password (default: NATS_PASSWORD from the consolidated env file)")
+	fmt.Println("  -env string     Consolidated env file (default: .env)")
+	fmt.Println("  -timeout duration Timeout for JetStream API calls (default: 10s)")
+	fmt.Println("\nTraefik options:")
+	fmt.Println("  -environment string Target environment, such as dev or prod (default: $DEPLOYMENT_ENVIRONMENT or dev)")
+	fmt.Println("  -o string       Output file path (default: traefik/traefik.yml)")
+	fmt.Println("  -dynamic string Directory for the dashboard router config (default: traefik/dynamic)")
+	fmt.Println("  -env string     Consolidated env file with the dashboard password (default: .env)")
+	fmt.Println("  -f              Force overwrite output file if it exists")
+	fmt.Println("  -c string       Path to services configuration file (default: services-config.yaml)")
+	fmt.Println("\nRelease commands:")
+	fmt.Println("  start      Run the service as blue and green variants, the candidate with -image and -weight percent")
+	fmt.Println("  shift      Send -weight percent of the traffic to the candidate color")
+	fmt.Println("  promote    Make the candidate the active color, with all the traffic")
+	fmt.Println("  rollback   Abort the canary, or undo the last promotion")
+	fmt.Println("  stop       Run the service as a single service again")
+	fmt.Println("  status     Show the split of every released service")
+	fmt.Println("\nRelease options:")
+	fmt.Println("  -service string  Service to release")
+	fmt.Println("  -weight int      Percent of the traffic sent to the candidate color (0-100)")
+	fmt.Println("  -image string    Image of the candidate color (default: the template build)")
+	fmt.Println("  -state string    Path to the release state file (default: releases.yaml)")
+	fmt.Println("  -no-regen        Only update the state file, do not regenerate the docker compose file")
+	fmt.Println("  -c, -t, -env, -o, -environment  Same as for update")
+	fmt.Println("\nCerts options:")
+	fmt.Println("  -ca string      Directory of the local development CA (default: traefik/ca)")
+	fmt.Println("  -o string       Output directory for the certificate (default: traefik/certs)")
+	fmt.Println("  -dynamic string Directory for the TLS config (default: traefik/dynamic)")
+	fmt.Println("  -hosts          Print hosts file entries for the dev hostnames")
+	fmt.Println("  -renew-ca       Create a new development CA, replacing the existing one")
+	fmt.Println("  -f              Issue a new certificate even if the current one is up to date")
+	fmt.Println("  -c string       Path to services configuration file (default: services-config.yaml)")
+	fmt.Println("\nMonitoring options:")
+	fmt.Println("  -environment string Target environment, such as dev or prod (default: $DEPLOYMENT_ENVIRONMENT or dev)")
+	fmt.Println("  -o string       Output directory (default: monitoring)")
+	fmt.Println("  -env string     Consolidated env file used to resolve the metrics ports (default: .env)")
+	fmt.Println("  -t string       Template file declaring the Traefik routers of the error budget rules (default: docker-compose.template.yml)")
+	fmt.Println("  -f              Force overwrite output files if they exist")
+	fmt.Println("  -check          Only check the syntax of the rule files in <output>/rules, exit with an error on problems")
+	fmt.Println("  -c string       Path to services configuration file (default: services-config.yaml)")
+	fmt.Println("\nCapacity options:")
+	fmt.Println("  -environment string Target environment, selects the resources and nodes (default: $DEPLOYMENT_ENVIRONMENT or dev)")
+	fmt.Println("  -stack string   Swarm stack file giving replicas and placement, the configured services run once without it (default: docker-stack.yml)")
+	fmt.Println("  -write          Write the resources of the configured services into the deploy sections of the stack file first")
+	fmt.Println("  -c string       Path to services configuration file (default: services-config.yaml)")
+	fmt.Println("\nAudit options:")
+	fmt.Println("  -files string   Comma separated files to audit (default: audit.files, or docker-compose.yml, docker-stack.yml and")
+	fmt.Println("                  monitoring/monitoring-stack.yml when they exist)")
+	fmt.Println("  -format string  Output format: text, json or sarif (default: text)")
+	fmt.Println("  -o string       Output file for the report (default: stdout)")
+	fmt.Println("  -strict         Fail on warnings as well as errors")
+	fmt.Println("  -c string       Path to services configuration file (default: services-config.yaml)")
+	fmt.Println("\nRedis config options:")
+	fmt.Println("  -environment string Target environment, such as dev or prod (default: $DEPLOYMENT_ENVIRONMENT or dev)")
+	fmt.Println("  -o string   Output file path (default: redis/redis.conf)")
+	fmt.Println("  -f          Force overwrite output file if it exists")
+	fmt.Println("  -c string   Path to services configuration file (default: services-config.yaml)")
+	fmt.Println("\nDb options:")
+	fmt.Println("  -o string       Output file path (init, default: postgres/initdb/10-provision.sql)")
+	fmt.Println("  -f              Force overwrite output file if it exists (init)")
+	fmt.Println("  -env string     Consolidated env file (provision, default: .env)")
+	fmt.Println("  -compose string Docker compose file running postgres (provision, default: docker-compose.yml)")
+	fmt.Println("  -dry-run        Print the provisioning SQL instead of running it (provision)")
+	fmt.Println("  -c string       Path to services configuration file (default: services-config.yaml)")
+	fmt.Println("\nTopology options:")
+	fmt.Println("  -strict        Fail on warnings as well as errors (check)")
+	fmt.Println("  -format string Graph format: mermaid or dot (graph, default: mermaid)")
+	fmt.Println("  -o string      Output file path for the graph (graph, default: stdout)")
+	fmt.Println("  -c, -t         Same as for update")
+	fmt.Println("\nPolicy options:")
+	fmt.Println("  -compose string Rendered compose or stack file to check (default: docker-compose.yml)")
+	fmt.Println("  -strict         Fail on warnings as well as errors")
+	fmt.Println("  -c string       Path to services configuration file (default: services-config.yaml)")
+	fmt.Println("  update checks the policies as well, and does not write docker-compose.yml when one fails with an error")
+	fmt.Println("\nBake options:")
+	fmt.Println("  -format string      Output format: hcl or json (default: hcl)")
+	fmt.Println("  -o string           Output file path (default: docker-bake.hcl or docker-bake.json)")
+	fmt.Println("  -environment string Target environment, selects the tags, platforms and cache (default: $DEPLOYMENT_ENVIRONMENT or dev)")
+	fmt.Println("  -f                  Force overwrite output file if it exists")
+	fmt.Println("  -c, -t, -env        Same as for update")
+	fmt.Println("\nImages options:")
+	fmt.Println("  -write    Rewrite the drifted images to the versions declared in services-config.yaml (check)")
+	fmt.Println("  -o string Output file path for the image digests (lock, default: images.lock)")
+	fmt.Println("  -c string Path to services configuration file (default: services-config.yaml)")
+	fmt.Println("  update sets the declared image of the -environment on the services that run an image, update and")
+	fmt.Println("  monitoring pin the images of images.lock to their digest")
 	fmt.Println("\nExamples:")
 	fmt.Println("  deployment env -d -o .env -f")
 	fmt.Println("  deployment env -d -o .env -dir ./services")
 	fmt.Println("  deployment update -t docker-compose.template.yml -env .env -o docker-compose.yml -dir ./services")
+	fmt.Println("  deployment update -only core,crawlers -exclude singapore-supreme-court-crawler")
+	fmt.Println("  deployment update -environment prod -mode prod")
+	fmt.Println("  deployment add-service -name lkpp-indonesia-crawler -groups crawlers -vars NATS_URL,DB_URL")
+	fmt.Println("  deployment remove-service -name lkpp-indonesia-crawler -y")
+	fmt.Println("  deployment watch -hook 'docker compose up -d {services}'")
+	fmt.Println("  deployment var set lexicon-beneficial-ownership-api PORT 8080 -regen")
+	fmt.Println("  deployment nats provision -apply")
+	fmt.Println("  deployment db provision -dry-run")
+	fmt.Println("  deployment redis config -environment prod -f")
+	fmt.Println("  deployment traefik -environment prod -f")
+	fmt.Println("  deployment certs -hosts")
+	fmt.Println("  deployment monitoring -environment prod -f")
+	fmt.Println("  deployment monitoring -check")
+	fmt.Println("  deployment capacity -environment prod -write")
+	fmt.Println("  deployment audit -format sarif -o audit.sarif")
+	fmt.Println("  deployment policy check -compose docker-stack.yml")
+	fmt.Println("  deployment images check -write")
+	fmt.Println("  deployment images lock")
+	fmt.Println("  deployment bake -environment prod -f && docker buildx bake crawlers")
+	fmt.Println("  deployment release start -service lexicon-beneficial-ownership-api -image ghcr.io/lexicon/bo-api:1.4.0 -weight 10")
+	fmt.Println("  deployment release promote -service lexicon-beneficial-ownership-api")
 }
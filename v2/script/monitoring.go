@@ -0,0 +1,715 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Defaults of the monitoring section
+const (
+	defaultScrapeInterval     = "15s"
+	defaultEvaluationInterval = "15s"
+	defaultMetricsRetention   = "15d"
+	defaultMetricsPath        = "/metrics"
+)
+
+// Images of the monitoring stack, matching the hand-written monitoring-stack.yml it replaces
+const (
+	prometheusImage       = "prom/prometheus:v2.36.2"
+	grafanaImage          = "grafana/grafana:9.0.3"
+	lokiImage             = "grafana/loki:2.8.0"
+	tempoImage            = "grafana/tempo:2.1.0"
+	mimirImage            = "grafana/mimir:2.9.0"
+	postgresExporterImage = "prometheuscommunity/postgres-exporter:v0.15.0"
+	redisExporterImage    = "oliver006/redis_exporter:v1.62.0"
+	natsExporterImage     = "natsio/prometheus-nats-exporter:0.15.0"
+	cadvisorImage         = "gcr.io/cadvisor/cadvisor:v0.47.2"
+)
+
+// cadvisorPort is the port cAdvisor serves its container metrics on
+const cadvisorPort = 8080
+
+// PrometheusConfig represents prometheus.yml
+type PrometheusConfig struct {
+	Global        PrometheusGlobal      `yaml:"global"`
+	RuleFiles     []string              `yaml:"rule_files,omitempty"`
+	ScrapeConfigs []PrometheusScrapeJob `yaml:"scrape_configs"`
+}
+
+// PrometheusGlobal holds the global scrape settings
+type PrometheusGlobal struct {
+	ScrapeInterval     string `yaml:"scrape_interval"`
+	EvaluationInterval string `yaml:"evaluation_interval"`
+}
+
+// PrometheusScrapeJob is a scrape config with static targets
+type PrometheusScrapeJob struct {
+	JobName        string                   `yaml:"job_name"`
+	ScrapeInterval string                   `yaml:"scrape_interval,omitempty"`
+	MetricsPath    string                   `yaml:"metrics_path,omitempty"`
+	StaticConfigs  []PrometheusStaticConfig `yaml:"static_configs,omitempty"`
+	DNSSDConfigs   []PrometheusDNSSDConfig  `yaml:"dns_sd_configs,omitempty"`
+}
+
+// PrometheusDNSSDConfig discovers targets from DNS, such as the tasks.<service> records of every Swarm replica
+type PrometheusDNSSDConfig struct {
+	Names []string `yaml:"names"`
+	Type  string   `yaml:"type"`
+	Port  int      `yaml:"port"`
+}
+
+// PrometheusStaticConfig lists targets sharing the same labels
+type PrometheusStaticConfig struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels,omitempty"`
+}
+
+// MonitoringStack represents the generated monitoring-stack.yml
+type MonitoringStack struct {
+	Version  string                            `yaml:"version"`
+	Networks map[string]map[string]any         `yaml:"networks"`
+	Volumes  map[string]any                    `yaml:"volumes"`
+	Services map[string]MonitoringStackService `yaml:"services"`
+}
+
+// MonitoringStackService is a service of the monitoring stack
+type MonitoringStackService struct {
+	Image       string            `yaml:"image"`
+	Ports       []string          `yaml:"ports,omitempty"`
+	Volumes     []string          `yaml:"volumes,omitempty"`
+	Environment []string          `yaml:"environment,omitempty"`
+	Networks    []string          `yaml:"networks"`
+	Command     []string          `yaml:"command,omitempty"`
+	Deploy      StackDeploy       `yaml:"deploy"`
+	Healthcheck *StackHealthcheck `yaml:"healthcheck,omitempty"`
+}
+
+// StackHealthcheck is a healthcheck whose timings, retries included, come from variables of the monitoring .env
+type StackHealthcheck struct {
+	Test        []string `yaml:"test"`
+	Interval    string   `yaml:"interval"`
+	Timeout     string   `yaml:"timeout"`
+	Retries     string   `yaml:"retries"`
+	StartPeriod string   `yaml:"start_period"`
+}
+
+// StackDeploy is the Swarm deploy section of a service
+type StackDeploy struct {
+	Mode          string              `yaml:"mode,omitempty"`
+	Replicas      int                 `yaml:"replicas,omitempty"`
+	Placement     *StackPlacement     `yaml:"placement,omitempty"`
+	Resources     *StackResources     `yaml:"resources,omitempty"`
+	RestartPolicy *StackRestartPolicy `yaml:"restart_policy,omitempty"`
+	Labels        []string            `yaml:"labels,omitempty"`
+}
+
+// StackPlacement constrains the nodes a service runs on
+type StackPlacement struct {
+	Constraints []string `yaml:"constraints"`
+}
+
+// StackResources holds the limits and reservations of a service
+type StackResources struct {
+	Limits       StackResourceValues `yaml:"limits"`
+	Reservations StackResourceValues `yaml:"reservations"`
+}
+
+// StackResourceValues is a memory and CPU amount
+type StackResourceValues struct {
+	Memory string `yaml:"memory,omitempty"`
+	CPUs   string `yaml:"cpus,omitempty"`
+}
+
+// StackRestartPolicy restarts failed tasks
+type StackRestartPolicy struct {
+	Condition   string `yaml:"condition"`
+	Delay       string `yaml:"delay"`
+	MaxAttempts int    `yaml:"max_attempts"`
+}
+
+// monitoringTool describes a component of the LGTM stack
+type monitoringTool struct {
+	Name       string
+	Image      string
+	Port       int
+	HealthPath string
+	DataPath   string
+	ConfigFile string
+	ConfigPath string
+}
+
+// monitoringTools are the components of the monitoring stack besides Grafana and the exporters
+var monitoringTools = []monitoringTool{
+	{Name: "prometheus", Image: prometheusImage, Port: 9090, HealthPath: "/-/healthy", DataPath: "/prometheus", ConfigFile: "prometheus.yml", ConfigPath: "/etc/prometheus/prometheus.yml"},
+	{Name: "loki", Image: lokiImage, Port: 3100, HealthPath: "/ready", DataPath: "/loki", ConfigFile: "loki-config.yaml", ConfigPath: "/etc/loki/local-config.yaml"},
+	{Name: "tempo", Image: tempoImage, Port: 3200, HealthPath: "/ready", DataPath: "/tmp/tempo", ConfigFile: "tempo-config.yaml", ConfigPath: "/etc/tempo/tempo-config.yaml"},
+	{Name: "mimir", Image: mimirImage, Port: 9009, HealthPath: "/ready", DataPath: "/data", ConfigFile: "mimir-config.yaml", ConfigPath: "/etc/mimir/mimir-config.yaml"},
+}
+
+// infraExporter describes the Prometheus exporter added for an infrastructure kind
+type infraExporter struct {
+	Kind  string
+	Image string
+	Port  int
+}
+
+// infraExporters are added for the postgres, redis and nats services of the config
+var infraExporters = []infraExporter{
+	{Kind: "postgres", Image: postgresExporterImage, Port: 9187},
+	{Kind: "redis", Image: redisExporterImage, Port: 9121},
+	{Kind: "nats", Image: natsExporterImage, Port: 7777},
+}
+
+// monitoringSettings returns the monitoring section with its defaults applied
+func monitoringSettings(config Config) MonitoringConfig {
+	settings := config.Monitoring
+	settings.ScrapeInterval = valueOrDefault(settings.ScrapeInterval, defaultScrapeInterval)
+	settings.EvaluationInterval = valueOrDefault(settings.EvaluationInterval, defaultEvaluationInterval)
+	settings.Retention = valueOrDefault(settings.Retention, defaultMetricsRetention)
+
+	return settings
+}
+
+// resolvePortValue turns a declared port into a literal port, reading variables from the consolidated env
+func resolvePortValue(port string, prefix string, envVars map[string]string) (string, bool) {
+	if _, err := strconv.Atoi(port); err == nil {
+		return port, true
+	}
+	for _, name := range []string{prefix + port, port} {
+		if value, ok := envVars[name]; ok && value != "" {
+			return value, true
+		}
+	}
+
+	return "", false
+}
+
+// infraServiceOfKind returns the service of an infrastructure kind, treating keydb as redis
+func infraServiceOfKind(config Config, kind string) (ServiceConfig, bool) {
+	for _, service := range getAllServiceConfigs(config) {
+		serviceKind := getServiceKind(service)
+		if serviceKind == "keydb" {
+			serviceKind = "redis"
+		}
+		if serviceKind == kind {
+			return service, true
+		}
+	}
+
+	return ServiceConfig{}, false
+}
+
+// exporterEnvironment returns the connection settings of an exporter, referencing the consolidated variables
+func exporterEnvironment(exporter infraExporter, service ServiceConfig, envVars map[string]string) ([]string, []string) {
+	prefix := service.Prefix
+
+	switch exporter.Kind {
+	case "postgres":
+		port, _ := resolvePortValue("PORT", prefix, envVars)
+		return []string{
+			fmt.Sprintf("DATA_SOURCE_URI=%s:%s/postgres?sslmode=disable", service.Name, valueOrDefault(port, "5432")),
+			fmt.Sprintf("DATA_SOURCE_USER=${%sUSER}", prefix),
+			fmt.Sprintf("DATA_SOURCE_PASS=${%sPASSWORD}", prefix),
+		}, nil
+	case "redis":
+		port, _ := resolvePortValue("PORT", prefix, envVars)
+		environment := []string{fmt.Sprintf("REDIS_ADDR=redis://%s:%s", service.Name, valueOrDefault(port, "6379"))}
+		if _, ok := envVars[prefix+"PASSWORD"]; ok {
+			environment = append(environment, fmt.Sprintf("REDIS_PASSWORD=${%sPASSWORD}", prefix))
+		}
+		return environment, nil
+	case "nats":
+		port, _ := resolvePortValue("PORT_MONITORING", prefix, envVars)
+		return nil, []string{"-varz", "-connz", "-jsz=all", "-healthz", fmt.Sprintf("http://%s:%s", service.Name, valueOrDefault(port, "8222"))}
+	}
+
+	return nil, nil
+}
+
+// buildPrometheusConfig builds the scrape configs of the monitoring tools, cAdvisor, the exporters, Traefik and every
+// service declaring a metrics endpoint. Released services are scraped on both colors.
+func buildPrometheusConfig(config Config, envVars map[string]string, releases ReleaseState, environment string) (PrometheusConfig, []string) {
+	settings := monitoringSettings(config)
+	prometheus := PrometheusConfig{
+		Global: PrometheusGlobal{ScrapeInterval: settings.ScrapeInterval, EvaluationInterval: settings.EvaluationInterval},
+	}
+	var warnings []string
+
+	prometheus.ScrapeConfigs = append(prometheus.ScrapeConfigs, PrometheusScrapeJob{
+		JobName:       "prometheus",
+		StaticConfigs: []PrometheusStaticConfig{{Targets: []string{"localhost:9090"}}},
+	})
+	prometheus.ScrapeConfigs = append(prometheus.ScrapeConfigs, PrometheusScrapeJob{
+		JobName:       "grafana",
+		StaticConfigs: []PrometheusStaticConfig{{Targets: []string{"grafana:3000"}}},
+	})
+	for _, tool := range monitoringTools[1:] {
+		prometheus.ScrapeConfigs = append(prometheus.ScrapeConfigs, PrometheusScrapeJob{
+			JobName:       tool.Name,
+			StaticConfigs: []PrometheusStaticConfig{{Targets: []string{fmt.Sprintf("%s:%d", tool.Name, tool.Port)}}},
+		})
+	}
+
+	if boolValue(settings.Cadvisor, true) {
+		// cAdvisor runs on every node, its tasks record lists one address per node
+		prometheus.ScrapeConfigs = append(prometheus.ScrapeConfigs, PrometheusScrapeJob{
+			JobName:      "cadvisor",
+			DNSSDConfigs: []PrometheusDNSSDConfig{{Names: []string{"tasks.cadvisor"}, Type: "A", Port: cadvisorPort}},
+		})
+	}
+
+	if traefikService, ok := getTraefikService(config); ok {
+		traefikSettings := traefikSettingsForEnvironment(config, environment)
+		if boolValue(traefikSettings.Metrics, traefikSettings.Profile != "dev") {
+			prometheus.ScrapeConfigs = append(prometheus.ScrapeConfigs, PrometheusScrapeJob{
+				JobName:       "traefik",
+				StaticConfigs: []PrometheusStaticConfig{{Targets: []string{fmt.Sprintf("%s:%d", traefikService.Name, traefikMetricsPort)}}},
+			})
+		} else {
+			warnings = append(warnings, fmt.Sprintf("Traefik metrics are disabled in the %s environment, it is not scraped (set metrics: true in its traefik section or use -environment prod)", environment))
+		}
+	}
+
+	if boolValue(settings.Exporters, true) {
+		for _, exporter := range infraExporters {
+			service, ok := infraServiceOfKind(config, exporter.Kind)
+			if !ok {
+				continue
+			}
+			prometheus.ScrapeConfigs = append(prometheus.ScrapeConfigs, PrometheusScrapeJob{
+				JobName: service.Name,
+				StaticConfigs: []PrometheusStaticConfig{{
+					Targets: []string{fmt.Sprintf("%s-exporter:%d", exporter.Kind, exporter.Port)},
+					Labels:  map[string]string{"kind": exporter.Kind},
+				}},
+			})
+		}
+	}
+
+	for _, service := range config.Services {
+		if service.Metrics == nil {
+			continue
+		}
+		port, ok := resolvePortValue(service.Metrics.Port, service.Prefix, envVars)
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("metrics port %s of service %s not found in the consolidated env file, skipping it", service.Metrics.Port, service.Name))
+			continue
+		}
+
+		job := PrometheusScrapeJob{
+			JobName:        service.Name,
+			ScrapeInterval: service.Metrics.Interval,
+			MetricsPath:    valueOrDefault(service.Metrics.Path, defaultMetricsPath),
+		}
+		if job.MetricsPath == "/metrics" {
+			job.MetricsPath = ""
+		}
+		if _, released := releases.Services[service.Name]; released {
+			for _, color := range releaseColors {
+				job.StaticConfigs = append(job.StaticConfigs, PrometheusStaticConfig{
+					Targets: []string{fmt.Sprintf("%s-%s:%s", service.Name, color, port)},
+					Labels:  map[string]string{"color": color},
+				})
+			}
+		} else if service.SLO != nil && service.SLO.Replicas > 1 {
+			// Scrape every replica instead of the virtual IP of the service
+			portNumber, err := strconv.Atoi(port)
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("metrics port %s of service %s is not a number, skipping it", port, service.Name))
+				continue
+			}
+			job.DNSSDConfigs = []PrometheusDNSSDConfig{{Names: []string{"tasks." + service.Name}, Type: "A", Port: portNumber}}
+		} else {
+			job.StaticConfigs = []PrometheusStaticConfig{{Targets: []string{fmt.Sprintf("%s:%s", service.Name, port)}}}
+		}
+		if len(service.Groups) > 0 {
+			for i := range job.StaticConfigs {
+				if job.StaticConfigs[i].Labels == nil {
+					job.StaticConfigs[i].Labels = make(map[string]string)
+				}
+				job.StaticConfigs[i].Labels["group"] = strings.Join(service.Groups, ",")
+			}
+		}
+		prometheus.ScrapeConfigs = append(prometheus.ScrapeConfigs, job)
+	}
+
+	return prometheus, warnings
+}
+
+// renderGrafanaDatasources renders the datasource provisioning of Prometheus, Loki, Tempo and Mimir
+func renderGrafanaDatasources() ([]byte, error) {
+	datasources := map[string]any{
+		"apiVersion": 1,
+		"datasources": []any{
+			map[string]any{"name": "Prometheus", "uid": "prometheus", "type": "prometheus", "access": "proxy", "url": "http://prometheus:9090", "isDefault": true, "editable": false},
+			map[string]any{"name": "Loki", "uid": "loki", "type": "loki", "access": "proxy", "url": "http://loki:3100", "editable": false},
+			map[string]any{
+				"name": "Tempo", "uid": "tempo", "type": "tempo", "access": "proxy", "url": "http://tempo:3200", "editable": false,
+				"jsonData": map[string]any{
+					"httpMethod": "GET",
+					"tracesToLogs": map[string]any{
+						"datasourceUid":      "loki",
+						"tags":               []string{"job", "instance", "pod", "namespace"},
+						"mappedTags":         []any{map[string]string{"key": "service.name", "value": "service"}},
+						"spanStartTimeShift": "-1h",
+						"spanEndTimeShift":   "1h",
+						"filterByTraceID":    true,
+						"filterBySpanID":     true,
+					},
+				},
+			},
+			map[string]any{"name": "Mimir", "uid": "mimir", "type": "prometheus", "access": "proxy", "url": "http://mimir:9009/prometheus", "editable": false},
+		},
+	}
+
+	return marshalYAML(datasources)
+}
+
+// renderGrafanaDashboardProvider renders the provisioning that loads the dashboards directory
+func renderGrafanaDashboardProvider() ([]byte, error) {
+	provider := map[string]any{
+		"apiVersion": 1,
+		"providers": []any{
+			map[string]any{
+				"name":                  "beneficial-ownership",
+				"folder":                "Beneficial Ownership",
+				"type":                  "file",
+				"disableDeletion":       true,
+				"allowUiUpdates":        false,
+				"updateIntervalSeconds": 30,
+				"options":               map[string]any{"path": "/var/lib/grafana/dashboards"},
+			},
+		},
+	}
+
+	return marshalYAML(provider)
+}
+
+// renderServicesDashboard renders a dashboard with the availability, memory and CPU of every scrape job
+func renderServicesDashboard(prometheus PrometheusConfig) ([]byte, error) {
+	var jobs []string
+	for _, job := range prometheus.ScrapeConfigs {
+		jobs = append(jobs, job.JobName)
+	}
+	sort.Strings(jobs)
+
+	datasource := map[string]string{"type": "prometheus", "uid": "prometheus"}
+	panel := func(id int, title string, kind string, expr string, legend string, unit string, x int, y int, width int) map[string]any {
+		return map[string]any{
+			"id": id, "title": title, "type": kind, "datasource": datasource,
+			"gridPos":     map[string]int{"x": x, "y": y, "w": width, "h": 8},
+			"fieldConfig": map[string]any{"defaults": map[string]any{"unit": unit}, "overrides": []any{}},
+			"targets":     []any{map[string]any{"refId": "A", "datasource": datasource, "expr": expr, "legendFormat": legend}},
+		}
+	}
+
+	panels := []any{
+		panel(1, "Targets up", "stat", "sum(up)", "up", "none", 0, 0, 6),
+		panel(2, "Targets down", "stat", "count(up == 0) or vector(0)", "down", "none", 6, 0, 6),
+		panel(3, "Scrape duration", "timeseries", "scrape_duration_seconds", "{{job}} {{instance}}", "s", 12, 0, 12),
+		panel(4, "Availability by job", "timeseries", "avg by (job) (up)", "{{job}}", "percentunit", 0, 8, 24),
+		panel(5, "Resident memory", "timeseries", "sum by (job) (process_resident_memory_bytes)", "{{job}}", "bytes", 0, 16, 12),
+		panel(6, "CPU", "timeseries", "sum by (job) (rate(process_cpu_seconds_total[5m]))", "{{job}}", "percentunit", 12, 16, 12),
+	}
+
+	dashboard := map[string]any{
+		"uid":           "bo-services",
+		"title":         "Services",
+		"tags":          []string{"generated", "beneficial-ownership"},
+		"timezone":      "browser",
+		"schemaVersion": 36,
+		"refresh":       "30s",
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"templating": map[string]any{"list": []any{map[string]any{
+			"name": "job", "type": "custom", "multi": true, "includeAll": true,
+			"query": strings.Join(jobs, ","),
+		}}},
+		"panels": panels,
+	}
+
+	return json.MarshalIndent(dashboard, "", "  ")
+}
+
+// stackDeploy returns the deploy section of a monitoring service, with the resources of its profile in the monitoring
+// section or, without one, read from the monitoring .env
+func stackDeploy(config Config, name string, variablePrefix string) StackDeploy {
+	resources, ok := monitoringStackResources(config, name)
+	if !ok {
+		resources = &StackResources{
+			Limits:       StackResourceValues{Memory: fmt.Sprintf("${%s_MEMORY_LIMIT}", variablePrefix), CPUs: fmt.Sprintf("${%s_CPU_LIMIT}", variablePrefix)},
+			Reservations: StackResourceValues{Memory: fmt.Sprintf("${%s_MEMORY_RESERVATION}", variablePrefix), CPUs: fmt.Sprintf("${%s_CPU_RESERVATION}", variablePrefix)},
+		}
+	}
+
+	return StackDeploy{
+		Replicas:      1,
+		Placement:     &StackPlacement{Constraints: []string{"node.role == manager"}},
+		Resources:     resources,
+		RestartPolicy: &StackRestartPolicy{Condition: "on-failure", Delay: "5s", MaxAttempts: 3},
+	}
+}
+
+// monitoringImage returns the image of a monitoring service, from monitoring.images when it is set
+func monitoringImage(config Config, name string, defaultImage string) string {
+	return valueOrDefault(config.Monitoring.Images[name], defaultImage)
+}
+
+// stackHealthcheck probes an HTTP endpoint with the timings of the monitoring .env
+func stackHealthcheck(url string) *StackHealthcheck {
+	return &StackHealthcheck{
+		Test:        []string{"CMD", "wget", "--spider", url},
+		Interval:    "${HEALTH_CHECK_INTERVAL}",
+		Timeout:     "${HEALTH_CHECK_TIMEOUT}",
+		Retries:     "${HEALTH_CHECK_RETRIES}",
+		StartPeriod: "${HEALTH_CHECK_START_PERIOD}",
+	}
+}
+
+// buildMonitoringStack builds the Swarm stack of the monitoring tools, cAdvisor and the infrastructure exporters
+func buildMonitoringStack(config Config, envVars map[string]string, ruleFiles []string) MonitoringStack {
+	settings := monitoringSettings(config)
+
+	appNetwork := "internal_network"
+	networks := map[string]map[string]any{
+		"monitoring_network": {"driver": "overlay", "attachable": true},
+		"traefik_network":    {"external": true},
+	}
+	if settings.AppNetwork != "" {
+		// Join the network of the application stack so its services can be scraped by name
+		appNetwork = settings.AppNetwork
+		networks[appNetwork] = map[string]any{"external": true}
+	} else {
+		networks[appNetwork] = map[string]any{"driver": "overlay", "attachable": true}
+	}
+
+	stack := MonitoringStack{
+		Version:  "3.8",
+		Networks: networks,
+		Volumes:  make(map[string]any),
+		Services: make(map[string]MonitoringStackService),
+	}
+
+	for _, tool := range monitoringTools {
+		volume := tool.Name + "_data"
+		stack.Volumes[volume] = nil
+		service := MonitoringStackService{
+			Image:       monitoringImage(config, tool.Name, tool.Image),
+			Volumes:     []string{volume + ":" + tool.DataPath, "./" + tool.ConfigFile + ":" + tool.ConfigPath},
+			Networks:    []string{appNetwork, "monitoring_network"},
+			Command:     []string{"-config.file=" + tool.ConfigPath},
+			Deploy:      stackDeploy(config, tool.Name, strings.ToUpper(tool.Name)),
+			Healthcheck: stackHealthcheck(fmt.Sprintf("http://localhost:%d%s", tool.Port, tool.HealthPath)),
+		}
+		if tool.Name == "prometheus" {
+			service.Command = []string{
+				"--config.file=" + tool.ConfigPath,
+				"--storage.tsdb.path=" + tool.DataPath,
+				"--storage.tsdb.retention.time=" + settings.Retention,
+				"--web.enable-lifecycle",
+			}
+			if len(ruleFiles) > 0 {
+				service.Volumes = append(service.Volumes, "./"+alertRulesDir+":/etc/prometheus/"+alertRulesDir+":ro")
+			}
+		}
+		stack.Services[tool.Name] = service
+	}
+
+	stack.Volumes["grafana_data"] = nil
+	grafanaDeploy := stackDeploy(config, "grafana", "GRAFANA")
+	grafanaDeploy.Labels = []string{
+		"traefik.enable=true",
+		"traefik.http.routers.grafana.rule=Host(`${GRAFANA_DOMAIN}`)",
+		"traefik.http.services.grafana.loadbalancer.server.port=3000",
+	}
+	stack.Services["grafana"] = MonitoringStackService{
+		Image: monitoringImage(config, "grafana", grafanaImage),
+		Ports: []string{"${GRAFANA_PORT}:3000"},
+		Volumes: []string{
+			"grafana_data:/var/lib/grafana",
+			"./grafana-datasources.yaml:/etc/grafana/provisioning/datasources/datasources.yaml:ro",
+			"./grafana-dashboards.yaml:/etc/grafana/provisioning/dashboards/dashboards.yaml:ro",
+			"./dashboards:/var/lib/grafana/dashboards:ro",
+		},
+		Environment: []string{
+			"GF_SECURITY_ADMIN_PASSWORD=${GRAFANA_ADMIN_PASSWORD}",
+			"GF_SECURITY_ADMIN_USER=${GRAFANA_ADMIN_USER}",
+			"GF_INSTALL_PLUGINS=grafana-clock-panel,grafana-simple-json-datasource",
+			"GF_PATHS_PROVISIONING=/etc/grafana/provisioning",
+			"GF_AUTH_ANONYMOUS_ENABLED=true",
+			"GF_AUTH_ANONYMOUS_ORG_ROLE=Viewer",
+		},
+		Networks:    []string{appNetwork, "monitoring_network", "traefik_network"},
+		Deploy:      grafanaDeploy,
+		Healthcheck: stackHealthcheck("http://localhost:3000/api/health"),
+	}
+
+	if boolValue(settings.Cadvisor, true) {
+		// Container metrics of every node. cAdvisor reads the container names from the Docker API, so it mounts
+		// docker.sock, which gives control of the Docker daemon whatever the mount mode. The rest of /var/run is
+		// not mounted, and the cgroups, the Docker data and the disks are mounted read-only, the host root is not.
+		cadvisorDeploy := stackDeploy(config, "cadvisor", "CADVISOR")
+		cadvisorDeploy.Mode = "global"
+		cadvisorDeploy.Replicas = 0
+		cadvisorDeploy.Placement = nil
+		stack.Services["cadvisor"] = MonitoringStackService{
+			Image: monitoringImage(config, "cadvisor", cadvisorImage),
+			Volumes: []string{
+				"/var/run/docker.sock:/var/run/docker.sock:ro",
+				"/sys:/sys:ro",
+				"/var/lib/docker:/var/lib/docker:ro",
+				"/dev/disk:/dev/disk:ro",
+			},
+			Networks:    []string{"monitoring_network"},
+			Command:     []string{"--docker_only=true", "--housekeeping_interval=30s"},
+			Deploy:      cadvisorDeploy,
+			Healthcheck: stackHealthcheck(fmt.Sprintf("http://localhost:%d/healthz", cadvisorPort)),
+		}
+	}
+
+	if boolValue(settings.Exporters, true) {
+		for _, exporter := range infraExporters {
+			service, ok := infraServiceOfKind(config, exporter.Kind)
+			if !ok {
+				continue
+			}
+			environment, command := exporterEnvironment(exporter, service, envVars)
+			stack.Services[exporter.Kind+"-exporter"] = MonitoringStackService{
+				Image:       monitoringImage(config, exporter.Kind+"-exporter", exporter.Image),
+				Environment: environment,
+				Networks:    []string{appNetwork, "monitoring_network"},
+				Command:     command,
+				Deploy:      stackDeploy(config, "exporters", "EXPORTER"),
+			}
+		}
+	}
+
+	return stack
+}
+
+// GenerateMonitoring writes the Prometheus scrape configs, the Grafana provisioning and the monitoring stack
+func GenerateMonitoring(configFile string, templateFile string, consolidatedEnvFile string, outputDir string, environment string, forceOverwrite bool) {
+	scriptDir, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("Error getting current directory: %v\n", err)
+		return
+	}
+
+	configFile = resolveFilePath(configFile, scriptDir, scriptDir)
+	templateFile = resolveFilePath(templateFile, scriptDir, scriptDir)
+	consolidatedEnvFile = resolveFilePath(consolidatedEnvFile, scriptDir, scriptDir)
+	outputDir = resolveFilePath(outputDir, scriptDir, scriptDir)
+	environment = resolveEnvironment(environment)
+	config := getConfig(configFile)
+	if problems := validateSLOConfig(config); len(problems) > 0 {
+		fmt.Printf("Invalid SLO hints:\n  %s\n", strings.Join(problems, "\n  "))
+		return
+	}
+	if problems := validateResourcesConfig(config); len(problems) > 0 {
+		fmt.Printf("Invalid resources configuration:\n  %s\n", strings.Join(problems, "\n  "))
+		return
+	}
+
+	if _, err := os.Stat(consolidatedEnvFile); err != nil {
+		fmt.Printf("Consolidated env file not found: %s, run deployment env first\n", consolidatedEnvFile)
+		return
+	}
+	envVars := readEnvVars(consolidatedEnvFile)
+	releases, err := readReleaseState(filepath.Join(scriptDir, releaseStateFile))
+	if err != nil {
+		fmt.Printf("Error reading release state: %v\n", err)
+		return
+	}
+	imageLock, err := readImageLock(filepath.Join(scriptDir, imageLockFile))
+	if err != nil {
+		fmt.Printf("Error reading image lock: %v\n", err)
+		return
+	}
+
+	prometheus, warnings := buildPrometheusConfig(config, envVars, releases, environment)
+	rules, ruleWarnings := buildAlertRules(config, getTemplateRouters(templateFile), environment)
+	for _, warning := range append(warnings, ruleWarnings...) {
+		fmt.Printf("Warning: %s\n", warning)
+	}
+	if len(rules.Groups) > 0 {
+		prometheus.RuleFiles = []string{"/etc/prometheus/" + alertRulesDir + "/*.yml"}
+	}
+
+	files := make(map[string][]byte)
+	var order []string
+	add := func(name string, header string, content []byte, err error) bool {
+		if err != nil {
+			fmt.Printf("Error rendering %s: %v\n", name, err)
+			return false
+		}
+		files[name] = append([]byte(header), content...)
+		order = append(order, name)
+		return true
+	}
+	yamlHeader := "# Generated by deployment monitoring from services-config.yaml\n# DO NOT EDIT THIS FILE DIRECTLY - Edit the metrics, slo and monitoring sections of services-config.yaml instead\n\n"
+
+	content, err := marshalYAML(prometheus)
+	if !add("prometheus.yml", yamlHeader, content, err) {
+		return
+	}
+	content, err = renderGrafanaDatasources()
+	if !add("grafana-datasources.yaml", yamlHeader, content, err) {
+		return
+	}
+	content, err = renderGrafanaDashboardProvider()
+	if !add("grafana-dashboards.yaml", yamlHeader, content, err) {
+		return
+	}
+	content, err = renderServicesDashboard(prometheus)
+	if !add(filepath.Join("dashboards", "services.json"), "", append(content, '\n'), err) {
+		return
+	}
+	stack := buildMonitoringStack(config, envVars, prometheus.RuleFiles)
+	for name, service := range stack.Services {
+		service.Image = pinImage(imageLock, service.Image)
+		stack.Services[name] = service
+	}
+	content, err = marshalYAML(stack)
+	if !add("monitoring-stack.yml", yamlHeader, content, err) {
+		return
+	}
+	if len(rules.Groups) > 0 {
+		content, err = marshalYAML(rules)
+		if err == nil {
+			// The generated rules must pass the same check as hand-written ones before Prometheus loads them
+			if problems := checkRuleFile(content); len(problems) > 0 {
+				err = fmt.Errorf("generated rules do not pass the check:\n  %s", strings.Join(problems, "\n  "))
+			}
+		}
+		if !add(filepath.Join(alertRulesDir, alertRulesFile), yamlHeader, content, err) {
+			return
+		}
+	}
+
+	for _, name := range order {
+		if !writeGeneratedFile(filepath.Join(outputDir, name), files[name], forceOverwrite) {
+			return
+		}
+	}
+
+	services := 0
+	for _, service := range config.Services {
+		if service.Metrics != nil {
+			services++
+		}
+	}
+	alerts := 0
+	for _, group := range rules.Groups {
+		alerts += len(group.Rules)
+	}
+	fmt.Printf("Generated monitoring for the %s environment in %s: %d scrape jobs, %d services with metrics, %d alert rules\n", environment, outputDir, len(prometheus.ScrapeConfigs), services, alerts)
+	envPath := consolidatedEnvFile
+	if relative, err := filepath.Rel(outputDir, consolidatedEnvFile); err == nil {
+		envPath = relative
+	}
+	fmt.Printf("Deploy it with: cd %s && set -a && . %s && . ./.env && set +a && docker stack deploy -c monitoring-stack.yml monitoring\n", filepath.Base(outputDir), envPath)
+}
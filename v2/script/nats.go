@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// natsConfigMountPath is where the generated nats-server.conf is mounted in the nats container
+const natsConfigMountPath = "/etc/nats/nats-server.conf"
+
+// natsCredentialFlags matches the shared credentials passed on the nats-server command line
+var natsCredentialFlags = regexp.MustCompile(`\s*--(user|pass)(\s+|=)\S+`)
+
+// getNatsService returns the common service running nats-server
+func getNatsService(config Config) (ServiceConfig, bool) {
+	for _, service := range getAllServiceConfigs(config) {
+		if getServiceKind(service) == "nats" {
+			return service, true
+		}
+	}
+
+	return ServiceConfig{}, false
+}
+
+// hasNatsPermissions reports whether any service declares its NATS subjects, enabling per-service users
+func hasNatsPermissions(config Config) bool {
+	for _, service := range getAllServiceConfigs(config) {
+		if service.Nats != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// natsCredentialNames returns the variable names used inside the service and in the consolidated env file
+func natsCredentialNames(service ServiceConfig) (string, string, string, string) {
+	userVar, passwordVar := "NATS_USER", "NATS_PASSWORD"
+	if service.Nats.UserVar != "" {
+		userVar = service.Nats.UserVar
+	}
+	if service.Nats.PasswordVar != "" {
+		passwordVar = service.Nats.PasswordVar
+	}
+
+	return userVar, passwordVar, consolidatedVariableName(service, userVar), consolidatedVariableName(service, passwordVar)
+}
+
+// natsInboxPrefix returns the inbox prefix of a service, so its replies are not readable by the other users
+func natsInboxPrefix(service ServiceConfig) string {
+	return "_INBOX_" + service.Name
+}
+
+// natsGeneratedVariables returns the per-service NATS user, password and inbox prefix injected into the
+// consolidated env
+func natsGeneratedVariables(services []ServiceConfig, config Config, existing map[string]string) []GeneratedVariable {
+	natsService, ok := getNatsService(config)
+	if !ok {
+		return nil
+	}
+
+	var variables []GeneratedVariable
+	for _, service := range services {
+		if service.Nats == nil {
+			continue
+		}
+
+		userVar, passwordVar, consolidatedUser, consolidatedPassword := natsCredentialNames(service)
+		inboxVar := valueOrDefault(service.Nats.InboxVar, "NATS_INBOX_PREFIX")
+		variables = append(variables,
+			GeneratedVariable{
+				Name:     consolidatedUser,
+				Value:    service.Name,
+				Bindings: []VariableBinding{{Service: service.Name, Variable: userVar}},
+			},
+			GeneratedVariable{
+				Name:  consolidatedPassword,
+				Value: existingOrNewSecret(existing, consolidatedPassword),
+				Bindings: []VariableBinding{
+					{Service: service.Name, Variable: passwordVar},
+					{Service: natsService.Name, Variable: consolidatedPassword},
+				},
+			},
+			GeneratedVariable{
+				Name:     consolidatedVariableName(service, inboxVar),
+				Value:    natsInboxPrefix(service),
+				Bindings: []VariableBinding{{Service: service.Name, Variable: inboxVar}},
+			},
+		)
+	}
+
+	return variables
+}
+
+// natsPermissions computes the least-privilege publish and subscribe permissions of a service
+func natsPermissions(service ServiceConfig) ([]string, []string) {
+	publish := append([]string{}, service.Nats.Publish...)
+	subscribe := append([]string{}, service.Nats.Subscribe...)
+
+	usesJetStream := len(service.Nats.Streams) > 0 || len(service.Nats.Consumers) > 0
+	if usesJetStream {
+		publish = append(publish, "$JS.API.INFO")
+	}
+
+	for _, stream := range service.Nats.Streams {
+		publish = append(publish,
+			"$JS.API.STREAM.CREATE."+stream.Name,
+			"$JS.API.STREAM.UPDATE."+stream.Name,
+			"$JS.API.STREAM.INFO."+stream.Name,
+		)
+	}
+
+	for _, consumer := range service.Nats.Consumers {
+		publish = append(publish,
+			fmt.Sprintf("$JS.API.CONSUMER.CREATE.%s.%s.>", consumer.Stream, consumer.Name),
+			fmt.Sprintf("$JS.API.CONSUMER.DURABLE.CREATE.%s.%s", consumer.Stream, consumer.Name),
+			fmt.Sprintf("$JS.API.CONSUMER.INFO.%s.%s", consumer.Stream, consumer.Name),
+			fmt.Sprintf("$JS.API.CONSUMER.MSG.NEXT.%s.%s", consumer.Stream, consumer.Name),
+			fmt.Sprintf("$JS.ACK.%s.%s.>", consumer.Stream, consumer.Name),
+		)
+	}
+
+	// Replies to requests and JetStream API calls are delivered on the inboxes of the service only, the client
+	// sets the prefix with its inbox prefix option
+	if usesJetStream || len(publish) > 0 {
+		subscribe = append(subscribe, natsInboxPrefix(service)+".>")
+	}
+
+	return publish, subscribe
+}
+
+// renderNatsServerConfig renders nats-server.conf with one account and a user per service
+func renderNatsServerConfig(config Config) string {
+	var content strings.Builder
+
+	content.WriteString("# nats-server configuration\n")
+	content.WriteString(fmt.Sprintf("# Generated by deployment nats config on %s\n", time.Now().Format(time.RFC1123)))
+	content.WriteString("# DO NOT EDIT THIS FILE DIRECTLY - Edit the nats section of services in services-config.yaml instead\n")
+	content.WriteString("# Passwords are read from the environment of the nats container\n\n")
+
+	content.WriteString("jetstream {\n  store_dir: \"/data/jetstream\"\n}\n\n")
+	content.WriteString("accounts {\n  APP {\n    jetstream: enabled\n    users: [\n")
+
+	if natsService, ok := getNatsService(config); ok {
+		content.WriteString("      # Administrative user with full access\n")
+		content.WriteString(fmt.Sprintf("      { user: $%sUSER, password: $%sPASSWORD }\n", natsService.Prefix, natsService.Prefix))
+	}
+
+	for _, service := range getAllServiceConfigs(config) {
+		if service.Nats == nil {
+			continue
+		}
+
+		_, _, _, consolidatedPassword := natsCredentialNames(service)
+		publish, subscribe := natsPermissions(service)
+
+		content.WriteString(fmt.Sprintf("      # %s\n", service.Name))
+		content.WriteString("      {\n")
+		content.WriteString(fmt.Sprintf("        user: %q\n", service.Name))
+		content.WriteString(fmt.Sprintf("        password: $%s\n", consolidatedPassword))
+		content.WriteString("        permissions: {\n")
+		content.WriteString(fmt.Sprintf("          publish: { allow: %s }\n", natsSubjectList(publish)))
+		content.WriteString(fmt.Sprintf("          subscribe: { allow: %s }\n", natsSubjectList(subscribe)))
+		if len(service.Nats.Subscribe) > 0 {
+			content.WriteString("          allow_responses: true\n")
+		}
+		content.WriteString("        }\n")
+		content.WriteString("      }\n")
+	}
+
+	content.WriteString("    ]\n  }\n}\n")
+
+	return content.String()
+}
+
+// natsSubjectList renders subjects as a quoted nats-server config array
+func natsSubjectList(subjects []string) string {
+	if len(subjects) == 0 {
+		return "[]"
+	}
+
+	quoted := make([]string, len(subjects))
+	for i, subject := range subjects {
+		quoted[i] = fmt.Sprintf("%q", subject)
+	}
+
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// GenerateNatsConfig writes nats-server.conf from the nats section of the services
+func GenerateNatsConfig(configFile string, outputFile string, forceOverwrite bool) {
+	scriptDir, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("Error getting current directory: %v\n", err)
+		return
+	}
+
+	configFile = resolveFilePath(configFile, scriptDir, scriptDir)
+	outputFile = resolveFilePath(outputFile, scriptDir, scriptDir)
+	config := getConfig(configFile)
+
+	if !hasNatsPermissions(config) {
+		fmt.Println("No service declares a nats section, nothing to generate.")
+		return
+	}
+
+	if _, err := os.Stat(outputFile); err == nil && !forceOverwrite {
+		fmt.Printf("Output file %s already exists. Overwrite? (y/n): ", outputFile)
+		var answer string
+		fmt.Scanln(&answer)
+		if strings.ToLower(answer) != "y" {
+			fmt.Println("Operation cancelled.")
+			return
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(outputFile), 0755); err != nil {
+		fmt.Printf("Error creating output directory: %v\n", err)
+		return
+	}
+	if err := os.WriteFile(outputFile, []byte(renderNatsServerConfig(config)), 0644); err != nil {
+		fmt.Printf("Error writing nats config file: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Generated nats-server config written to %s\n", outputFile)
+	fmt.Println("Run deployment env and deployment update to inject the per-service credentials")
+}
+
+// updateNatsService mounts the generated config into the nats service and drops the shared credentials flags.
+// The service is left alone until deployment nats config wrote the file, docker would mount a directory in its place.
+func updateNatsService(dockerCompose *DockerComposeConfig, configFile string, projectDir string) {
+	config := getConfig(configFile)
+	if !hasNatsPermissions(config) {
+		return
+	}
+
+	natsService, ok := getNatsService(config)
+	if !ok {
+		return
+	}
+	service, ok := dockerCompose.Services[natsService.Name]
+	if !ok {
+		return
+	}
+
+	configPath := filepath.Join(projectDir, natsService.Name, "nats-server.conf")
+	if _, err := os.Stat(configPath); err != nil {
+		fmt.Printf("  Warning: %s not found, run deployment nats config to use per-service nats users\n", configPath)
+		return
+	}
+
+	if command, ok := service.Command.(string); ok {
+		command = strings.TrimSpace(natsCredentialFlags.ReplaceAllString(command, ""))
+		if !strings.Contains(command, "--config") && !strings.Contains(command, "-c ") {
+			command = strings.TrimSpace(command + " --config " + natsConfigMountPath)
+		}
+		service.Command = command
+	}
+
+	mount := fmt.Sprintf("./%s/nats-server.conf:%s:ro", natsService.Name, natsConfigMountPath)
+	volumes, _ := service.Volumes.([]any)
+	for _, volume := range volumes {
+		if volume == mount {
+			mount = ""
+		}
+	}
+	if mount != "" {
+		service.Volumes = append(volumes, mount)
+	}
+
+	dockerCompose.Services[natsService.Name] = service
+	fmt.Printf("  Mounted generated nats-server config into service %s\n", natsService.Name)
+}
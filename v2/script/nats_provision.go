@@ -0,0 +1,654 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// ProvisionOptions holds the options of deployment nats provision
+type ProvisionOptions struct {
+	ConfigFile          string
+	ConsolidatedEnvFile string
+	Server              string
+	User                string
+	Password            string
+	Apply               bool
+	Prune               bool
+	ForceApply          bool
+	Timeout             time.Duration
+}
+
+// ProvisionChange is a single step of a provisioning plan
+type ProvisionChange struct {
+	Action         string // create, update, delete or unchanged
+	Kind           string // stream or consumer
+	Stream         string
+	Name           string
+	Diff           []string
+	Blocked        string // reason the change cannot be applied in place
+	StreamConfig   *jetstream.StreamConfig
+	ConsumerConfig *jetstream.ConsumerConfig
+}
+
+// declaredStream is a stream declared in the config together with the service owning it
+type declaredStream struct {
+	Service string
+	Config  jetstream.StreamConfig
+}
+
+// declaredConsumer is a durable consumer declared in the config together with the service reading from it
+type declaredConsumer struct {
+	Service string
+	Stream  string
+	Config  jetstream.ConsumerConfig
+}
+
+// parseRetentionDuration parses a Go duration, also accepting a number of days such as 7d
+func parseRetentionDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return duration, nil
+}
+
+// streamConfigFromDeclaration converts a stream declaration into a JetStream stream config
+func streamConfigFromDeclaration(stream NatsStreamConfig) (jetstream.StreamConfig, error) {
+	config := jetstream.StreamConfig{
+		Name:     stream.Name,
+		Subjects: append([]string{}, stream.Subjects...),
+		MaxMsgs:  -1,
+		MaxBytes: -1,
+		Replicas: 1,
+	}
+
+	switch stream.Retention {
+	case "", "limits":
+		config.Retention = jetstream.LimitsPolicy
+	case "interest":
+		config.Retention = jetstream.InterestPolicy
+	case "workqueue":
+		config.Retention = jetstream.WorkQueuePolicy
+	default:
+		return config, fmt.Errorf("stream %s: unknown retention %q (expected limits, interest or workqueue)", stream.Name, stream.Retention)
+	}
+
+	switch stream.Storage {
+	case "", "file":
+		config.Storage = jetstream.FileStorage
+	case "memory":
+		config.Storage = jetstream.MemoryStorage
+	default:
+		return config, fmt.Errorf("stream %s: unknown storage %q (expected file or memory)", stream.Name, stream.Storage)
+	}
+
+	maxAge, err := parseRetentionDuration(stream.MaxAge)
+	if err != nil {
+		return config, fmt.Errorf("stream %s: max_age: %v", stream.Name, err)
+	}
+	config.MaxAge = maxAge
+
+	if stream.MaxMsgs > 0 {
+		config.MaxMsgs = stream.MaxMsgs
+	}
+	if stream.MaxBytes > 0 {
+		config.MaxBytes = stream.MaxBytes
+	}
+	if stream.Replicas > 0 {
+		config.Replicas = stream.Replicas
+	}
+
+	return config, nil
+}
+
+// consumerConfigFromDeclaration converts a consumer declaration into a durable JetStream pull consumer config
+func consumerConfigFromDeclaration(consumer NatsConsumerConfig) (jetstream.ConsumerConfig, error) {
+	config := jetstream.ConsumerConfig{
+		Durable:       consumer.Name,
+		FilterSubject: consumer.FilterSubject,
+		AckWait:       30 * time.Second,
+		MaxDeliver:    -1,
+	}
+
+	switch consumer.DeliverPolicy {
+	case "", "all":
+		config.DeliverPolicy = jetstream.DeliverAllPolicy
+	case "last":
+		config.DeliverPolicy = jetstream.DeliverLastPolicy
+	case "new":
+		config.DeliverPolicy = jetstream.DeliverNewPolicy
+	case "last_per_subject":
+		config.DeliverPolicy = jetstream.DeliverLastPerSubjectPolicy
+	default:
+		return config, fmt.Errorf("consumer %s: unknown deliver_policy %q (expected all, last, new or last_per_subject)", consumer.Name, consumer.DeliverPolicy)
+	}
+
+	switch consumer.AckPolicy {
+	case "", "explicit":
+		config.AckPolicy = jetstream.AckExplicitPolicy
+	case "all":
+		config.AckPolicy = jetstream.AckAllPolicy
+	case "none":
+		config.AckPolicy = jetstream.AckNonePolicy
+	default:
+		return config, fmt.Errorf("consumer %s: unknown ack_policy %q (expected explicit, all or none)", consumer.Name, consumer.AckPolicy)
+	}
+
+	if consumer.AckWait != "" {
+		ackWait, err := time.ParseDuration(consumer.AckWait)
+		if err != nil {
+			return config, fmt.Errorf("consumer %s: invalid ack_wait %q", consumer.Name, consumer.AckWait)
+		}
+		config.AckWait = ackWait
+	}
+	if consumer.MaxDeliver > 0 {
+		config.MaxDeliver = consumer.MaxDeliver
+	}
+
+	return config, nil
+}
+
+// declaredJetStream collects the streams and consumers declared by all services
+func declaredJetStream(config Config) ([]declaredStream, []declaredConsumer, error) {
+	var streams []declaredStream
+	var consumers []declaredConsumer
+	seenStreams := make(map[string]string)
+	seenConsumers := make(map[string]string)
+
+	for _, service := range messagingServices(config) {
+		for _, stream := range service.Nats.Streams {
+			if owner, ok := seenStreams[stream.Name]; ok {
+				return nil, nil, fmt.Errorf("stream %s is declared by both %s and %s", stream.Name, owner, service.Name)
+			}
+			seenStreams[stream.Name] = service.Name
+
+			streamConfig, err := streamConfigFromDeclaration(stream)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", service.Name, err)
+			}
+			streams = append(streams, declaredStream{Service: service.Name, Config: streamConfig})
+		}
+
+		for _, consumer := range service.Nats.Consumers {
+			key := consumer.Stream + "/" + consumer.Name
+			if owner, ok := seenConsumers[key]; ok {
+				return nil, nil, fmt.Errorf("consumer %s on stream %s is declared by both %s and %s", consumer.Name, consumer.Stream, owner, service.Name)
+			}
+			seenConsumers[key] = service.Name
+
+			consumerConfig, err := consumerConfigFromDeclaration(consumer)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", service.Name, err)
+			}
+			consumers = append(consumers, declaredConsumer{Service: service.Name, Stream: consumer.Stream, Config: consumerConfig})
+		}
+	}
+
+	for _, consumer := range consumers {
+		if _, ok := seenStreams[consumer.Stream]; !ok {
+			return nil, nil, fmt.Errorf("consumer %s of %s reads from stream %s which no service declares", consumer.Config.Durable, consumer.Service, consumer.Stream)
+		}
+	}
+
+	return streams, consumers, nil
+}
+
+// formatProvisionValue renders a config value for the plan output
+func formatProvisionValue(value any) string {
+	switch v := value.(type) {
+	case time.Duration:
+		if v == 0 {
+			return "unlimited"
+		}
+		return v.String()
+	case int64:
+		if v < 0 {
+			return "unlimited"
+		}
+		return strconv.FormatInt(v, 10)
+	case int:
+		if v < 0 {
+			return "unlimited"
+		}
+		return strconv.Itoa(v)
+	case []string:
+		return "[" + strings.Join(v, ", ") + "]"
+	case json.Marshaler:
+		// Policies marshal to the same names used in services-config.yaml
+		if data, err := v.MarshalJSON(); err == nil {
+			return strings.Trim(string(data), `"`)
+		}
+	}
+
+	return fmt.Sprint(value)
+}
+
+// provisionField compares one field of the desired and current config
+func provisionField(diff *[]string, name string, current any, desired any) bool {
+	currentValue, desiredValue := formatProvisionValue(current), formatProvisionValue(desired)
+	if currentValue == desiredValue {
+		return false
+	}
+
+	*diff = append(*diff, fmt.Sprintf("%s: %s -> %s", name, currentValue, desiredValue))
+	return true
+}
+
+// sortedSubjects returns a sorted copy of subjects so ordering does not count as a change
+func sortedSubjects(subjects []string) []string {
+	sorted := append([]string{}, subjects...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// diffStreamConfig lists the fields that differ between the server and the config.
+// The storage and a retention change to or from workqueue cannot be applied to an existing stream, so they block the update.
+func diffStreamConfig(current jetstream.StreamConfig, desired jetstream.StreamConfig) ([]string, string) {
+	var diff []string
+	var blocked []string
+
+	if provisionField(&diff, "retention", current.Retention, desired.Retention) &&
+		(current.Retention == jetstream.WorkQueuePolicy || desired.Retention == jetstream.WorkQueuePolicy) {
+		blocked = append(blocked, "retention")
+	}
+	if provisionField(&diff, "storage", current.Storage, desired.Storage) {
+		blocked = append(blocked, "storage")
+	}
+	provisionField(&diff, "subjects", sortedSubjects(current.Subjects), sortedSubjects(desired.Subjects))
+	provisionField(&diff, "max_age", current.MaxAge, desired.MaxAge)
+	provisionField(&diff, "max_msgs", current.MaxMsgs, desired.MaxMsgs)
+	provisionField(&diff, "max_bytes", current.MaxBytes, desired.MaxBytes)
+	provisionField(&diff, "replicas", current.Replicas, desired.Replicas)
+
+	if len(blocked) > 0 {
+		return diff, fmt.Sprintf("%s cannot be changed on an existing stream, delete it first", strings.Join(blocked, " and "))
+	}
+	return diff, ""
+}
+
+// diffConsumerConfig lists the fields that differ between the server and the config.
+// The deliver and ack policies cannot be changed on an existing consumer, so they block the update.
+func diffConsumerConfig(current jetstream.ConsumerConfig, desired jetstream.ConsumerConfig) ([]string, string) {
+	var diff []string
+	var blocked []string
+
+	if provisionField(&diff, "deliver_policy", current.DeliverPolicy, desired.DeliverPolicy) {
+		blocked = append(blocked, "deliver_policy")
+	}
+	if provisionField(&diff, "ack_policy", current.AckPolicy, desired.AckPolicy) {
+		blocked = append(blocked, "ack_policy")
+	}
+	provisionField(&diff, "filter_subject", current.FilterSubject, desired.FilterSubject)
+	provisionField(&diff, "ack_wait", current.AckWait, desired.AckWait)
+	provisionField(&diff, "max_deliver", current.MaxDeliver, desired.MaxDeliver)
+
+	if len(blocked) > 0 {
+		return diff, fmt.Sprintf("%s cannot be changed on an existing consumer, delete it first", strings.Join(blocked, " and "))
+	}
+	return diff, ""
+}
+
+// describeStreamConfig lists the fields of a stream about to be created
+func describeStreamConfig(config jetstream.StreamConfig) []string {
+	return []string{
+		"subjects: " + formatProvisionValue(config.Subjects),
+		"retention: " + formatProvisionValue(config.Retention),
+		"storage: " + formatProvisionValue(config.Storage),
+		"max_age: " + formatProvisionValue(config.MaxAge),
+		"replicas: " + formatProvisionValue(config.Replicas),
+	}
+}
+
+// describeConsumerConfig lists the fields of a consumer about to be created
+func describeConsumerConfig(config jetstream.ConsumerConfig) []string {
+	description := []string{
+		"deliver_policy: " + formatProvisionValue(config.DeliverPolicy),
+		"ack_policy: " + formatProvisionValue(config.AckPolicy),
+		"ack_wait: " + formatProvisionValue(config.AckWait),
+	}
+	if config.FilterSubject != "" {
+		description = append([]string{"filter_subject: " + config.FilterSubject}, description...)
+	}
+	return description
+}
+
+// isInternalStream reports whether a stream backs a key-value or object store and must never be pruned
+func isInternalStream(name string) bool {
+	return strings.HasPrefix(name, "KV_") || strings.HasPrefix(name, "OBJ_")
+}
+
+// planProvision compares the declared streams and consumers with the ones on the server
+func planProvision(ctx context.Context, js jetstream.JetStream, streams []declaredStream, consumers []declaredConsumer, prune bool) ([]ProvisionChange, error) {
+	var changes []ProvisionChange
+	existingStreams := make(map[string]jetstream.Stream)
+
+	for _, declared := range streams {
+		desired := declared.Config
+		stream, err := js.Stream(ctx, desired.Name)
+		if errors.Is(err, jetstream.ErrStreamNotFound) {
+			changes = append(changes, ProvisionChange{Action: "create", Kind: "stream", Name: desired.Name, Diff: describeStreamConfig(desired), StreamConfig: &desired})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("looking up stream %s: %v", desired.Name, err)
+		}
+		existingStreams[desired.Name] = stream
+
+		diff, blocked := diffStreamConfig(stream.CachedInfo().Config, desired)
+		action := "update"
+		if len(diff) == 0 {
+			action = "unchanged"
+		}
+		changes = append(changes, ProvisionChange{Action: action, Kind: "stream", Name: desired.Name, Diff: diff, Blocked: blocked, StreamConfig: &desired})
+	}
+
+	for _, declared := range consumers {
+		desired := declared.Config
+		change := ProvisionChange{Kind: "consumer", Stream: declared.Stream, Name: desired.Durable, ConsumerConfig: &desired}
+
+		stream, ok := existingStreams[declared.Stream]
+		if !ok {
+			// The stream is created by this plan, so the consumer is new as well
+			change.Action, change.Diff = "create", describeConsumerConfig(desired)
+			changes = append(changes, change)
+			continue
+		}
+
+		consumer, err := stream.Consumer(ctx, desired.Durable)
+		if errors.Is(err, jetstream.ErrConsumerNotFound) {
+			change.Action, change.Diff = "create", describeConsumerConfig(desired)
+			changes = append(changes, change)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("looking up consumer %s on stream %s: %v", desired.Durable, declared.Stream, err)
+		}
+
+		change.Diff, change.Blocked = diffConsumerConfig(consumer.CachedInfo().Config, desired)
+		change.Action = "update"
+		if len(change.Diff) == 0 {
+			change.Action = "unchanged"
+		}
+		changes = append(changes, change)
+	}
+
+	if prune {
+		pruned, err := planPrune(ctx, js, streams, consumers, existingStreams)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, pruned...)
+	}
+
+	return changes, nil
+}
+
+// planPrune lists the streams and consumers on the server that no service declares
+func planPrune(ctx context.Context, js jetstream.JetStream, streams []declaredStream, consumers []declaredConsumer, existingStreams map[string]jetstream.Stream) ([]ProvisionChange, error) {
+	var changes []ProvisionChange
+
+	declaredStreams := make(map[string]bool)
+	for _, stream := range streams {
+		declaredStreams[stream.Config.Name] = true
+	}
+	declaredConsumers := make(map[string]bool)
+	for _, consumer := range consumers {
+		declaredConsumers[consumer.Stream+"/"+consumer.Config.Durable] = true
+	}
+
+	names := js.StreamNames(ctx)
+	var serverStreams []string
+	for name := range names.Name() {
+		serverStreams = append(serverStreams, name)
+	}
+	if err := names.Err(); err != nil {
+		return nil, fmt.Errorf("listing streams: %v", err)
+	}
+	sort.Strings(serverStreams)
+
+	for _, name := range serverStreams {
+		if isInternalStream(name) {
+			continue
+		}
+		if !declaredStreams[name] {
+			changes = append(changes, ProvisionChange{Action: "delete", Kind: "stream", Name: name})
+		}
+	}
+
+	for _, name := range serverStreams {
+		stream, ok := existingStreams[name]
+		if !ok {
+			continue
+		}
+
+		consumerNames := stream.ConsumerNames(ctx)
+		var serverConsumers []string
+		for consumer := range consumerNames.Name() {
+			serverConsumers = append(serverConsumers, consumer)
+		}
+		if err := consumerNames.Err(); err != nil {
+			return nil, fmt.Errorf("listing consumers of stream %s: %v", name, err)
+		}
+		sort.Strings(serverConsumers)
+
+		for _, consumer := range serverConsumers {
+			if !declaredConsumers[name+"/"+consumer] {
+				changes = append(changes, ProvisionChange{Action: "delete", Kind: "consumer", Stream: name, Name: consumer})
+			}
+		}
+	}
+
+	return changes, nil
+}
+
+// printProvisionPlan prints the plan with one line per change and the diff of updates, returning the number of pending changes
+func printProvisionPlan(changes []ProvisionChange) int {
+	symbols := map[string]string{"create": "+", "update": "~", "delete": "-", "unchanged": "="}
+	pending, blocked := 0, 0
+	counts := make(map[string]int)
+
+	for _, change := range changes {
+		name := change.Name
+		if change.Kind == "consumer" {
+			name = change.Stream + " > " + change.Name
+		}
+
+		fmt.Printf("  %s %s %s\n", symbols[change.Action], change.Kind, name)
+		for _, line := range change.Diff {
+			fmt.Printf("      %s\n", line)
+		}
+		if change.Blocked != "" {
+			fmt.Printf("      BLOCKED: %s\n", change.Blocked)
+			blocked++
+			continue
+		}
+
+		counts[change.Action]++
+		if change.Action != "unchanged" {
+			pending++
+		}
+	}
+
+	fmt.Printf("\nPlan: %d to create, %d to update, %d to delete, %d unchanged", counts["create"], counts["update"], counts["delete"], counts["unchanged"])
+	if blocked > 0 {
+		fmt.Printf(", %d blocked", blocked)
+	}
+	fmt.Println(".")
+
+	return pending
+}
+
+// applyProvisionChange performs a single change of the plan against the server
+func applyProvisionChange(ctx context.Context, js jetstream.JetStream, change ProvisionChange) error {
+	switch {
+	case change.Kind == "stream" && change.Action == "create":
+		_, err := js.CreateStream(ctx, *change.StreamConfig)
+		return err
+	case change.Kind == "stream" && change.Action == "update":
+		_, err := js.UpdateStream(ctx, *change.StreamConfig)
+		return err
+	case change.Kind == "stream" && change.Action == "delete":
+		return js.DeleteStream(ctx, change.Name)
+	case change.Kind == "consumer" && change.Action == "create":
+		_, err := js.CreateConsumer(ctx, change.Stream, *change.ConsumerConfig)
+		return err
+	case change.Kind == "consumer" && change.Action == "update":
+		_, err := js.UpdateConsumer(ctx, change.Stream, *change.ConsumerConfig)
+		return err
+	case change.Kind == "consumer" && change.Action == "delete":
+		return js.DeleteConsumer(ctx, change.Stream, change.Name)
+	}
+
+	return nil
+}
+
+// applyProvisionPlan performs the pending changes of the plan, skipping the blocked ones, and returns the number of failures
+func applyProvisionPlan(ctx context.Context, js jetstream.JetStream, changes []ProvisionChange) int {
+	failed := 0
+	for _, change := range changes {
+		if change.Action == "unchanged" || change.Blocked != "" {
+			continue
+		}
+
+		name := change.Name
+		if change.Kind == "consumer" {
+			name = change.Stream + " > " + change.Name
+		}
+		if err := applyProvisionChange(ctx, js, change); err != nil {
+			fmt.Printf("  Error: failed to %s %s %s: %v\n", change.Action, change.Kind, name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("  %s %s %s\n", map[string]string{"create": "Created", "update": "Updated", "delete": "Deleted"}[change.Action], change.Kind, name)
+	}
+
+	return failed
+}
+
+// natsConnectionDefaults reads the server address and the administrative credentials from the consolidated env file
+func natsConnectionDefaults(config Config, consolidatedEnvFile string) (string, string, string) {
+	natsService, ok := getNatsService(config)
+	if !ok {
+		return nats.DefaultURL, "", ""
+	}
+
+	envVars := readEnvVars(consolidatedEnvFile)
+	server := nats.DefaultURL
+	if port := envVars[natsService.Prefix+"PORT"]; port != "" {
+		server = "nats://localhost:" + port
+	}
+
+	return server, envVars[natsService.Prefix+"USER"], envVars[natsService.Prefix+"PASSWORD"]
+}
+
+// ProvisionNats reconciles the declared JetStream streams and consumers against a running NATS server
+func ProvisionNats(options ProvisionOptions) {
+	scriptDir, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("Error getting current directory: %v\n", err)
+		return
+	}
+
+	configFile := resolveFilePath(options.ConfigFile, scriptDir, scriptDir)
+	consolidatedEnvFile := resolveFilePath(options.ConsolidatedEnvFile, scriptDir, scriptDir)
+	config := getConfig(configFile)
+
+	streams, consumers, err := declaredJetStream(config)
+	if err != nil {
+		fmt.Printf("Error reading JetStream declarations: %v\n", err)
+		os.Exit(1)
+	}
+	if len(streams) == 0 && len(consumers) == 0 && !options.Prune {
+		fmt.Println("No service declares JetStream streams or consumers, nothing to provision.")
+		return
+	}
+
+	server, user, password := natsConnectionDefaults(config, consolidatedEnvFile)
+	if options.Server != "" {
+		server = options.Server
+	}
+	if options.User != "" {
+		user, password = options.User, options.Password
+	}
+
+	connectOptions := []nats.Option{nats.Name("deployment nats provision"), nats.Timeout(options.Timeout)}
+	if user != "" {
+		connectOptions = append(connectOptions, nats.UserInfo(user, password))
+	}
+
+	nc, err := nats.Connect(server, connectOptions...)
+	if err != nil {
+		fmt.Printf("Error connecting to NATS at %s: %v\n", server, err)
+		os.Exit(1)
+	}
+	defer nc.Close()
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		fmt.Printf("Error creating JetStream context: %v\n", err)
+		os.Exit(1)
+	}
+
+	planCtx, cancelPlan := context.WithTimeout(context.Background(), options.Timeout)
+	changes, err := planProvision(planCtx, js, streams, consumers, options.Prune)
+	cancelPlan()
+	if err != nil {
+		fmt.Printf("Error planning JetStream changes: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("JetStream plan for %s:\n\n", server)
+	pending := printProvisionPlan(changes)
+
+	if !options.Apply {
+		if pending > 0 {
+			fmt.Println("Run with -apply to make these changes.")
+		}
+		return
+	}
+	if pending == 0 {
+		fmt.Println("Nothing to apply.")
+		return
+	}
+
+	if !options.ForceApply {
+		fmt.Printf("Apply %d changes to %s? (y/n): ", pending, server)
+		var answer string
+		fmt.Scanln(&answer)
+		if strings.ToLower(answer) != "y" {
+			fmt.Println("Operation cancelled.")
+			return
+		}
+	}
+
+	// The confirmation may have taken longer than the timeout, the changes get a deadline of their own
+	ctx, cancel := context.WithTimeout(context.Background(), options.Timeout)
+	defer cancel()
+
+	if failed := applyProvisionPlan(ctx, js, changes); failed > 0 {
+		fmt.Printf("\n%d of %d changes failed\n", failed, pending)
+		os.Exit(1)
+	}
+	fmt.Printf("\nApplied %d changes\n", pending)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// runJetStream starts an embedded nats-server with JetStream and returns a JetStream context connected to it
+func runJetStream(t *testing.T) jetstream.JetStream {
+	t.Helper()
+
+	options := natsserver.DefaultTestOptions
+	options.Port = server.RANDOM_PORT
+	options.JetStream = true
+	options.StoreDir = t.TempDir()
+	srv := natsserver.RunServer(&options)
+	t.Cleanup(srv.Shutdown)
+
+	nc, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatalf("connecting to the embedded server: %v", err)
+	}
+	t.Cleanup(nc.Close)
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatalf("creating the JetStream context: %v", err)
+	}
+	return js
+}
+
+// testDeclarations converts stream and consumer declarations the way declaredJetStream does
+func testDeclarations(t *testing.T, streams []NatsStreamConfig, consumers []NatsConsumerConfig) ([]declaredStream, []declaredConsumer) {
+	t.Helper()
+
+	var declaredStreams []declaredStream
+	for _, stream := range streams {
+		config, err := streamConfigFromDeclaration(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		declaredStreams = append(declaredStreams, declaredStream{Service: "crawler", Config: config})
+	}
+	var declaredConsumers []declaredConsumer
+	for _, consumer := range consumers {
+		config, err := consumerConfigFromDeclaration(consumer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		declaredConsumers = append(declaredConsumers, declaredConsumer{Service: "crawler", Stream: consumer.Stream, Config: config})
+	}
+	return declaredStreams, declaredConsumers
+}
+
+// planActions returns the action of every change of a plan by kind and name
+func planActions(changes []ProvisionChange) map[string]string {
+	actions := make(map[string]string)
+	for _, change := range changes {
+		action := change.Action
+		if change.Blocked != "" {
+			action = "blocked"
+		}
+		actions[change.Kind+" "+change.Stream+"/"+change.Name] = action
+	}
+	return actions
+}
+
+func TestProvisionCreatesThenReportsUnchanged(t *testing.T) {
+	js := runJetStream(t)
+	ctx := context.Background()
+	streams, consumers := testDeclarations(t,
+		[]NatsStreamConfig{{Name: "CRAWLER_JOBS", Subjects: []string{"crawler.jobs.>"}, Retention: "workqueue", MaxAge: "7d"}},
+		[]NatsConsumerConfig{{Name: "worker", Stream: "CRAWLER_JOBS", FilterSubject: "crawler.jobs.sg", AckWait: "5m", MaxDeliver: 5}},
+	)
+
+	changes, err := planProvision(ctx, js, streams, consumers, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"stream /CRAWLER_JOBS": "create", "consumer CRAWLER_JOBS/worker": "create"}
+	if got := planActions(changes); !maps.Equal(got, want) {
+		t.Fatalf("plan on an empty server = %v, want %v", got, want)
+	}
+
+	if failed := applyProvisionPlan(ctx, js, changes); failed != 0 {
+		t.Fatalf("%d changes failed", failed)
+	}
+	consumer, err := js.Consumer(ctx, "CRAWLER_JOBS", "worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := consumer.CachedInfo().Config; info.AckWait != 5*time.Minute || info.MaxDeliver != 5 {
+		t.Errorf("consumer created with ack_wait %s and max_deliver %d", info.AckWait, info.MaxDeliver)
+	}
+
+	changes, err = planProvision(ctx, js, streams, consumers, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]string{"stream /CRAWLER_JOBS": "unchanged", "consumer CRAWLER_JOBS/worker": "unchanged"}
+	if got := planActions(changes); !maps.Equal(got, want) {
+		t.Errorf("plan after apply = %v, want %v", got, want)
+	}
+}
+
+func TestProvisionUpdatesAndBlocks(t *testing.T) {
+	js := runJetStream(t)
+	ctx := context.Background()
+	if _, err := js.CreateStream(ctx, jetstream.StreamConfig{Name: "RESULTS", Subjects: []string{"crawler.results.>"}, MaxAge: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.CreateStream(ctx, jetstream.StreamConfig{Name: "EVENTS", Subjects: []string{"events.>"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.CreateConsumer(ctx, "EVENTS", jetstream.ConsumerConfig{Durable: "reader", AckPolicy: jetstream.AckNonePolicy}); err != nil {
+		t.Fatal(err)
+	}
+
+	streams, consumers := testDeclarations(t,
+		[]NatsStreamConfig{
+			{Name: "RESULTS", Subjects: []string{"crawler.results.>"}, MaxAge: "24h"},
+			{Name: "EVENTS", Subjects: []string{"events.>"}, Storage: "memory"},
+		},
+		[]NatsConsumerConfig{{Name: "reader", Stream: "EVENTS"}},
+	)
+
+	changes, err := planProvision(ctx, js, streams, consumers, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"stream /RESULTS": "update", "stream /EVENTS": "blocked", "consumer EVENTS/reader": "blocked"}
+	if got := planActions(changes); !maps.Equal(got, want) {
+		t.Fatalf("plan = %v, want %v", got, want)
+	}
+
+	if failed := applyProvisionPlan(ctx, js, changes); failed != 0 {
+		t.Fatalf("%d changes failed", failed)
+	}
+	stream, err := js.Stream(ctx, "RESULTS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxAge := stream.CachedInfo().Config.MaxAge; maxAge != 24*time.Hour {
+		t.Errorf("max_age after apply = %s, want 24h", maxAge)
+	}
+	stream, err = js.Stream(ctx, "EVENTS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storage := stream.CachedInfo().Config.Storage; storage != jetstream.FileStorage {
+		t.Errorf("blocked stream was changed to %s storage", storage)
+	}
+}
+
+func TestProvisionPrune(t *testing.T) {
+	js := runJetStream(t)
+	ctx := context.Background()
+	for _, config := range []jetstream.StreamConfig{
+		{Name: "CRAWLER_JOBS", Subjects: []string{"crawler.jobs.>"}},
+		{Name: "LEGACY", Subjects: []string{"legacy.>"}},
+	} {
+		if _, err := js.CreateStream(ctx, config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := js.CreateKeyValue(ctx, jetstream.KeyValueConfig{Bucket: "sessions"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.CreateConsumer(ctx, "CRAWLER_JOBS", jetstream.ConsumerConfig{Durable: "old-worker", AckPolicy: jetstream.AckExplicitPolicy}); err != nil {
+		t.Fatal(err)
+	}
+
+	streams, consumers := testDeclarations(t, []NatsStreamConfig{{Name: "CRAWLER_JOBS", Subjects: []string{"crawler.jobs.>"}}}, nil)
+
+	changes, err := planProvision(ctx, js, streams, consumers, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := planActions(changes); len(got) != 1 {
+		t.Fatalf("plan without -prune = %v, want only the declared stream", got)
+	}
+
+	changes, err = planProvision(ctx, js, streams, consumers, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"stream /CRAWLER_JOBS":             "unchanged",
+		"stream /LEGACY":                   "delete",
+		"consumer CRAWLER_JOBS/old-worker": "delete",
+	}
+	if got := planActions(changes); !maps.Equal(got, want) {
+		t.Fatalf("plan with -prune = %v, want %v", got, want)
+	}
+
+	if failed := applyProvisionPlan(ctx, js, changes); failed != 0 {
+		t.Fatalf("%d changes failed", failed)
+	}
+	if _, err := js.Stream(ctx, "LEGACY"); err == nil {
+		t.Error("stream LEGACY was not deleted")
+	}
+	if _, err := js.KeyValue(ctx, "sessions"); err != nil {
+		t.Errorf("key-value bucket was pruned: %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+// testNatsConfig declares an API answering requests, a crawler sending them and a third service
+func testNatsConfig() Config {
+	return Config{
+		CommonServices: []ServiceConfig{{Name: "nats", Prefix: "NATS_"}},
+		Services: []ServiceConfig{
+			{Name: "api", Prefix: "API_", Nats: &NatsConfig{Subscribe: []string{"api.requests"}}},
+			{Name: "crawler", Prefix: "CRAWLER_", Nats: &NatsConfig{Publish: []string{"api.requests"}}},
+			{Name: "dataminer", Prefix: "DATAMINER_", Nats: &NatsConfig{Publish: []string{"dataminer.>"}}},
+		},
+	}
+}
+
+func TestNatsPermissionsUseTheInboxOfTheService(t *testing.T) {
+	service := ServiceConfig{Name: "crawler", Nats: &NatsConfig{
+		Publish:   []string{"crawler.results"},
+		Consumers: []NatsConsumerConfig{{Name: "worker", Stream: "JOBS"}},
+	}}
+
+	publish, subscribe := natsPermissions(service)
+	if !slices.Contains(publish, "$JS.API.CONSUMER.MSG.NEXT.JOBS.worker") {
+		t.Errorf("publish = %v, missing the pull request of its consumer", publish)
+	}
+	if !slices.Equal(subscribe, []string{"_INBOX_crawler.>"}) {
+		t.Errorf("subscribe = %v, want only the inbox of the service", subscribe)
+	}
+
+	variables := natsGeneratedVariables([]ServiceConfig{service}, testNatsConfig(), nil)
+	var inbox GeneratedVariable
+	for _, variable := range variables {
+		if variable.Name == "NATS_INBOX_PREFIX" {
+			inbox = variable
+		}
+	}
+	if inbox.Value != "_INBOX_crawler" || len(inbox.Bindings) != 1 || inbox.Bindings[0].Variable != "NATS_INBOX_PREFIX" {
+		t.Errorf("inbox prefix variable = %+v", inbox)
+	}
+}
+
+// runNatsWithConfig starts an embedded nats-server from a generated nats-server.conf
+func runNatsWithConfig(t *testing.T, content string) *server.Server {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "nats-server.conf")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	options, err := server.ProcessConfigFile(path)
+	if err != nil {
+		t.Fatalf("generated config rejected by nats-server: %v\n%s", err, content)
+	}
+	options.Port = server.RANDOM_PORT
+	options.StoreDir = t.TempDir()
+	options.NoLog, options.NoSigs = true, true
+	srv := natsserver.RunServer(options)
+	t.Cleanup(srv.Shutdown)
+	return srv
+}
+
+func TestNatsServerConfigIsolatesReplies(t *testing.T) {
+	for name, value := range map[string]string{
+		"NATS_USER": "admin", "NATS_PASSWORD": "admin-secret",
+		"API_NATS_PASSWORD": "api-secret", "CRAWLER_NATS_PASSWORD": "crawler-secret", "DATAMINER_NATS_PASSWORD": "dataminer-secret",
+	} {
+		t.Setenv(name, value)
+	}
+	srv := runNatsWithConfig(t, renderNatsServerConfig(testNatsConfig()))
+
+	connect := func(user string, options ...nats.Option) *nats.Conn {
+		t.Helper()
+		options = append(options, nats.UserInfo(user, os.Getenv(strings.ToUpper(user)+"_NATS_PASSWORD")))
+		nc, err := nats.Connect(srv.ClientURL(), options...)
+		if err != nil {
+			t.Fatalf("connecting as %s: %v", user, err)
+		}
+		t.Cleanup(nc.Close)
+		return nc
+	}
+
+	api := connect("api")
+	if _, err := api.Subscribe("api.requests", func(msg *nats.Msg) { msg.Respond([]byte("ok")) }); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	crawler := connect("crawler", nats.CustomInboxPrefix(natsInboxPrefix(ServiceConfig{Name: "crawler"})))
+	reply, err := crawler.Request("api.requests", nil, 2*time.Second)
+	if err != nil {
+		t.Fatalf("request with the inbox prefix of the service: %v", err)
+	}
+	if string(reply.Data) != "ok" {
+		t.Errorf("reply = %q", reply.Data)
+	}
+
+	// Another service can listen neither on the shared inboxes nor on the inboxes of the crawler
+	violations := make(chan error, 2)
+	dataminer := connect("dataminer", nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+		violations <- err
+	}))
+	for _, subject := range []string{"_INBOX.>", "_INBOX_crawler.>"} {
+		if _, err := dataminer.SubscribeSync(subject); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dataminer.Flush()
+	for range 2 {
+		select {
+		case err := <-violations:
+			if !strings.Contains(strings.ToLower(err.Error()), "permissions violation") {
+				t.Errorf("error = %v, want a permissions violation", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("dataminer subscribed to inboxes of other services")
+		}
+	}
+}
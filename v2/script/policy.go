@@ -0,0 +1,421 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// traefikMiddlewareType matches the labels defining a middleware and gives its type
+var traefikMiddlewareType = regexp.MustCompile(`^traefik\.http\.middlewares\.([^.]+)\.([^.=]+)`)
+
+// PolicyViolation is a policy that does not hold for a service or a router
+type PolicyViolation struct {
+	Policy   string
+	Severity string
+	Service  string
+	Path     string
+	Message  string
+}
+
+// compiledPolicy is a policy with its expressions parsed
+type compiledPolicy struct {
+	PolicyConfig
+	When    policyNode
+	Require policyNode
+}
+
+// compilePolicies parses the expressions of the policies section
+func compilePolicies(policies []PolicyConfig) ([]compiledPolicy, []string) {
+	var compiled []compiledPolicy
+	var problems []string
+	for i, policy := range policies {
+		name := valueOrDefault(policy.Name, fmt.Sprintf("policy %d", i+1))
+		if policy.Name == "" {
+			problems = append(problems, fmt.Sprintf("%s: name is required", name))
+		}
+		if policy.For != "" && policy.For != "service" && policy.For != "router" {
+			problems = append(problems, fmt.Sprintf("%s: for must be service or router, not %q", name, policy.For))
+		}
+		if policy.Severity != "" && policy.Severity != "error" && policy.Severity != "warning" {
+			problems = append(problems, fmt.Sprintf("%s: severity must be error or warning, not %q", name, policy.Severity))
+		}
+
+		entry := compiledPolicy{PolicyConfig: policy}
+		entry.For = valueOrDefault(policy.For, "service")
+		entry.Severity = valueOrDefault(policy.Severity, "error")
+		if strings.TrimSpace(policy.Require) == "" {
+			problems = append(problems, fmt.Sprintf("%s: require is required", name))
+			continue
+		}
+		var err error
+		if entry.Require, err = parsePolicyExpr(policy.Require); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: require: %v", name, err))
+			continue
+		}
+		if policy.When != "" {
+			if entry.When, err = parsePolicyExpr(policy.When); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: when: %v", name, err))
+				continue
+			}
+		}
+		compiled = append(compiled, entry)
+	}
+
+	return compiled, problems
+}
+
+// policyStrings turns a short syntax list or a mapping of a compose service into a list of strings
+func policyStrings(value any) []any {
+	items := []any{}
+	switch typed := value.(type) {
+	case []any:
+		for _, item := range typed {
+			switch entry := item.(type) {
+			case map[string]any:
+				// Long syntax of ports and volumes
+				if entry["source"] != nil {
+					items = append(items, fmt.Sprintf("%v:%v", entry["source"], entry["target"]))
+				} else if entry["published"] != nil {
+					items = append(items, fmt.Sprintf("%v:%v", entry["published"], entry["target"]))
+				} else {
+					items = append(items, fmt.Sprint(entry["target"]))
+				}
+			default:
+				items = append(items, fmt.Sprint(entry))
+			}
+		}
+	case map[string]any:
+		keys := make([]string, 0, len(typed))
+		for key := range typed {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			items = append(items, key)
+		}
+	}
+
+	return items
+}
+
+// policyResourceValues returns the cpus and memory of a deploy.resources entry
+func policyResourceValues(resources map[string]any, key string) map[string]any {
+	values, _ := resources[key].(map[string]any)
+	result := map[string]any{"cpus": "", "memory": ""}
+	for field := range result {
+		if values[field] != nil {
+			result[field] = fmt.Sprint(values[field])
+		}
+	}
+
+	return result
+}
+
+// policyServiceModel builds the object a policy sees as service. Fields come from the rendered compose service
+// and from its entry in services-config.yaml, so unknown fields can be reported as mistakes.
+func policyServiceModel(name string, service DockerComposeService, serviceConfig *ServiceConfig, middlewareTypes map[string]string) map[string]any {
+	labels := make(map[string]any)
+	labelList := auditLabels(service)
+	for _, label := range labelList {
+		key, value, _ := strings.Cut(label, "=")
+		labels[key] = value
+	}
+	environment := make(map[string]any)
+	for _, entry := range auditEnvironment(service) {
+		environment[entry[0]] = entry[1]
+	}
+
+	routers := []any{}
+	for _, router := range serviceRouters(labelList) {
+		prefix := "traefik.http.routers." + router + "."
+		entrypoints := []any{}
+		if value, ok := labels[prefix+"entrypoints"].(string); ok {
+			for entrypoint := range strings.SplitSeq(value, ",") {
+				entrypoints = append(entrypoints, strings.TrimSpace(entrypoint))
+			}
+		}
+		middlewares := []any{}
+		if value, ok := labels[prefix+"middlewares"].(string); ok {
+			for reference := range strings.SplitSeq(value, ",") {
+				middleware, provider, _ := strings.Cut(strings.TrimSpace(reference), "@")
+				middlewares = append(middlewares, map[string]any{
+					"name":     middleware,
+					"provider": valueOrDefault(provider, "docker"),
+					"type":     middlewareTypes[middleware],
+				})
+			}
+		}
+		_, tls := labels[prefix+"tls.certresolver"]
+		routers = append(routers, map[string]any{
+			"name":        router,
+			"service":     name,
+			"rule":        labels[prefix+"rule"],
+			"entrypoints": entrypoints,
+			"middlewares": middlewares,
+			"tls":         tls || labels[prefix+"tls"] == "true",
+		})
+	}
+
+	deploy, _ := service.ExtraFields["deploy"].(map[string]any)
+	resources, _ := deploy["resources"].(map[string]any)
+	user := ""
+	if service.ExtraFields["user"] != nil {
+		user = fmt.Sprint(service.ExtraFields["user"])
+	}
+	privileged, _ := service.ExtraFields["privileged"].(bool)
+	profiles := []any{}
+	for _, profile := range service.Profiles {
+		profiles = append(profiles, profile)
+	}
+
+	model := map[string]any{
+		"name":        name,
+		"configured":  serviceConfig != nil,
+		"kind":        "",
+		"groups":      []any{},
+		"prefix":      "",
+		"domain":      "",
+		"image":       service.Image,
+		"build":       service.Build != nil,
+		"networks":    policyStrings(service.Networks),
+		"ports":       policyStrings(service.Ports),
+		"volumes":     policyStrings(service.Volumes),
+		"depends_on":  policyStrings(service.DependsOn),
+		"profiles":    profiles,
+		"environment": environment,
+		"labels":      labels,
+		"routers":     routers,
+		"user":        user,
+		"privileged":  privileged,
+		"restart":     service.Restart,
+		"resources": map[string]any{
+			"limits":       policyResourceValues(resources, "limits"),
+			"reservations": policyResourceValues(resources, "reservations"),
+		},
+	}
+	if serviceConfig != nil {
+		groups := []any{}
+		for _, group := range serviceConfig.Groups {
+			groups = append(groups, group)
+		}
+		model["kind"] = getServiceKind(*serviceConfig)
+		model["groups"] = groups
+		model["prefix"] = serviceConfig.Prefix
+		model["domain"] = serviceConfig.Domain
+	}
+
+	return model
+}
+
+// policyMiddlewareTypes returns the type of the middlewares of the catalog and of those defined by labels
+func policyMiddlewareTypes(config Config, dockerCompose DockerComposeConfig) map[string]string {
+	types := make(map[string]string)
+	for _, middleware := range config.Middlewares {
+		types[middleware.Name] = middleware.Type
+	}
+	for _, service := range dockerCompose.Services {
+		for _, label := range auditLabels(service) {
+			if match := traefikMiddlewareType.FindStringSubmatch(label); match != nil {
+				types[match[1]] = strings.ToLower(match[2])
+			}
+		}
+	}
+
+	return types
+}
+
+// policyPath locates a violation in the compose file from the first field the requirement reads
+func policyPath(policy compiledPolicy, service string, router string) string {
+	path := "services." + service
+	field := policyRootField(policy.Require, policy.For)
+	if policy.For == "router" {
+		path += ".labels.traefik.http.routers." + router
+		if field != "" && field != "name" && field != "service" {
+			path += "." + field
+		}
+		return path
+	}
+
+	switch field {
+	case "":
+		return path
+	case "routers":
+		return path + ".labels"
+	case "resources":
+		return path + ".deploy.resources"
+	case "kind", "groups", "prefix", "domain", "configured":
+		// Read from services-config.yaml rather than the compose file
+		return path
+	}
+	return path + "." + field
+}
+
+// evaluatePolicies checks the policies against the services of a compose model. Expressions that fail to evaluate,
+// for example by reading an unknown field, are returned as problems of the policies section.
+func evaluatePolicies(config Config, dockerCompose DockerComposeConfig) ([]PolicyViolation, []string) {
+	policies, problems := compilePolicies(config.Policies)
+	if len(problems) > 0 {
+		return nil, problems
+	}
+
+	configured := make(map[string]*ServiceConfig)
+	for _, service := range getAllServiceConfigs(config) {
+		configured[service.Name] = &service
+	}
+	middlewareTypes := policyMiddlewareTypes(config, dockerCompose)
+
+	names := make([]string, 0, len(dockerCompose.Services))
+	for name := range dockerCompose.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var violations []PolicyViolation
+	for _, policy := range policies {
+		failed := false
+		for _, name := range names {
+			serviceConfig := configured[name]
+			if serviceConfig == nil {
+				// Release variants are checked as the service they belong to
+				for _, color := range releaseColors {
+					if base, ok := strings.CutSuffix(name, "-"+color); ok && configured[base] != nil {
+						serviceConfig = configured[base]
+					}
+				}
+			}
+			service := policyServiceModel(name, dockerCompose.Services[name], serviceConfig, middlewareTypes)
+
+			scopes := []map[string]any{{"service": service}}
+			if policy.For == "router" {
+				scopes = nil
+				for _, router := range service["routers"].([]any) {
+					scopes = append(scopes, map[string]any{"service": service, "router": router})
+				}
+			}
+
+			for _, scope := range scopes {
+				if policy.When != nil {
+					applies, err := policyBool(policy.When, scope)
+					if err != nil {
+						problems = append(problems, fmt.Sprintf("%s: when: %v (service %s)", policy.Name, err, name))
+						failed = true
+						break
+					}
+					if !applies {
+						continue
+					}
+				}
+				holds, err := policyBool(policy.Require, scope)
+				if err != nil {
+					problems = append(problems, fmt.Sprintf("%s: require: %v (service %s)", policy.Name, err, name))
+					failed = true
+					break
+				}
+				if holds {
+					continue
+				}
+
+				router := ""
+				message := valueOrDefault(policy.Description, "require "+policy.PolicyConfig.Require+" is false")
+				if policy.For == "router" {
+					router = scope["router"].(map[string]any)["name"].(string)
+					message = fmt.Sprintf("router %s: %s", router, message)
+				}
+				violations = append(violations, PolicyViolation{
+					Policy:   policy.Name,
+					Severity: policy.Severity,
+					Service:  name,
+					Path:     policyPath(policy, name, router),
+					Message:  message,
+				})
+			}
+			if failed {
+				// One report per broken policy is enough, the error repeats on every service
+				break
+			}
+		}
+	}
+
+	return violations, problems
+}
+
+// printPolicyViolations prints the violations and returns the number of errors and warnings
+func printPolicyViolations(violations []PolicyViolation) (int, int) {
+	errors, warnings := 0, 0
+	for _, violation := range violations {
+		fmt.Printf("%-8s %-30s %-60s %s\n", strings.ToUpper(violation.Severity), violation.Policy, violation.Path, violation.Message)
+		if violation.Severity == "error" {
+			errors++
+		} else {
+			warnings++
+		}
+	}
+
+	return errors, warnings
+}
+
+// enforcePolicies checks the policies on the compose model about to be written by update, and reports whether the
+// output may be written: invalid policies and error violations stop it, warnings are only printed
+func enforcePolicies(config Config, dockerCompose DockerComposeConfig) bool {
+	if len(config.Policies) == 0 {
+		return true
+	}
+
+	violations, problems := evaluatePolicies(config, dockerCompose)
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Printf("Error: invalid policy: %s\n", problem)
+		}
+		return false
+	}
+	errors, warnings := printPolicyViolations(violations)
+	if errors > 0 {
+		fmt.Printf("%d policy errors, %d warnings\n", errors, warnings)
+		return false
+	}
+	fmt.Printf("  Checked %d policies: %d warnings\n", len(config.Policies), warnings)
+
+	return true
+}
+
+// CheckPolicies evaluates the policies against a rendered compose or stack file
+func CheckPolicies(configFile string, composeFile string, strict bool) {
+	scriptDir, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("Error getting current directory: %v\n", err)
+		return
+	}
+	config := getConfig(resolveFilePath(configFile, scriptDir, scriptDir))
+	if len(config.Policies) == 0 {
+		fmt.Println("No policies declared, nothing to check.")
+		return
+	}
+
+	composeFile = resolveFilePath(composeFile, scriptDir, scriptDir)
+	content, err := os.ReadFile(composeFile)
+	if err != nil {
+		fmt.Printf("Error reading %s: %v\n", composeFile, err)
+		os.Exit(1)
+	}
+	var dockerCompose DockerComposeConfig
+	if err := yaml.Unmarshal(content, &dockerCompose); err != nil {
+		fmt.Printf("Error parsing %s: %v\n", composeFile, err)
+		os.Exit(1)
+	}
+
+	violations, problems := evaluatePolicies(config, dockerCompose)
+	if len(problems) > 0 {
+		fmt.Printf("Invalid policies:\n  %s\n", strings.Join(problems, "\n  "))
+		os.Exit(1)
+	}
+	errors, warnings := printPolicyViolations(violations)
+	fmt.Printf("Checked %d policies on %d services: %d errors, %d warnings\n", len(config.Policies), len(dockerCompose.Services), errors, warnings)
+	if errors > 0 || (strict && warnings > 0) {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,826 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The policy expressions are a subset of CEL: literals, field selection, indexing, the operators
+// ! - * / % + < <= > >= == != in && ||, the functions size and has, the string methods contains, startsWith,
+// endsWith and matches, and the list macros exists, all, exists_one, filter and map.
+
+// policyToken is a lexical token of a policy expression
+type policyToken struct {
+	Kind  string // ident, number, string, op or eof
+	Value string
+	Pos   int
+}
+
+// lexPolicy splits a policy expression into tokens
+func lexPolicy(expr string) ([]policyToken, error) {
+	var tokens []policyToken
+	runes := []rune(expr)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"' || r == '\'':
+			start := i
+			i++
+			var value strings.Builder
+			for i < len(runes) && runes[i] != r {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+					switch runes[i] {
+					case 'n':
+						value.WriteRune('\n')
+					case 't':
+						value.WriteRune('\t')
+					default:
+						value.WriteRune(runes[i])
+					}
+				} else {
+					value.WriteRune(runes[i])
+				}
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			i++
+			tokens = append(tokens, policyToken{Kind: "string", Value: value.String(), Pos: start})
+		case unicode.IsDigit(r):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			value := string(runes[start:i])
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				return nil, fmt.Errorf("invalid number %q at position %d", value, start)
+			}
+			tokens = append(tokens, policyToken{Kind: "number", Value: value, Pos: start})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, policyToken{Kind: "ident", Value: string(runes[start:i]), Pos: start})
+		default:
+			start := i
+			operator := string(r)
+			if i+1 < len(runes) {
+				switch pair := string(runes[i : i+2]); pair {
+				case "==", "!=", ">=", "<=", "&&", "||":
+					operator = pair
+				}
+			}
+			if len(operator) == 1 && !strings.Contains("()[],.!<>+-*/%", operator) {
+				return nil, fmt.Errorf("unexpected character %q at position %d", r, start)
+			}
+			i += len(operator)
+			tokens = append(tokens, policyToken{Kind: "op", Value: operator, Pos: start})
+		}
+	}
+
+	return append(tokens, policyToken{Kind: "eof", Pos: len(runes)}), nil
+}
+
+// policyNode is a node of a parsed policy expression
+type policyNode interface {
+	eval(scope map[string]any) (any, error)
+}
+
+type (
+	policyLiteral struct{ Value any }
+	policyIdent   struct{ Name string }
+	policySelect  struct {
+		Operand policyNode
+		Field   string
+	}
+	policyIndex struct{ Operand, Index policyNode }
+	policyList  struct{ Items []policyNode }
+	policyUnary struct {
+		Op      string
+		Operand policyNode
+	}
+	policyBinary struct {
+		Op          string
+		Left, Right policyNode
+	}
+	policyCall struct {
+		Target policyNode // nil for global functions
+		Name   string
+		Args   []policyNode
+	}
+	policyMacro struct {
+		Target   policyNode
+		Name     string
+		Variable string
+		Body     policyNode
+	}
+	policyHas struct{ Select *policySelect }
+)
+
+// policyBinaryPrecedence orders the binary operators, higher binds tighter
+var policyBinaryPrecedence = map[string]int{
+	"||": 1, "&&": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3, "in": 3,
+	"+": 4, "-": 4,
+	"*": 5, "/": 5, "%": 5,
+}
+
+// policyParser is a recursive descent parser of policy expressions
+type policyParser struct {
+	tokens []policyToken
+	pos    int
+}
+
+func (p *policyParser) peek() policyToken {
+	return p.tokens[p.pos]
+}
+
+func (p *policyParser) next() policyToken {
+	token := p.tokens[p.pos]
+	if token.Kind != "eof" {
+		p.pos++
+	}
+	return token
+}
+
+func (p *policyParser) is(value string) bool {
+	token := p.peek()
+	return (token.Kind == "op" || token.Kind == "ident") && token.Value == value
+}
+
+func (p *policyParser) expect(value string) error {
+	if !p.is(value) {
+		token := p.peek()
+		return fmt.Errorf("expected %q at position %d, got %s", value, token.Pos, describePolicyToken(token))
+	}
+	p.next()
+	return nil
+}
+
+// describePolicyToken names a token in error messages
+func describePolicyToken(token policyToken) string {
+	if token.Kind == "eof" {
+		return "end of expression"
+	}
+	return fmt.Sprintf("%q", token.Value)
+}
+
+// parsePolicyExpr parses a policy expression
+func parsePolicyExpr(expr string) (policyNode, error) {
+	tokens, err := lexPolicy(expr)
+	if err != nil {
+		return nil, err
+	}
+	parser := &policyParser{tokens: tokens}
+	node, err := parser.parseBinary(1)
+	if err != nil {
+		return nil, err
+	}
+	if token := parser.peek(); token.Kind != "eof" {
+		return nil, fmt.Errorf("unexpected %s at position %d", describePolicyToken(token), token.Pos)
+	}
+
+	return node, nil
+}
+
+// parseBinary parses binary operators of at least the given precedence, all of them associate to the left
+func (p *policyParser) parseBinary(minPrecedence int) (policyNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		token := p.peek()
+		precedence, ok := policyBinaryPrecedence[token.Value]
+		if (token.Kind != "op" && token.Kind != "ident") || !ok || precedence < minPrecedence {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseBinary(precedence + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &policyBinary{Op: token.Value, Left: left, Right: right}
+	}
+}
+
+func (p *policyParser) parseUnary() (policyNode, error) {
+	if p.is("!") || p.is("-") {
+		op := p.next().Value
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &policyUnary{Op: op, Operand: operand}, nil
+	}
+
+	return p.parseMember()
+}
+
+// policyMacros are the list methods taking a variable and an expression instead of values
+var policyMacros = map[string]bool{"exists": true, "all": true, "exists_one": true, "filter": true, "map": true}
+
+func (p *policyParser) parseMember() (policyNode, error) {
+	node, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		switch {
+		case p.is("."):
+			p.next()
+			field := p.next()
+			if field.Kind != "ident" {
+				return nil, fmt.Errorf("expected a field name at position %d, got %s", field.Pos, describePolicyToken(field))
+			}
+			if !p.is("(") {
+				node = &policySelect{Operand: node, Field: field.Value}
+				continue
+			}
+			p.next()
+			if policyMacros[field.Value] {
+				variable := p.next()
+				if variable.Kind != "ident" {
+					return nil, fmt.Errorf("%s expects a variable name at position %d", field.Value, variable.Pos)
+				}
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+				body, err := p.parseBinary(1)
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(")"); err != nil {
+					return nil, err
+				}
+				node = &policyMacro{Target: node, Name: field.Value, Variable: variable.Value, Body: body}
+				continue
+			}
+			args, err := p.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			node = &policyCall{Target: node, Name: field.Value, Args: args}
+		case p.is("["):
+			p.next()
+			index, err := p.parseBinary(1)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			node = &policyIndex{Operand: node, Index: index}
+		default:
+			return node, nil
+		}
+	}
+}
+
+// parseArgs parses the arguments of a call after its opening parenthesis
+func (p *policyParser) parseArgs() ([]policyNode, error) {
+	var args []policyNode
+	for !p.is(")") {
+		arg, err := p.parseBinary(1)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if !p.is(",") {
+			break
+		}
+		p.next()
+	}
+
+	return args, p.expect(")")
+}
+
+func (p *policyParser) parsePrimary() (policyNode, error) {
+	token := p.next()
+	switch token.Kind {
+	case "string":
+		return &policyLiteral{Value: token.Value}, nil
+	case "number":
+		value, _ := strconv.ParseFloat(token.Value, 64)
+		return &policyLiteral{Value: value}, nil
+	case "ident":
+		switch token.Value {
+		case "true", "false":
+			return &policyLiteral{Value: token.Value == "true"}, nil
+		case "null":
+			return &policyLiteral{Value: nil}, nil
+		case "in":
+			return nil, fmt.Errorf("unexpected \"in\" at position %d", token.Pos)
+		}
+		if !p.is("(") {
+			return &policyIdent{Name: token.Value}, nil
+		}
+		p.next()
+		args, err := p.parseArgs()
+		if err != nil {
+			return nil, err
+		}
+		switch token.Value {
+		case "has":
+			var selection *policySelect
+			if len(args) == 1 {
+				selection, _ = args[0].(*policySelect)
+			}
+			if selection == nil {
+				return nil, fmt.Errorf("has at position %d expects a field selection like has(service.user)", token.Pos)
+			}
+			return &policyHas{Select: selection}, nil
+		case "size":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("size at position %d expects one argument", token.Pos)
+			}
+		default:
+			return nil, fmt.Errorf("unknown function %s at position %d", token.Value, token.Pos)
+		}
+		return &policyCall{Name: token.Value, Args: args}, nil
+	case "op":
+		switch token.Value {
+		case "(":
+			node, err := p.parseBinary(1)
+			if err != nil {
+				return nil, err
+			}
+			return node, p.expect(")")
+		case "[":
+			list := &policyList{}
+			for !p.is("]") {
+				item, err := p.parseBinary(1)
+				if err != nil {
+					return nil, err
+				}
+				list.Items = append(list.Items, item)
+				if !p.is(",") {
+					break
+				}
+				p.next()
+			}
+			return list, p.expect("]")
+		}
+	}
+
+	return nil, fmt.Errorf("unexpected %s at position %d", describePolicyToken(token), token.Pos)
+}
+
+// policyNumber converts the numeric types decoded from YAML, JSON or built by Go code to float64, so an int of the
+// model compares equal to a number literal of an expression
+func policyNumber(value any) (float64, bool) {
+	number := reflect.ValueOf(value)
+	switch number.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(number.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(number.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return number.Float(), true
+	}
+
+	return 0, false
+}
+
+// policyEqual compares two values with numbers normalised to float64, in lists and maps as well
+func policyEqual(left any, right any) bool {
+	if leftNumber, ok := policyNumber(left); ok {
+		rightNumber, ok := policyNumber(right)
+		return ok && leftNumber == rightNumber
+	}
+
+	switch typed := left.(type) {
+	case []any:
+		other, ok := right.([]any)
+		if !ok || len(other) != len(typed) {
+			return false
+		}
+		for i := range typed {
+			if !policyEqual(typed[i], other[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		other, ok := right.(map[string]any)
+		if !ok || len(other) != len(typed) {
+			return false
+		}
+		for key, value := range typed {
+			otherValue, found := other[key]
+			if !found || !policyEqual(value, otherValue) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return reflect.DeepEqual(left, right)
+}
+
+// policyTypeName names the type of a value in error messages
+func policyTypeName(value any) string {
+	if _, ok := policyNumber(value); ok {
+		return "number"
+	}
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case []any:
+		return "list"
+	case map[string]any:
+		return "map"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func (n *policyLiteral) eval(scope map[string]any) (any, error) {
+	return n.Value, nil
+}
+
+func (n *policyIdent) eval(scope map[string]any) (any, error) {
+	value, ok := scope[n.Name]
+	if !ok {
+		return nil, fmt.Errorf("unknown variable %s", n.Name)
+	}
+	return value, nil
+}
+
+// selectField returns a field of a map, unknown fields are errors so typos in policies do not pass silently
+func selectField(value any, field string) (any, error) {
+	fields, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("cannot select .%s on a %s", field, policyTypeName(value))
+	}
+	selected, ok := fields[field]
+	if !ok {
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("no field %s, available: %s", field, strings.Join(names, ", "))
+	}
+	return selected, nil
+}
+
+func (n *policySelect) eval(scope map[string]any) (any, error) {
+	operand, err := n.Operand.eval(scope)
+	if err != nil {
+		return nil, err
+	}
+	return selectField(operand, n.Field)
+}
+
+func (n *policyHas) eval(scope map[string]any) (any, error) {
+	operand, err := n.Select.Operand.eval(scope)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := operand.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("has: cannot select .%s on a %s", n.Select.Field, policyTypeName(operand))
+	}
+	value, ok := fields[n.Select.Field]
+	return ok && value != nil, nil
+}
+
+func (n *policyIndex) eval(scope map[string]any) (any, error) {
+	operand, err := n.Operand.eval(scope)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.Index.eval(scope)
+	if err != nil {
+		return nil, err
+	}
+
+	switch typed := operand.(type) {
+	case []any:
+		position, ok := policyNumber(index)
+		if !ok || position != float64(int(position)) || position < 0 || int(position) >= len(typed) {
+			return nil, fmt.Errorf("invalid index %v of a list of %d items", index, len(typed))
+		}
+		return typed[int(position)], nil
+	case map[string]any:
+		key, ok := index.(string)
+		if !ok {
+			return nil, fmt.Errorf("map keys are strings, got a %s", policyTypeName(index))
+		}
+		// Indexing is how optional keys such as labels are read, a missing key is null
+		return typed[key], nil
+	}
+
+	return nil, fmt.Errorf("cannot index a %s", policyTypeName(operand))
+}
+
+func (n *policyList) eval(scope map[string]any) (any, error) {
+	items := make([]any, 0, len(n.Items))
+	for _, item := range n.Items {
+		value, err := item.eval(scope)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, value)
+	}
+	return items, nil
+}
+
+// policyBool evaluates a node that must be a bool
+func policyBool(node policyNode, scope map[string]any) (bool, error) {
+	value, err := node.eval(scope)
+	if err != nil {
+		return false, err
+	}
+	result, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected a bool, got a %s", policyTypeName(value))
+	}
+	return result, nil
+}
+
+func (n *policyUnary) eval(scope map[string]any) (any, error) {
+	if n.Op == "!" {
+		value, err := policyBool(n.Operand, scope)
+		return !value, err
+	}
+
+	value, err := n.Operand.eval(scope)
+	if err != nil {
+		return nil, err
+	}
+	number, ok := policyNumber(value)
+	if !ok {
+		return nil, fmt.Errorf("cannot negate a %s", policyTypeName(value))
+	}
+	return -number, nil
+}
+
+func (n *policyBinary) eval(scope map[string]any) (any, error) {
+	switch n.Op {
+	case "&&", "||":
+		left, err := policyBool(n.Left, scope)
+		if err != nil || left == (n.Op == "||") {
+			return left, err
+		}
+		return policyBool(n.Right, scope)
+	}
+
+	left, err := n.Left.eval(scope)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.Right.eval(scope)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.Op {
+	case "==":
+		return policyEqual(left, right), nil
+	case "!=":
+		return !policyEqual(left, right), nil
+	case "in":
+		switch container := right.(type) {
+		case []any:
+			for _, item := range container {
+				if policyEqual(item, left) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case map[string]any:
+			key, ok := left.(string)
+			_, found := container[key]
+			return ok && found, nil
+		}
+		return nil, fmt.Errorf("in expects a list or a map, got a %s", policyTypeName(right))
+	case "+":
+		switch typed := left.(type) {
+		case string:
+			if other, ok := right.(string); ok {
+				return typed + other, nil
+			}
+		case []any:
+			if other, ok := right.([]any); ok {
+				return append(append([]any{}, typed...), other...), nil
+			}
+		}
+	case "<", "<=", ">", ">=":
+		if leftString, ok := left.(string); ok {
+			if rightString, ok := right.(string); ok {
+				comparison := strings.Compare(leftString, rightString)
+				return map[string]bool{"<": comparison < 0, "<=": comparison <= 0, ">": comparison > 0, ">=": comparison >= 0}[n.Op], nil
+			}
+		}
+	}
+
+	leftNumber, leftOK := policyNumber(left)
+	rightNumber, rightOK := policyNumber(right)
+	if !leftOK || !rightOK {
+		return nil, fmt.Errorf("operator %s does not apply to a %s and a %s", n.Op, policyTypeName(left), policyTypeName(right))
+	}
+	switch n.Op {
+	case "+":
+		return leftNumber + rightNumber, nil
+	case "-":
+		return leftNumber - rightNumber, nil
+	case "*":
+		return leftNumber * rightNumber, nil
+	case "/", "%":
+		if rightNumber == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		if n.Op == "/" {
+			return leftNumber / rightNumber, nil
+		}
+		return float64(int64(leftNumber) % int64(rightNumber)), nil
+	case "<":
+		return leftNumber < rightNumber, nil
+	case "<=":
+		return leftNumber <= rightNumber, nil
+	case ">":
+		return leftNumber > rightNumber, nil
+	}
+	return leftNumber >= rightNumber, nil
+}
+
+func (n *policyCall) eval(scope map[string]any) (any, error) {
+	var target any
+	if n.Target != nil {
+		var err error
+		if target, err = n.Target.eval(scope); err != nil {
+			return nil, err
+		}
+	}
+	args := make([]any, 0, len(n.Args))
+	for _, arg := range n.Args {
+		value, err := arg.eval(scope)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, value)
+	}
+
+	// size is the only global function besides the has macro, and can be called as a method as well
+	if n.Target == nil || (n.Name == "size" && len(args) == 0) {
+		sized := target
+		if n.Target == nil {
+			sized = args[0]
+		}
+		switch typed := sized.(type) {
+		case string:
+			return float64(len([]rune(typed))), nil
+		case []any:
+			return float64(len(typed)), nil
+		case map[string]any:
+			return float64(len(typed)), nil
+		}
+		return nil, fmt.Errorf("size expects a string, list or map, got a %s", policyTypeName(sized))
+	}
+
+	text, ok := target.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s expects a string, got a %s", n.Name, policyTypeName(target))
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("%s expects one argument", n.Name)
+	}
+	argument, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("the argument of %s must be a string, got a %s", n.Name, policyTypeName(args[0]))
+	}
+
+	switch n.Name {
+	case "contains":
+		return strings.Contains(text, argument), nil
+	case "startsWith":
+		return strings.HasPrefix(text, argument), nil
+	case "endsWith":
+		return strings.HasSuffix(text, argument), nil
+	case "matches":
+		pattern, err := regexp.Compile(argument)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %v", argument, err)
+		}
+		return pattern.MatchString(text), nil
+	}
+
+	return nil, fmt.Errorf("unknown method %s", n.Name)
+}
+
+func (n *policyMacro) eval(scope map[string]any) (any, error) {
+	target, err := n.Target.eval(scope)
+	if err != nil {
+		return nil, err
+	}
+	var items []any
+	switch typed := target.(type) {
+	case []any:
+		items = typed
+	case map[string]any:
+		// Macros over a map iterate over its keys
+		for key := range typed {
+			items = append(items, key)
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i].(string) < items[j].(string) })
+	default:
+		return nil, fmt.Errorf("%s expects a list or a map, got a %s", n.Name, policyTypeName(target))
+	}
+
+	inner := make(map[string]any, len(scope)+1)
+	for name, value := range scope {
+		inner[name] = value
+	}
+	matches := 0
+	var results []any
+	for _, item := range items {
+		inner[n.Variable] = item
+		if n.Name == "map" {
+			value, err := n.Body.eval(inner)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, value)
+			continue
+		}
+		matched, err := policyBool(n.Body, inner)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			matches++
+			results = append(results, item)
+		}
+	}
+
+	switch n.Name {
+	case "exists":
+		return matches > 0, nil
+	case "all":
+		return matches == len(items), nil
+	case "exists_one":
+		return matches == 1, nil
+	}
+	if results == nil {
+		results = []any{}
+	}
+	return results, nil
+}
+
+// policyRootField returns the first field selected on a variable by an expression, to locate a violation
+func policyRootField(node policyNode, variable string) string {
+	switch typed := node.(type) {
+	case *policySelect:
+		if ident, ok := typed.Operand.(*policyIdent); ok && ident.Name == variable {
+			return typed.Field
+		}
+		return policyRootField(typed.Operand, variable)
+	case *policyHas:
+		return policyRootField(typed.Select, variable)
+	case *policyIndex:
+		return valueOrDefault(policyRootField(typed.Operand, variable), policyRootField(typed.Index, variable))
+	case *policyUnary:
+		return policyRootField(typed.Operand, variable)
+	case *policyBinary:
+		return valueOrDefault(policyRootField(typed.Left, variable), policyRootField(typed.Right, variable))
+	case *policyList:
+		for _, item := range typed.Items {
+			if field := policyRootField(item, variable); field != "" {
+				return field
+			}
+		}
+	case *policyCall:
+		if typed.Target != nil {
+			if field := policyRootField(typed.Target, variable); field != "" {
+				return field
+			}
+		}
+		for _, arg := range typed.Args {
+			if field := policyRootField(arg, variable); field != "" {
+				return field
+			}
+		}
+	case *policyMacro:
+		return valueOrDefault(policyRootField(typed.Target, variable), policyRootField(typed.Body, variable))
+	}
+
+	return ""
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPolicyExpressions(t *testing.T) {
+	// Numbers of the model are ints as decoded from YAML, literals of the expressions are float64
+	scope := map[string]any{"service": map[string]any{
+		"name":     "api",
+		"replicas": 2,
+		"pair":     []any{1, int64(2)},
+		"ports":    []any{8080},
+		"networks": []any{"web", "backend"},
+		"labels":   map[string]any{"traefik.enable": "true", "traefik.http.routers.api.rule": "Host(`api.localhost`)"},
+		"user":     "",
+		"limits":   map[string]any{"memory": nil},
+	}}
+
+	tests := []struct {
+		expr  string
+		want  any
+		error string // part of the expected parse or evaluation error
+	}{
+		// Precedence and associativity
+		{expr: `1 + 2 * 3 == 7`, want: true},
+		{expr: `(1 + 2) * 3`, want: 9.0},
+		{expr: `10 - 4 - 3`, want: 3.0},
+		{expr: `8 / 2 / 2`, want: 2.0},
+		{expr: `7 % 4 + 1`, want: 4.0},
+		{expr: `-2 * 3`, want: -6.0},
+		{expr: `true || false && false`, want: true},
+		{expr: `!false && false`, want: false},
+		{expr: `1 < 2 == true`, want: true},
+		{expr: `"a" + "b" == "ab" && "a" < "b"`, want: true},
+
+		// Numbers of the model against literals
+		{expr: `service.replicas == 2`, want: true},
+		{expr: `service.replicas != 2`, want: false},
+		{expr: `service.replicas >= 2.0 && service.replicas < 3`, want: true},
+		{expr: `service.replicas + 1 == 3`, want: true},
+		{expr: `-service.replicas`, want: -2.0},
+		{expr: `service.pair == [1, 2]`, want: true},
+		{expr: `service.ports[0] == 8080`, want: true},
+		{expr: `service.networks[service.replicas - 1]`, want: "backend"},
+		{expr: `service.replicas == "2"`, want: false},
+
+		// in
+		{expr: `"web" in service.networks`, want: true},
+		{expr: `"frontend" in service.networks`, want: false},
+		{expr: `8080 in service.ports`, want: true},
+		{expr: `2 in service.pair`, want: true},
+		{expr: `"traefik.enable" in service.labels`, want: true},
+		{expr: `1 in service.labels`, want: false},
+		{expr: `"a" in service.name`, error: "in expects a list or a map"},
+
+		// Macros
+		{expr: `service.networks.exists(n, n == "web")`, want: true},
+		{expr: `service.networks.all(n, n.startsWith("w"))`, want: false},
+		{expr: `service.networks.exists_one(n, n.endsWith("end"))`, want: true},
+		{expr: `service.networks.filter(n, n != "web")`, want: []any{"backend"}},
+		{expr: `service.networks.map(n, size(n))`, want: []any{3.0, 7.0}},
+		{expr: `service.labels.exists(key, key.startsWith("traefik.http.routers."))`, want: true},
+		{expr: `[].all(x, x > 0)`, want: true},
+		{expr: `service.networks.all(n, n)`, error: "expected a bool"},
+		{expr: `service.name.exists(c, c == "a")`, error: "exists expects a list or a map"},
+		{expr: `service.networks.exists(1, true)`, error: "expects a variable name"},
+
+		// has, indexing optional keys and size
+		{expr: `has(service.user)`, want: true},
+		{expr: `has(service.deploy)`, want: false},
+		{expr: `has(service.limits.memory)`, want: false},
+		{expr: `has(service)`, error: "expects a field selection"},
+		{expr: `service.labels["traefik.docker.network"] == null`, want: true},
+		{expr: `size(service.name) == 3 && service.networks.size() == 2`, want: true},
+		{expr: `service.networks[2]`, error: "invalid index 2"},
+
+		// String methods
+		{expr: `service.name.matches("^a[a-z]+$")`, want: true},
+		{expr: `service.labels["traefik.http.routers.api.rule"].contains("api.localhost")`, want: true},
+		{expr: `service.name.contains(1)`, error: "must be a string"},
+		{expr: `service.name.matches("(")`, error: "invalid regular expression"},
+
+		// Unknown fields, variables and functions
+		{expr: `service.replica == 2`, error: "no field replica, available: labels, limits, name"},
+		{expr: `service.name.length`, error: "cannot select .length on a string"},
+		{expr: `svc.name == "api"`, error: "unknown variable svc"},
+		{expr: `len(service.name)`, error: "unknown function len"},
+		{expr: `service.name.trim()`, error: "trim expects one argument"},
+
+		// Type and syntax errors
+		{expr: `1 / 0`, error: "division by zero"},
+		{expr: `"a" + 1`, error: "operator + does not apply to a string and a number"},
+		{expr: `service.replicas && true`, error: "expected a bool, got a number"},
+		{expr: `service.name ==`, error: "unexpected end of expression"},
+		{expr: `(1 + 2`, error: "expected \")\""},
+		{expr: `"api`, error: "unterminated string"},
+		{expr: `1 # 2`, error: "unexpected character"},
+		{expr: `1.2.3`, error: "invalid number"},
+	}
+	for _, test := range tests {
+		node, err := parsePolicyExpr(test.expr)
+		var value any
+		if err == nil {
+			value, err = node.eval(scope)
+		}
+		if test.error != "" {
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("%s: error = %v, want %q", test.expr, err, test.error)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(value, test.want) {
+			t.Errorf("%s = %#v, %v, want %#v", test.expr, value, err, test.want)
+		}
+	}
+}
+
+func TestPolicyEqual(t *testing.T) {
+	tests := []struct {
+		left, right any
+		want        bool
+	}{
+		{2, 2.0, true},
+		{uint8(2), int64(2), true},
+		{float32(0.5), 0.5, true},
+		{2, "2", false},
+		{nil, nil, true},
+		{nil, 0.0, false},
+		{[]any{1, "a"}, []any{1.0, "a"}, true},
+		{[]any{1}, []any{1.0, 2.0}, false},
+		{map[string]any{"port": 80}, map[string]any{"port": 80.0}, true},
+		{map[string]any{"port": 80}, map[string]any{"target": 80.0}, false},
+	}
+	for _, test := range tests {
+		if got := policyEqual(test.left, test.right); got != test.want {
+			t.Errorf("policyEqual(%#v, %#v) = %v, want %v", test.left, test.right, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// testPolicyCompose decodes a compose file as update hands it to the policies
+func testPolicyCompose(t *testing.T, content string) DockerComposeConfig {
+	t.Helper()
+	var dockerCompose DockerComposeConfig
+	if err := yaml.Unmarshal([]byte(content), &dockerCompose); err != nil {
+		t.Fatal(err)
+	}
+
+	return dockerCompose
+}
+
+func TestCompilePolicies(t *testing.T) {
+	_, problems := compilePolicies([]PolicyConfig{
+		{Require: "true"},
+		{Name: "scope", For: "network", Require: "true"},
+		{Name: "severity", Severity: "fatal", Require: "true"},
+		{Name: "empty"},
+		{Name: "syntax", Require: "service.name =="},
+		{Name: "when", When: "has(service)", Require: "true"},
+	})
+	want := []string{
+		"policy 1: name is required",
+		"scope: for must be service or router",
+		"severity: severity must be error or warning",
+		"empty: require is required",
+		"syntax: require: unexpected end of expression",
+		"when: when: has at position 0 expects a field selection",
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("problems = %v, want %d", problems, len(want))
+	}
+	for i := range want {
+		if !strings.HasPrefix(problems[i], want[i]) {
+			t.Errorf("problem %d = %s, want %s", i, problems[i], want[i])
+		}
+	}
+}
+
+func TestEvaluatePolicies(t *testing.T) {
+	dockerCompose := testPolicyCompose(t, `services:
+  api:
+    image: registry.example.com/api:1.4
+    networks: [traefik-network]
+    labels:
+      - traefik.http.routers.api.rule=Host(`+"`api.localhost`"+`)
+      - traefik.http.routers.api-admin.rule=Host(`+"`api.localhost`"+`) && PathPrefix(`+"`/admin`"+`)
+      - traefik.http.routers.api-admin.middlewares=admin-auth@file
+    deploy:
+      replicas: 2
+      resources:
+        limits: {memory: 256M}
+  crawler:
+    image: registry.example.com/crawler:1.0
+    networks: [traefik-network, internal]
+    labels:
+      - traefik.http.routers.crawler-admin.rule=PathPrefix(`+"`/admin`"+`)
+      - traefik.http.routers.crawler-admin.middlewares=compress
+      - traefik.http.middlewares.compress.compress=true
+`)
+	config := Config{
+		Services: []ServiceConfig{
+			{Name: "api", Prefix: "API_"},
+			{Name: "crawler", Prefix: "CRAWLER_", Groups: []string{"crawlers"}},
+		},
+		Middlewares: []MiddlewareConfig{{Name: "admin-auth", Type: "basicauth", Users: []string{"admin"}}},
+		Policies: []PolicyConfig{
+			{
+				Name:    "admin-routes-need-auth",
+				For:     "router",
+				When:    `router.rule.contains("/admin")`,
+				Require: `router.middlewares.exists(m, m.type in ["basicauth", "forwardauth"])`,
+			},
+			{
+				Name:        "crawlers-off-traefik",
+				Description: "crawlers must not join traefik-network",
+				When:        `"crawlers" in service.groups`,
+				Require:     `!("traefik-network" in service.networks)`,
+			},
+			{
+				Name:     "memory-limits",
+				Severity: "warning",
+				Require:  `service.resources.limits.memory != ""`,
+			},
+		},
+	}
+
+	violations, problems := evaluatePolicies(config, dockerCompose)
+	if len(problems) > 0 {
+		t.Fatalf("problems = %v", problems)
+	}
+	want := []PolicyViolation{
+		{Policy: "admin-routes-need-auth", Severity: "error", Service: "crawler", Path: "services.crawler.labels.traefik.http.routers.crawler-admin.middlewares",
+			Message: `router crawler-admin: require router.middlewares.exists(m, m.type in ["basicauth", "forwardauth"]) is false`},
+		{Policy: "crawlers-off-traefik", Severity: "error", Service: "crawler", Path: "services.crawler.networks", Message: "crawlers must not join traefik-network"},
+		{Policy: "memory-limits", Severity: "warning", Service: "crawler", Path: "services.crawler.deploy.resources", Message: `require service.resources.limits.memory != "" is false`},
+	}
+	if len(violations) != len(want) {
+		t.Fatalf("violations = %+v\nwant %+v", violations, want)
+	}
+	for i := range want {
+		if violations[i] != want[i] {
+			t.Errorf("violation %d = %+v\nwant %+v", i, violations[i], want[i])
+		}
+	}
+}
+
+func TestEvaluatePoliciesReportsUnknownFieldsOnce(t *testing.T) {
+	dockerCompose := testPolicyCompose(t, "services:\n  api: {image: api:1}\n  worker: {image: worker:1}\n")
+	config := Config{Policies: []PolicyConfig{{Name: "typo", Require: `service.netwroks.size() > 0`}}}
+
+	violations, problems := evaluatePolicies(config, dockerCompose)
+	if len(violations) > 0 || len(problems) != 1 || !strings.Contains(problems[0], "typo: require: no field netwroks") || !strings.HasSuffix(problems[0], "(service api)") {
+		t.Errorf("violations = %v, problems = %v, want one problem about the unknown field", violations, problems)
+	}
+}
+
+func TestEvaluatePoliciesChecksReleaseVariantsAsTheirService(t *testing.T) {
+	dockerCompose := testPolicyCompose(t, "services:\n  api-blue: {image: api:1}\n  api-green: {image: api:2}\n")
+	config := Config{
+		Services: []ServiceConfig{{Name: "api", Prefix: "API_", Groups: []string{"public"}}},
+		Policies: []PolicyConfig{{Name: "public-images", When: `"public" in service.groups`, Require: `service.image.endsWith(":1")`}},
+	}
+
+	violations, problems := evaluatePolicies(config, dockerCompose)
+	if len(problems) > 0 || len(violations) != 1 || violations[0].Service != "api-green" || violations[0].Path != "services.api-green.image" {
+		t.Errorf("violations = %+v, problems = %v, want the green variant only", violations, problems)
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// postgresInitMountPath is where the official postgres image looks for init scripts
+const postgresInitMountPath = "/docker-entrypoint-initdb.d"
+
+// postgresManagedComment marks the roles created by the tool so removed services can be found again
+const postgresManagedComment = "managed by deployment db"
+
+// postgresIdentifier matches the database and role names accepted without quoting
+var postgresIdentifier = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+// postgresAccessLevels lists the supported grant access levels
+var postgresAccessLevels = map[string]bool{"read-only": true, "read-write": true, "owner": true}
+
+// getPostgresService returns the common service running postgres
+func getPostgresService(config Config) (ServiceConfig, bool) {
+	for _, service := range getAllServiceConfigs(config) {
+		if getServiceKind(service) == "postgres" {
+			return service, true
+		}
+	}
+
+	return ServiceConfig{}, false
+}
+
+// hasDatabaseGrants reports whether databases or per-service roles are declared
+func hasDatabaseGrants(config Config) bool {
+	if len(config.Databases) > 0 {
+		return true
+	}
+	for _, service := range getAllServiceConfigs(config) {
+		if service.Postgres != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// postgresRoleName returns the role of a service, derived from its name unless set explicitly
+func postgresRoleName(service ServiceConfig) string {
+	if service.Postgres.Role != "" {
+		return service.Postgres.Role
+	}
+
+	return strings.ReplaceAll(strings.ToLower(service.Name), "-", "_")
+}
+
+// postgresCredentialNames returns the variable names used inside the service and in the consolidated env file
+func postgresCredentialNames(service ServiceConfig) (string, string, string, string) {
+	userVar, passwordVar := "DB_USER", "DB_PASSWORD"
+	if service.Postgres.UserVar != "" {
+		userVar = service.Postgres.UserVar
+	}
+	if service.Postgres.PasswordVar != "" {
+		passwordVar = service.Postgres.PasswordVar
+	}
+
+	return userVar, passwordVar, consolidatedVariableName(service, userVar), consolidatedVariableName(service, passwordVar)
+}
+
+// postgresDatabaseVar returns the variable receiving the database name of a grant, DB_NAME for a service with a single grant
+func postgresDatabaseVar(service ServiceConfig, grant PostgresGrantConfig) string {
+	if grant.DatabaseVar != "" {
+		return grant.DatabaseVar
+	}
+	if len(service.Postgres.Grants) == 1 {
+		return "DB_NAME"
+	}
+
+	return ""
+}
+
+// databaseServices returns the services declaring a postgres role, sorted by name
+func databaseServices(config Config) []ServiceConfig {
+	var services []ServiceConfig
+	for _, service := range getAllServiceConfigs(config) {
+		if service.Postgres != nil {
+			services = append(services, service)
+		}
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+
+	return services
+}
+
+// validateDatabaseConfig checks names, access levels and that every database has at most one owner
+func validateDatabaseConfig(config Config) []string {
+	var problems []string
+
+	databases := make(map[string]bool)
+	for _, database := range config.Databases {
+		if !postgresIdentifier.MatchString(database.Name) {
+			problems = append(problems, fmt.Sprintf("database name %q must be lowercase letters, digits and underscores", database.Name))
+		}
+		if databases[database.Name] {
+			problems = append(problems, fmt.Sprintf("database %s is declared twice", database.Name))
+		}
+		databases[database.Name] = true
+	}
+
+	roles := make(map[string]string)
+	owners := make(map[string]string)
+	for _, service := range databaseServices(config) {
+		role := postgresRoleName(service)
+		if !postgresIdentifier.MatchString(role) {
+			problems = append(problems, fmt.Sprintf("%s: role name %q must be lowercase letters, digits and underscores", service.Name, role))
+		}
+		if other, ok := roles[role]; ok {
+			problems = append(problems, fmt.Sprintf("%s: role %s is already used by %s", service.Name, role, other))
+		}
+		roles[role] = service.Name
+
+		granted := make(map[string]bool)
+		for _, grant := range service.Postgres.Grants {
+			if !databases[grant.Database] {
+				problems = append(problems, fmt.Sprintf("%s: database %s is not declared in databases", service.Name, grant.Database))
+			}
+			if !postgresAccessLevels[grant.Access] {
+				problems = append(problems, fmt.Sprintf("%s: unknown access %q on %s (expected read-only, read-write or owner)", service.Name, grant.Access, grant.Database))
+			}
+			if granted[grant.Database] {
+				problems = append(problems, fmt.Sprintf("%s: database %s is granted twice", service.Name, grant.Database))
+			}
+			granted[grant.Database] = true
+
+			if grant.Access == "owner" {
+				if other, ok := owners[grant.Database]; ok {
+					problems = append(problems, fmt.Sprintf("%s: database %s is already owned by %s", service.Name, grant.Database, other))
+				}
+				owners[grant.Database] = service.Name
+			}
+		}
+	}
+
+	return problems
+}
+
+// postgresGeneratedVariables returns the per-service role, password and database names injected into the consolidated env
+func postgresGeneratedVariables(services []ServiceConfig, config Config, existing map[string]string) []GeneratedVariable {
+	postgresService, ok := getPostgresService(config)
+	if !ok {
+		return nil
+	}
+
+	var variables []GeneratedVariable
+	for _, service := range services {
+		if service.Postgres == nil {
+			continue
+		}
+
+		userVar, passwordVar, consolidatedUser, consolidatedPassword := postgresCredentialNames(service)
+		variables = append(variables,
+			GeneratedVariable{
+				Name:     consolidatedUser,
+				Value:    postgresRoleName(service),
+				Bindings: []VariableBinding{{Service: service.Name, Variable: userVar}},
+			},
+			GeneratedVariable{
+				Name:  consolidatedPassword,
+				Value: existingOrNewSecret(existing, consolidatedPassword),
+				Bindings: []VariableBinding{
+					{Service: service.Name, Variable: passwordVar},
+					{Service: postgresService.Name, Variable: consolidatedPassword},
+				},
+			},
+		)
+
+		for _, grant := range service.Postgres.Grants {
+			databaseVar := postgresDatabaseVar(service, grant)
+			if databaseVar == "" {
+				continue
+			}
+			variables = append(variables, GeneratedVariable{
+				Name:     consolidatedVariableName(service, databaseVar),
+				Value:    grant.Database,
+				Bindings: []VariableBinding{{Service: service.Name, Variable: databaseVar}},
+			})
+		}
+	}
+
+	return variables
+}
+
+// postgresTablePrivileges returns the table and sequence privileges of an access level
+func postgresTablePrivileges(access string) (string, string) {
+	if access == "read-only" {
+		return "SELECT", "SELECT"
+	}
+
+	return "SELECT, INSERT, UPDATE, DELETE", "USAGE, SELECT, UPDATE"
+}
+
+// renderPostgresProvisionSQL renders an idempotent psql script creating the roles and databases and
+// reconciling the grants, so it can run both as an init script and against an existing cluster
+func renderPostgresProvisionSQL(config Config) string {
+	var content strings.Builder
+	services := databaseServices(config)
+
+	content.WriteString("-- Postgres roles, databases and privileges\n")
+	content.WriteString(fmt.Sprintf("-- Generated by deployment db on %s\n", time.Now().Format(time.RFC1123)))
+	content.WriteString("-- DO NOT EDIT THIS FILE DIRECTLY - Edit databases and the postgres section of services in services-config.yaml instead\n")
+	content.WriteString("-- Passwords are read from the environment of the postgres container, the script is safe to run again\n\n")
+	content.WriteString("\\set ON_ERROR_STOP on\n\n")
+
+	// Passwords are read with printenv, \getenv needs psql 15 while the stack still runs postgres:14
+	for _, service := range services {
+		_, _, _, consolidatedPassword := postgresCredentialNames(service)
+		role := postgresRoleName(service)
+		content.WriteString(fmt.Sprintf("\\set %s_password `printenv %s`\n", role, consolidatedPassword))
+		content.WriteString(fmt.Sprintf("SELECT :'%s_password' = '' AS %s_password_missing \\gset\n", role, role))
+		content.WriteString(fmt.Sprintf("\\if :%s_password_missing\n", role))
+		content.WriteString(fmt.Sprintf("DO $$ BEGIN RAISE EXCEPTION '%s is not set, run deployment env and deployment update first'; END $$;\n", consolidatedPassword))
+		content.WriteString("\\endif\n")
+	}
+
+	// Roles
+	content.WriteString("\n-- Roles\n")
+	var roles []string
+	for _, service := range services {
+		role := postgresRoleName(service)
+		roles = append(roles, "'"+role+"'")
+		content.WriteString(fmt.Sprintf("-- %s\n", service.Name))
+		content.WriteString(fmt.Sprintf("SELECT 'CREATE ROLE %s' WHERE NOT EXISTS (SELECT FROM pg_roles WHERE rolname = '%s')\\gexec\n", role, role))
+		content.WriteString(fmt.Sprintf("ALTER ROLE %s WITH LOGIN NOSUPERUSER NOCREATEDB NOCREATEROLE PASSWORD :'%s_password';\n", role, role))
+		content.WriteString(fmt.Sprintf("COMMENT ON ROLE %s IS '%s';\n", role, postgresManagedComment))
+	}
+
+	// Roles of removed services keep their objects but can no longer log in
+	content.WriteString("\n-- Disable the roles of services that are no longer declared\n")
+	managed := "ARRAY[]::text[]"
+	if len(roles) > 0 {
+		managed = "ARRAY[" + strings.Join(roles, ", ") + "]"
+	}
+	content.WriteString("DO $$\nDECLARE\n  stale record;\nBEGIN\n")
+	content.WriteString("  FOR stale IN SELECT rolname FROM pg_roles\n")
+	content.WriteString(fmt.Sprintf("    WHERE shobj_description(oid, 'pg_authid') = '%s' AND rolcanlogin AND NOT rolname = ANY(%s)\n", postgresManagedComment, managed))
+	content.WriteString("  LOOP\n    EXECUTE format('ALTER ROLE %I NOLOGIN', stale.rolname);\n    RAISE NOTICE 'Disabled login of role %', stale.rolname;\n  END LOOP;\nEND $$;\n")
+
+	// Databases
+	owners := make(map[string]string)
+	for _, service := range services {
+		for _, grant := range service.Postgres.Grants {
+			if grant.Access == "owner" {
+				owners[grant.Database] = postgresRoleName(service)
+			}
+		}
+	}
+
+	content.WriteString("\n-- Databases\n")
+	for _, database := range config.Databases {
+		if database.Description != "" {
+			content.WriteString(fmt.Sprintf("-- %s\n", database.Description))
+		}
+		content.WriteString(fmt.Sprintf("SELECT 'CREATE DATABASE %s' WHERE NOT EXISTS (SELECT FROM pg_database WHERE datname = '%s')\\gexec\n", database.Name, database.Name))
+		if owner, ok := owners[database.Name]; ok {
+			content.WriteString(fmt.Sprintf("ALTER DATABASE %s OWNER TO %s;\n", database.Name, owner))
+		}
+		content.WriteString(fmt.Sprintf("REVOKE ALL ON DATABASE %s FROM PUBLIC;\n", database.Name))
+	}
+
+	// Privileges are reset and granted again so access removed from the config is revoked
+	for _, database := range config.Databases {
+		owner := owners[database.Name]
+		content.WriteString(fmt.Sprintf("\n-- Privileges on %s\n", database.Name))
+		content.WriteString(fmt.Sprintf("\\connect %s\n", database.Name))
+		if owner != "" {
+			content.WriteString(fmt.Sprintf("ALTER SCHEMA public OWNER TO %s;\n", owner))
+		}
+		content.WriteString("REVOKE CREATE ON SCHEMA public FROM PUBLIC;\n")
+
+		defaultPrivileges := "ALTER DEFAULT PRIVILEGES IN SCHEMA public"
+		if owner != "" {
+			defaultPrivileges = fmt.Sprintf("ALTER DEFAULT PRIVILEGES FOR ROLE %s IN SCHEMA public", owner)
+		}
+
+		for _, service := range services {
+			role := postgresRoleName(service)
+			if role == owner {
+				content.WriteString(fmt.Sprintf("GRANT ALL ON DATABASE %s TO %s;\n", database.Name, role))
+				continue
+			}
+
+			content.WriteString(fmt.Sprintf("REVOKE ALL ON DATABASE %s FROM %s;\n", database.Name, role))
+			content.WriteString(fmt.Sprintf("REVOKE ALL ON SCHEMA public FROM %s;\n", role))
+			content.WriteString(fmt.Sprintf("REVOKE ALL ON ALL TABLES IN SCHEMA public FROM %s;\n", role))
+			content.WriteString(fmt.Sprintf("REVOKE ALL ON ALL SEQUENCES IN SCHEMA public FROM %s;\n", role))
+			content.WriteString(fmt.Sprintf("%s REVOKE ALL ON TABLES FROM %s;\n", defaultPrivileges, role))
+			content.WriteString(fmt.Sprintf("%s REVOKE ALL ON SEQUENCES FROM %s;\n", defaultPrivileges, role))
+
+			for _, grant := range service.Postgres.Grants {
+				if grant.Database != database.Name {
+					continue
+				}
+
+				tables, sequences := postgresTablePrivileges(grant.Access)
+				content.WriteString(fmt.Sprintf("GRANT CONNECT, TEMPORARY ON DATABASE %s TO %s;\n", database.Name, role))
+				content.WriteString(fmt.Sprintf("GRANT USAGE ON SCHEMA public TO %s;\n", role))
+				content.WriteString(fmt.Sprintf("GRANT %s ON ALL TABLES IN SCHEMA public TO %s;\n", tables, role))
+				content.WriteString(fmt.Sprintf("GRANT %s ON ALL SEQUENCES IN SCHEMA public TO %s;\n", sequences, role))
+				content.WriteString(fmt.Sprintf("%s GRANT %s ON TABLES TO %s;\n", defaultPrivileges, tables, role))
+				content.WriteString(fmt.Sprintf("%s GRANT %s ON SEQUENCES TO %s;\n", defaultPrivileges, sequences, role))
+			}
+		}
+	}
+
+	return content.String()
+}
+
+// loadDatabaseConfig reads the config and reports validation problems, returning false when provisioning must stop
+func loadDatabaseConfig(configFile string) (Config, bool) {
+	config := getConfig(configFile)
+	if !hasDatabaseGrants(config) {
+		fmt.Println("No databases or service postgres sections are declared, nothing to provision.")
+		return config, false
+	}
+
+	if problems := validateDatabaseConfig(config); len(problems) > 0 {
+		fmt.Println("Error: invalid database configuration:")
+		for _, problem := range problems {
+			fmt.Printf("  %s\n", problem)
+		}
+		return config, false
+	}
+
+	return config, true
+}
+
+// GeneratePostgresInitSQL writes the provisioning script mounted into /docker-entrypoint-initdb.d
+func GeneratePostgresInitSQL(configFile string, outputFile string, forceOverwrite bool) {
+	scriptDir, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("Error getting current directory: %v\n", err)
+		return
+	}
+
+	configFile = resolveFilePath(configFile, scriptDir, scriptDir)
+	outputFile = resolveFilePath(outputFile, scriptDir, scriptDir)
+	config, ok := loadDatabaseConfig(configFile)
+	if !ok {
+		return
+	}
+
+	if _, err := os.Stat(outputFile); err == nil && !forceOverwrite {
+		fmt.Printf("Output file %s already exists. Overwrite? (y/n): ", outputFile)
+		var answer string
+		fmt.Scanln(&answer)
+		if strings.ToLower(answer) != "y" {
+			fmt.Println("Operation cancelled.")
+			return
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(outputFile), 0755); err != nil {
+		fmt.Printf("Error creating output directory: %v\n", err)
+		return
+	}
+	if err := os.WriteFile(outputFile, []byte(renderPostgresProvisionSQL(config)), 0644); err != nil {
+		fmt.Printf("Error writing init SQL file: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Generated postgres init SQL written to %s\n", outputFile)
+	fmt.Println("It runs when the postgres data volume is first initialized, use deployment db provision for an existing cluster")
+}
+
+// ProvisionPostgres reconciles roles, databases and grants on a running cluster by piping the
+// provisioning script to psql inside the postgres container
+func ProvisionPostgres(configFile string, consolidatedEnvFile string, composeFile string, dryRun bool) {
+	scriptDir, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("Error getting current directory: %v\n", err)
+		return
+	}
+
+	configFile = resolveFilePath(configFile, scriptDir, scriptDir)
+	consolidatedEnvFile = resolveFilePath(consolidatedEnvFile, scriptDir, scriptDir)
+	composeFile = resolveFilePath(composeFile, scriptDir, scriptDir)
+	config, ok := loadDatabaseConfig(configFile)
+	if !ok {
+		return
+	}
+
+	script := renderPostgresProvisionSQL(config)
+	if dryRun {
+		fmt.Print(script)
+		return
+	}
+
+	postgresService, ok := getPostgresService(config)
+	if !ok {
+		fmt.Println("Error: no postgres service found in the config")
+		return
+	}
+
+	envVars := readEnvVars(consolidatedEnvFile)
+	superuser := envVars[postgresService.Prefix+"USER"]
+	if superuser == "" {
+		fmt.Printf("Error: %sUSER is not set in %s\n", postgresService.Prefix, consolidatedEnvFile)
+		return
+	}
+
+	// Passwords are passed by name so they never appear on the command line
+	args := []string{"compose", "-f", composeFile, "exec", "-T"}
+	environment := os.Environ()
+	for _, service := range databaseServices(config) {
+		_, _, _, consolidatedPassword := postgresCredentialNames(service)
+		password := envVars[consolidatedPassword]
+		if password == "" {
+			fmt.Printf("Error: %s is missing from %s, run deployment env first\n", consolidatedPassword, consolidatedEnvFile)
+			return
+		}
+		args = append(args, "-e", consolidatedPassword)
+		environment = append(environment, consolidatedPassword+"="+password)
+	}
+	args = append(args, postgresService.Name, "psql", "-v", "ON_ERROR_STOP=1", "--no-psqlrc", "-U", superuser, "-d", "postgres", "-f", "-")
+
+	fmt.Printf("Provisioning %d databases and %d roles in service %s\n", len(config.Databases), len(databaseServices(config)), postgresService.Name)
+
+	cmd := exec.Command("docker", args...)
+	cmd.Env = environment
+	cmd.Stdin = strings.NewReader(script)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Printf("Error running psql in service %s: %v\n", postgresService.Name, err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Roles, databases and privileges are up to date")
+}
+
+// updatePostgresService mounts the directory holding the generated init SQL into the postgres service
+func updatePostgresService(dockerCompose *DockerComposeConfig, configFile string) {
+	config := getConfig(configFile)
+	if !hasDatabaseGrants(config) {
+		return
+	}
+
+	postgresService, ok := getPostgresService(config)
+	if !ok {
+		return
+	}
+	service, ok := dockerCompose.Services[postgresService.Name]
+	if !ok {
+		return
+	}
+
+	mount := fmt.Sprintf("./%s/initdb:%s:ro", postgresService.Name, postgresInitMountPath)
+	volumes, _ := service.Volumes.([]any)
+	for _, volume := range volumes {
+		if volume == mount {
+			mount = ""
+		}
+	}
+	if mount != "" {
+		service.Volumes = append(volumes, mount)
+	}
+
+	dockerCompose.Services[postgresService.Name] = service
+	fmt.Printf("  Mounted generated init SQL into service %s\n", postgresService.Name)
+}
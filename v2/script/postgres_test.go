@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPostgresProvisionSQLRunsOnPsql14(t *testing.T) {
+	config := Config{
+		CommonServices: []ServiceConfig{{Name: "postgres", Prefix: "POSTGRES_"}},
+		Services: []ServiceConfig{
+			{Name: "api", Prefix: "API_", Postgres: &PostgresConfig{Grants: []PostgresGrantConfig{{Database: "app", Access: "owner"}}}},
+			{Name: "data-miner", Prefix: "DATAMINER_", Postgres: &PostgresConfig{Grants: []PostgresGrantConfig{{Database: "app", Access: "read-only"}}}},
+		},
+		Databases: []DatabaseConfig{{Name: "app"}},
+	}
+
+	script := renderPostgresProvisionSQL(config)
+	// \getenv only exists since psql 15
+	if strings.Contains(script, `\getenv`) {
+		t.Errorf("script uses \\getenv:\n%s", script)
+	}
+	for _, want := range []string{
+		"\\set api_password `printenv API_DB_PASSWORD`\n",
+		"SELECT :'data_miner_password' = '' AS data_miner_password_missing \\gset\n\\if :data_miner_password_missing\n",
+		"ALTER ROLE data_miner WITH LOGIN NOSUPERUSER NOCREATEDB NOCREATEROLE PASSWORD :'data_miner_password';\n",
+		"ALTER DATABASE app OWNER TO api;\n",
+		"GRANT SELECT ON ALL TABLES IN SCHEMA public TO data_miner;\n",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script is missing %q:\n%s", want, script)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultGroups are the groups started by a plain `docker compose up` when none are configured
+var defaultGroups = []string{"core"}
+
+// getDefaultGroups returns the groups whose services are emitted without a compose profile
+func getDefaultGroups(config Config) []string {
+	if len(config.DefaultGroups) > 0 {
+		return config.DefaultGroups
+	}
+
+	return defaultGroups
+}
+
+// getAllServiceConfigs returns common and application services from the config in declaration order
+func getAllServiceConfigs(config Config) []ServiceConfig {
+	services := append([]ServiceConfig{}, config.CommonServices...)
+	return append(services, config.Services...)
+}
+
+// parseSelector splits a comma separated list of service or group names
+func parseSelector(value string) []string {
+	var items []string
+	for item := range strings.SplitSeq(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// getTemplateDependencies reads the depends_on entries of every service in the compose template
+func getTemplateDependencies(templateFile string) map[string][]string {
+	dependencies := make(map[string][]string)
+
+	templateBytes, err := os.ReadFile(templateFile)
+	if err != nil {
+		fmt.Printf("Warning: unable to read template file %s for dependencies: %v\n", templateFile, err)
+		return dependencies
+	}
+
+	var dockerCompose DockerComposeConfig
+	if err := yaml.Unmarshal(templateBytes, &dockerCompose); err != nil {
+		fmt.Printf("Warning: unable to parse template file %s for dependencies: %v\n", templateFile, err)
+		return dependencies
+	}
+
+	for serviceName, service := range dockerCompose.Services {
+		dependencies[serviceName] = dependsOnNames(service.DependsOn)
+	}
+
+	return dependencies
+}
+
+// matchesSelector reports whether a service is selected by name or by one of its groups
+func matchesSelector(serviceName string, groups []string, selector []string) bool {
+	for _, item := range selector {
+		if item == serviceName || slices.Contains(groups, item) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// selectServices resolves --only/--exclude against service names and groups, pulling in dependencies transitively
+func selectServices(serviceNames []string, config Config, dependencies map[string][]string, only []string, exclude []string) map[string]bool {
+	groups := make(map[string][]string)
+	for _, service := range getAllServiceConfigs(config) {
+		groups[service.Name] = service.Groups
+	}
+
+	selected := make(map[string]bool)
+	for _, serviceName := range serviceNames {
+		if len(only) == 0 || matchesSelector(serviceName, groups[serviceName], only) {
+			selected[serviceName] = true
+		}
+	}
+
+	// Walk depends_on until no new service is added
+	queue := make([]string, 0, len(selected))
+	for serviceName := range selected {
+		queue = append(queue, serviceName)
+	}
+	for len(queue) > 0 {
+		serviceName := queue[0]
+		queue = queue[1:]
+		for _, dependency := range dependencies[serviceName] {
+			if !selected[dependency] {
+				fmt.Printf("Including %s as a dependency of %s\n", dependency, serviceName)
+				selected[dependency] = true
+				queue = append(queue, dependency)
+			}
+		}
+	}
+
+	for serviceName := range selected {
+		if matchesSelector(serviceName, groups[serviceName], exclude) {
+			delete(selected, serviceName)
+		}
+	}
+
+	// Excluded services that are still required will be missing from the reduced stack
+	for serviceName := range selected {
+		for _, dependency := range dependencies[serviceName] {
+			if !selected[dependency] {
+				fmt.Printf("Warning: %s depends on excluded service %s\n", serviceName, dependency)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(selected))
+	for serviceName := range selected {
+		names = append(names, serviceName)
+	}
+	sort.Strings(names)
+	fmt.Printf("Selected %d services: %s\n", len(names), strings.Join(names, ", "))
+
+	return selected
+}
+
+// filterServiceConfigs keeps only the selected services
+func filterServiceConfigs(services []ServiceConfig, selected map[string]bool) []ServiceConfig {
+	var filtered []ServiceConfig
+	for _, service := range services {
+		if selected[service.Name] {
+			filtered = append(filtered, service)
+		} else {
+			fmt.Printf("Skipping unselected service %s\n", service.Name)
+		}
+	}
+
+	return filtered
+}
+
+// applyProfiles assigns compose profiles to services outside of the default groups
+func applyProfiles(dockerCompose *DockerComposeConfig, configFile string) {
+	config := getConfig(configFile)
+	defaults := getDefaultGroups(config)
+
+	for serviceName, service := range dockerCompose.Services {
+		groups := getServiceConfig(serviceName, configFile).Groups
+		if len(groups) == 0 {
+			continue
+		}
+
+		isDefault := false
+		for _, group := range groups {
+			if slices.Contains(defaults, group) {
+				isDefault = true
+				break
+			}
+		}
+
+		if isDefault {
+			service.Profiles = nil
+			fmt.Printf("  Service %s belongs to a default group, no profile assigned\n", serviceName)
+		} else {
+			service.Profiles = groups
+			fmt.Printf("  Assigned profiles %v to service %s\n", groups, serviceName)
+		}
+
+		dockerCompose.Services[serviceName] = service
+	}
+}
@@ -0,0 +1,601 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// promqlKind is the type of a PromQL expression
+type promqlKind int
+
+const (
+	promqlScalar promqlKind = iota
+	promqlVector
+	promqlMatrix
+	promqlString
+)
+
+func (kind promqlKind) String() string {
+	return [...]string{"scalar", "instant vector", "range vector", "string"}[kind]
+}
+
+// promqlFunction describes the arguments and the result of a PromQL function
+type promqlFunction struct {
+	Args     []promqlKind
+	Optional int  // trailing arguments that may be left out
+	Variadic bool // the last argument may repeat
+	Returns  promqlKind
+}
+
+// promqlFunctions are the functions accepted by the rule check
+var promqlFunctions = map[string]promqlFunction{
+	"abs": {Args: []promqlKind{promqlVector}, Returns: promqlVector}, "ceil": {Args: []promqlKind{promqlVector}, Returns: promqlVector},
+	"floor": {Args: []promqlKind{promqlVector}, Returns: promqlVector}, "exp": {Args: []promqlKind{promqlVector}, Returns: promqlVector},
+	"ln": {Args: []promqlKind{promqlVector}, Returns: promqlVector}, "log2": {Args: []promqlKind{promqlVector}, Returns: promqlVector},
+	"log10": {Args: []promqlKind{promqlVector}, Returns: promqlVector}, "sqrt": {Args: []promqlKind{promqlVector}, Returns: promqlVector},
+	"sgn": {Args: []promqlKind{promqlVector}, Returns: promqlVector}, "sort": {Args: []promqlKind{promqlVector}, Returns: promqlVector},
+	"sort_desc": {Args: []promqlKind{promqlVector}, Returns: promqlVector}, "timestamp": {Args: []promqlKind{promqlVector}, Returns: promqlVector},
+	"absent":    {Args: []promqlKind{promqlVector}, Returns: promqlVector},
+	"round":     {Args: []promqlKind{promqlVector, promqlScalar}, Optional: 1, Returns: promqlVector},
+	"clamp":     {Args: []promqlKind{promqlVector, promqlScalar, promqlScalar}, Returns: promqlVector},
+	"clamp_min": {Args: []promqlKind{promqlVector, promqlScalar}, Returns: promqlVector},
+	"clamp_max": {Args: []promqlKind{promqlVector, promqlScalar}, Returns: promqlVector},
+	"rate":      {Args: []promqlKind{promqlMatrix}, Returns: promqlVector}, "irate": {Args: []promqlKind{promqlMatrix}, Returns: promqlVector},
+	"increase": {Args: []promqlKind{promqlMatrix}, Returns: promqlVector}, "delta": {Args: []promqlKind{promqlMatrix}, Returns: promqlVector},
+	"idelta": {Args: []promqlKind{promqlMatrix}, Returns: promqlVector}, "deriv": {Args: []promqlKind{promqlMatrix}, Returns: promqlVector},
+	"changes": {Args: []promqlKind{promqlMatrix}, Returns: promqlVector}, "resets": {Args: []promqlKind{promqlMatrix}, Returns: promqlVector},
+	"avg_over_time": {Args: []promqlKind{promqlMatrix}, Returns: promqlVector}, "min_over_time": {Args: []promqlKind{promqlMatrix}, Returns: promqlVector},
+	"max_over_time": {Args: []promqlKind{promqlMatrix}, Returns: promqlVector}, "sum_over_time": {Args: []promqlKind{promqlMatrix}, Returns: promqlVector},
+	"count_over_time": {Args: []promqlKind{promqlMatrix}, Returns: promqlVector}, "last_over_time": {Args: []promqlKind{promqlMatrix}, Returns: promqlVector},
+	"stddev_over_time": {Args: []promqlKind{promqlMatrix}, Returns: promqlVector}, "stdvar_over_time": {Args: []promqlKind{promqlMatrix}, Returns: promqlVector},
+	"present_over_time": {Args: []promqlKind{promqlMatrix}, Returns: promqlVector}, "absent_over_time": {Args: []promqlKind{promqlMatrix}, Returns: promqlVector},
+	"quantile_over_time": {Args: []promqlKind{promqlScalar, promqlMatrix}, Returns: promqlVector},
+	"predict_linear":     {Args: []promqlKind{promqlMatrix, promqlScalar}, Returns: promqlVector},
+	"holt_winters":       {Args: []promqlKind{promqlMatrix, promqlScalar, promqlScalar}, Returns: promqlVector},
+	"histogram_quantile": {Args: []promqlKind{promqlScalar, promqlVector}, Returns: promqlVector},
+	"label_replace":      {Args: []promqlKind{promqlVector, promqlString, promqlString, promqlString, promqlString}, Returns: promqlVector},
+	"label_join":         {Args: []promqlKind{promqlVector, promqlString, promqlString, promqlString}, Variadic: true, Returns: promqlVector},
+	"time":               {Returns: promqlScalar},
+	"vector":             {Args: []promqlKind{promqlScalar}, Returns: promqlVector},
+	"scalar":             {Args: []promqlKind{promqlVector}, Returns: promqlScalar},
+	"minute":             {Args: []promqlKind{promqlVector}, Optional: 1, Returns: promqlVector}, "hour": {Args: []promqlKind{promqlVector}, Optional: 1, Returns: promqlVector},
+	"day_of_week": {Args: []promqlKind{promqlVector}, Optional: 1, Returns: promqlVector}, "day_of_month": {Args: []promqlKind{promqlVector}, Optional: 1, Returns: promqlVector},
+	"days_in_month": {Args: []promqlKind{promqlVector}, Optional: 1, Returns: promqlVector}, "month": {Args: []promqlKind{promqlVector}, Optional: 1, Returns: promqlVector},
+	"year": {Args: []promqlKind{promqlVector}, Optional: 1, Returns: promqlVector},
+}
+
+// promqlAggregations maps the aggregation operators to the kind of their parameter, if they take one
+var promqlAggregations = map[string]*promqlKind{
+	"sum": nil, "avg": nil, "min": nil, "max": nil, "count": nil, "stddev": nil, "stdvar": nil, "group": nil,
+	"topk": kindRef(promqlScalar), "bottomk": kindRef(promqlScalar), "quantile": kindRef(promqlScalar),
+	"count_values": kindRef(promqlString),
+}
+
+func kindRef(kind promqlKind) *promqlKind {
+	return &kind
+}
+
+// promqlBinaryPrecedence orders the binary operators, higher binds tighter
+var promqlBinaryPrecedence = map[string]int{
+	"or": 1, "and": 2, "unless": 2,
+	"==": 3, "!=": 3, ">": 3, "<": 3, ">=": 3, "<=": 3,
+	"+": 4, "-": 4,
+	"*": 5, "/": 5, "%": 5, "atan2": 5,
+	"^": 6,
+}
+
+var (
+	promqlLabelName  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	promqlMetricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	promqlDuration   = regexp.MustCompile(`^([0-9]+(ms|s|m|h|d|w|y))+$`)
+)
+
+// promqlToken is a lexical token of a PromQL expression
+type promqlToken struct {
+	Kind  string // ident, number, duration, string, op or eof
+	Value string
+	Pos   int
+}
+
+// lexPromQL splits a PromQL expression into tokens
+func lexPromQL(expr string) ([]promqlToken, error) {
+	var tokens []promqlToken
+	runes := []rune(expr)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '#':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+		case r == '"' || r == '\'' || r == '`':
+			start := i
+			i++
+			for i < len(runes) && runes[i] != r {
+				if runes[i] == '\\' && r != '`' {
+					i++
+				}
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			i++
+			tokens = append(tokens, promqlToken{Kind: "string", Value: string(runes[start:i]), Pos: start})
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			if i+1 < len(runes) && (runes[i] == 'e' || runes[i] == 'E') && (unicode.IsDigit(runes[i+1]) || runes[i+1] == '+' || runes[i+1] == '-') {
+				i += 2
+				for i < len(runes) && unicode.IsDigit(runes[i]) {
+					i++
+				}
+			} else {
+				// Durations such as 5m or 1h30m
+				for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+					i++
+				}
+			}
+			value := string(runes[start:i])
+			if promqlDuration.MatchString(value) {
+				tokens = append(tokens, promqlToken{Kind: "duration", Value: value, Pos: start})
+				continue
+			}
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				return nil, fmt.Errorf("invalid number %q at position %d", value, start)
+			}
+			tokens = append(tokens, promqlToken{Kind: "number", Value: value, Pos: start})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == ':') {
+				i++
+			}
+			tokens = append(tokens, promqlToken{Kind: "ident", Value: string(runes[start:i]), Pos: start})
+		default:
+			start := i
+			operator := string(r)
+			if i+1 < len(runes) {
+				switch pair := string(runes[i : i+2]); pair {
+				case "==", "!=", ">=", "<=", "=~", "!~":
+					operator = pair
+				}
+			}
+			if !strings.Contains("(){}[],:=!=~><+-*/%^@", operator[:1]) || operator == "!" {
+				return nil, fmt.Errorf("unexpected character %q at position %d", r, start)
+			}
+			i += len(operator)
+			tokens = append(tokens, promqlToken{Kind: "op", Value: operator, Pos: start})
+		}
+	}
+
+	return append(tokens, promqlToken{Kind: "eof", Pos: len(runes)}), nil
+}
+
+// promqlParser is a recursive descent parser checking the syntax and the types of a PromQL expression
+type promqlParser struct {
+	tokens []promqlToken
+	pos    int
+}
+
+func (p *promqlParser) peek() promqlToken {
+	return p.tokens[p.pos]
+}
+
+func (p *promqlParser) next() promqlToken {
+	token := p.tokens[p.pos]
+	if token.Kind != "eof" {
+		p.pos++
+	}
+	return token
+}
+
+func (p *promqlParser) is(value string) bool {
+	token := p.peek()
+	return (token.Kind == "op" || token.Kind == "ident") && token.Value == value
+}
+
+func (p *promqlParser) expect(value string) error {
+	token := p.next()
+	if (token.Kind != "op" && token.Kind != "ident") || token.Value != value {
+		return p.errorAt(token, "expected %q", value)
+	}
+	return nil
+}
+
+func (p *promqlParser) errorAt(token promqlToken, format string, args ...any) error {
+	found := token.Value
+	if token.Kind == "eof" {
+		found = "end of expression"
+	}
+	return fmt.Errorf("%s at position %d, found %s", fmt.Sprintf(format, args...), token.Pos, found)
+}
+
+// checkPromQL reports the first syntax or type error of a PromQL expression
+func checkPromQL(expr string) error {
+	if strings.TrimSpace(expr) == "" {
+		return fmt.Errorf("empty expression")
+	}
+	tokens, err := lexPromQL(expr)
+	if err != nil {
+		return err
+	}
+
+	parser := &promqlParser{tokens: tokens}
+	kind, err := parser.parseExpr(0)
+	if err != nil {
+		return err
+	}
+	if token := parser.peek(); token.Kind != "eof" {
+		return parser.errorAt(token, "unexpected token")
+	}
+	if kind != promqlVector && kind != promqlScalar {
+		return fmt.Errorf("expression must evaluate to an instant vector or a scalar, got %s", kind)
+	}
+
+	return nil
+}
+
+// parseExpr parses binary operations binding tighter than the given precedence
+func (p *promqlParser) parseExpr(minPrecedence int) (promqlKind, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return left, err
+	}
+
+	for {
+		token := p.peek()
+		precedence, ok := promqlBinaryPrecedence[token.Value]
+		if !ok || (token.Kind != "op" && token.Kind != "ident") || precedence <= minPrecedence {
+			return left, nil
+		}
+		operator := p.next().Value
+
+		returnBool := false
+		if p.is("bool") {
+			if precedence != 3 {
+				return left, p.errorAt(p.peek(), "bool modifier on non-comparison operator %s", operator)
+			}
+			p.next()
+			returnBool = true
+		}
+		if err := p.parseVectorMatching(); err != nil {
+			return left, err
+		}
+
+		// ^ is right associative, the others left associative
+		nextPrecedence := precedence
+		if operator == "^" {
+			nextPrecedence--
+		}
+		right, err := p.parseExpr(nextPrecedence)
+		if err != nil {
+			return left, err
+		}
+
+		for _, operand := range []promqlKind{left, right} {
+			if operand != promqlScalar && operand != promqlVector {
+				return left, fmt.Errorf("operator %s does not accept %s operands", operator, operand)
+			}
+		}
+		if precedence <= 2 && (left != promqlVector || right != promqlVector) {
+			return left, fmt.Errorf("set operator %s needs instant vectors on both sides", operator)
+		}
+		if precedence == 3 && left == promqlScalar && right == promqlScalar && !returnBool {
+			return left, fmt.Errorf("comparison between scalars needs the bool modifier")
+		}
+		if left == promqlScalar && right == promqlScalar {
+			left = promqlScalar
+		} else {
+			left = promqlVector
+		}
+	}
+}
+
+// parseVectorMatching parses the optional on, ignoring, group_left and group_right modifiers
+func (p *promqlParser) parseVectorMatching() error {
+	if p.is("on") || p.is("ignoring") {
+		p.next()
+		if err := p.parseLabelList(); err != nil {
+			return err
+		}
+		if p.is("group_left") || p.is("group_right") {
+			p.next()
+			if p.is("(") {
+				return p.parseLabelList()
+			}
+		}
+	}
+	return nil
+}
+
+// parseLabelList parses a parenthesized list of label names
+func (p *promqlParser) parseLabelList() error {
+	if err := p.expect("("); err != nil {
+		return err
+	}
+	for !p.is(")") {
+		token := p.next()
+		if token.Kind != "ident" || !promqlLabelName.MatchString(token.Value) {
+			return p.errorAt(token, "expected a label name")
+		}
+		if !p.is(",") {
+			break
+		}
+		p.next()
+	}
+	return p.expect(")")
+}
+
+// parseUnary parses an optionally negated expression with its range, offset and @ modifiers
+func (p *promqlParser) parseUnary() (promqlKind, error) {
+	if p.is("-") || p.is("+") {
+		p.next()
+		kind, err := p.parseUnary()
+		if err == nil && kind != promqlScalar && kind != promqlVector {
+			err = fmt.Errorf("unary operator does not accept %s", kind)
+		}
+		return kind, err
+	}
+
+	kind, err := p.parsePrimary()
+	if err != nil {
+		return kind, err
+	}
+
+	// Subqueries turn an instant vector into a range vector
+	if p.is("[") {
+		if kind != promqlVector {
+			return kind, p.errorAt(p.peek(), "range on %s", kind)
+		}
+		if err := p.parseRange(true); err != nil {
+			return kind, err
+		}
+		kind = promqlMatrix
+	}
+	return kind, p.parseModifiers(kind)
+}
+
+// parseRange parses [duration] or, for subqueries, [duration:resolution]
+func (p *promqlParser) parseRange(subquery bool) error {
+	if err := p.expect("["); err != nil {
+		return err
+	}
+	if token := p.next(); token.Kind != "duration" {
+		return p.errorAt(token, "expected a duration")
+	}
+	if p.is(":") {
+		if !subquery {
+			return p.errorAt(p.peek(), "unexpected subquery resolution")
+		}
+		p.next()
+		if p.peek().Kind == "duration" {
+			p.next()
+		}
+	} else if subquery {
+		return p.errorAt(p.peek(), "range only allowed on a selector, an expression needs a subquery like [1h:1m]")
+	}
+	return p.expect("]")
+}
+
+// parseModifiers parses the offset and @ modifiers of a selector or subquery
+func (p *promqlParser) parseModifiers(kind promqlKind) error {
+	for p.is("offset") || p.is("@") {
+		if kind != promqlVector && kind != promqlMatrix {
+			return p.errorAt(p.peek(), "modifier on %s", kind)
+		}
+		if p.next().Value == "offset" {
+			if p.is("-") {
+				p.next()
+			}
+			if token := p.next(); token.Kind != "duration" {
+				return p.errorAt(token, "expected a duration after offset")
+			}
+			continue
+		}
+		if token := p.next(); token.Kind != "number" && token.Value != "start" && token.Value != "end" {
+			return p.errorAt(token, "expected a timestamp after @")
+		}
+		if p.is("(") {
+			p.next()
+			if err := p.expect(")"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parsePrimary parses a literal, parenthesized expression, aggregation, function call or selector
+func (p *promqlParser) parsePrimary() (promqlKind, error) {
+	token := p.peek()
+
+	switch {
+	case token.Kind == "number":
+		p.next()
+		return promqlScalar, nil
+	case token.Kind == "string":
+		p.next()
+		return promqlString, nil
+	case token.Kind == "op" && token.Value == "(":
+		p.next()
+		kind, err := p.parseExpr(0)
+		if err != nil {
+			return kind, err
+		}
+		return kind, p.expect(")")
+	case token.Kind == "op" && token.Value == "{":
+		return p.parseSelector()
+	case token.Kind == "ident":
+		lower := strings.ToLower(token.Value)
+		if lower == "inf" || lower == "nan" {
+			p.next()
+			return promqlScalar, nil
+		}
+		if _, ok := promqlAggregations[token.Value]; ok && (p.tokens[p.pos+1].Value == "(" || p.tokens[p.pos+1].Value == "by" || p.tokens[p.pos+1].Value == "without") {
+			return p.parseAggregation()
+		}
+		if p.tokens[p.pos+1].Kind == "op" && p.tokens[p.pos+1].Value == "(" {
+			return p.parseFunctionCall()
+		}
+		return p.parseSelector()
+	}
+
+	return promqlScalar, p.errorAt(token, "expected an expression")
+}
+
+// parseAggregation parses an aggregation with its grouping before or after the arguments
+func (p *promqlParser) parseAggregation() (promqlKind, error) {
+	name := p.next().Value
+	grouped := false
+	if p.is("by") || p.is("without") {
+		p.next()
+		if err := p.parseLabelList(); err != nil {
+			return promqlVector, err
+		}
+		grouped = true
+	}
+
+	if err := p.expect("("); err != nil {
+		return promqlVector, err
+	}
+	if parameter := promqlAggregations[name]; parameter != nil {
+		kind, err := p.parseExpr(0)
+		if err != nil {
+			return promqlVector, err
+		}
+		if kind != *parameter {
+			return promqlVector, fmt.Errorf("parameter of %s must be of type %s, got %s", name, *parameter, kind)
+		}
+		if err := p.expect(","); err != nil {
+			return promqlVector, err
+		}
+	}
+	kind, err := p.parseExpr(0)
+	if err != nil {
+		return promqlVector, err
+	}
+	if kind != promqlVector {
+		return promqlVector, fmt.Errorf("%s expects an instant vector, got %s", name, kind)
+	}
+	if err := p.expect(")"); err != nil {
+		return promqlVector, err
+	}
+
+	if !grouped && (p.is("by") || p.is("without")) {
+		p.next()
+		if err := p.parseLabelList(); err != nil {
+			return promqlVector, err
+		}
+	}
+	return promqlVector, nil
+}
+
+// parseFunctionCall parses a function call and checks its arguments
+func (p *promqlParser) parseFunctionCall() (promqlKind, error) {
+	nameToken := p.next()
+	function, ok := promqlFunctions[nameToken.Value]
+	if !ok {
+		return promqlVector, p.errorAt(nameToken, "unknown function")
+	}
+	p.next()
+
+	var args []promqlKind
+	for !p.is(")") {
+		kind, err := p.parseExpr(0)
+		if err != nil {
+			return function.Returns, err
+		}
+		args = append(args, kind)
+		if !p.is(",") {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect(")"); err != nil {
+		return function.Returns, err
+	}
+
+	required := len(function.Args) - function.Optional
+	if len(args) < required || (len(args) > len(function.Args) && !function.Variadic) {
+		return function.Returns, fmt.Errorf("%s expects %d arguments, got %d", nameToken.Value, len(function.Args), len(args))
+	}
+	for i, kind := range args {
+		expected := function.Args[min(i, len(function.Args)-1)]
+		if kind != expected {
+			return function.Returns, fmt.Errorf("argument %d of %s must be of type %s, got %s", i+1, nameToken.Value, expected, kind)
+		}
+	}
+
+	return function.Returns, nil
+}
+
+// parseSelector parses a metric name with optional label matchers and range
+func (p *promqlParser) parseSelector() (promqlKind, error) {
+	hasName := false
+	if p.peek().Kind == "ident" {
+		token := p.next()
+		if !promqlMetricName.MatchString(token.Value) {
+			return promqlVector, p.errorAt(token, "invalid metric name")
+		}
+		hasName = true
+	}
+
+	hasMatcher := false
+	if p.is("{") {
+		p.next()
+		for !p.is("}") {
+			label := p.next()
+			if label.Kind != "ident" || !promqlLabelName.MatchString(label.Value) {
+				return promqlVector, p.errorAt(label, "expected a label name")
+			}
+			operator := p.next()
+			if operator.Kind != "op" || (operator.Value != "=" && operator.Value != "!=" && operator.Value != "=~" && operator.Value != "!~") {
+				return promqlVector, p.errorAt(operator, "expected a label matcher operator")
+			}
+			value := p.next()
+			if value.Kind != "string" {
+				return promqlVector, p.errorAt(value, "expected a quoted label value")
+			}
+			if operator.Value == "=~" || operator.Value == "!~" {
+				unquoted, err := strconv.Unquote(value.Value)
+				if err != nil {
+					unquoted = strings.Trim(value.Value, "'")
+				}
+				if _, err := regexp.Compile("^(?:" + unquoted + ")$"); err != nil {
+					return promqlVector, fmt.Errorf("invalid regular expression for label %s: %v", label.Value, err)
+				}
+			}
+			// A selector matching the empty string on every label would select all series
+			if !(operator.Value == "=" && value.Value == `""`) {
+				hasMatcher = true
+			}
+			if !p.is(",") {
+				break
+			}
+			p.next()
+		}
+		if err := p.expect("}"); err != nil {
+			return promqlVector, err
+		}
+	}
+	if !hasName && !hasMatcher {
+		return promqlVector, fmt.Errorf("vector selector must contain a metric name or a non-empty matcher")
+	}
+
+	if p.is("[") && p.tokens[p.pos+1].Kind == "duration" && p.tokens[p.pos+2].Value == "]" {
+		if err := p.parseRange(false); err != nil {
+			return promqlMatrix, err
+		}
+		return promqlMatrix, p.parseModifiers(promqlMatrix)
+	}
+
+	return promqlVector, p.parseModifiers(promqlVector)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckPromQL(t *testing.T) {
+	tests := []struct {
+		expr  string
+		error string // part of the expected error, empty when the expression is valid
+	}{
+		// Selectors and ranges
+		{`up`, ""},
+		{`up{job="api", instance=~"api-.*", env!="dev", path!~"/health"}`, ""},
+		{`{__name__="up"}`, ""},
+		{`rate(http_requests_total{job="api"}[5m] offset 1h)`, ""},
+		{`rate(http_requests_total[5m] @ 1700000000)`, ""},
+		{`up{job="api"`, "expected"},
+		{`up[5x]`, "invalid number"},
+
+		// Function arguments
+		{`rate(x)`, "range vector"},
+		{`rate(x[5m], 1)`, "argument"},
+		{`round(x)`, ""},
+		{`round(x, 0.5)`, ""},
+		{`histogram_quantile(0.99, sum by (le) (rate(x_bucket[5m])))`, ""},
+		{`histogram_quantile(x, 0.99)`, "scalar"},
+		{`label_join(x, "dst", ",", "a", "b", "c")`, ""},
+		{`time()`, ""},
+		{`unknown_function(x)`, "unknown function"},
+
+		// Binary operators, precedence and the bool modifier
+		{`1 + 2 * 3 ^ 2`, ""},
+		{`x / on(instance) group_left(job) y`, ""},
+		{`x and ignoring(path) y`, ""},
+		{`x * on(instance) group_right y`, ""},
+		{`x > 0.8`, ""},
+		{`1 > 2`, "bool"},
+		{`1 > bool 2`, ""},
+		{`x > bool 0`, ""},
+		{`x and 1`, "set operator"},
+		{`-x`, ""},
+		{`(x + y) / 2`, ""},
+		{`x +`, "expected"},
+
+		// Aggregations
+		{`sum by (job) (rate(x[5m]))`, ""},
+		{`sum(rate(x[5m])) without (instance)`, ""},
+		{`topk(3, x)`, ""},
+		{`topk(x)`, "parameter"},
+		{`count_values("value", x)`, ""},
+		{`sum(x[5m])`, "instant vector"},
+
+		// Subqueries
+		{`max_over_time(rate(x[5m])[1h:5m])`, ""},
+		{`max_over_time(rate(x[5m])[1h:])`, ""},
+		{`max_over_time(rate(x[5m])[1h])`, "subquery"},
+		{`min_over_time(deriv(x[5m])[30m:1m] offset 5m)`, ""},
+	}
+	for _, test := range tests {
+		err := checkPromQL(test.expr)
+		switch {
+		case test.error == "" && err != nil:
+			t.Errorf("checkPromQL(%s) = %v, want no error", test.expr, err)
+		case test.error != "" && err == nil:
+			t.Errorf("checkPromQL(%s) accepted the expression, want an error about %q", test.expr, test.error)
+		case test.error != "" && !strings.Contains(err.Error(), test.error):
+			t.Errorf("checkPromQL(%s) = %v, want an error about %q", test.expr, err, test.error)
+		}
+	}
+}
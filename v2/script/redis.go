@@ -0,0 +1,423 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// redisDefaultSettings applies to environments without built-in defaults
+var redisDefaultSettings = RedisSettings{
+	Persistence:     "rdb",
+	Save:            []string{"900 1", "300 10", "60 10000"},
+	AppendFsync:     "everysec",
+	MaxMemoryPolicy: "noeviction",
+}
+
+// redisEnvironmentDefaults are the built-in settings of the known environments: a throwaway cache in
+// development and durable storage in production, where queues must not be evicted
+var redisEnvironmentDefaults = map[string]RedisSettings{
+	"dev": {
+		Persistence:     "none",
+		MaxMemory:       "256mb",
+		MaxMemoryPolicy: "allkeys-lru",
+	},
+	"prod": {
+		Persistence:     "both",
+		Save:            []string{"900 1", "300 10", "60 10000"},
+		AppendFsync:     "everysec",
+		MaxMemory:       "1gb",
+		MaxMemoryPolicy: "noeviction",
+	},
+}
+
+// redisACLMountPath is where the generated users.acl is mounted in the KeyDB container, next to redis.conf
+const redisACLMountPath = "/etc/keydb/users.acl"
+
+// redisPatternPattern matches key and channel patterns, which must not contain whitespace
+var redisPatternPattern = regexp.MustCompile(`^\S+$`)
+
+// getRedisService returns the common service running KeyDB or Redis
+func getRedisService(config Config) (ServiceConfig, bool) {
+	for _, service := range getAllServiceConfigs(config) {
+		if kind := getServiceKind(service); kind == "redis" || kind == "keydb" {
+			return service, true
+		}
+	}
+
+	return ServiceConfig{}, false
+}
+
+// hasRedisUsers reports whether any service declares its KeyDB keys, enabling per-service ACL users
+func hasRedisUsers(config Config) bool {
+	for _, service := range getAllServiceConfigs(config) {
+		if service.Redis != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// redisUserName returns the ACL user of a service, the service name unless set explicitly
+func redisUserName(service ServiceConfig) string {
+	if service.Redis.User != "" {
+		return service.Redis.User
+	}
+
+	return service.Name
+}
+
+// redisCredentialNames returns the variable names used inside the service and in the consolidated env file
+func redisCredentialNames(service ServiceConfig) (string, string, string, string) {
+	userVar, passwordVar := "REDIS_USER", "REDIS_PASSWORD"
+	if service.Redis.UserVar != "" {
+		userVar = service.Redis.UserVar
+	}
+	if service.Redis.PasswordVar != "" {
+		passwordVar = service.Redis.PasswordVar
+	}
+
+	return userVar, passwordVar, consolidatedVariableName(service, userVar), consolidatedVariableName(service, passwordVar)
+}
+
+// redisGeneratedVariables returns the per-service ACL user and password injected into the consolidated env.
+// The passwords reach KeyDB hashed in the users.acl written by deployment update from the same file.
+func redisGeneratedVariables(services []ServiceConfig, config Config, existing map[string]string) []GeneratedVariable {
+	if _, ok := getRedisService(config); !ok {
+		return nil
+	}
+
+	var variables []GeneratedVariable
+	for _, service := range services {
+		if service.Redis == nil {
+			continue
+		}
+
+		userVar, passwordVar, consolidatedUser, consolidatedPassword := redisCredentialNames(service)
+		variables = append(variables,
+			GeneratedVariable{
+				Name:     consolidatedUser,
+				Value:    redisUserName(service),
+				Bindings: []VariableBinding{{Service: service.Name, Variable: userVar}},
+			},
+			GeneratedVariable{
+				Name:     consolidatedPassword,
+				Value:    existingOrNewSecret(existing, consolidatedPassword),
+				Bindings: []VariableBinding{{Service: service.Name, Variable: passwordVar}},
+			},
+		)
+	}
+
+	return variables
+}
+
+// redisServices returns the services declaring a KeyDB user, sorted by name
+func redisServices(config Config) []ServiceConfig {
+	var services []ServiceConfig
+	for _, service := range getAllServiceConfigs(config) {
+		if service.Redis != nil {
+			services = append(services, service)
+		}
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+
+	return services
+}
+
+// validateRedisConfig checks the server settings of the environment and the ACL users of the services
+func validateRedisConfig(config Config, settings RedisSettings) []string {
+	var problems []string
+
+	switch settings.Persistence {
+	case "none", "rdb", "aof", "both":
+	default:
+		problems = append(problems, fmt.Sprintf("unknown persistence %q (expected none, rdb, aof or both)", settings.Persistence))
+	}
+	switch settings.AppendFsync {
+	case "", "always", "everysec", "no":
+	default:
+		problems = append(problems, fmt.Sprintf("unknown appendfsync %q (expected always, everysec or no)", settings.AppendFsync))
+	}
+
+	users := make(map[string]string)
+	for _, service := range redisServices(config) {
+		user := redisUserName(service)
+		if user == "default" || !redisPatternPattern.MatchString(user) {
+			problems = append(problems, fmt.Sprintf("%s: invalid redis user name %q", service.Name, user))
+		}
+		if other, ok := users[user]; ok {
+			problems = append(problems, fmt.Sprintf("%s: redis user %s is already used by %s", service.Name, user, other))
+		}
+		users[user] = service.Name
+
+		if len(service.Redis.Keys) == 0 {
+			problems = append(problems, fmt.Sprintf("%s: redis section must list the key patterns of the service", service.Name))
+		}
+		for _, pattern := range append(append([]string{}, service.Redis.Keys...), service.Redis.Channels...) {
+			if !redisPatternPattern.MatchString(pattern) {
+				problems = append(problems, fmt.Sprintf("%s: invalid key or channel pattern %q", service.Name, pattern))
+			}
+		}
+	}
+
+	return problems
+}
+
+// mergeRedisSettings overrides the fields of base that are set in override
+func mergeRedisSettings(base RedisSettings, override RedisSettings) RedisSettings {
+	if override.Persistence != "" {
+		base.Persistence = override.Persistence
+	}
+	if len(override.Save) > 0 {
+		base.Save = override.Save
+	}
+	if override.AppendFsync != "" {
+		base.AppendFsync = override.AppendFsync
+	}
+	if override.MaxMemory != "" {
+		base.MaxMemory = override.MaxMemory
+	}
+	if override.MaxMemoryPolicy != "" {
+		base.MaxMemoryPolicy = override.MaxMemoryPolicy
+	}
+
+	return base
+}
+
+// redisSettingsForEnvironment layers the built-in defaults, the redis section and its environment override
+func redisSettingsForEnvironment(config Config, environment string) RedisSettings {
+	settings := redisDefaultSettings
+	if defaults, ok := redisEnvironmentDefaults[environment]; ok {
+		settings = mergeRedisSettings(settings, defaults)
+	}
+	settings = mergeRedisSettings(settings, config.Redis.RedisSettings)
+	settings = mergeRedisSettings(settings, config.Redis.Environments[environment])
+
+	if len(settings.Save) == 0 {
+		settings.Save = redisDefaultSettings.Save
+	}
+	if settings.AppendFsync == "" {
+		settings.AppendFsync = redisDefaultSettings.AppendFsync
+	}
+
+	return settings
+}
+
+// redisACLRules renders the ACL rules of a service user, starting from a reset user so the rules are exact.
+// The password is stored as its SHA-256 hash, so the ACL file does not hold it in clear text.
+func redisACLRules(service ServiceConfig, password string) []string {
+	rules := []string{redisUserName(service), "reset", "on", redisPasswordHash(password)}
+
+	for _, pattern := range service.Redis.Keys {
+		rules = append(rules, "~"+pattern)
+	}
+	for _, pattern := range service.Redis.Channels {
+		rules = append(rules, "&"+pattern)
+	}
+
+	commands := service.Redis.Commands
+	if commands == "" {
+		commands = "+@all -@dangerous"
+	}
+
+	return append(rules, strings.Fields(commands)...)
+}
+
+// redisPasswordHash returns the ACL rule setting a password by its SHA-256 hash
+func redisPasswordHash(password string) string {
+	return fmt.Sprintf("#%x", sha256.Sum256([]byte(password)))
+}
+
+// renderRedisACLFile renders users.acl with the default user, which keeps the shared password of the
+// healthcheck since an ACL file replaces every user, and a user per service
+func renderRedisACLFile(config Config, redisService ServiceConfig, envVars map[string]string) (string, error) {
+	var content strings.Builder
+
+	sharedPassword := redisService.Prefix + "PASSWORD"
+	if envVars[sharedPassword] == "" {
+		return "", fmt.Errorf("%s is not set", sharedPassword)
+	}
+	content.WriteString(fmt.Sprintf("user default on %s ~* &* +@all\n", redisPasswordHash(envVars[sharedPassword])))
+
+	for _, service := range redisServices(config) {
+		_, _, _, consolidatedPassword := redisCredentialNames(service)
+		if envVars[consolidatedPassword] == "" {
+			return "", fmt.Errorf("%s is not set, run deployment env first", consolidatedPassword)
+		}
+		content.WriteString(fmt.Sprintf("user %s\n", strings.Join(redisACLRules(service, envVars[consolidatedPassword]), " ")))
+	}
+
+	return content.String(), nil
+}
+
+// renderRedisConfig renders redis.conf for an environment
+func renderRedisConfig(config Config, environment string, settings RedisSettings) string {
+	var content strings.Builder
+
+	content.WriteString(fmt.Sprintf("# KeyDB configuration for the %s environment\n", environment))
+	content.WriteString(fmt.Sprintf("# Generated by deployment redis config on %s\n", time.Now().Format(time.RFC1123)))
+	content.WriteString("# DO NOT EDIT THIS FILE DIRECTLY - Edit the redis section of services-config.yaml instead\n\n")
+
+	content.WriteString("dir /var/lib/keydb\n\n")
+
+	content.WriteString("# Memory\n")
+	if settings.MaxMemory != "" {
+		content.WriteString(fmt.Sprintf("maxmemory %s\n", settings.MaxMemory))
+	}
+	if settings.MaxMemoryPolicy != "" {
+		content.WriteString(fmt.Sprintf("maxmemory-policy %s\n", settings.MaxMemoryPolicy))
+	}
+
+	content.WriteString(fmt.Sprintf("\n# Persistence: %s\n", settings.Persistence))
+	if settings.Persistence == "rdb" || settings.Persistence == "both" {
+		for _, rule := range settings.Save {
+			content.WriteString(fmt.Sprintf("save %s\n", rule))
+		}
+	} else {
+		content.WriteString("save \"\"\n")
+	}
+	if settings.Persistence == "aof" || settings.Persistence == "both" {
+		content.WriteString("appendonly yes\n")
+		content.WriteString(fmt.Sprintf("appendfsync %s\n", settings.AppendFsync))
+	} else {
+		content.WriteString("appendonly no\n")
+	}
+
+	services := redisServices(config)
+	if len(services) > 0 {
+		content.WriteString("\n# ACL users are written to users.acl by deployment update, which loads it with --aclfile,\n")
+		content.WriteString("# so their passwords stay in the consolidated .env file:\n")
+		for _, service := range services {
+			content.WriteString(fmt.Sprintf("#   user %s\n", redisUserName(service)))
+		}
+	}
+
+	return content.String()
+}
+
+// GenerateRedisConfig writes redis.conf for an environment from the redis section of the config
+func GenerateRedisConfig(configFile string, outputFile string, environment string, forceOverwrite bool) {
+	scriptDir, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("Error getting current directory: %v\n", err)
+		return
+	}
+
+	configFile = resolveFilePath(configFile, scriptDir, scriptDir)
+	outputFile = resolveFilePath(outputFile, scriptDir, scriptDir)
+	environment = resolveEnvironment(environment)
+	config := getConfig(configFile)
+	settings := redisSettingsForEnvironment(config, environment)
+
+	if problems := validateRedisConfig(config, settings); len(problems) > 0 {
+		fmt.Println("Error: invalid redis configuration:")
+		for _, problem := range problems {
+			fmt.Printf("  %s\n", problem)
+		}
+		return
+	}
+
+	if _, err := os.Stat(outputFile); err == nil && !forceOverwrite {
+		fmt.Printf("Output file %s already exists. Overwrite? (y/n): ", outputFile)
+		var answer string
+		fmt.Scanln(&answer)
+		if strings.ToLower(answer) != "y" {
+			fmt.Println("Operation cancelled.")
+			return
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(outputFile), 0755); err != nil {
+		fmt.Printf("Error creating output directory: %v\n", err)
+		return
+	}
+	if err := os.WriteFile(outputFile, []byte(renderRedisConfig(config, environment, settings)), 0644); err != nil {
+		fmt.Printf("Error writing redis config file: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Generated redis config for the %s environment written to %s\n", environment, outputFile)
+	fmt.Printf("  persistence: %s, maxmemory: %s, maxmemory-policy: %s\n", settings.Persistence, valueOrDefault(settings.MaxMemory, "unlimited"), settings.MaxMemoryPolicy)
+	if hasRedisUsers(config) {
+		fmt.Println("Run deployment env and deployment update to inject the per-service credentials")
+	}
+}
+
+// valueOrDefault returns value, or fallback when it is empty
+func valueOrDefault(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+
+	return value
+}
+
+// updateRedisService writes the per-service ACL users to users.acl next to redis.conf and loads it with --aclfile,
+// so their passwords appear neither on the keydb-server command line nor in docker inspect
+func updateRedisService(dockerCompose *DockerComposeConfig, envVars map[string]string, configFile string, projectDir string) {
+	config := getConfig(configFile)
+	if !hasRedisUsers(config) {
+		return
+	}
+
+	redisService, ok := getRedisService(config)
+	if !ok {
+		return
+	}
+	service, ok := dockerCompose.Services[redisService.Name]
+	if !ok {
+		return
+	}
+
+	command, ok := service.Command.(string)
+	if !ok {
+		fmt.Printf("  Warning: command of service %s is not a string, ACL users not added\n", redisService.Name)
+		return
+	}
+
+	content, err := renderRedisACLFile(config, redisService, envVars)
+	if err != nil {
+		fmt.Printf("  Warning: %v, ACL users not added to service %s\n", err, redisService.Name)
+		return
+	}
+	aclPath := filepath.Join(projectDir, redisService.Name, "users.acl")
+	if err := os.MkdirAll(filepath.Dir(aclPath), 0755); err != nil {
+		fmt.Printf("  Warning: creating %s: %v\n", filepath.Dir(aclPath), err)
+		return
+	}
+	if err := os.WriteFile(aclPath, []byte(content), 0644); err != nil {
+		fmt.Printf("  Warning: writing %s: %v\n", aclPath, err)
+		return
+	}
+
+	// Drop ACL options already on the command line, everything up to the next option belongs to them.
+	// Users of earlier versions were passed with --user, which cannot be combined with an ACL file.
+	var options []string
+	for i, option := range strings.Split(command, " --") {
+		if i > 0 && (strings.HasPrefix(option, "user ") || strings.HasPrefix(option, "aclfile ")) {
+			continue
+		}
+		options = append(options, option)
+	}
+	service.Command = strings.TrimSpace(strings.Join(options, " --")) + " --aclfile " + redisACLMountPath
+
+	mount := fmt.Sprintf("./%s/users.acl:%s:ro", redisService.Name, redisACLMountPath)
+	volumes, _ := service.Volumes.([]any)
+	for _, volume := range volumes {
+		if volume == mount {
+			mount = ""
+		}
+	}
+	if mount != "" {
+		service.Volumes = append(volumes, mount)
+	}
+
+	dockerCompose.Services[redisService.Name] = service
+	fmt.Printf("  Wrote %d ACL users to %s and mounted it into service %s\n", len(redisServices(config)), aclPath, redisService.Name)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testRedisServicesConfig = `common_services:
+  - name: redis
+    prefix: "REDIS_"
+services:
+  - name: crawler
+    prefix: "CRAWLER_"
+    redis:
+      keys: ["crawler:*"]
+      channels: ["crawler:*"]
+`
+
+func TestUpdateRedisServiceWritesACLFile(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "services-config.yaml")
+	if err := os.WriteFile(configFile, []byte(testRedisServicesConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dockerCompose := DockerComposeConfig{Services: map[string]DockerComposeService{
+		"redis": {
+			Command: "keydb-server /etc/keydb/redis.conf --requirepass ${REDIS_PASSWORD} --user crawler reset on >${CRAWLER_REDIS_PASSWORD} ~crawler:*",
+			Volumes: []any{"./redis/redis.conf:/etc/keydb/redis.conf"},
+		},
+	}}
+	envVars := map[string]string{"REDIS_PASSWORD": "shared-secret", "CRAWLER_REDIS_PASSWORD": "crawler-secret"}
+
+	updateRedisService(&dockerCompose, envVars, configFile, dir)
+
+	service := dockerCompose.Services["redis"]
+	if want := "keydb-server /etc/keydb/redis.conf --requirepass ${REDIS_PASSWORD} --aclfile " + redisACLMountPath; service.Command != want {
+		t.Errorf("command = %q, want %q", service.Command, want)
+	}
+	if volumes, _ := service.Volumes.([]any); !slices.Contains(volumes, any("./redis/users.acl:"+redisACLMountPath+":ro")) {
+		t.Errorf("volumes = %v, users.acl not mounted", service.Volumes)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, "redis", "users.acl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "user default on " + redisPasswordHash("shared-secret") + " ~* &* +@all\n" +
+		"user crawler reset on " + redisPasswordHash("crawler-secret") + " ~crawler:* &crawler:* +@all -@dangerous\n"
+	if string(content) != want {
+		t.Errorf("users.acl:\n%s\nwant:\n%s", content, want)
+	}
+	if strings.Contains(string(content), "secret") {
+		t.Error("users.acl holds a clear text password")
+	}
+
+	// A second run keeps a single ACL option and mount
+	updateRedisService(&dockerCompose, envVars, configFile, dir)
+	service = dockerCompose.Services["redis"]
+	if strings.Count(service.Command.(string), "--aclfile") != 1 || len(service.Volumes.([]any)) != 2 {
+		t.Errorf("second run duplicated the ACL file: %q, %v", service.Command, service.Volumes)
+	}
+}
+
+func TestUpdateRedisServiceNeedsEveryPassword(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "services-config.yaml")
+	if err := os.WriteFile(configFile, []byte(testRedisServicesConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	command := "keydb-server /etc/keydb/redis.conf --requirepass ${REDIS_PASSWORD}"
+	dockerCompose := DockerComposeConfig{Services: map[string]DockerComposeService{"redis": {Command: command}}}
+
+	updateRedisService(&dockerCompose, map[string]string{"REDIS_PASSWORD": "shared-secret"}, configFile, dir)
+
+	if got := dockerCompose.Services["redis"].Command; got != command {
+		t.Errorf("command = %q, changed without the password of crawler", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "redis", "users.acl")); err == nil {
+		t.Error("users.acl written without the password of crawler")
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Docker Hub serves the images without a registry host, docker login stores its credentials under dockerHubAuthKey
+const (
+	dockerHubRegistry = "docker.io"
+	dockerHubHost     = "registry-1.docker.io"
+	dockerHubAuthKey  = "https://index.docker.io/v1/"
+)
+
+// manifestMediaTypes are accepted when resolving a tag, indexes first so multi-platform images keep their index digest
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// registryChallenge matches the key="value" pairs of a WWW-Authenticate header
+var registryChallenge = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// registryImage is an image reference split for the Distribution API
+type registryImage struct {
+	Registry   string // host of the registry, docker.io for Docker Hub
+	Repository string // path of the repository, with the library/ prefix of official Docker Hub images
+	Tag        string
+}
+
+// parseRegistryImage splits an image into its registry, repository and tag, an image without a tag is latest
+func parseRegistryImage(image string) registryImage {
+	reference := parseImageReference(image)
+	result := registryImage{Registry: dockerHubRegistry, Repository: reference.Repository, Tag: valueOrDefault(reference.Tag, "latest")}
+	if first, rest, ok := strings.Cut(reference.Repository, "/"); ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		result.Registry, result.Repository = first, rest
+	}
+	if result.Registry == dockerHubRegistry && !strings.Contains(result.Repository, "/") {
+		result.Repository = "library/" + result.Repository
+	}
+
+	return result
+}
+
+// registryClient talks to registries through the OCI Distribution API, with the anonymous or Docker credential
+// token flow of Docker Hub, GHCR and most hosted registries
+type registryClient struct {
+	client      *http.Client
+	credentials map[string]string // base64 user:password by registry, from ~/.docker/config.json
+	tokens      map[string]string // bearer tokens by registry and scope
+}
+
+// newRegistryClient creates a client with the credentials stored by docker login, credential helpers are not read
+func newRegistryClient() *registryClient {
+	client := &registryClient{
+		client:      &http.Client{Timeout: 30 * time.Second},
+		credentials: make(map[string]string),
+		tokens:      make(map[string]string),
+	}
+
+	configDir := os.Getenv("DOCKER_CONFIG")
+	if configDir == "" {
+		home, _ := os.UserHomeDir()
+		configDir = filepath.Join(home, ".docker")
+	}
+	var dockerConfig struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if content, err := os.ReadFile(filepath.Join(configDir, "config.json")); err == nil && json.Unmarshal(content, &dockerConfig) == nil {
+		for registry, auth := range dockerConfig.Auths {
+			if auth.Auth == "" {
+				continue
+			}
+			if registry == dockerHubAuthKey {
+				registry = dockerHubRegistry
+			}
+			client.credentials[strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://")] = auth.Auth
+		}
+	}
+
+	return client
+}
+
+// registryURL returns the base URL of a registry, plain HTTP for a registry on the local host
+func registryURL(registry string) string {
+	if registry == dockerHubRegistry {
+		return "https://" + dockerHubHost
+	}
+	host := registry
+	if colon := strings.LastIndex(host, ":"); colon >= 0 {
+		host = host[:colon]
+	}
+	if host == "localhost" || host == "127.0.0.1" {
+		return "http://" + registry
+	}
+
+	return "https://" + registry
+}
+
+// request sends a request to the registry, answering a bearer or basic challenge once
+func (c *registryClient) request(method string, image registryImage, path string, accept []string) (*http.Response, error) {
+	requestURL := registryURL(image.Registry) + "/v2/" + image.Repository + path
+	scope := "repository:" + image.Repository + ":pull"
+	tokenKey := image.Registry + " " + scope
+
+	send := func() (*http.Response, error) {
+		request, err := http.NewRequest(method, requestURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, mediaType := range accept {
+			request.Header.Add("Accept", mediaType)
+		}
+		if token, ok := c.tokens[tokenKey]; ok {
+			request.Header.Set("Authorization", token)
+		}
+		return c.client.Do(request)
+	}
+
+	response, err := send()
+	if err != nil || response.StatusCode != http.StatusUnauthorized {
+		return response, err
+	}
+	challenge := response.Header.Get("WWW-Authenticate")
+	response.Body.Close()
+
+	scheme, parameters, _ := strings.Cut(challenge, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		credentials, ok := c.credentials[image.Registry]
+		if !ok {
+			return nil, fmt.Errorf("%s requires credentials, run docker login %s", image.Registry, image.Registry)
+		}
+		c.tokens[tokenKey] = "Basic " + credentials
+	case "bearer":
+		token, err := c.fetchToken(image.Registry, parameters, scope)
+		if err != nil {
+			return nil, err
+		}
+		c.tokens[tokenKey] = "Bearer " + token
+	default:
+		return nil, fmt.Errorf("%s: unsupported authentication challenge %q", image.Registry, challenge)
+	}
+
+	return send()
+}
+
+// fetchToken asks the token service of a bearer challenge for a pull token
+func (c *registryClient) fetchToken(registry string, parameters string, scope string) (string, error) {
+	values := make(map[string]string)
+	for _, match := range registryChallenge.FindAllStringSubmatch(parameters, -1) {
+		values[match[1]] = match[2]
+	}
+	if values["realm"] == "" {
+		return "", fmt.Errorf("%s: bearer challenge without a realm", registry)
+	}
+	if values["scope"] != "" {
+		scope = values["scope"]
+	}
+	query := url.Values{"scope": {scope}}
+	if values["service"] != "" {
+		query.Set("service", values["service"])
+	}
+
+	request, err := http.NewRequest(http.MethodGet, values["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if credentials, ok := c.credentials[registry]; ok {
+		request.Header.Set("Authorization", "Basic "+credentials)
+	}
+	response, err := c.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: token request failed with %s", registry, response.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("%s: invalid token response: %v", registry, err)
+	}
+
+	return valueOrDefault(token.Token, token.AccessToken), nil
+}
+
+// resolveDigest returns the digest of the manifest a tag points to, from the Docker-Content-Digest header of a
+// HEAD request, or by hashing the manifest when the registry does not send it
+func (c *registryClient) resolveDigest(image string) (string, error) {
+	target := parseRegistryImage(image)
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		response, err := c.request(method, target, "/manifests/"+target.Tag, manifestMediaTypes)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", image, err)
+		}
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", image, err)
+		}
+		switch {
+		case response.StatusCode == http.StatusNotFound:
+			return "", fmt.Errorf("%s: tag %s not found in %s/%s", image, target.Tag, target.Registry, target.Repository)
+		case response.StatusCode != http.StatusOK:
+			return "", fmt.Errorf("%s: manifest request failed with %s", image, response.Status)
+		}
+		if digest := response.Header.Get("Docker-Content-Digest"); digest != "" {
+			return digest, nil
+		}
+		if method == http.MethodGet {
+			return fmt.Sprintf("sha256:%x", sha256.Sum256(body)), nil
+		}
+	}
+
+	return "", fmt.Errorf("%s: no digest returned", image)
+}
+
+// listTags returns every tag of the repository of an image, following the Link header of paginated responses
+func (c *registryClient) listTags(image string) ([]string, error) {
+	target := parseRegistryImage(image)
+	var tags []string
+	path := "/tags/list?n=1000"
+	for path != "" {
+		response, err := c.request(http.MethodGet, target, path, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", image, err)
+		}
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(response.Body).Decode(&page)
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s: tag list request failed with %s", image, response.Status)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid tag list: %v", image, err)
+		}
+		tags = append(tags, page.Tags...)
+
+		// The next page is a link like </v2/<repository>/tags/list?n=1000&last=tag>; rel="next"
+		path = ""
+		link := response.Header.Get("Link")
+		if start, end := strings.Index(link, "<"), strings.Index(link, ">"); start >= 0 && end > start {
+			next := link[start+1 : end]
+			if _, after, ok := strings.Cut(next, "/tags/list"); ok {
+				path = "/tags/list" + after
+			}
+		}
+	}
+
+	return tags, nil
+}
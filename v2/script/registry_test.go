@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fakeRegistry is a Distribution API registry serving one repository, behind a bearer or basic challenge
+type fakeRegistry struct {
+	t          *testing.T
+	repository string
+	scheme     string            // bearer or basic
+	manifest   string            // manifest served for every tag
+	headDigest bool              // send Docker-Content-Digest on HEAD requests
+	tags       []string          // tags listed two by page
+	requests   map[string]int    // requests by method and path
+	tokens     map[string]string // scope requested for every token handed out
+}
+
+func newFakeRegistry(t *testing.T, repository string, scheme string) (*fakeRegistry, *httptest.Server) {
+	t.Helper()
+
+	registry := &fakeRegistry{
+		t:          t,
+		repository: repository,
+		scheme:     scheme,
+		manifest:   `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`,
+		headDigest: true,
+		requests:   make(map[string]int),
+		tokens:     make(map[string]string),
+	}
+	server := httptest.NewServer(registry)
+	t.Cleanup(server.Close)
+	return registry, server
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	r.requests[request.Method+" "+request.URL.Path]++
+
+	if request.URL.Path == "/token" {
+		user, password, ok := request.BasicAuth()
+		if r.scheme == "bearer-login" && (!ok || user != "ci" || password != "secret") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		token := fmt.Sprintf("token-%d", len(r.tokens)+1)
+		r.tokens[token] = request.URL.Query().Get("scope")
+		fmt.Fprintf(w, `{"access_token":%q}`, token)
+		return
+	}
+
+	if !r.authorized(request.Header.Get("Authorization")) {
+		if r.scheme == "basic" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="fake-registry"`, request.Host))
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	prefix := "/v2/" + r.repository
+	switch {
+	case strings.HasPrefix(request.URL.Path, prefix+"/manifests/"):
+		if !slices.Contains(request.Header.Values("Accept"), "application/vnd.oci.image.index.v1+json") {
+			r.t.Errorf("manifest request without the OCI index media type: %v", request.Header.Values("Accept"))
+		}
+		if strings.TrimPrefix(request.URL.Path, prefix+"/manifests/") == "missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.headDigest {
+			w.Header().Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(r.manifest))))
+		}
+		if request.Method == http.MethodGet {
+			fmt.Fprint(w, r.manifest)
+		}
+	case request.URL.Path == prefix+"/tags/list":
+		start := 0
+		if last := request.URL.Query().Get("last"); last != "" {
+			start = slices.Index(r.tags, last) + 1
+		}
+		end := min(start+2, len(r.tags))
+		if end < len(r.tags) {
+			w.Header().Set("Link", fmt.Sprintf(`<%s/tags/list?n=2&last=%s>; rel="next"`, prefix, r.tags[end-1]))
+		}
+		fmt.Fprintf(w, `{"name":%q,"tags":["%s"]}`, r.repository, strings.Join(r.tags[start:end], `","`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// authorized accepts a token handed out for the pull scope of the repository, or the basic credentials ci:secret
+func (r *fakeRegistry) authorized(header string) bool {
+	if credentials, ok := strings.CutPrefix(header, "Basic "); ok {
+		return r.scheme == "basic" && credentials == base64.StdEncoding.EncodeToString([]byte("ci:secret"))
+	}
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	return ok && r.tokens[token] == "repository:"+r.repository+":pull"
+}
+
+// testRegistryClient returns a client without the credentials of the host, like newRegistryClient without docker login
+func testRegistryClient(server *httptest.Server, credentials map[string]string) *registryClient {
+	if credentials == nil {
+		credentials = make(map[string]string)
+	}
+	return &registryClient{client: server.Client(), credentials: credentials, tokens: make(map[string]string)}
+}
+
+func TestParseRegistryImage(t *testing.T) {
+	tests := []struct {
+		image string
+		want  registryImage
+	}{
+		{"postgres:17.4-alpine", registryImage{Registry: "docker.io", Repository: "library/postgres", Tag: "17.4-alpine"}},
+		{"eqalpha/keydb", registryImage{Registry: "docker.io", Repository: "eqalpha/keydb", Tag: "latest"}},
+		{"ghcr.io/lexicon/crawler:1.2", registryImage{Registry: "ghcr.io", Repository: "lexicon/crawler", Tag: "1.2"}},
+		{"localhost:5000/api:dev", registryImage{Registry: "localhost:5000", Repository: "api", Tag: "dev"}},
+		{"traefik:v3.1@sha256:abc", registryImage{Registry: "docker.io", Repository: "library/traefik", Tag: "v3.1"}},
+	}
+	for _, test := range tests {
+		if got := parseRegistryImage(test.image); got != test.want {
+			t.Errorf("parseRegistryImage(%q) = %+v, want %+v", test.image, got, test.want)
+		}
+	}
+
+	if got := registryURL("docker.io"); got != "https://registry-1.docker.io" {
+		t.Errorf("registryURL(docker.io) = %s", got)
+	}
+	if got := registryURL("127.0.0.1:5000"); got != "http://127.0.0.1:5000" {
+		t.Errorf("registryURL(127.0.0.1:5000) = %s", got)
+	}
+}
+
+func TestResolveDigestWithBearerToken(t *testing.T) {
+	registry, server := newFakeRegistry(t, "team/api", "bearer")
+	client := testRegistryClient(server, nil)
+	image := strings.TrimPrefix(server.URL, "http://") + "/team/api:1.0"
+
+	digest, err := client.resolveDigest(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(registry.manifest))); digest != want {
+		t.Errorf("digest = %s, want %s", digest, want)
+	}
+	if registry.requests["GET /v2/team/api/manifests/1.0"] != 0 {
+		t.Error("the manifest was downloaded although HEAD returned its digest")
+	}
+
+	// The token of the repository is reused for the next requests
+	if _, err := client.resolveDigest(image); err != nil {
+		t.Fatal(err)
+	}
+	if got := registry.requests["GET /token"]; got != 1 {
+		t.Errorf("%d token requests, want 1", got)
+	}
+
+	if _, err := client.resolveDigest(strings.TrimSuffix(image, "1.0") + "missing"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("missing tag error = %v", err)
+	}
+}
+
+func TestResolveDigestFallsBackToManifestHash(t *testing.T) {
+	registry, server := newFakeRegistry(t, "team/api", "bearer")
+	registry.headDigest = false
+	client := testRegistryClient(server, nil)
+
+	digest, err := client.resolveDigest(strings.TrimPrefix(server.URL, "http://") + "/team/api:1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(registry.manifest))); digest != want {
+		t.Errorf("digest = %s, want the hash of the manifest %s", digest, want)
+	}
+	if registry.requests["HEAD /v2/team/api/manifests/1.0"] == 0 || registry.requests["GET /v2/team/api/manifests/1.0"] == 0 {
+		t.Errorf("requests = %v, want HEAD then GET", registry.requests)
+	}
+}
+
+func TestBasicChallenge(t *testing.T) {
+	_, server := newFakeRegistry(t, "team/api", "basic")
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	if _, err := testRegistryClient(server, nil).resolveDigest(host + "/team/api:1.0"); err == nil || !strings.Contains(err.Error(), "docker login") {
+		t.Errorf("error without credentials = %v, want a docker login hint", err)
+	}
+
+	credentials := map[string]string{host: base64.StdEncoding.EncodeToString([]byte("ci:secret"))}
+	if _, err := testRegistryClient(server, credentials).resolveDigest(host + "/team/api:1.0"); err != nil {
+		t.Errorf("with credentials: %v", err)
+	}
+}
+
+func TestBearerTokenWithDockerLoginCredentials(t *testing.T) {
+	registry, server := newFakeRegistry(t, "team/api", "bearer-login")
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	// docker login stores Docker Hub under its index URL and other registries by host
+	configDir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", configDir)
+	auth := base64.StdEncoding.EncodeToString([]byte("ci:secret"))
+	config := fmt.Sprintf(`{"auths":{%q:{"auth":%q},%q:{"auth":%q}}}`, host, auth, dockerHubAuthKey, auth)
+	if err := os.WriteFile(filepath.Join(configDir, "config.json"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	client := newRegistryClient()
+	if client.credentials[dockerHubRegistry] != auth {
+		t.Errorf("Docker Hub credentials not read from %s", dockerHubAuthKey)
+	}
+
+	if _, err := client.resolveDigest(host + "/team/api:1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if len(registry.tokens) != 1 {
+		t.Errorf("%d tokens handed out, want 1", len(registry.tokens))
+	}
+}
+
+func TestListTagsFollowsLinkPagination(t *testing.T) {
+	registry, server := newFakeRegistry(t, "library/postgres", "bearer")
+	registry.tags = []string{"16.8-alpine", "17.2-alpine", "17.4", "17.4-alpine", "17.5-alpine"}
+	client := testRegistryClient(server, nil)
+
+	// The fake registry runs on the local host, so the library/ prefix of official images is spelled out
+	tags, err := client.listTags(strings.TrimPrefix(server.URL, "http://") + "/library/postgres:17.4-alpine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(tags, registry.tags) {
+		t.Errorf("tags = %v, want %v", tags, registry.tags)
+	}
+	// Three pages, the first one sent again after the challenge
+	if got := registry.requests["GET /v2/library/postgres/tags/list"]; got != 4 {
+		t.Errorf("%d tag list requests, want 4", got)
+	}
+
+	// images outdated keeps the tags of the same pattern
+	if newer := newerTags("17.2-alpine", tags); !slices.Equal(newer, []string{"17.4-alpine", "17.5-alpine"}) {
+		t.Errorf("newerTags = %v", newer)
+	}
+}
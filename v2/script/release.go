@@ -0,0 +1,504 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// releaseColors are the two variants a released service runs as
+var releaseColors = []string{"blue", "green"}
+
+// releaseStateFile keeps the current split of every released service next to the compose file
+const releaseStateFile = "releases.yaml"
+
+// traefikReleasesFile is the dynamic configuration holding the weighted services of the releases
+const traefikReleasesFile = "releases.yml"
+
+// traefikServiceLabel matches the labels of a Traefik service declared on a compose service
+var traefikServiceLabel = regexp.MustCompile(`^traefik\.http\.services\.([^.]+)\.(.+)$`)
+
+// ReleaseState represents the release state file
+type ReleaseState struct {
+	Services map[string]*ServiceRelease `yaml:"services"`
+}
+
+// ServiceRelease tracks the traffic split between the two colors of a service
+type ServiceRelease struct {
+	Active   string            `yaml:"active"`             // color receiving the stable traffic
+	Weight   int               `yaml:"weight"`             // percent of the traffic sent to the candidate color
+	Previous string            `yaml:"previous,omitempty"` // color active before the last promotion, for rollback
+	Images   map[string]string `yaml:"images,omitempty"`   // image per color, the template build is used otherwise
+	Updated  string            `yaml:"updated"`
+}
+
+// ReleaseOptions holds the files a release command regenerates
+type ReleaseOptions struct {
+	StateFile           string
+	ConfigFile          string
+	TemplateFile        string
+	ConsolidatedEnvFile string
+	OutputFile          string
+	Environment         string
+	Regenerate          bool
+}
+
+// candidateColor returns the color that is not active
+func (release *ServiceRelease) candidateColor() string {
+	if release.Active == releaseColors[0] {
+		return releaseColors[1]
+	}
+
+	return releaseColors[0]
+}
+
+// readReleaseState loads the state file, returning an empty state when it does not exist
+func readReleaseState(path string) (ReleaseState, error) {
+	state := ReleaseState{Services: make(map[string]*ServiceRelease)}
+
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := yaml.Unmarshal(content, &state); err != nil {
+		return state, fmt.Errorf("invalid release state %s: %v", path, err)
+	}
+	if state.Services == nil {
+		state.Services = make(map[string]*ServiceRelease)
+	}
+
+	return state, nil
+}
+
+// writeReleaseState saves the state file, removing it once no service is released
+func writeReleaseState(path string, state ReleaseState) error {
+	if len(state.Services) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	content, err := yaml.Marshal(state)
+	if err != nil {
+		return err
+	}
+	header := "# Blue/green release state, managed by deployment release\n\n"
+
+	return os.WriteFile(path, append([]byte(header), content...), 0644)
+}
+
+// releaseBaseService returns the configured service a color variant belongs to, or the name itself
+func releaseBaseService(serviceName string, configFile string) string {
+	if getServiceConfig(serviceName, configFile).Name != "" {
+		return serviceName
+	}
+	for _, color := range releaseColors {
+		if base, ok := strings.CutSuffix(serviceName, "-"+color); ok && getServiceConfig(base, configFile).Name != "" {
+			return base
+		}
+	}
+
+	return serviceName
+}
+
+// withNetworkAlias adds an alias on every network of a compose service, converting the list syntax when needed
+func withNetworkAlias(networks any, alias string) any {
+	converted := make(map[string]any)
+
+	switch typed := networks.(type) {
+	case []any:
+		for _, network := range typed {
+			converted[fmt.Sprint(network)] = map[string]any{}
+		}
+	case map[string]any:
+		for name, settings := range typed {
+			converted[name] = settings
+		}
+	default:
+		return networks
+	}
+
+	for name, settings := range converted {
+		network, _ := settings.(map[string]any)
+		copied := map[string]any{}
+		for key, value := range network {
+			copied[key] = value
+		}
+		aliases, _ := copied["aliases"].([]any)
+		copied["aliases"] = append(aliases, alias)
+		converted[name] = copied
+	}
+
+	return converted
+}
+
+// buildContext returns the context directory of a compose build section
+func buildContext(build any) string {
+	switch typed := build.(type) {
+	case string:
+		return typed
+	case map[string]any:
+		context, _ := typed["context"].(string)
+		return context
+	}
+
+	return ""
+}
+
+// withoutBindMount removes the volumes mounting the given host directory
+func withoutBindMount(volumes any, source string) any {
+	list, ok := volumes.([]any)
+	if !ok || source == "" {
+		return volumes
+	}
+
+	source = filepath.Clean(source)
+	var kept []any
+	for _, volume := range list {
+		host, _, _ := strings.Cut(fmt.Sprint(volume), ":")
+		if filepath.Clean(host) != source {
+			kept = append(kept, volume)
+		}
+	}
+
+	return kept
+}
+
+// renameDependency replaces a dependency in depends_on, in short or long syntax
+func renameDependency(dependsOn any, from string, to string) any {
+	switch typed := dependsOn.(type) {
+	case []any:
+		renamed := make([]any, 0, len(typed))
+		for _, dependency := range typed {
+			if dependency == from {
+				dependency = to
+			}
+			renamed = append(renamed, dependency)
+		}
+		return renamed
+	case map[string]any:
+		renamed := make(map[string]any, len(typed))
+		for name, condition := range typed {
+			if name == from {
+				name = to
+			}
+			renamed[name] = condition
+		}
+		return renamed
+	}
+
+	return dependsOn
+}
+
+// colorLabels rewrites the Traefik labels of a service for one color: its Traefik services get the color
+// suffix and its routers point at the weighted service of the file provider
+func colorLabels(labels []string, color string) ([]string, []string) {
+	var traefikServices []string
+	for _, label := range labels {
+		key, _, _ := strings.Cut(label, "=")
+		if match := traefikServiceLabel.FindStringSubmatch(key); match != nil && !slices.Contains(traefikServices, match[1]) {
+			traefikServices = append(traefikServices, match[1])
+		}
+	}
+
+	var rewritten []string
+	routerServices := make(map[string]string)
+	for _, label := range labels {
+		key, value, _ := strings.Cut(label, "=")
+		if match := traefikServiceLabel.FindStringSubmatch(key); match != nil {
+			rewritten = append(rewritten, fmt.Sprintf("traefik.http.services.%s-%s.%s=%s", match[1], color, match[2], value))
+			continue
+		}
+		if router, ok := strings.CutSuffix(key, ".service"); ok && strings.HasPrefix(router, "traefik.http.routers.") {
+			routerServices[router] = value
+			continue
+		}
+		rewritten = append(rewritten, label)
+	}
+
+	for _, router := range serviceRouters(labels) {
+		key := "traefik.http.routers." + router
+		service := routerServices[key]
+		if service == "" && len(traefikServices) == 1 {
+			service = traefikServices[0]
+		}
+		if service == "" || strings.Contains(service, "@") {
+			if service != "" {
+				rewritten = append(rewritten, key+".service="+service)
+			}
+			continue
+		}
+		rewritten = append(rewritten, key+".service="+service+"@file")
+	}
+
+	return rewritten, traefikServices
+}
+
+// applyReleases replaces every released service by its blue and green variants and returns the Traefik
+// weighted services splitting the traffic between them
+func applyReleases(dockerCompose *DockerComposeConfig, state ReleaseState, provider string) map[string]any {
+	weighted := make(map[string]any)
+
+	names := make([]string, 0, len(state.Services))
+	for name := range state.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		release := state.Services[name]
+		base, ok := dockerCompose.Services[name]
+		if !ok {
+			continue
+		}
+		candidate := release.candidateColor()
+
+		var traefikServices []string
+		for _, color := range releaseColors {
+			variant := base
+			labels, services := colorLabels(serviceLabels(base), color)
+			traefikServices = services
+			if len(labels) > 0 {
+				setServiceLabels(&variant, labels)
+			}
+			if variant.ContainerName != "" {
+				variant.ContainerName += "-" + color
+			}
+			if image := release.Images[color]; image != "" {
+				// The source bind mount of the build context would hide the code of the released image
+				variant.Volumes = withoutBindMount(base.Volumes, buildContext(base.Build))
+				variant.Image = image
+				variant.Build = nil
+			}
+			switch environment := base.Environment.(type) {
+			case []string:
+				variant.Environment = append(append([]string{}, environment...), "RELEASE_COLOR="+color)
+			case []any:
+				variant.Environment = append(append([]any{}, environment...), "RELEASE_COLOR="+color)
+			}
+
+			// Only the active color keeps the host ports and answers on the original name inside the network
+			if color == release.Active {
+				variant.Networks = withNetworkAlias(base.Networks, name)
+			} else {
+				variant.Ports = nil
+			}
+
+			dockerCompose.Services[name+"-"+color] = variant
+		}
+		delete(dockerCompose.Services, name)
+
+		for serviceName, service := range dockerCompose.Services {
+			if service.DependsOn != nil {
+				service.DependsOn = renameDependency(service.DependsOn, name, name+"-"+release.Active)
+				dockerCompose.Services[serviceName] = service
+			}
+		}
+
+		for _, traefikService := range traefikServices {
+			var servers []any
+			for _, color := range []string{release.Active, candidate} {
+				weight := 100 - release.Weight
+				if color == candidate {
+					weight = release.Weight
+				}
+				if weight > 0 {
+					servers = append(servers, map[string]any{"name": fmt.Sprintf("%s-%s@%s", traefikService, color, provider), "weight": weight})
+				}
+			}
+			weighted[traefikService] = map[string]any{"weighted": map[string]any{"services": servers}}
+		}
+
+		fmt.Printf("  Released %s as %s-%s (%d%%) and %s-%s (%d%%)\n", name, name, release.Active, 100-release.Weight, name, candidate, release.Weight)
+	}
+
+	return weighted
+}
+
+// writeTraefikReleases writes the weighted services of the releases to the dynamic configuration, and removes
+// the file once no service is released
+func writeTraefikReleases(weighted map[string]any, dynamicDir string) error {
+	releasesFile := filepath.Join(dynamicDir, traefikReleasesFile)
+	if len(weighted) == 0 {
+		if err := os.Remove(releasesFile); err == nil {
+			fmt.Printf("  Removed %s, no service is released\n", releasesFile)
+		}
+		return nil
+	}
+
+	content, err := marshalYAML(map[string]any{"http": map[string]any{"services": weighted}})
+	if err != nil {
+		return err
+	}
+	header := "# Traefik weighted services of the blue/green releases, generated by deployment update from " + releaseStateFile + "\n\n"
+	if !writeGeneratedFile(releasesFile, append([]byte(header), content...), true) {
+		return fmt.Errorf("unable to write %s", releasesFile)
+	}
+
+	return nil
+}
+
+// printReleaseStatus prints the split of every released service
+func printReleaseStatus(state ReleaseState) {
+	if len(state.Services) == 0 {
+		fmt.Println("No service is released, start one with deployment release start -service <name>")
+		return
+	}
+
+	names := make([]string, 0, len(state.Services))
+	for name := range state.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Printf("%-40s %-8s %-10s %-10s %s\n", "SERVICE", "ACTIVE", "CANDIDATE", "CANARY", "UPDATED")
+	for _, name := range names {
+		release := state.Services[name]
+		fmt.Printf("%-40s %-8s %-10s %-10s %s\n", name, release.Active, release.candidateColor(), fmt.Sprintf("%d%%", release.Weight), release.Updated)
+		for _, color := range releaseColors {
+			if image := release.Images[color]; image != "" {
+				fmt.Printf("  %s: %s\n", color, image)
+			}
+		}
+	}
+}
+
+// Release changes the traffic split of a service and regenerates the compose file and the weighted services
+func Release(action string, serviceName string, weight int, image string, options ReleaseOptions) {
+	state, err := readReleaseState(options.StateFile)
+	if err != nil {
+		fmt.Printf("Error reading release state: %v\n", err)
+		return
+	}
+
+	if action == "status" {
+		printReleaseStatus(state)
+		return
+	}
+
+	if serviceName == "" {
+		fmt.Println("Error: -service is required")
+		return
+	}
+	if getServiceConfig(serviceName, options.ConfigFile).Name == "" {
+		fmt.Printf("Error: service %s is not defined in %s\n", serviceName, options.ConfigFile)
+		return
+	}
+	if weight > 100 || (action == "shift" && weight < 0) {
+		fmt.Println("Error: -weight must be between 0 and 100")
+		return
+	}
+	weight = max(weight, 0)
+
+	release, released := state.Services[serviceName]
+	if action != "start" && !released {
+		fmt.Printf("Error: service %s is not released, start it with deployment release start -service %s\n", serviceName, serviceName)
+		return
+	}
+
+	switch action {
+	case "start":
+		if !released {
+			release = &ServiceRelease{Active: releaseColors[0]}
+			state.Services[serviceName] = release
+		}
+		if image != "" {
+			if release.Images == nil {
+				release.Images = make(map[string]string)
+			}
+			release.Images[release.candidateColor()] = image
+		}
+		release.Weight = weight
+		fmt.Printf("Service %s runs as %s (active) and %s (candidate%s) with %d%% of the traffic on %s\n",
+			serviceName, release.Active, release.candidateColor(), imageNote(release.Images[release.candidateColor()]), weight, release.candidateColor())
+
+	case "shift":
+		release.Weight = weight
+		fmt.Printf("Sending %d%% of the traffic of %s to %s and %d%% to %s\n", weight, serviceName, release.candidateColor(), 100-weight, release.Active)
+
+	case "promote":
+		release.Previous = release.Active
+		release.Active = release.candidateColor()
+		release.Weight = 0
+		fmt.Printf("Promoted %s of %s, it now receives all the traffic\n", release.Active, serviceName)
+
+	case "rollback":
+		if release.Weight > 0 {
+			release.Weight = 0
+			fmt.Printf("Rolled back the canary of %s, %s receives all the traffic\n", serviceName, release.Active)
+		} else if release.Previous != "" {
+			release.Active, release.Previous = release.Previous, ""
+			fmt.Printf("Rolled back the promotion of %s, %s receives all the traffic again\n", serviceName, release.Active)
+		} else {
+			fmt.Printf("Error: nothing to roll back for %s\n", serviceName)
+			return
+		}
+
+	case "stop":
+		delete(state.Services, serviceName)
+		fmt.Printf("Service %s runs as a single service again from the template\n", serviceName)
+
+	default:
+		fmt.Printf("Unknown release command: %s\n", action)
+		return
+	}
+
+	if released || action == "start" {
+		release.Updated = time.Now().UTC().Format(time.RFC3339)
+	}
+	// update renders the split from the state file, so the previous state is put back when it fails
+	previous, previousErr := os.ReadFile(options.StateFile)
+	if err := writeReleaseState(options.StateFile, state); err != nil {
+		fmt.Printf("Error writing release state: %v\n", err)
+		return
+	}
+
+	if !options.Regenerate {
+		fmt.Println("Run deployment update to apply the new split")
+		return
+	}
+	fmt.Println("Regenerating docker compose file...")
+	if err := UpdateDockerCompose(options.ConsolidatedEnvFile, options.OutputFile, true, options.TemplateFile, "", options.ConfigFile, "", "", options.Environment, ""); err != nil {
+		fmt.Printf("Error regenerating docker compose file: %v\n", err)
+		if previousErr == nil {
+			err = os.WriteFile(options.StateFile, previous, 0644)
+		} else {
+			err = os.Remove(options.StateFile)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Error restoring release state: %v\n", err)
+		} else {
+			fmt.Println("Release state left unchanged, nothing to apply")
+		}
+		os.Exit(1)
+	}
+	switch action {
+	case "stop":
+		fmt.Println("Apply it with: docker compose up -d --remove-orphans")
+	case "shift":
+		fmt.Println("Traefik reloads the weighted services on its own, no container restart is needed")
+	default:
+		// Starting creates the variants, promoting and rolling back move the host ports and the alias
+		fmt.Printf("Apply it with: docker compose up -d --remove-orphans %s-blue %s-green\n", serviceName, serviceName)
+	}
+}
+
+// imageNote describes the image of the candidate color
+func imageNote(image string) string {
+	if image == "" {
+		return ""
+	}
+
+	return ", image " + image
+}
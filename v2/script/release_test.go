@@ -0,0 +1,141 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestColorLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		labels   []string
+		want     []string
+		services []string
+	}{
+		{
+			name: "router using the only service",
+			labels: []string{
+				"traefik.enable=true",
+				"traefik.http.routers.api.rule=Host(`api.localhost`)",
+				"traefik.http.services.api.loadbalancer.server.port=8080",
+			},
+			want: []string{
+				"traefik.enable=true",
+				"traefik.http.routers.api.rule=Host(`api.localhost`)",
+				"traefik.http.services.api-blue.loadbalancer.server.port=8080",
+				"traefik.http.routers.api.service=api@file",
+			},
+			services: []string{"api"},
+		},
+		{
+			name: "router naming a service of another provider",
+			labels: []string{
+				"traefik.http.routers.api.rule=Host(`api.localhost`)",
+				"traefik.http.routers.api.service=api@internal",
+				"traefik.http.services.api.loadbalancer.server.port=8080",
+				"traefik.http.services.metrics.loadbalancer.server.port=9090",
+			},
+			want: []string{
+				"traefik.http.routers.api.rule=Host(`api.localhost`)",
+				"traefik.http.services.api-blue.loadbalancer.server.port=8080",
+				"traefik.http.services.metrics-blue.loadbalancer.server.port=9090",
+				"traefik.http.routers.api.service=api@internal",
+			},
+			services: []string{"api", "metrics"},
+		},
+		{
+			name:   "no Traefik labels",
+			labels: []string{"com.example.team=core"},
+			want:   []string{"com.example.team=core"},
+		},
+	}
+	for _, test := range tests {
+		labels, services := colorLabels(test.labels, "blue")
+		if !slices.Equal(labels, test.want) || !slices.Equal(services, test.services) {
+			t.Errorf("%s: colorLabels = %v, %v\nwant %v, %v", test.name, labels, services, test.want, test.services)
+		}
+	}
+}
+
+func TestApplyReleases(t *testing.T) {
+	dockerCompose := DockerComposeConfig{Services: map[string]DockerComposeService{
+		"api": {
+			Build:       map[string]any{"context": "./api"},
+			Volumes:     []any{"./api:/app", "api-cache:/cache"},
+			Environment: []any{"PORT=8080"},
+			Ports:       []any{"8080:8080"},
+			Networks:    []any{"infra-network"},
+			Labels: []any{
+				"traefik.http.routers.api.rule=Host(`api.localhost`)",
+				"traefik.http.services.api.loadbalancer.server.port=8080",
+			},
+		},
+		"frontend": {DependsOn: []any{"api"}},
+	}}
+	state := ReleaseState{Services: map[string]*ServiceRelease{
+		"api":     {Active: "blue", Weight: 10, Images: map[string]string{"green": "registry.example.com/api:2.0"}},
+		"removed": {Active: "green"},
+	}}
+
+	weighted := applyReleases(&dockerCompose, state, "docker")
+
+	if _, ok := dockerCompose.Services["api"]; ok {
+		t.Error("the released service was kept next to its variants")
+	}
+	if _, ok := dockerCompose.Services["removed-green"]; ok {
+		t.Error("a release of a service missing from the compose file got variants")
+	}
+	blue, green := dockerCompose.Services["api-blue"], dockerCompose.Services["api-green"]
+
+	// The active color keeps the build, the host ports and the original name on the network
+	if blue.Build == nil || len(blue.Ports.([]any)) != 1 || !slices.Equal(blue.Volumes.([]any), []any{"./api:/app", "api-cache:/cache"}) {
+		t.Errorf("blue variant = %+v", blue)
+	}
+	wantNetworks := map[string]any{"infra-network": map[string]any{"aliases": []any{"api"}}}
+	if !reflect.DeepEqual(blue.Networks, wantNetworks) {
+		t.Errorf("blue networks = %v, want %v", blue.Networks, wantNetworks)
+	}
+
+	// The candidate runs its released image without the source mount and without host ports
+	if green.Image != "registry.example.com/api:2.0" || green.Build != nil || green.Ports != nil {
+		t.Errorf("green variant = %+v", green)
+	}
+	if !slices.Equal(green.Volumes.([]any), []any{"api-cache:/cache"}) {
+		t.Errorf("green volumes = %v, want the source bind mount removed", green.Volumes)
+	}
+	if !slices.Equal(green.Environment.([]any), []any{"PORT=8080", "RELEASE_COLOR=green"}) {
+		t.Errorf("green environment = %v", green.Environment)
+	}
+	if !slices.Equal(blue.Environment.([]any), []any{"PORT=8080", "RELEASE_COLOR=blue"}) {
+		t.Errorf("blue environment = %v", blue.Environment)
+	}
+
+	if dependsOn := dockerCompose.Services["frontend"].DependsOn; !slices.Equal(dependsOn.([]any), []any{"api-blue"}) {
+		t.Errorf("frontend depends_on = %v, want the active color", dependsOn)
+	}
+
+	want := map[string]any{"api": map[string]any{"weighted": map[string]any{"services": []any{
+		map[string]any{"name": "api-blue@docker", "weight": 90},
+		map[string]any{"name": "api-green@docker", "weight": 10},
+	}}}}
+	if !reflect.DeepEqual(weighted, want) {
+		t.Errorf("weighted services = %v\nwant %v", weighted, want)
+	}
+}
+
+func TestApplyReleasesSkipsEmptyWeights(t *testing.T) {
+	dockerCompose := DockerComposeConfig{Services: map[string]DockerComposeService{
+		"api": {Labels: []any{"traefik.http.services.api.loadbalancer.server.port=8080"}},
+	}}
+	state := ReleaseState{Services: map[string]*ServiceRelease{"api": {Active: "green", Weight: 0}}}
+
+	weighted := applyReleases(&dockerCompose, state, "file")
+
+	want := map[string]any{"api": map[string]any{"weighted": map[string]any{"services": []any{
+		map[string]any{"name": "api-green@file", "weight": 100},
+	}}}}
+	if !reflect.DeepEqual(weighted, want) {
+		t.Errorf("weighted services = %v\nwant %v", weighted, want)
+	}
+}
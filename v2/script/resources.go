@@ -0,0 +1,418 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// builtinResourceProfiles are the profiles available without a resources section, sized after the services of docker-stack.yml
+var builtinResourceProfiles = map[string]ResourceSettings{
+	"small": {
+		Limits:       ResourceValues{CPUs: "0.25", Memory: "128M"},
+		Reservations: ResourceValues{CPUs: "0.1", Memory: "64M"},
+	},
+	"medium": {
+		Limits:       ResourceValues{CPUs: "0.5", Memory: "256M"},
+		Reservations: ResourceValues{CPUs: "0.25", Memory: "128M"},
+	},
+	"large": {
+		Limits:       ResourceValues{CPUs: "1", Memory: "512M"},
+		Reservations: ResourceValues{CPUs: "0.5", Memory: "256M"},
+	},
+}
+
+// memoryPattern matches the byte values of docker compose, like 512M, 1.5g or 256MiB
+var memoryPattern = regexp.MustCompile(`(?i)^([0-9]+(?:\.[0-9]+)?)\s*([kmgt]?)(i?b)?$`)
+
+// parseMemory returns the number of bytes of a memory value, units are powers of 1024 as in docker
+func parseMemory(value string) (int64, error) {
+	match := memoryPattern.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil {
+		return 0, fmt.Errorf("invalid memory %q, expected a value like 256M or 1G", value)
+	}
+	amount, _ := strconv.ParseFloat(match[1], 64)
+	exponent := 0
+	if match[2] != "" {
+		exponent = strings.Index("kmgt", strings.ToLower(match[2])) + 1
+	}
+
+	bytes := amount
+	for range exponent {
+		bytes *= 1024
+	}
+
+	return int64(bytes), nil
+}
+
+// parseCPUs returns the number of CPUs of a cpus value
+func parseCPUs(value string) (float64, error) {
+	cpus, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || cpus < 0 {
+		return 0, fmt.Errorf("invalid cpus %q, expected a value like 0.5 or 2", value)
+	}
+
+	return cpus, nil
+}
+
+// formatMemory renders a number of bytes in the largest unit that keeps it readable
+func formatMemory(bytes int64) string {
+	value := float64(bytes)
+	for _, unit := range []string{"", "K", "M", "G"} {
+		if value < 1024 {
+			return strconv.FormatFloat(value, 'f', -1, 64) + unit
+		}
+		value = float64(int64(value/1024*100)) / 100
+	}
+
+	return strconv.FormatFloat(value, 'f', -1, 64) + "T"
+}
+
+// formatCPUs renders a number of CPUs without trailing zeros
+func formatCPUs(cpus float64) string {
+	return strconv.FormatFloat(float64(int64(cpus*1000+0.5))/1000, 'f', -1, 64)
+}
+
+// mergeResourceValues overrides the fields of base that are set in override
+func mergeResourceValues(base ResourceValues, override ResourceValues) ResourceValues {
+	if override.CPUs != "" {
+		base.CPUs = override.CPUs
+	}
+	if override.Memory != "" {
+		base.Memory = override.Memory
+	}
+
+	return base
+}
+
+// mergeResourceSettings overrides base with the settings of an environment. Selecting a profile in the override
+// replaces the explicit values of base, which were refining the previous profile.
+func mergeResourceSettings(base ResourceSettings, override ResourceSettings) ResourceSettings {
+	if override.Profile != "" {
+		base = ResourceSettings{Profile: override.Profile}
+	}
+	base.Limits = mergeResourceValues(base.Limits, override.Limits)
+	base.Reservations = mergeResourceValues(base.Reservations, override.Reservations)
+
+	return base
+}
+
+// resourceProfile returns a built-in profile, or a profile of the resources section refining it
+func resourceProfile(config Config, name string) (ResourceSettings, bool) {
+	builtin, isBuiltin := builtinResourceProfiles[name]
+	custom, isCustom := config.Resources.Profiles[name]
+	if !isBuiltin && !isCustom {
+		return ResourceSettings{}, false
+	}
+
+	return ResourceSettings{
+		Limits:       mergeResourceValues(builtin.Limits, custom.Limits),
+		Reservations: mergeResourceValues(builtin.Reservations, custom.Reservations),
+	}, true
+}
+
+// resolveResourceSettings expands the profile of the settings and applies their explicit values
+func resolveResourceSettings(config Config, settings ResourceSettings) (ResourceSettings, error) {
+	resolved := ResourceSettings{Profile: settings.Profile}
+	if settings.Profile != "" {
+		profile, ok := resourceProfile(config, settings.Profile)
+		if !ok {
+			return resolved, fmt.Errorf("unknown resource profile %q", settings.Profile)
+		}
+		resolved.Limits = profile.Limits
+		resolved.Reservations = profile.Reservations
+	}
+	resolved.Limits = mergeResourceValues(resolved.Limits, settings.Limits)
+	resolved.Reservations = mergeResourceValues(resolved.Reservations, settings.Reservations)
+
+	return resolved, validateResourceValues(resolved)
+}
+
+// validateResourceValues checks the values parse and no reservation exceeds its limit
+func validateResourceValues(settings ResourceSettings) error {
+	for _, values := range []ResourceValues{settings.Limits, settings.Reservations} {
+		if values.CPUs != "" {
+			if _, err := parseCPUs(values.CPUs); err != nil {
+				return err
+			}
+		}
+		if values.Memory != "" {
+			if _, err := parseMemory(values.Memory); err != nil {
+				return err
+			}
+		}
+	}
+
+	if settings.Limits.CPUs != "" && settings.Reservations.CPUs != "" {
+		limit, _ := parseCPUs(settings.Limits.CPUs)
+		reservation, _ := parseCPUs(settings.Reservations.CPUs)
+		if reservation > limit {
+			return fmt.Errorf("cpus reservation %s exceeds the limit %s", settings.Reservations.CPUs, settings.Limits.CPUs)
+		}
+	}
+	if settings.Limits.Memory != "" && settings.Reservations.Memory != "" {
+		limit, _ := parseMemory(settings.Limits.Memory)
+		reservation, _ := parseMemory(settings.Reservations.Memory)
+		if reservation > limit {
+			return fmt.Errorf("memory reservation %s exceeds the limit %s", settings.Reservations.Memory, settings.Limits.Memory)
+		}
+	}
+
+	return nil
+}
+
+// serviceResources returns the resolved resources of a service in an environment, false when it declares none
+func serviceResources(config Config, service ServiceConfig, environment string) (ResourceSettings, bool, error) {
+	if service.Resources == nil {
+		return ResourceSettings{}, false, nil
+	}
+	settings := mergeResourceSettings(service.Resources.ResourceSettings, service.Resources.Environments[environment])
+	resolved, err := resolveResourceSettings(config, settings)
+	if err != nil {
+		return resolved, true, fmt.Errorf("service %s: %v", service.Name, err)
+	}
+
+	return resolved, true, nil
+}
+
+// resourceNodes returns the nodes declared for an environment, falling back to the nodes of the resources section
+func resourceNodes(config Config, environment string) []NodeConfig {
+	if override, ok := config.Resources.Environments[environment]; ok && len(override.Nodes) > 0 {
+		return override.Nodes
+	}
+
+	return config.Resources.Nodes
+}
+
+// validateResourcesConfig reports invalid profiles, service resources, monitoring profiles and nodes
+func validateResourcesConfig(config Config) []string {
+	var problems []string
+	for name, profile := range config.Resources.Profiles {
+		if profile.Profile != "" {
+			problems = append(problems, fmt.Sprintf("resource profile %s: profiles cannot refer to another profile", name))
+		}
+		if err := validateResourceValues(profile); err != nil {
+			problems = append(problems, fmt.Sprintf("resource profile %s: %v", name, err))
+		}
+	}
+
+	environments := map[string]bool{"": true}
+	for _, service := range getAllServiceConfigs(config) {
+		if service.Resources != nil {
+			for environment := range service.Resources.Environments {
+				environments[environment] = true
+			}
+		}
+	}
+	for _, service := range getAllServiceConfigs(config) {
+		for environment := range environments {
+			if _, _, err := serviceResources(config, service, environment); err != nil {
+				if environment != "" {
+					err = fmt.Errorf("%v (%s environment)", err, environment)
+				}
+				problems = append(problems, err.Error())
+				break
+			}
+		}
+	}
+
+	for tool, profile := range config.Monitoring.Resources {
+		if _, ok := resourceProfile(config, profile); !ok {
+			problems = append(problems, fmt.Sprintf("monitoring resources %s: unknown resource profile %q", tool, profile))
+		}
+	}
+
+	checkNodes := func(where string, nodes []NodeConfig) {
+		for _, node := range nodes {
+			if node.Role != "" && node.Role != "manager" && node.Role != "worker" {
+				problems = append(problems, fmt.Sprintf("%s node %s: role must be manager or worker, not %q", where, node.Name, node.Role))
+			}
+			if _, err := parseCPUs(node.CPUs); err != nil {
+				problems = append(problems, fmt.Sprintf("%s node %s: %v", where, node.Name, err))
+			}
+			if _, err := parseMemory(node.Memory); err != nil {
+				problems = append(problems, fmt.Sprintf("%s node %s: %v", where, node.Name, err))
+			}
+		}
+	}
+	checkNodes("resources", config.Resources.Nodes)
+	for environment, override := range config.Resources.Environments {
+		checkNodes("resources environment "+environment, override.Nodes)
+	}
+
+	return problems
+}
+
+// composeResources returns the deploy.resources section of a service
+func composeResources(settings ResourceSettings) map[string]any {
+	resources := make(map[string]any)
+	for key, values := range map[string]ResourceValues{"limits": settings.Limits, "reservations": settings.Reservations} {
+		entry := make(map[string]any)
+		if values.CPUs != "" {
+			entry["cpus"] = values.CPUs
+		}
+		if values.Memory != "" {
+			entry["memory"] = values.Memory
+		}
+		if len(entry) > 0 {
+			resources[key] = entry
+		}
+	}
+
+	return resources
+}
+
+// applyResources sets deploy.resources on the services declaring resources, keeping the rest of their deploy section
+func applyResources(dockerCompose *DockerComposeConfig, configFile string, environment string) error {
+	config := getConfig(configFile)
+	if problems := validateResourcesConfig(config); len(problems) > 0 {
+		return fmt.Errorf("invalid resources configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	applied := 0
+	for _, serviceConfig := range getAllServiceConfigs(config) {
+		service, ok := dockerCompose.Services[serviceConfig.Name]
+		if !ok {
+			continue
+		}
+		settings, declared, _ := serviceResources(config, serviceConfig, environment)
+		if !declared {
+			continue
+		}
+
+		if service.ExtraFields == nil {
+			service.ExtraFields = make(map[string]any)
+		}
+		deploy, _ := service.ExtraFields["deploy"].(map[string]any)
+		if deploy == nil {
+			deploy = make(map[string]any)
+		}
+		deploy["resources"] = composeResources(settings)
+		service.ExtraFields["deploy"] = deploy
+		dockerCompose.Services[serviceConfig.Name] = service
+		applied++
+	}
+
+	if applied > 0 {
+		fmt.Printf("  Applied resource limits to %d services (%s environment)\n", applied, environment)
+	}
+
+	return nil
+}
+
+// monitoringStackResources returns the resources of a monitoring service from its profile in the monitoring section
+func monitoringStackResources(config Config, name string) (*StackResources, bool) {
+	profileName, ok := config.Monitoring.Resources[name]
+	if !ok {
+		return nil, false
+	}
+	profile, ok := resourceProfile(config, profileName)
+	if !ok {
+		return nil, false
+	}
+
+	return &StackResources{
+		Limits:       StackResourceValues{Memory: profile.Limits.Memory, CPUs: profile.Limits.CPUs},
+		Reservations: StackResourceValues{Memory: profile.Reservations.Memory, CPUs: profile.Reservations.CPUs},
+	}, true
+}
+
+// renderStackResources renders a resources section in the layout of docker-stack.yml
+func renderStackResources(settings ResourceSettings) []string {
+	lines := []string{"resources:"}
+	for _, entry := range []struct {
+		key    string
+		values ResourceValues
+	}{{"limits", settings.Limits}, {"reservations", settings.Reservations}} {
+		if entry.values == (ResourceValues{}) {
+			continue
+		}
+		lines = append(lines, "  "+entry.key+":")
+		if entry.values.Memory != "" {
+			lines = append(lines, "    memory: "+entry.values.Memory)
+		}
+		if entry.values.CPUs != "" {
+			lines = append(lines, "    cpus: '"+entry.values.CPUs+"'")
+		}
+	}
+
+	return lines
+}
+
+// stackServiceName returns the name of a configured service in docker-stack.yml
+func stackServiceName(service ServiceConfig) string {
+	return valueOrDefault(service.StackName, service.Name)
+}
+
+// updateStackResources rewrites the deploy.resources section of the configured services in a stack file,
+// editing the lines in place so comments and the layout of the rest of the file are kept
+func updateStackResources(stackFile string, config Config, environment string) error {
+	stackYAML, err := loadYAMLFile(stackFile)
+	if err != nil {
+		return err
+	}
+	_, services := mappingEntry(stackYAML.Root, "services")
+	if services == nil {
+		return fmt.Errorf("%s has no services section", stackFile)
+	}
+
+	updated := 0
+	var missing []string
+	for _, serviceConfig := range getAllServiceConfigs(config) {
+		settings, declared, err := serviceResources(config, serviceConfig, environment)
+		if err != nil {
+			return err
+		}
+		if !declared {
+			continue
+		}
+		name := stackServiceName(serviceConfig)
+		_, service := mappingEntry(services, name)
+		if service == nil || service.Kind != yaml.MappingNode || len(service.Content) == 0 {
+			missing = append(missing, name)
+			continue
+		}
+
+		block := renderStackResources(settings)
+		_, deploy := mappingEntry(service, "deploy")
+		switch {
+		case deploy == nil:
+			// Append a deploy section at the end of the service
+			indent := strings.Repeat(" ", service.Content[0].Column-1)
+			lines := append([]string{"deploy:"}, indentLines(block, "  ")...)
+			err = stackYAML.InsertLines(nodeEndLine(service)+1, indentLines(lines, indent))
+		case deploy.Kind != yaml.MappingNode || len(deploy.Content) == 0:
+			return fmt.Errorf("%s: deploy section of %s is not a mapping", stackFile, name)
+		default:
+			indent := strings.Repeat(" ", deploy.Content[0].Column-1)
+			resourcesKey, resources := mappingEntry(deploy, "resources")
+			insertAt := nodeEndLine(deploy) + 1
+			if resources != nil {
+				insertAt = resourcesKey.Line
+				if err := stackYAML.RemoveLines(resourcesKey.Line, nodeEndLine(resources)); err != nil {
+					return err
+				}
+			}
+			err = stackYAML.InsertLines(insertAt, indentLines(block, indent))
+		}
+		if err != nil {
+			return err
+		}
+		// Line positions changed, look the services up again in the reloaded tree
+		_, services = mappingEntry(stackYAML.Root, "services")
+		updated++
+	}
+
+	if err := stackYAML.Save(); err != nil {
+		return err
+	}
+	fmt.Printf("Updated the resources of %d services in %s (%s environment)\n", updated, stackFile, environment)
+	if len(missing) > 0 {
+		fmt.Printf("  Not in the stack file, set stack_name when the service is named differently: %s\n", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseMemory(t *testing.T) {
+	tests := []struct {
+		value string
+		bytes int64
+		ok    bool
+	}{
+		{"512", 512, true},
+		{"512b", 512, true},
+		{"64k", 64 << 10, true},
+		{"256M", 256 << 20, true},
+		{"256MiB", 256 << 20, true},
+		{"256mb", 256 << 20, true},
+		{"1.5g", 3 << 29, true},
+		{" 2G ", 2 << 30, true},
+		{"1T", 1 << 40, true},
+		{"", 0, false},
+		{"-1G", 0, false},
+		{"1.5.2G", 0, false},
+		{"256 megabytes", 0, false},
+		{"1P", 0, false},
+	}
+	for _, test := range tests {
+		bytes, err := parseMemory(test.value)
+		if (err == nil) != test.ok || bytes != test.bytes {
+			t.Errorf("parseMemory(%q) = %d, %v, want %d (valid: %v)", test.value, bytes, err, test.bytes, test.ok)
+		}
+	}
+}
+
+func TestParseCPUs(t *testing.T) {
+	tests := []struct {
+		value string
+		cpus  float64
+		ok    bool
+	}{
+		{"0.5", 0.5, true},
+		{"2", 2, true},
+		{" 0.25 ", 0.25, true},
+		{"0", 0, true},
+		{"-1", 0, false},
+		{"half", 0, false},
+		{"", 0, false},
+	}
+	for _, test := range tests {
+		cpus, err := parseCPUs(test.value)
+		if (err == nil) != test.ok || cpus != test.cpus {
+			t.Errorf("parseCPUs(%q) = %v, %v, want %v (valid: %v)", test.value, cpus, err, test.cpus, test.ok)
+		}
+	}
+}
+
+func TestFormatResources(t *testing.T) {
+	for bytes, want := range map[int64]string{512: "512", 64 << 10: "64K", 256 << 20: "256M", 3 << 29: "1.5G", 2 << 40: "2T"} {
+		if got := formatMemory(bytes); got != want {
+			t.Errorf("formatMemory(%d) = %s, want %s", bytes, got, want)
+		}
+	}
+	for cpus, want := range map[float64]string{0.5: "0.5", 2: "2", 0.1 + 0.2: "0.3", 1.0 / 3: "0.333"} {
+		if got := formatCPUs(cpus); got != want {
+			t.Errorf("formatCPUs(%v) = %s, want %s", cpus, got, want)
+		}
+	}
+}
+
+func TestResolveResourceSettings(t *testing.T) {
+	config := Config{Resources: ResourcesConfig{Profiles: map[string]ResourceSettings{
+		"medium": {Limits: ResourceValues{Memory: "384M"}},
+		"worker": {Limits: ResourceValues{CPUs: "2", Memory: "2G"}, Reservations: ResourceValues{CPUs: "1", Memory: "1G"}},
+	}}}
+
+	tests := []struct {
+		name     string
+		settings ResourceSettings
+		want     ResourceSettings
+		error    string
+	}{
+		{
+			name:     "built-in profile refined by the resources section",
+			settings: ResourceSettings{Profile: "medium"},
+			want:     ResourceSettings{Profile: "medium", Limits: ResourceValues{CPUs: "0.5", Memory: "384M"}, Reservations: ResourceValues{CPUs: "0.25", Memory: "128M"}},
+		},
+		{
+			name:     "explicit values override the profile",
+			settings: ResourceSettings{Profile: "worker", Reservations: ResourceValues{Memory: "512M"}},
+			want:     ResourceSettings{Profile: "worker", Limits: ResourceValues{CPUs: "2", Memory: "2G"}, Reservations: ResourceValues{CPUs: "1", Memory: "512M"}},
+		},
+		{
+			name:     "unknown profile",
+			settings: ResourceSettings{Profile: "huge"},
+			error:    "unknown resource profile",
+		},
+		{
+			name:     "reservation above the limit",
+			settings: ResourceSettings{Profile: "small", Reservations: ResourceValues{Memory: "1G"}},
+			error:    "memory reservation 1G exceeds the limit 128M",
+		},
+		{
+			name:     "invalid value",
+			settings: ResourceSettings{Limits: ResourceValues{CPUs: "lots"}},
+			error:    "invalid cpus",
+		},
+	}
+	for _, test := range tests {
+		resolved, err := resolveResourceSettings(config, test.settings)
+		if test.error != "" {
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("%s: error = %v, want %q", test.name, err, test.error)
+			}
+			continue
+		}
+		if err != nil || resolved != test.want {
+			t.Errorf("%s: resolved = %+v, %v\nwant %+v", test.name, resolved, err, test.want)
+		}
+	}
+
+	// Selecting another profile for an environment drops the values refining the base profile
+	merged := mergeResourceSettings(ResourceSettings{Profile: "small", Limits: ResourceValues{Memory: "192M"}}, ResourceSettings{Profile: "large"})
+	if merged != (ResourceSettings{Profile: "large"}) {
+		t.Errorf("merged = %+v, want the large profile alone", merged)
+	}
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	serviceNamePattern   = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+	servicePrefixPattern = regexp.MustCompile(`^[A-Z][A-Z0-9_]*_$`)
+)
+
+// ScaffoldOptions describes a service to add with `deployment add-service`
+type ScaffoldOptions struct {
+	Name        string
+	Prefix      string
+	Groups      []string
+	Domain      string
+	PathPrefix  string
+	PortVar     string
+	DependsOn   []string
+	Variables   []string
+	Healthcheck string
+}
+
+// defaultServicePrefix derives the env prefix from the service name, like auto-discovery does
+func defaultServicePrefix(serviceName string) string {
+	return strings.ToUpper(strings.ReplaceAll(serviceName, "-", "_")) + "_"
+}
+
+// promptValue asks for a value on stdin, returning the default when the answer is empty
+func promptValue(reader *bufio.Reader, label string, defaultValue string) string {
+	if defaultValue != "" {
+		fmt.Printf("%s [%s]: ", label, defaultValue)
+	} else {
+		fmt.Printf("%s: ", label)
+	}
+
+	answer, _ := reader.ReadString('\n')
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return defaultValue
+	}
+
+	return answer
+}
+
+// promptScaffoldOptions fills in the scaffold options interactively
+func promptScaffoldOptions(options *ScaffoldOptions) {
+	reader := bufio.NewReader(os.Stdin)
+
+	options.Name = promptValue(reader, "Service name", options.Name)
+	if options.Prefix == "" && options.Name != "" {
+		options.Prefix = defaultServicePrefix(options.Name)
+	}
+	options.Prefix = promptValue(reader, "Environment variable prefix", options.Prefix)
+	options.Groups = parseSelector(promptValue(reader, "Groups (comma separated)", strings.Join(options.Groups, ",")))
+	options.PathPrefix = promptValue(reader, "Traefik path prefix (empty for no routing)", options.PathPrefix)
+	if options.PathPrefix != "" {
+		options.Domain = promptValue(reader, "Public domain", options.Domain)
+		options.PortVar = promptValue(reader, "Port variable", options.PortVar)
+	}
+	options.DependsOn = parseSelector(promptValue(reader, "Depends on (comma separated)", strings.Join(options.DependsOn, ",")))
+	options.Variables = parseSelector(promptValue(reader, "Variables for .env.example (comma separated)", strings.Join(options.Variables, ",")))
+	options.Healthcheck = promptValue(reader, "Healthcheck type (http, tcp or none)", options.Healthcheck)
+}
+
+// validateScaffoldOptions checks the name and prefix against the existing config and template
+func validateScaffoldOptions(options ScaffoldOptions, config Config, templateServices map[string]bool) error {
+	if !serviceNamePattern.MatchString(options.Name) {
+		return fmt.Errorf("invalid service name %q: use lowercase letters, digits and dashes", options.Name)
+	}
+	if !servicePrefixPattern.MatchString(options.Prefix) {
+		return fmt.Errorf("invalid prefix %q: use uppercase letters, digits and underscores, ending with _", options.Prefix)
+	}
+	if templateServices[options.Name] {
+		return fmt.Errorf("service %s is already defined in the template", options.Name)
+	}
+
+	for _, service := range getAllServiceConfigs(config) {
+		if service.Name == options.Name {
+			return fmt.Errorf("service %s is already defined in the config", options.Name)
+		}
+		if service.Prefix == options.Prefix {
+			return fmt.Errorf("prefix %s is already used by service %s", options.Prefix, service.Name)
+		}
+		if strings.HasPrefix(service.Prefix, options.Prefix) || strings.HasPrefix(options.Prefix, service.Prefix) {
+			fmt.Printf("Warning: prefix %s overlaps with prefix %s of service %s\n", options.Prefix, service.Prefix, service.Name)
+		}
+	}
+
+	for _, dependency := range options.DependsOn {
+		if !templateServices[dependency] {
+			return fmt.Errorf("dependency %s is not defined in the template", dependency)
+		}
+	}
+
+	switch options.Healthcheck {
+	case "", "none", "http", "tcp":
+	default:
+		return fmt.Errorf("unsupported healthcheck type %q", options.Healthcheck)
+	}
+
+	return nil
+}
+
+// AddService scaffolds a new service in the config, the template and the service directory
+func AddService(options ScaffoldOptions, interactive bool, configFile string, templateFile string, serviceDir string, consolidatedEnvFile string, outputFile string, regenerate bool) {
+	scriptDir, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("Error getting current directory: %v\n", err)
+		return
+	}
+
+	configFile = resolveFilePath(configFile, scriptDir, scriptDir)
+	templateFile = resolveFilePath(templateFile, scriptDir, scriptDir)
+	if serviceDir == "" {
+		serviceDir = scriptDir
+	} else {
+		serviceDir = resolveFilePath(serviceDir, scriptDir, scriptDir)
+	}
+
+	if interactive || options.Name == "" {
+		promptScaffoldOptions(&options)
+	}
+	if options.Prefix == "" {
+		options.Prefix = defaultServicePrefix(options.Name)
+	}
+	if options.PathPrefix != "" && !strings.HasPrefix(options.PathPrefix, "/") {
+		options.PathPrefix = "/" + options.PathPrefix
+	}
+
+	configYAML, err := loadYAMLFile(configFile)
+	if err != nil {
+		fmt.Printf("Error loading services config file: %v\n", err)
+		return
+	}
+	templateYAML, err := loadYAMLFile(templateFile)
+	if err != nil {
+		fmt.Printf("Error loading template file: %v\n", err)
+		return
+	}
+
+	_, templateServicesNode := mappingEntry(templateYAML.Root, "services")
+	if templateServicesNode == nil || templateServicesNode.Kind != yaml.MappingNode {
+		fmt.Printf("Template file %s has no services section\n", templateFile)
+		return
+	}
+	templateServices := make(map[string]bool)
+	for i := 0; i < len(templateServicesNode.Content); i += 2 {
+		templateServices[templateServicesNode.Content[i].Value] = true
+	}
+
+	if err := validateScaffoldOptions(options, getConfig(configFile), templateServices); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	// Append the config entry after the last application service
+	_, servicesNode := mappingEntry(configYAML.Root, "services")
+	if servicesNode == nil || servicesNode.Kind != yaml.SequenceNode || len(servicesNode.Content) == 0 {
+		fmt.Printf("Services config file %s has no services list\n", configFile)
+		return
+	}
+	lastService := servicesNode.Content[len(servicesNode.Content)-1]
+	if err := configYAML.InsertLines(nodeEndLine(lastService)+1, renderServiceConfigEntry(options)); err != nil {
+		fmt.Printf("Error adding service to config: %v\n", err)
+		return
+	}
+
+	// Insert the template block in alphabetical order
+	insertBefore := nodeEndLine(templateServicesNode) + 1
+	for i := 0; i < len(templateServicesNode.Content); i += 2 {
+		if templateServicesNode.Content[i].Value > options.Name {
+			insertBefore = templateServicesNode.Content[i].Line
+			break
+		}
+	}
+	block := renderTemplateServiceBlock(options, templateAppNetwork(templateYAML.Root))
+	if err := templateYAML.InsertLines(insertBefore, block); err != nil {
+		fmt.Printf("Error adding service to template: %v\n", err)
+		return
+	}
+
+	if err := configYAML.Save(); err != nil {
+		fmt.Printf("Error writing services config file: %v\n", err)
+		return
+	}
+	fmt.Printf("Added %s to %s\n", options.Name, configFile)
+
+	if err := templateYAML.Save(); err != nil {
+		fmt.Printf("Error writing template file: %v\n", err)
+		return
+	}
+	fmt.Printf("Added %s to %s\n", options.Name, templateFile)
+
+	if err := scaffoldServiceDirectory(filepath.Join(serviceDir, options.Name), options); err != nil {
+		fmt.Printf("Error creating service directory: %v\n", err)
+		return
+	}
+
+	if regenerate {
+		regenerateOutputs(configFile, templateFile, serviceDir, consolidatedEnvFile, outputFile)
+	}
+}
+
+// renderServiceConfigEntry renders the services-config.yaml entry in the style of the existing entries
+func renderServiceConfigEntry(options ScaffoldOptions) []string {
+	lines := []string{
+		"",
+		fmt.Sprintf("  - name: %s", options.Name),
+		fmt.Sprintf("    env_file: %s/.env", options.Name),
+		fmt.Sprintf("    prefix: %q", options.Prefix),
+	}
+	if len(options.Groups) > 0 {
+		lines = append(lines, fmt.Sprintf("    groups: [%s]", strings.Join(options.Groups, ", ")))
+	}
+	if options.Domain != "" {
+		lines = append(lines, fmt.Sprintf("    domain: %q", options.Domain))
+	}
+	if options.Healthcheck != "" && options.Healthcheck != "none" {
+		lines = append(lines,
+			"    healthcheck:",
+			fmt.Sprintf("      type: %s", options.Healthcheck),
+			fmt.Sprintf("      port: %s", options.PortVar),
+		)
+		if options.Healthcheck == "http" {
+			lines = append(lines, "      path: /health")
+		}
+	}
+
+	return lines
+}
+
+// renderTemplateServiceBlock renders the docker-compose.template.yml block for a new service
+func renderTemplateServiceBlock(options ScaffoldOptions, appNetwork string) []string {
+	lines := []string{
+		fmt.Sprintf("%s:", options.Name),
+		"    build:",
+		fmt.Sprintf("        context: ./%s", options.Name),
+		"        dockerfile: dev.Dockerfile",
+		"",
+		"    environment:",
+		`        - ""`,
+	}
+
+	if options.PathPrefix != "" {
+		lines = append(lines,
+			"    labels:",
+			"        - traefik.enable=true",
+			fmt.Sprintf("        - traefik.http.routers.%s.rule=Host(`localhost`) && PathPrefix(`%s`)", options.Name, options.PathPrefix),
+			fmt.Sprintf("        - traefik.http.services.%s.loadbalancer.server.port=${%s%s}", options.Name, options.Prefix, options.PortVar),
+		)
+	}
+
+	lines = append(lines,
+		"    volumes:",
+		fmt.Sprintf("        - ./%s:/app", options.Name),
+		"    networks:",
+	)
+	if options.PathPrefix != "" {
+		lines = append(lines, "        - traefik-network")
+	}
+	lines = append(lines, "        - "+appNetwork)
+
+	if len(options.DependsOn) > 0 {
+		lines = append(lines, "    depends_on:")
+		for _, dependency := range options.DependsOn {
+			lines = append(lines, "        - "+dependency)
+		}
+	}
+
+	return indentLines(lines, "    ")
+}
+
+// templateAppNetwork returns the network shared by application and infrastructure services
+func templateAppNetwork(root *yaml.Node) string {
+	_, networks := mappingEntry(root, "networks")
+	if networks != nil {
+		for i := 0; i < len(networks.Content); i += 2 {
+			if name := networks.Content[i].Value; name != "traefik-network" {
+				return name
+			}
+		}
+	}
+
+	return "infra-network"
+}
+
+// scaffoldServiceDirectory creates the service directory with .env.example and a matching .env
+func scaffoldServiceDirectory(directory string, options ScaffoldOptions) error {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+
+	variables := append([]string{}, options.Variables...)
+	if options.PortVar != "" && !slices.Contains(variables, options.PortVar) {
+		variables = append([]string{options.PortVar}, variables...)
+	}
+
+	var content strings.Builder
+	for _, variable := range variables {
+		content.WriteString(variable + "=\n")
+	}
+
+	examplePath := filepath.Join(directory, ".env.example")
+	if _, err := os.Stat(examplePath); err == nil {
+		fmt.Printf("Keeping existing %s\n", examplePath)
+	} else {
+		if err := os.WriteFile(examplePath, []byte(content.String()), 0644); err != nil {
+			return err
+		}
+		fmt.Printf("Created %s\n", examplePath)
+	}
+
+	envPath := filepath.Join(directory, ".env")
+	if _, err := os.Stat(envPath); err == nil {
+		fmt.Printf("Keeping existing %s\n", envPath)
+	} else {
+		if err := os.WriteFile(envPath, []byte(content.String()), 0644); err != nil {
+			return err
+		}
+		fmt.Printf("Created %s\n", envPath)
+	}
+
+	return nil
+}
+
+// RemoveService undoes AddService: config entry, template block, depends_on references and scaffolded files
+func RemoveService(serviceName string, purge bool, assumeYes bool, configFile string, templateFile string, serviceDir string, consolidatedEnvFile string, outputFile string, regenerate bool) {
+	scriptDir, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("Error getting current directory: %v\n", err)
+		return
+	}
+
+	configFile = resolveFilePath(configFile, scriptDir, scriptDir)
+	templateFile = resolveFilePath(templateFile, scriptDir, scriptDir)
+	if serviceDir == "" {
+		serviceDir = scriptDir
+	} else {
+		serviceDir = resolveFilePath(serviceDir, scriptDir, scriptDir)
+	}
+
+	if serviceName == "" {
+		fmt.Println("Error: -name is required")
+		return
+	}
+
+	if !assumeYes {
+		fmt.Printf("Remove service %s from %s and %s? (y/n): ", serviceName, configFile, templateFile)
+		var answer string
+		fmt.Scanln(&answer)
+		if strings.ToLower(answer) != "y" {
+			fmt.Println("Operation cancelled.")
+			return
+		}
+	}
+
+	configYAML, err := loadYAMLFile(configFile)
+	if err != nil {
+		fmt.Printf("Error loading services config file: %v\n", err)
+		return
+	}
+	templateYAML, err := loadYAMLFile(templateFile)
+	if err != nil {
+		fmt.Printf("Error loading template file: %v\n", err)
+		return
+	}
+
+	removed := false
+	for _, section := range []string{"common_services", "services"} {
+		_, sequence := mappingEntry(configYAML.Root, section)
+		if _, item := sequenceItemByName(sequence, serviceName); item != nil {
+			// The commented-out examples of the entry go with it
+			end := configYAML.commentBlockEnd(nodeEndLine(item), item.Column-1)
+			if err := configYAML.RemoveLines(item.Line, end); err != nil {
+				fmt.Printf("Error removing service from config: %v\n", err)
+				return
+			}
+			removed = true
+		}
+	}
+	if removed {
+		fmt.Printf("Removed %s from %s\n", serviceName, configFile)
+	} else {
+		fmt.Printf("Service %s not found in %s\n", serviceName, configFile)
+	}
+
+	if err := removeTemplateService(templateYAML, serviceName); err != nil {
+		fmt.Printf("Error removing service from template: %v\n", err)
+		return
+	}
+
+	if err := configYAML.Save(); err != nil {
+		fmt.Printf("Error writing services config file: %v\n", err)
+		return
+	}
+	if err := templateYAML.Save(); err != nil {
+		fmt.Printf("Error writing template file: %v\n", err)
+		return
+	}
+
+	removeServiceDirectory(filepath.Join(serviceDir, serviceName), purge)
+
+	if regenerate {
+		regenerateOutputs(configFile, templateFile, serviceDir, consolidatedEnvFile, outputFile)
+	}
+}
+
+// removeTemplateService removes the service block and every depends_on reference to it
+func removeTemplateService(templateYAML *YAMLFile, serviceName string) error {
+	_, services := mappingEntry(templateYAML.Root, "services")
+	if services == nil {
+		return fmt.Errorf("template has no services section")
+	}
+
+	// Remove references from the bottom up so earlier line numbers stay valid
+	var ranges [][2]int
+	for i := 0; i+1 < len(services.Content); i += 2 {
+		key, service := services.Content[i], services.Content[i+1]
+		if key.Value == serviceName {
+			ranges = append(ranges, [2]int{key.Line, nodeEndLine(service)})
+			continue
+		}
+
+		dependsOnKey, dependsOn := mappingEntry(service, "depends_on")
+		if dependsOn == nil {
+			continue
+		}
+		switch dependsOn.Kind {
+		case yaml.SequenceNode:
+			for _, item := range dependsOn.Content {
+				if item.Value == serviceName {
+					if len(dependsOn.Content) == 1 {
+						ranges = append(ranges, [2]int{dependsOnKey.Line, nodeEndLine(dependsOn)})
+					} else {
+						ranges = append(ranges, [2]int{item.Line, item.Line})
+					}
+					fmt.Printf("Removed depends_on reference from %s\n", key.Value)
+				}
+			}
+		case yaml.MappingNode:
+			dependencyKey, dependency := mappingEntry(dependsOn, serviceName)
+			if dependencyKey != nil {
+				if len(dependsOn.Content) == 2 {
+					ranges = append(ranges, [2]int{dependsOnKey.Line, nodeEndLine(dependsOn)})
+				} else {
+					ranges = append(ranges, [2]int{dependencyKey.Line, nodeEndLine(dependency)})
+				}
+				fmt.Printf("Removed depends_on reference from %s\n", key.Value)
+			}
+		}
+	}
+
+	if len(ranges) == 0 {
+		fmt.Printf("Service %s not found in %s\n", serviceName, templateYAML.Path)
+		return nil
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] > ranges[j][0] })
+	for _, lineRange := range ranges {
+		if err := templateYAML.RemoveLines(lineRange[0], lineRange[1]); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Removed %s from %s\n", serviceName, templateYAML.Path)
+
+	return nil
+}
+
+// removeServiceDirectory deletes the files add-service created and left unchanged, and the whole directory when
+// purging. A .env holding other values than the scaffolded .env.example keeps its secrets and the directory.
+func removeServiceDirectory(directory string, purge bool) {
+	if _, err := os.Stat(directory); err != nil {
+		return
+	}
+
+	if purge {
+		if err := os.RemoveAll(directory); err != nil {
+			fmt.Printf("Error removing %s: %v\n", directory, err)
+			return
+		}
+		fmt.Printf("Removed directory %s\n", directory)
+		return
+	}
+
+	examplePath := filepath.Join(directory, ".env.example")
+	envPath := filepath.Join(directory, ".env")
+	example, exampleErr := os.ReadFile(examplePath)
+	if env, err := os.ReadFile(envPath); err == nil {
+		if exampleErr == nil && bytes.Equal(env, example) {
+			if err := os.Remove(envPath); err == nil {
+				fmt.Printf("Removed %s\n", envPath)
+			}
+		} else {
+			fmt.Printf("Keeping %s because it was edited after add-service (use -purge to delete it)\n", envPath)
+		}
+	}
+	if exampleErr == nil {
+		if err := os.Remove(examplePath); err == nil {
+			fmt.Printf("Removed %s\n", examplePath)
+		}
+	}
+
+	if err := os.Remove(directory); err != nil {
+		fmt.Printf("Keeping %s because it contains other files (use -purge to delete it)\n", directory)
+		return
+	}
+	fmt.Printf("Removed directory %s\n", directory)
+}
+
+// regenerateOutputs re-runs env consolidation and compose generation after the sources changed
+func regenerateOutputs(configFile string, templateFile string, serviceDir string, consolidatedEnvFile string, outputFile string) {
+	fmt.Println("Regenerating consolidated env file...")
+	ConsolidateEnvFiles(consolidatedEnvFile, true, configFile, false, serviceDir, templateFile, "", "")
+
+	fmt.Println("Regenerating docker compose file...")
+	if err := UpdateDockerCompose(consolidatedEnvFile, outputFile, true, templateFile, serviceDir, configFile, "", "", "", ""); err != nil {
+		fmt.Printf("Error regenerating docker compose file: %v\n", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRemoveServiceDropsEntryCommentsAndKeepsEditedEnv(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "services-config.yaml")
+	templateFile := filepath.Join(dir, "docker-compose.template.yml")
+	if err := os.WriteFile(configFile, []byte(testServicesConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	template := `services:
+    api:
+        image: api
+        depends_on:
+            - crawler
+    crawler:
+        image: crawler
+`
+	if err := os.WriteFile(templateFile, []byte(template), 0644); err != nil {
+		t.Fatal(err)
+	}
+	serviceDir := filepath.Join(dir, "crawler")
+	if err := os.MkdirAll(serviceDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{".env.example": "CRAWLER_PORT=\n", ".env": "CRAWLER_PORT=8080\n", ".gitkeep": ""} {
+		if err := os.WriteFile(filepath.Join(serviceDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	RemoveService("crawler", false, true, configFile, templateFile, dir, filepath.Join(dir, ".env"), filepath.Join(dir, "docker-compose.yml"), false)
+
+	config, _ := os.ReadFile(configFile)
+	if strings.Contains(string(config), "crawler") || strings.Contains(string(config), "nats:") {
+		t.Errorf("crawler or its commented-out examples left in the config:\n%s", config)
+	}
+	if !strings.Contains(string(config), "# Add more services here as needed") {
+		t.Errorf("the comment of the services list was removed:\n%s", config)
+	}
+	content, _ := os.ReadFile(templateFile)
+	if strings.Contains(string(content), "crawler") {
+		t.Errorf("crawler left in the template:\n%s", content)
+	}
+
+	for name, kept := range map[string]bool{".env": true, ".gitkeep": true, ".env.example": false} {
+		if _, err := os.Stat(filepath.Join(serviceDir, name)); (err == nil) != kept {
+			t.Errorf("%s kept = %v, want %v", name, err == nil, kept)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Defaults of the telemetry section, Tempo of the monitoring stack receives OTLP over HTTP on 4318
+const (
+	defaultOTLPEndpoint = "http://tempo:4318"
+	defaultOTLPProtocol = "http/protobuf"
+	// The loki logging driver runs in the Docker daemon, outside the compose networks
+	defaultLokiURL = "http://localhost:3100/loki/api/v1/push"
+)
+
+// mergeTelemetrySettings overrides the fields of base that are set in override
+func mergeTelemetrySettings(base TelemetrySettings, override TelemetrySettings) TelemetrySettings {
+	if override.Enabled != nil {
+		base.Enabled = override.Enabled
+	}
+	if override.Endpoint != "" {
+		base.Endpoint = override.Endpoint
+	}
+	if override.Protocol != "" {
+		base.Protocol = override.Protocol
+	}
+	if override.Logging != "" {
+		base.Logging = override.Logging
+	}
+	if override.LokiURL != "" {
+		base.LokiURL = override.LokiURL
+	}
+	if len(override.Attributes) > 0 {
+		attributes := make(map[string]string)
+		for key, value := range base.Attributes {
+			attributes[key] = value
+		}
+		for key, value := range override.Attributes {
+			attributes[key] = value
+		}
+		base.Attributes = attributes
+	}
+
+	return base
+}
+
+// telemetrySettingsForEnvironment layers the built-in defaults, the telemetry section and its environment override
+func telemetrySettingsForEnvironment(config Config, environment string) TelemetrySettings {
+	settings := TelemetrySettings{Endpoint: defaultOTLPEndpoint, Protocol: defaultOTLPProtocol, Logging: "none", LokiURL: defaultLokiURL}
+	settings = mergeTelemetrySettings(settings, config.Telemetry.TelemetrySettings)
+
+	return mergeTelemetrySettings(settings, config.Telemetry.Environments[environment])
+}
+
+// serviceTelemetrySettings applies the overrides of a service to the settings of the environment
+func serviceTelemetrySettings(settings TelemetrySettings, service ServiceConfig) TelemetrySettings {
+	if service.Telemetry == nil {
+		return settings
+	}
+
+	return mergeTelemetrySettings(settings, TelemetrySettings{
+		Enabled:    service.Telemetry.Enabled,
+		Logging:    service.Telemetry.Logging,
+		Attributes: service.Telemetry.Attributes,
+	})
+}
+
+// validateTelemetryConfig reports unknown protocols and logging modes
+func validateTelemetryConfig(config Config) []string {
+	var problems []string
+	check := func(where string, protocol string, logging string) {
+		if protocol != "" && protocol != "http/protobuf" && protocol != "grpc" {
+			problems = append(problems, fmt.Sprintf("%s: protocol must be http/protobuf or grpc, not %q", where, protocol))
+		}
+		if logging != "" && logging != "none" && logging != "loki" && logging != "json" {
+			problems = append(problems, fmt.Sprintf("%s: logging must be none, loki or json, not %q", where, logging))
+		}
+	}
+
+	check("telemetry", config.Telemetry.Protocol, config.Telemetry.Logging)
+	for environment, settings := range config.Telemetry.Environments {
+		check("telemetry environment "+environment, settings.Protocol, settings.Logging)
+	}
+	for _, service := range config.Services {
+		if service.Telemetry != nil {
+			check("service "+service.Name, "", service.Telemetry.Logging)
+		}
+	}
+
+	return problems
+}
+
+// gitOutput runs git in a directory and returns its trimmed output, or an empty string when it fails
+func gitOutput(dir string, args ...string) string {
+	output, err := exec.Command("git", append([]string{"-C", dir}, args...)...).Output()
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(output))
+}
+
+// imageTag returns the tag of an image reference, ignoring the port of a registry
+func imageTag(image string) string {
+	name := image[strings.LastIndex(image, "/")+1:]
+	name, _, _ = strings.Cut(name, "@")
+	if _, tag, ok := strings.Cut(name, ":"); ok {
+		return tag
+	}
+
+	return ""
+}
+
+// serviceVersion returns the service.version attribute: the <PREFIX>VERSION variable when the service declares one,
+// the tag of its image, or the git description of its build context
+func serviceVersion(service DockerComposeService, serviceConfig ServiceConfig, envVars map[string]string, composeDir string) string {
+	if _, ok := envVars[serviceConfig.Prefix+"VERSION"]; ok {
+		return fmt.Sprintf("${%sVERSION}", serviceConfig.Prefix)
+	}
+	if tag := imageTag(service.Image); tag != "" && tag != "latest" {
+		return tag
+	}
+	if context := buildContext(service.Build); context != "" {
+		return gitOutput(filepath.Join(composeDir, context), "describe", "--tags", "--always", "--dirty")
+	}
+
+	return ""
+}
+
+// escapeResourceAttribute percent-encodes the characters separating OTEL_RESOURCE_ATTRIBUTES entries
+func escapeResourceAttribute(value string) string {
+	return strings.NewReplacer("%", "%25", ",", "%2C", "=", "%3D", " ", "%20").Replace(value)
+}
+
+// environmentKeys returns the variables already set in the environment of a compose service
+func environmentKeys(service DockerComposeService) map[string]bool {
+	keys := make(map[string]bool)
+	switch environment := service.Environment.(type) {
+	case []string:
+		for _, entry := range environment {
+			keys[strings.SplitN(entry, "=", 2)[0]] = true
+		}
+	case []any:
+		for _, entry := range environment {
+			keys[strings.SplitN(fmt.Sprint(entry), "=", 2)[0]] = true
+		}
+	case map[string]any:
+		for key := range environment {
+			keys[key] = true
+		}
+	}
+
+	return keys
+}
+
+// telemetryLogging returns the logging section and the container labels of a logging mode
+func telemetryLogging(settings TelemetrySettings, serviceName string, environment string) (map[string]any, []string) {
+	switch settings.Logging {
+	case "loki":
+		// Requires the Loki Docker driver: docker plugin install grafana/loki-docker-driver --alias loki
+		return map[string]any{
+			"driver": "loki",
+			"options": map[string]string{
+				"loki-url":             settings.LokiURL,
+				"loki-external-labels": fmt.Sprintf("service=%s,environment=%s", serviceName, environment),
+				"loki-retries":         "3",
+				"loki-batch-size":      "400",
+				"mode":                 "non-blocking",
+			},
+		}, nil
+	case "json":
+		// A collector discovering the containers, like Promtail or Alloy, turns these labels into Loki labels
+		return map[string]any{
+			"driver": "json-file",
+			"options": map[string]string{
+				"max-size": "10m",
+				"max-file": "3",
+				"labels":   "service.name,deployment.environment",
+			},
+		}, []string{
+			"service.name=" + serviceName,
+			"deployment.environment=" + environment,
+		}
+	}
+
+	return nil, nil
+}
+
+// applyTelemetry injects the OpenTelemetry variables and the Loki logging configuration into the application
+// services, as configured for the environment and each service. Variables a service already sets are kept.
+func applyTelemetry(dockerCompose *DockerComposeConfig, envVars map[string]string, configFile string, environment string, composeDir string) error {
+	config := getConfig(configFile)
+	if problems := validateTelemetryConfig(config); len(problems) > 0 {
+		return fmt.Errorf("invalid telemetry configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	environmentSettings := telemetrySettingsForEnvironment(config, environment)
+	revision := gitOutput(composeDir, "rev-parse", "--short", "HEAD")
+
+	instrumented, logged := 0, 0
+	for _, serviceConfig := range config.Services {
+		service, ok := dockerCompose.Services[serviceConfig.Name]
+		if !ok {
+			continue
+		}
+		settings := serviceTelemetrySettings(environmentSettings, serviceConfig)
+
+		if boolValue(settings.Enabled, false) {
+			attributes := map[string]string{"deployment.environment": environment}
+			if version := serviceVersion(service, serviceConfig, envVars, composeDir); version != "" {
+				attributes["service.version"] = version
+			}
+			serviceRevision := revision
+			if context := buildContext(service.Build); context != "" {
+				serviceRevision = valueOrDefault(gitOutput(filepath.Join(composeDir, context), "rev-parse", "--short", "HEAD"), revision)
+			}
+			if serviceRevision != "" {
+				attributes["vcs.ref.head.revision"] = serviceRevision
+			}
+			for key, value := range settings.Attributes {
+				attributes[key] = value
+			}
+
+			keys := make([]string, 0, len(attributes))
+			for key := range attributes {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			var resource []string
+			for _, key := range keys {
+				value := attributes[key]
+				// Keep compose references such as ${BO_API_VERSION} intact for docker compose to interpolate
+				if !strings.HasPrefix(value, "${") {
+					value = escapeResourceAttribute(value)
+				}
+				resource = append(resource, key+"="+value)
+			}
+
+			serviceName := serviceConfig.Name
+			if serviceConfig.Telemetry != nil && serviceConfig.Telemetry.ServiceName != "" {
+				serviceName = serviceConfig.Telemetry.ServiceName
+			}
+			existing := environmentKeys(service)
+			var entries []string
+			for _, entry := range []string{
+				"OTEL_SERVICE_NAME=" + serviceName,
+				"OTEL_EXPORTER_OTLP_ENDPOINT=" + settings.Endpoint,
+				"OTEL_EXPORTER_OTLP_PROTOCOL=" + settings.Protocol,
+				"OTEL_RESOURCE_ATTRIBUTES=" + strings.Join(resource, ","),
+			} {
+				if !existing[strings.SplitN(entry, "=", 2)[0]] {
+					entries = append(entries, entry)
+				}
+			}
+			mergeServiceEnvironment(&service, entries)
+			instrumented++
+		}
+
+		if logging, labels := telemetryLogging(settings, serviceConfig.Name, environment); logging != nil {
+			if service.ExtraFields == nil {
+				service.ExtraFields = make(map[string]any)
+			}
+			service.ExtraFields["logging"] = logging
+			if len(labels) > 0 {
+				setServiceLabels(&service, append(serviceLabels(service), labels...))
+			}
+			logged++
+		}
+
+		dockerCompose.Services[serviceConfig.Name] = service
+	}
+
+	if instrumented > 0 || logged > 0 {
+		fmt.Printf("  Injected OpenTelemetry variables into %d services and Loki logging into %d services (%s environment)\n", instrumented, logged, environment)
+	}
+
+	return nil
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// TopologyIssue is a problem found in the declared messaging topology
+type TopologyIssue struct {
+	Severity string
+	Service  string
+	Message  string
+}
+
+// subjectsOverlap reports whether two NATS subjects, possibly with * and > wildcards, can match a common subject
+func subjectsOverlap(a string, b string) bool {
+	aTokens, bTokens := strings.Split(a, "."), strings.Split(b, ".")
+
+	for i := 0; i < len(aTokens) && i < len(bTokens); i++ {
+		if aTokens[i] == ">" || bTokens[i] == ">" {
+			return true
+		}
+		if aTokens[i] == "*" || bTokens[i] == "*" || aTokens[i] == bTokens[i] {
+			continue
+		}
+		return false
+	}
+
+	return len(aTokens) == len(bTokens)
+}
+
+// anySubjectOverlaps reports whether a subject overlaps with one of the given subjects
+func anySubjectOverlaps(subject string, subjects []string) bool {
+	for _, other := range subjects {
+		if subjectsOverlap(subject, other) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// messagingServices returns the services declaring a nats section
+func messagingServices(config Config) []ServiceConfig {
+	var services []ServiceConfig
+	for _, service := range getAllServiceConfigs(config) {
+		if service.Nats != nil {
+			services = append(services, service)
+		}
+	}
+
+	return services
+}
+
+// findStream returns a declared stream and the service owning it
+func findStream(config Config, name string) (NatsStreamConfig, string, bool) {
+	for _, service := range messagingServices(config) {
+		for _, stream := range service.Nats.Streams {
+			if stream.Name == name {
+				return stream, service.Name, true
+			}
+		}
+	}
+
+	return NatsStreamConfig{}, "", false
+}
+
+// consumerSubjects returns the subjects a JetStream consumer receives, from its filter or its stream
+func consumerSubjects(config Config, consumer NatsConsumerConfig) []string {
+	if consumer.FilterSubject != "" {
+		return []string{consumer.FilterSubject}
+	}
+
+	stream, _, _ := findStream(config, consumer.Stream)
+	return stream.Subjects
+}
+
+// checkTopology validates producers, consumers and streams against each other
+func checkTopology(config Config) []TopologyIssue {
+	var issues []TopologyIssue
+	services := messagingServices(config)
+
+	var published []string
+	var consumed []string
+	for _, service := range services {
+		published = append(published, service.Nats.Publish...)
+		consumed = append(consumed, service.Nats.Subscribe...)
+		for _, consumer := range service.Nats.Consumers {
+			consumed = append(consumed, consumerSubjects(config, consumer)...)
+		}
+	}
+
+	var declared []string
+	for _, subject := range config.Messaging.Subjects {
+		declared = append(declared, subject.Name)
+	}
+
+	streamOwners := make(map[string]string)
+	for _, service := range services {
+		// Orphaned core subscriptions
+		for _, subject := range service.Nats.Subscribe {
+			if !anySubjectOverlaps(subject, published) {
+				issues = append(issues, TopologyIssue{"error", service.Name, fmt.Sprintf("subscribes to %s but no service publishes to it", subject)})
+			}
+		}
+
+		// Orphaned JetStream consumers
+		for _, consumer := range service.Nats.Consumers {
+			stream, _, ok := findStream(config, consumer.Stream)
+			if !ok {
+				issues = append(issues, TopologyIssue{"error", service.Name, fmt.Sprintf("consumer %s reads from undeclared stream %s", consumer.Name, consumer.Stream)})
+				continue
+			}
+			if consumer.FilterSubject != "" && !anySubjectOverlaps(consumer.FilterSubject, stream.Subjects) {
+				issues = append(issues, TopologyIssue{"error", service.Name, fmt.Sprintf("consumer %s filters on %s which is not part of stream %s", consumer.Name, consumer.FilterSubject, stream.Name)})
+				continue
+			}
+			for _, subject := range consumerSubjects(config, consumer) {
+				if !anySubjectOverlaps(subject, published) {
+					issues = append(issues, TopologyIssue{"error", service.Name, fmt.Sprintf("consumer %s reads %s from stream %s but no service publishes to it", consumer.Name, subject, stream.Name)})
+				}
+			}
+		}
+
+		// Unconsumed subjects
+		for _, subject := range service.Nats.Publish {
+			if !anySubjectOverlaps(subject, consumed) {
+				issues = append(issues, TopologyIssue{"warning", service.Name, fmt.Sprintf("publishes to %s but no service consumes it", subject)})
+			}
+		}
+
+		// Streams must be unique and must not capture the same subjects
+		for _, stream := range service.Nats.Streams {
+			if owner, ok := streamOwners[stream.Name]; ok {
+				issues = append(issues, TopologyIssue{"error", service.Name, fmt.Sprintf("stream %s is also declared by %s", stream.Name, owner)})
+				continue
+			}
+			streamOwners[stream.Name] = service.Name
+		}
+
+		// Subjects missing from the catalog
+		if len(declared) > 0 {
+			for _, subject := range append(append([]string{}, service.Nats.Publish...), service.Nats.Subscribe...) {
+				if !anySubjectOverlaps(subject, declared) {
+					issues = append(issues, TopologyIssue{"warning", service.Name, fmt.Sprintf("uses %s which is not declared in messaging.subjects", subject)})
+				}
+			}
+		}
+	}
+
+	issues = append(issues, checkWildcardOverlaps(services)...)
+
+	return issues
+}
+
+// checkWildcardOverlaps flags streams capturing the same subjects, and producers of different services sharing subjects
+func checkWildcardOverlaps(services []ServiceConfig) []TopologyIssue {
+	var issues []TopologyIssue
+
+	type ownedSubject struct {
+		owner   string
+		name    string
+		subject string
+	}
+
+	var streamSubjects, publishSubjects []ownedSubject
+	for _, service := range services {
+		for _, stream := range service.Nats.Streams {
+			for _, subject := range stream.Subjects {
+				streamSubjects = append(streamSubjects, ownedSubject{service.Name, stream.Name, subject})
+			}
+		}
+		for _, subject := range service.Nats.Publish {
+			publishSubjects = append(publishSubjects, ownedSubject{service.Name, service.Name, subject})
+		}
+	}
+
+	for i := 0; i < len(streamSubjects); i++ {
+		for j := i + 1; j < len(streamSubjects); j++ {
+			a, b := streamSubjects[i], streamSubjects[j]
+			if a.name != b.name && subjectsOverlap(a.subject, b.subject) {
+				issues = append(issues, TopologyIssue{"error", a.owner, fmt.Sprintf("stream %s subject %s overlaps with stream %s subject %s", a.name, a.subject, b.name, b.subject)})
+			}
+		}
+	}
+
+	for i := 0; i < len(publishSubjects); i++ {
+		for j := i + 1; j < len(publishSubjects); j++ {
+			a, b := publishSubjects[i], publishSubjects[j]
+			if a.owner != b.owner && subjectsOverlap(a.subject, b.subject) {
+				issues = append(issues, TopologyIssue{"warning", a.owner, fmt.Sprintf("publishes to %s which overlaps with %s published by %s", a.subject, b.subject, b.owner)})
+			}
+		}
+	}
+
+	return issues
+}
+
+// CheckTopology prints the issues of the messaging topology, exiting with an error when there are any
+func CheckTopology(configFile string, strict bool) {
+	scriptDir, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("Error getting current directory: %v\n", err)
+		return
+	}
+	config := getConfig(resolveFilePath(configFile, scriptDir, scriptDir))
+
+	services := messagingServices(config)
+	if len(services) == 0 {
+		fmt.Println("No service declares a nats section, nothing to check.")
+		return
+	}
+
+	issues := checkTopology(config)
+	errors, warnings := 0, 0
+	for _, issue := range issues {
+		fmt.Printf("%-8s %-45s %s\n", strings.ToUpper(issue.Severity), issue.Service, issue.Message)
+		if issue.Severity == "error" {
+			errors++
+		} else {
+			warnings++
+		}
+	}
+
+	fmt.Printf("Checked %d services: %d errors, %d warnings\n", len(services), errors, warnings)
+	if errors > 0 || (strict && warnings > 0) {
+		os.Exit(1)
+	}
+}
+
+// graphNodeID turns a name into an identifier usable in Mermaid and DOT
+func graphNodeID(prefix string, name string) string {
+	return prefix + "_" + regexp.MustCompile(`[^A-Za-z0-9_]`).ReplaceAllString(name, "_")
+}
+
+// RenderTopologyGraph renders the service dependency graph and the messaging data flow
+func RenderTopologyGraph(configFile string, templateFile string, format string, outputFile string) {
+	scriptDir, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("Error getting current directory: %v\n", err)
+		return
+	}
+	config := getConfig(resolveFilePath(configFile, scriptDir, scriptDir))
+	dependencies := getTemplateDependencies(resolveFilePath(templateFile, scriptDir, scriptDir))
+
+	var graph string
+	switch format {
+	case "mermaid":
+		graph = renderMermaidTopology(config, dependencies)
+	case "dot":
+		graph = renderDotTopology(config, dependencies)
+	default:
+		fmt.Printf("Unknown graph format: %s (use mermaid or dot)\n", format)
+		return
+	}
+
+	if outputFile == "" {
+		fmt.Print(graph)
+		return
+	}
+
+	outputFile = resolveFilePath(outputFile, scriptDir, scriptDir)
+	if err := os.MkdirAll(filepath.Dir(outputFile), 0755); err != nil {
+		fmt.Printf("Error creating output directory: %v\n", err)
+		return
+	}
+	if err := os.WriteFile(outputFile, []byte(graph), 0644); err != nil {
+		fmt.Printf("Error writing graph file: %v\n", err)
+		return
+	}
+	fmt.Printf("Topology graph written to %s\n", outputFile)
+}
+
+// topologyEdge is an edge of the rendered graph
+type topologyEdge struct {
+	from  string
+	to    string
+	label string
+}
+
+// dataFlowEdges returns producer to stream, stream to consumer and core publish to subscribe edges
+func dataFlowEdges(config Config) ([]topologyEdge, map[string]bool) {
+	var edges []topologyEdge
+	streams := make(map[string]bool)
+	services := messagingServices(config)
+
+	for _, producer := range services {
+		for _, subject := range producer.Nats.Publish {
+			for _, target := range services {
+				for _, stream := range target.Nats.Streams {
+					if anySubjectOverlaps(subject, stream.Subjects) {
+						streams[stream.Name] = true
+						edges = append(edges, topologyEdge{producer.Name, "stream:" + stream.Name, subject})
+					}
+				}
+				for _, subscribed := range target.Nats.Subscribe {
+					if subjectsOverlap(subject, subscribed) {
+						edges = append(edges, topologyEdge{producer.Name, target.Name, subject})
+					}
+				}
+			}
+		}
+	}
+
+	for _, consumer := range services {
+		for _, definition := range consumer.Nats.Consumers {
+			streams[definition.Stream] = true
+			label := definition.Name
+			if definition.FilterSubject != "" {
+				label += " (" + definition.FilterSubject + ")"
+			}
+			edges = append(edges, topologyEdge{"stream:" + definition.Stream, consumer.Name, label})
+		}
+	}
+
+	return edges, streams
+}
+
+// sortedDependencyEdges returns the depends_on edges in a stable order
+func sortedDependencyEdges(dependencies map[string][]string) []topologyEdge {
+	var edges []topologyEdge
+	for service, serviceDependencies := range dependencies {
+		for _, dependency := range serviceDependencies {
+			edges = append(edges, topologyEdge{service, dependency, ""})
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].from != edges[j].from {
+			return edges[i].from < edges[j].from
+		}
+		return edges[i].to < edges[j].to
+	})
+
+	return edges
+}
+
+// renderMermaidTopology renders both graphs as a Mermaid flowchart
+func renderMermaidTopology(config Config, dependencies map[string][]string) string {
+	var content strings.Builder
+	content.WriteString("flowchart LR\n")
+
+	content.WriteString("  subgraph dependencies [Service dependencies]\n")
+	for _, edge := range sortedDependencyEdges(dependencies) {
+		content.WriteString(fmt.Sprintf("    %s[%s] --> %s[%s]\n", graphNodeID("dep", edge.from), edge.from, graphNodeID("dep", edge.to), edge.to))
+	}
+	content.WriteString("  end\n")
+
+	edges, _ := dataFlowEdges(config)
+	content.WriteString("  subgraph dataflow [Messaging data flow]\n")
+	for _, edge := range edges {
+		content.WriteString(fmt.Sprintf("    %s -- \"%s\" --> %s\n", mermaidNode(edge.from), edge.label, mermaidNode(edge.to)))
+	}
+	content.WriteString("  end\n")
+
+	return content.String()
+}
+
+// mermaidNode renders a data flow node, drawing streams as databases
+func mermaidNode(name string) string {
+	if stream, ok := strings.CutPrefix(name, "stream:"); ok {
+		return fmt.Sprintf("%s[(%s)]", graphNodeID("stream", stream), stream)
+	}
+
+	return fmt.Sprintf("%s[%s]", graphNodeID("flow", name), name)
+}
+
+// renderDotTopology renders both graphs as Graphviz clusters
+func renderDotTopology(config Config, dependencies map[string][]string) string {
+	var content strings.Builder
+	content.WriteString("digraph topology {\n  rankdir=LR;\n  node [shape=box];\n")
+
+	content.WriteString("  subgraph cluster_dependencies {\n    label=\"Service dependencies\";\n")
+	for _, edge := range sortedDependencyEdges(dependencies) {
+		content.WriteString(fmt.Sprintf("    %s [label=%q];\n    %s [label=%q];\n    %s -> %s;\n",
+			graphNodeID("dep", edge.from), edge.from, graphNodeID("dep", edge.to), edge.to,
+			graphNodeID("dep", edge.from), graphNodeID("dep", edge.to)))
+	}
+	content.WriteString("  }\n")
+
+	edges, streams := dataFlowEdges(config)
+	content.WriteString("  subgraph cluster_dataflow {\n    label=\"Messaging data flow\";\n")
+	var streamNames []string
+	for stream := range streams {
+		streamNames = append(streamNames, stream)
+	}
+	sort.Strings(streamNames)
+	for _, stream := range streamNames {
+		content.WriteString(fmt.Sprintf("    %s [label=%q, shape=cylinder];\n", graphNodeID("stream", stream), stream))
+	}
+	declared := make(map[string]bool)
+	for _, edge := range edges {
+		for _, name := range []string{edge.from, edge.to} {
+			if !strings.HasPrefix(name, "stream:") && !declared[name] {
+				declared[name] = true
+				content.WriteString(fmt.Sprintf("    %s [label=%q];\n", dotNode(name), name))
+			}
+		}
+		content.WriteString(fmt.Sprintf("    %s -> %s [label=%q];\n", dotNode(edge.from), dotNode(edge.to), edge.label))
+	}
+	content.WriteString("  }\n}\n")
+
+	return content.String()
+}
+
+// dotNode returns the identifier of a data flow node
+func dotNode(name string) string {
+	if stream, ok := strings.CutPrefix(name, "stream:"); ok {
+		return graphNodeID("stream", stream)
+	}
+
+	return graphNodeID("flow", name)
+}
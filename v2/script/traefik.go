@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// letsEncryptStagingCA is the directory of the Let's Encrypt staging CA, used to test ACME without hitting rate limits
+const letsEncryptStagingCA = "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+// traefikDynamicMountPath is where the file provider reads the generated dynamic configuration
+const traefikDynamicMountPath = "/etc/traefik/dynamic"
+
+// traefikCertsMountPath is where the certificates issued by deployment certs are mounted
+const traefikCertsMountPath = "/etc/traefik/certs"
+
+// traefikCertResolver is the name of the ACME certificate resolver referenced by routers
+const traefikCertResolver = "letsencrypt"
+
+// traefikMetricsPort is the entrypoint Prometheus scrapes the Traefik metrics from
+const traefikMetricsPort = 8082
+
+// TraefikStaticConfig represents the traefik.yml static configuration
+type TraefikStaticConfig struct {
+	Global                TraefikGlobal                  `yaml:"global"`
+	EntryPoints           map[string]TraefikEntryPoint   `yaml:"entryPoints"`
+	API                   TraefikAPI                     `yaml:"api"`
+	CertificatesResolvers map[string]TraefikCertResolver `yaml:"certificatesResolvers,omitempty"`
+	Providers             TraefikProviders               `yaml:"providers"`
+	Log                   TraefikLog                     `yaml:"log"`
+	AccessLog             *TraefikAccessLog              `yaml:"accessLog,omitempty"`
+	Metrics               *TraefikMetrics                `yaml:"metrics,omitempty"`
+}
+
+// TraefikGlobal represents the global section of the static configuration
+type TraefikGlobal struct {
+	CheckNewVersion    bool `yaml:"checkNewVersion"`
+	SendAnonymousUsage bool `yaml:"sendAnonymousUsage"`
+}
+
+// TraefikEntryPoint represents an entrypoint of the static configuration
+type TraefikEntryPoint struct {
+	Address          string                   `yaml:"address"`
+	AsDefault        bool                     `yaml:"asDefault,omitempty"`
+	HTTP             *TraefikEntryPointHTTP   `yaml:"http,omitempty"`
+	ForwardedHeaders *TraefikForwardedHeaders `yaml:"forwardedHeaders,omitempty"`
+}
+
+// TraefikEntryPointHTTP represents the redirections and default TLS of an entrypoint
+type TraefikEntryPointHTTP struct {
+	Redirections map[string]any `yaml:"redirections,omitempty"`
+	TLS          map[string]any `yaml:"tls,omitempty"`
+}
+
+// TraefikForwardedHeaders represents which proxies may set the X-Forwarded-* headers
+type TraefikForwardedHeaders struct {
+	Insecure   bool     `yaml:"insecure,omitempty"`
+	TrustedIPs []string `yaml:"trustedIPs,omitempty"`
+}
+
+// TraefikAPI represents the api and dashboard section
+type TraefikAPI struct {
+	Dashboard bool `yaml:"dashboard"`
+	Insecure  bool `yaml:"insecure"`
+}
+
+// TraefikCertResolver represents an ACME certificate resolver
+type TraefikCertResolver struct {
+	ACME TraefikACME `yaml:"acme"`
+}
+
+// TraefikACME represents the ACME account and challenge of a certificate resolver
+type TraefikACME struct {
+	Email         string            `yaml:"email"`
+	Storage       string            `yaml:"storage"`
+	CAServer      string            `yaml:"caServer,omitempty"`
+	HTTPChallenge map[string]string `yaml:"httpChallenge"`
+}
+
+// TraefikProviders represents the providers section
+type TraefikProviders struct {
+	Docker *TraefikDockerProvider `yaml:"docker,omitempty"`
+	File   *TraefikFileProvider   `yaml:"file,omitempty"`
+}
+
+// TraefikDockerProvider represents the docker provider
+type TraefikDockerProvider struct {
+	Endpoint         string `yaml:"endpoint"`
+	ExposedByDefault bool   `yaml:"exposedByDefault"`
+}
+
+// TraefikFileProvider represents the file provider reading dynamic configuration from a directory
+type TraefikFileProvider struct {
+	Directory string `yaml:"directory"`
+	Watch     bool   `yaml:"watch"`
+}
+
+// TraefikLog represents the log section
+type TraefikLog struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format,omitempty"`
+}
+
+// TraefikAccessLog represents the access log section
+type TraefikAccessLog struct {
+	Format string         `yaml:"format,omitempty"`
+	Fields map[string]any `yaml:"fields,omitempty"`
+}
+
+// TraefikMetrics represents the metrics section
+type TraefikMetrics struct {
+	Prometheus map[string]any `yaml:"prometheus"`
+}
+
+// traefikEnvironmentDefaults are the built-in settings of the known environments
+var traefikEnvironmentDefaults = map[string]TraefikSettings{
+	"dev": {
+		Profile:  "dev",
+		LogLevel: "DEBUG",
+	},
+	"prod": {
+		Profile:  "production",
+		LogLevel: "INFO",
+	},
+}
+
+// getTraefikService returns the common service running Traefik
+func getTraefikService(config Config) (ServiceConfig, bool) {
+	for _, service := range getAllServiceConfigs(config) {
+		if getServiceKind(service) == "traefik" {
+			return service, true
+		}
+	}
+
+	return ServiceConfig{}, false
+}
+
+// boolValue returns the value of an optional flag, or fallback when it is not set
+func boolValue(value *bool, fallback bool) bool {
+	if value == nil {
+		return fallback
+	}
+
+	return *value
+}
+
+// mergeTraefikSettings overrides the fields of base that are set in override
+func mergeTraefikSettings(base TraefikSettings, override TraefikSettings) TraefikSettings {
+	if override.Profile != "" {
+		base.Profile = override.Profile
+	}
+	if override.Provider != "" {
+		base.Provider = override.Provider
+	}
+	if override.LogLevel != "" {
+		base.LogLevel = override.LogLevel
+	}
+	if override.ACMEEmail != "" {
+		base.ACMEEmail = override.ACMEEmail
+	}
+	if override.ACMECAServer != "" {
+		base.ACMECAServer = override.ACMECAServer
+	}
+	if override.DashboardDomain != "" {
+		base.DashboardDomain = override.DashboardDomain
+	}
+	if override.DashboardUser != "" {
+		base.DashboardUser = override.DashboardUser
+	}
+	if len(override.TrustedIPs) > 0 {
+		base.TrustedIPs = override.TrustedIPs
+	}
+	if override.AccessLog != nil {
+		base.AccessLog = override.AccessLog
+	}
+	if override.Metrics != nil {
+		base.Metrics = override.Metrics
+	}
+
+	return base
+}
+
+// traefikSettingsForEnvironment layers the built-in defaults, the traefik section and its environment override.
+// Environments without built-in defaults use the production profile.
+func traefikSettingsForEnvironment(config Config, environment string) TraefikSettings {
+	settings := TraefikSettings{Profile: "production", LogLevel: "INFO", DashboardUser: "admin"}
+	if defaults, ok := traefikEnvironmentDefaults[environment]; ok {
+		settings = mergeTraefikSettings(settings, defaults)
+	}
+	settings = mergeTraefikSettings(settings, config.Traefik.TraefikSettings)
+	settings = mergeTraefikSettings(settings, config.Traefik.Environments[environment])
+
+	if settings.ACMECAServer == "staging" {
+		settings.ACMECAServer = letsEncryptStagingCA
+	}
+
+	return settings
+}
+
+// traefikDashboardPasswordName returns the consolidated variable holding the dashboard password
+func traefikDashboardPasswordName(traefikService ServiceConfig) string {
+	return traefikService.Prefix + "DASHBOARD_PASSWORD"
+}
+
+// hasTraefikDashboard reports whether any environment exposes the dashboard on its own domain
+func hasTraefikDashboard(config Config) bool {
+	if config.Traefik.DashboardDomain != "" {
+		return true
+	}
+	for _, settings := range config.Traefik.Environments {
+		if settings.DashboardDomain != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// traefikGeneratedVariables returns the dashboard password injected into the consolidated env
+func traefikGeneratedVariables(services []ServiceConfig, config Config, existing map[string]string) []GeneratedVariable {
+	traefikService, ok := getTraefikService(config)
+	if !ok || !hasTraefikDashboard(config) {
+		return nil
+	}
+
+	// Only generate it when the traefik service itself is part of the consolidated env
+	for _, service := range services {
+		if service.Name == traefikService.Name {
+			name := traefikDashboardPasswordName(traefikService)
+			return []GeneratedVariable{{Name: name, Value: existingOrNewSecret(existing, name)}}
+		}
+	}
+
+	return nil
+}
+
+// htpasswdEntry hashes a password with bcrypt into a user:hash line accepted by the Traefik basicAuth middleware.
+// An entry of previous for the same user and password is returned as is, so regenerating the compose file or the
+// dynamic configuration does not change the output.
+func htpasswdEntry(user string, password string, previous []string) (string, error) {
+	for _, entry := range previous {
+		name, hash, ok := strings.Cut(entry, ":")
+		if ok && name == user && bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+			return entry, nil
+		}
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("hashing the password of %s: %v", user, err)
+	}
+
+	return user + ":" + string(hash), nil
+}
+
+// previousHtpasswdEntries returns the basicAuth users of the dynamic configuration files already written to dir
+func previousHtpasswdEntries(dir string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.yml"))
+
+	var entries []string
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var dynamic TraefikDynamicConfig
+		if err := yaml.Unmarshal(content, &dynamic); err != nil {
+			continue
+		}
+		for _, definition := range dynamic.HTTP.Middlewares {
+			basicAuth, _ := definition["basicAuth"].(map[string]any)
+			users, _ := basicAuth["users"].([]any)
+			for _, user := range users {
+				if entry, ok := user.(string); ok {
+					entries = append(entries, entry)
+				}
+			}
+		}
+	}
+
+	return entries
+}
+
+// buildTraefikStaticConfig builds the static configuration of a profile
+func buildTraefikStaticConfig(settings TraefikSettings) TraefikStaticConfig {
+	static := TraefikStaticConfig{
+		// Routers without entrypoints attach to the default ones only, never to metrics
+		EntryPoints: map[string]TraefikEntryPoint{
+			"web":       {Address: ":80", AsDefault: true},
+			"websecure": {Address: ":443", AsDefault: true},
+		},
+		API: TraefikAPI{Dashboard: true},
+		Providers: TraefikProviders{
+			Docker: &TraefikDockerProvider{Endpoint: "unix:///var/run/docker.sock"},
+			File:   &TraefikFileProvider{Directory: traefikDynamicMountPath, Watch: true},
+		},
+		Log: TraefikLog{Level: settings.LogLevel},
+	}
+	if settings.Provider == "file" {
+		// Routing comes from the routing.yml written by deployment update, Traefik needs no Docker API access
+		static.Providers.Docker = nil
+	}
+
+	if settings.Profile == "dev" {
+		// Permissive: insecure dashboard on :8080, any client may set forwarded headers. HTTPS uses the
+		// default certificate of the TLS store, issued by deployment certs
+		static.API.Insecure = true
+		static.EntryPoints["websecure"] = TraefikEntryPoint{Address: ":443", AsDefault: true, HTTP: &TraefikEntryPointHTTP{TLS: map[string]any{"options": "default"}}}
+		for name, entryPoint := range static.EntryPoints {
+			entryPoint.ForwardedHeaders = &TraefikForwardedHeaders{Insecure: true}
+			static.EntryPoints[name] = entryPoint
+		}
+		if boolValue(settings.AccessLog, false) {
+			static.AccessLog = &TraefikAccessLog{}
+		}
+		if boolValue(settings.Metrics, false) {
+			static.EntryPoints["metrics"] = TraefikEntryPoint{Address: fmt.Sprintf(":%d", traefikMetricsPort)}
+			static.Metrics = &TraefikMetrics{Prometheus: map[string]any{"entryPoint": "metrics"}}
+		}
+		return static
+	}
+
+	var forwardedHeaders *TraefikForwardedHeaders
+	if len(settings.TrustedIPs) > 0 {
+		forwardedHeaders = &TraefikForwardedHeaders{TrustedIPs: settings.TrustedIPs}
+	}
+
+	static.EntryPoints["web"] = TraefikEntryPoint{
+		Address:   ":80",
+		AsDefault: true,
+		HTTP: &TraefikEntryPointHTTP{
+			Redirections: map[string]any{
+				"entryPoint": map[string]any{"to": "websecure", "scheme": "https", "permanent": true},
+			},
+		},
+		ForwardedHeaders: forwardedHeaders,
+	}
+	static.EntryPoints["websecure"] = TraefikEntryPoint{
+		Address:          ":443",
+		AsDefault:        true,
+		HTTP:             &TraefikEntryPointHTTP{TLS: map[string]any{"certResolver": traefikCertResolver}},
+		ForwardedHeaders: forwardedHeaders,
+	}
+
+	static.CertificatesResolvers = map[string]TraefikCertResolver{
+		traefikCertResolver: {
+			ACME: TraefikACME{
+				Email:         settings.ACMEEmail,
+				Storage:       "/letsencrypt/acme.json",
+				CAServer:      settings.ACMECAServer,
+				HTTPChallenge: map[string]string{"entryPoint": "web"},
+			},
+		},
+	}
+	static.Log.Format = "json"
+
+	if boolValue(settings.AccessLog, true) {
+		static.AccessLog = &TraefikAccessLog{
+			Format: "json",
+			Fields: map[string]any{
+				"headers": map[string]any{
+					"defaultMode": "drop",
+					"names":       map[string]string{"User-Agent": "keep", "Authorization": "drop", "Cookie": "drop"},
+				},
+			},
+		}
+	}
+	if boolValue(settings.Metrics, true) {
+		static.EntryPoints["metrics"] = TraefikEntryPoint{Address: fmt.Sprintf(":%d", traefikMetricsPort)}
+		static.Metrics = &TraefikMetrics{
+			Prometheus: map[string]any{
+				"entryPoint":           "metrics",
+				"addEntryPointsLabels": true,
+				"addRoutersLabels":     true,
+				"addServicesLabels":    true,
+			},
+		}
+	}
+
+	return static
+}
+
+// renderTraefikDashboardConfig renders the dynamic configuration exposing the dashboard on its own router behind basic auth
+func renderTraefikDashboardConfig(settings TraefikSettings, usersEntry string) ([]byte, error) {
+	dynamic := map[string]any{
+		"http": map[string]any{
+			"routers": map[string]any{
+				"dashboard": map[string]any{
+					"rule":        fmt.Sprintf("Host(`%s`)", settings.DashboardDomain),
+					"service":     "api@internal",
+					"entryPoints": []string{"websecure"},
+					"middlewares": []string{"dashboard-auth"},
+					"tls":         map[string]any{"certResolver": traefikCertResolver},
+				},
+			},
+			"middlewares": map[string]any{
+				"dashboard-auth": map[string]any{
+					"basicAuth": map[string]any{"users": []string{usersEntry}},
+				},
+			},
+		},
+	}
+
+	return marshalYAML(dynamic)
+}
+
+// writeGeneratedFile writes a generated file, asking before overwriting it unless forced
+func writeGeneratedFile(path string, content []byte, forceOverwrite bool) bool {
+	if _, err := os.Stat(path); err == nil && !forceOverwrite {
+		fmt.Printf("Output file %s already exists. Overwrite? (y/n): ", path)
+		var answer string
+		fmt.Scanln(&answer)
+		if strings.ToLower(answer) != "y" {
+			fmt.Println("Operation cancelled.")
+			return false
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		fmt.Printf("Error creating output directory: %v\n", err)
+		return false
+	}
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		fmt.Printf("Error writing %s: %v\n", path, err)
+		return false
+	}
+
+	return true
+}
+
+// GenerateTraefikConfig writes the Traefik static configuration of an environment and, for the production
+// profile, the dynamic configuration of the dashboard router
+func GenerateTraefikConfig(configFile string, consolidatedEnvFile string, outputFile string, dynamicDir string, environment string, forceOverwrite bool) {
+	scriptDir, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("Error getting current directory: %v\n", err)
+		return
+	}
+
+	configFile = resolveFilePath(configFile, scriptDir, scriptDir)
+	consolidatedEnvFile = resolveFilePath(consolidatedEnvFile, scriptDir, scriptDir)
+	outputFile = resolveFilePath(outputFile, scriptDir, scriptDir)
+	dynamicDir = resolveFilePath(dynamicDir, scriptDir, scriptDir)
+	environment = resolveEnvironment(environment)
+	config := getConfig(configFile)
+	settings := traefikSettingsForEnvironment(config, environment)
+
+	if settings.Profile != "dev" && settings.Profile != "production" {
+		fmt.Printf("Error: unknown traefik profile %q (expected dev or production)\n", settings.Profile)
+		return
+	}
+	if settings.Provider != "" && settings.Provider != "docker" && settings.Provider != "file" {
+		fmt.Printf("Error: unknown traefik provider %q (expected docker or file)\n", settings.Provider)
+		return
+	}
+	if settings.Profile == "production" && settings.ACMEEmail == "" {
+		fmt.Printf("Error: the production profile needs traefik.acme_email for the %s environment\n", environment)
+		return
+	}
+
+	static := buildTraefikStaticConfig(settings)
+	body, err := marshalYAML(static)
+	if err != nil {
+		fmt.Printf("Error marshalling traefik config: %v\n", err)
+		return
+	}
+
+	var content bytes.Buffer
+	content.WriteString(fmt.Sprintf("# Traefik static configuration for the %s environment (%s profile)\n", environment, settings.Profile))
+	content.WriteString(fmt.Sprintf("# Generated by deployment traefik on %s\n", time.Now().Format(time.RFC1123)))
+	content.WriteString("# DO NOT EDIT THIS FILE DIRECTLY - Edit the traefik section of services-config.yaml instead\n\n")
+	content.Write(body)
+
+	if !writeGeneratedFile(outputFile, content.Bytes(), forceOverwrite) {
+		return
+	}
+	fmt.Printf("Generated traefik config for the %s environment (%s profile) written to %s\n", environment, settings.Profile, outputFile)
+
+	dashboardFile := filepath.Join(dynamicDir, "dashboard.yml")
+	if settings.Profile == "dev" {
+		// The dev dashboard is served by the insecure API, a router left from another environment would shadow it
+		if err := os.Remove(dashboardFile); err == nil {
+			fmt.Printf("  Removed %s generated for another environment\n", dashboardFile)
+		}
+		fmt.Println("  Dashboard available without authentication on port 8080")
+		return
+	}
+	if settings.ACMECAServer != "" {
+		fmt.Printf("  ACME certificates issued by %s\n", settings.ACMECAServer)
+	}
+	if static.Metrics != nil {
+		fmt.Printf("  Prometheus metrics exposed on port %d\n", traefikMetricsPort)
+	}
+
+	if settings.DashboardDomain == "" {
+		fmt.Println("  Warning: traefik.dashboard_domain is not set, the dashboard is not routed")
+		return
+	}
+
+	traefikService, _ := getTraefikService(config)
+	passwordName := traefikDashboardPasswordName(traefikService)
+	password := readEnvVars(consolidatedEnvFile)[passwordName]
+	if password == "" {
+		fmt.Printf("Error: %s is missing from %s, run deployment env first\n", passwordName, consolidatedEnvFile)
+		return
+	}
+
+	usersEntry, err := htpasswdEntry(settings.DashboardUser, password, previousHtpasswdEntries(dynamicDir))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	dashboard, err := renderTraefikDashboardConfig(settings, usersEntry)
+	if err != nil {
+		fmt.Printf("Error marshalling dashboard config: %v\n", err)
+		return
+	}
+
+	header := "# Traefik dashboard router, generated by deployment traefik\n# The password is " + passwordName + " from the consolidated .env file\n\n"
+	if !writeGeneratedFile(dashboardFile, append([]byte(header), dashboard...), true) {
+		return
+	}
+	fmt.Printf("  Dashboard routed on https://%s for user %s, written to %s\n", settings.DashboardDomain, settings.DashboardUser, dashboardFile)
+}
+
+// updateTraefikService mounts the dynamic configuration directory and the ACME storage into the traefik service
+func updateTraefikService(dockerCompose *DockerComposeConfig, configFile string) {
+	config := getConfig(configFile)
+	traefikService, ok := getTraefikService(config)
+	if !ok {
+		return
+	}
+	service, ok := dockerCompose.Services[traefikService.Name]
+	if !ok {
+		return
+	}
+
+	volumes, _ := service.Volumes.([]any)
+	mounts := []string{
+		fmt.Sprintf("./%s/dynamic:%s:ro", traefikService.Name, traefikDynamicMountPath),
+		fmt.Sprintf("./%s/letsencrypt:/letsencrypt", traefikService.Name),
+		fmt.Sprintf("./%s/certs:%s:ro", traefikService.Name, traefikCertsMountPath),
+	}
+	added := 0
+	for _, mount := range mounts {
+		exists := false
+		for _, volume := range volumes {
+			if volume == mount {
+				exists = true
+			}
+		}
+		if !exists {
+			volumes = append(volumes, mount)
+			added++
+		}
+	}
+
+	service.Volumes = volumes
+	dockerCompose.Services[traefikService.Name] = service
+	if added > 0 {
+		fmt.Printf("  Mounted dynamic config, certificates and ACME storage into service %s\n", traefikService.Name)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TraefikDynamicConfig represents the routing written for the Traefik file provider
+type TraefikDynamicConfig struct {
+	HTTP TraefikDynamicHTTP `yaml:"http"`
+}
+
+// TraefikDynamicHTTP holds the HTTP routers, services and middlewares of the dynamic configuration
+type TraefikDynamicHTTP struct {
+	Routers     map[string]*TraefikRouter  `yaml:"routers,omitempty"`
+	Services    map[string]*TraefikService `yaml:"services,omitempty"`
+	Middlewares map[string]map[string]any  `yaml:"middlewares,omitempty"`
+}
+
+// TraefikRouter represents an HTTP router
+type TraefikRouter struct {
+	Rule        string            `yaml:"rule"`
+	EntryPoints []string          `yaml:"entryPoints,omitempty"`
+	Middlewares []string          `yaml:"middlewares,omitempty"`
+	Service     string            `yaml:"service"`
+	Priority    int               `yaml:"priority,omitempty"`
+	TLS         *TraefikRouterTLS `yaml:"tls,omitempty"`
+}
+
+// TraefikRouterTLS enables TLS on a router, optionally with a certificate resolver
+type TraefikRouterTLS struct {
+	CertResolver string `yaml:"certResolver,omitempty"`
+	Options      string `yaml:"options,omitempty"`
+}
+
+// TraefikService represents a load balanced HTTP service
+type TraefikService struct {
+	LoadBalancer TraefikLoadBalancer `yaml:"loadBalancer"`
+}
+
+// TraefikLoadBalancer lists the backend servers of a service
+type TraefikLoadBalancer struct {
+	Servers        []TraefikServer `yaml:"servers"`
+	PassHostHeader *bool           `yaml:"passHostHeader,omitempty"`
+}
+
+// TraefikServer is a backend URL
+type TraefikServer struct {
+	URL string `yaml:"url"`
+}
+
+// traefikRoutingFile is the dynamic configuration file written in file provider mode
+const traefikRoutingFile = "routing.yml"
+
+// traefikProvider returns how routing reaches Traefik in the environment, docker labels or the file provider
+func traefikProvider(config Config, environment string) string {
+	return valueOrDefault(traefikSettingsForEnvironment(config, environment).Provider, "docker")
+}
+
+// usesTraefikFileProvider reports whether the traefik section or one of its environments selects the file provider
+func usesTraefikFileProvider(config Config) bool {
+	if config.Traefik.Provider == "file" {
+		return true
+	}
+	for _, settings := range config.Traefik.Environments {
+		if settings.Provider == "file" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// interpolateComposeValue resolves ${VAR}, ${VAR:-default} and $VAR references like docker compose does
+func interpolateComposeValue(value string, envVars map[string]string) string {
+	return os.Expand(value, func(name string) string {
+		if variable, fallback, ok := strings.Cut(name, ":-"); ok {
+			return valueOrDefault(envVars[variable], fallback)
+		}
+		return envVars[name]
+	})
+}
+
+// parseTraefikLabels converts the Traefik labels of a compose service into routers, services and the names of
+// middlewares defined on it. Backend URLs use the compose service name, which resolves on the shared network.
+func parseTraefikLabels(serviceName string, labels []string, envVars map[string]string, dynamic *TraefikDynamicConfig) ([]string, []string) {
+	var definedMiddlewares []string
+	var warnings []string
+
+	routers := make(map[string]*TraefikRouter)
+	services := make(map[string]*TraefikService)
+	schemes := make(map[string]string)
+	ports := make(map[string]string)
+
+	for _, label := range labels {
+		key, value, _ := strings.Cut(label, "=")
+		lowerKey := strings.ToLower(key)
+		if !strings.HasPrefix(lowerKey, "traefik.") {
+			continue
+		}
+
+		parts := strings.SplitN(strings.TrimPrefix(lowerKey, "traefik."), ".", 4)
+		if parts[0] == "enable" || parts[0] == "docker" {
+			continue
+		}
+		if len(parts) < 4 || parts[0] != "http" {
+			warnings = append(warnings, fmt.Sprintf("label %s of service %s is not supported by the file provider mode", key, serviceName))
+			continue
+		}
+
+		// Keep the case of router and service names from the original key
+		name := strings.SplitN(key, ".", 5)[3]
+		option := parts[3]
+		switch parts[1] {
+		case "routers":
+			router, ok := routers[name]
+			if !ok {
+				router = &TraefikRouter{}
+				routers[name] = router
+			}
+			switch option {
+			case "rule":
+				router.Rule = value
+			case "entrypoints":
+				router.EntryPoints = splitList(value)
+			case "middlewares":
+				for _, middleware := range splitList(value) {
+					router.Middlewares = append(router.Middlewares, strings.TrimSuffix(middleware, "@docker"))
+				}
+			case "service":
+				router.Service = strings.TrimSuffix(value, "@docker")
+			case "priority":
+				router.Priority, _ = strconv.Atoi(value)
+			case "tls":
+				if enabled, _ := strconv.ParseBool(value); enabled && router.TLS == nil {
+					router.TLS = &TraefikRouterTLS{}
+				}
+			case "tls.certresolver":
+				if router.TLS == nil {
+					router.TLS = &TraefikRouterTLS{}
+				}
+				router.TLS.CertResolver = value
+			case "tls.options":
+				if router.TLS == nil {
+					router.TLS = &TraefikRouterTLS{}
+				}
+				router.TLS.Options = value
+			default:
+				warnings = append(warnings, fmt.Sprintf("router option %s of service %s is not supported by the file provider mode", key, serviceName))
+			}
+		case "services":
+			service, ok := services[name]
+			if !ok {
+				service = &TraefikService{}
+				services[name] = service
+			}
+			switch option {
+			case "loadbalancer.server.port":
+				ports[name] = interpolateComposeValue(value, envVars)
+			case "loadbalancer.server.scheme":
+				schemes[name] = value
+			case "loadbalancer.passhostheader":
+				passHostHeader, _ := strconv.ParseBool(value)
+				service.LoadBalancer.PassHostHeader = &passHostHeader
+			default:
+				warnings = append(warnings, fmt.Sprintf("service option %s of service %s is not supported by the file provider mode", key, serviceName))
+			}
+		case "middlewares":
+			if !slices.Contains(definedMiddlewares, name) {
+				definedMiddlewares = append(definedMiddlewares, name)
+			}
+		default:
+			warnings = append(warnings, fmt.Sprintf("label %s of service %s is not supported by the file provider mode", key, serviceName))
+		}
+	}
+
+	for name, service := range services {
+		port := ports[name]
+		if port == "" {
+			warnings = append(warnings, fmt.Sprintf("Traefik service %s of service %s has no port, skipping it", name, serviceName))
+			delete(services, name)
+			continue
+		}
+		url := fmt.Sprintf("%s://%s:%s", valueOrDefault(schemes[name], "http"), serviceName, port)
+		service.LoadBalancer.Servers = []TraefikServer{{URL: url}}
+		if existing, ok := dynamic.HTTP.Services[name]; ok && !reflect.DeepEqual(existing, service) {
+			warnings = append(warnings, fmt.Sprintf("Traefik service %s of service %s is already defined differently for %s, keeping the first definition", name, serviceName, existing.LoadBalancer.Servers[0].URL))
+			delete(services, name)
+			continue
+		}
+		dynamic.HTTP.Services[name] = service
+	}
+
+	for name, router := range routers {
+		if router.Rule == "" {
+			warnings = append(warnings, fmt.Sprintf("router %s of service %s has no rule, skipping it", name, serviceName))
+			continue
+		}
+		// Like the docker provider, a router without a service uses the only service of its container
+		if router.Service == "" {
+			if len(services) != 1 {
+				warnings = append(warnings, fmt.Sprintf("router %s of service %s does not name one of its %d services, skipping it", name, serviceName, len(services)))
+				continue
+			}
+			for only := range services {
+				router.Service = only
+			}
+		}
+		// Identical routers are expected from the blue and green variants of a released service
+		if existing, ok := dynamic.HTTP.Routers[name]; ok && !reflect.DeepEqual(existing, router) {
+			warnings = append(warnings, fmt.Sprintf("router %s of service %s is already defined differently by another service, keeping the first definition", name, serviceName))
+			continue
+		}
+		dynamic.HTTP.Routers[name] = router
+	}
+
+	return definedMiddlewares, warnings
+}
+
+// splitList splits a comma separated label value
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// applyTraefikFileProvider moves the routing of the compose services from labels into a dynamic configuration
+// file read by the Traefik file provider, and removes the docker.sock mount Traefik no longer needs
+func applyTraefikFileProvider(dockerCompose *DockerComposeConfig, envVars map[string]string, configFile string, environment string, dynamicDir string, middlewares map[string]map[string]any) error {
+	config := getConfig(configFile)
+	routingFile := filepath.Join(dynamicDir, traefikRoutingFile)
+
+	if traefikProvider(config, environment) != "file" {
+		// A routing file left from the file provider mode would duplicate the routers of the labels
+		if err := os.Remove(routingFile); err == nil {
+			fmt.Printf("  Removed %s, routing uses Docker labels in the %s environment\n", routingFile, environment)
+		}
+		return nil
+	}
+
+	dynamic := TraefikDynamicConfig{HTTP: TraefikDynamicHTTP{
+		Routers:     make(map[string]*TraefikRouter),
+		Services:    make(map[string]*TraefikService),
+		Middlewares: make(map[string]map[string]any),
+	}}
+
+	serviceNames := make([]string, 0, len(dockerCompose.Services))
+	for serviceName := range dockerCompose.Services {
+		serviceNames = append(serviceNames, serviceName)
+	}
+	sort.Strings(serviceNames)
+
+	traefikName := "traefik"
+	if traefikService, ok := getTraefikService(config); ok {
+		traefikName = traefikService.Name
+	}
+
+	labelMiddlewares := make(map[string]string)
+	for _, serviceName := range serviceNames {
+		service := dockerCompose.Services[serviceName]
+		labels := serviceLabels(service)
+
+		defined, warnings := parseTraefikLabels(serviceName, labels, envVars, &dynamic)
+		for _, warning := range warnings {
+			fmt.Printf("Warning: %s\n", warning)
+		}
+		for _, name := range defined {
+			labelMiddlewares[name] = serviceName
+		}
+
+		var kept []string
+		for _, label := range labels {
+			if !strings.HasPrefix(strings.ToLower(label), "traefik.") {
+				kept = append(kept, label)
+			}
+		}
+		if len(kept) != len(labels) {
+			if len(kept) == 0 {
+				service.Labels = nil
+			} else {
+				setServiceLabels(&service, kept)
+			}
+		}
+
+		// Without the docker provider Traefik no longer needs the Docker API, other services keep their mounts
+		if volumes, ok := service.Volumes.([]any); ok && serviceName == traefikName {
+			var keptVolumes []any
+			for _, volume := range volumes {
+				if strings.Contains(fmt.Sprint(volume), "docker.sock") {
+					fmt.Printf("  Removed the docker.sock mount of service %s\n", serviceName)
+					continue
+				}
+				keptVolumes = append(keptVolumes, volume)
+			}
+			service.Volumes = keptVolumes
+		}
+
+		dockerCompose.Services[serviceName] = service
+	}
+
+	// Middlewares of the catalog are defined from their configuration, those in use already in middlewares.yml,
+	// others cannot be converted from labels
+	for _, router := range dynamic.HTTP.Routers {
+		for _, reference := range router.Middlewares {
+			if strings.Contains(reference, "@") {
+				continue
+			}
+			if _, ok := dynamic.HTTP.Middlewares[reference]; ok {
+				continue
+			}
+			if _, ok := middlewares[reference]; ok {
+				continue
+			}
+			middleware, ok := findMiddleware(config, reference)
+			if !ok {
+				if owner, ok := labelMiddlewares[reference]; ok {
+					fmt.Printf("Warning: middleware %s is defined by labels of service %s, declare it in the middlewares catalog to use it with the file provider\n", reference, owner)
+				}
+				continue
+			}
+			definition, err := traefikMiddlewareDefinition(config, middleware, envVars, previousHtpasswdEntries(dynamicDir))
+			if err != nil {
+				return err
+			}
+			dynamic.HTTP.Middlewares[reference] = definition
+		}
+	}
+
+	content, err := marshalYAML(dynamic)
+	if err != nil {
+		return err
+	}
+	header := "# Traefik routing for the file provider, generated by deployment update\n# DO NOT EDIT THIS FILE DIRECTLY - Edit the labels of docker-compose.template.yml and services-config.yaml instead\n\n"
+	if !writeGeneratedFile(routingFile, append([]byte(header), content...), true) {
+		return fmt.Errorf("unable to write %s", routingFile)
+	}
+	fmt.Printf("  Wrote %d routers, %d services and %d middlewares to %s\n", len(dynamic.HTTP.Routers), len(dynamic.HTTP.Services), len(dynamic.HTTP.Middlewares), routingFile)
+
+	return nil
+}
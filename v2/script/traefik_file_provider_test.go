@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseTraefikLabelsWarnsOnConflictingNames(t *testing.T) {
+	dynamic := TraefikDynamicConfig{HTTP: TraefikDynamicHTTP{
+		Routers:  make(map[string]*TraefikRouter),
+		Services: make(map[string]*TraefikService),
+	}}
+	envVars := map[string]string{"API_PORT": "8080"}
+
+	apiLabels := []string{
+		"traefik.enable=true",
+		"traefik.http.routers.api.rule=Host(`api.localhost`)",
+		"traefik.http.routers.api.middlewares=secure@docker",
+		"traefik.http.services.api.loadbalancer.server.port=${API_PORT}",
+	}
+	if _, warnings := parseTraefikLabels("api", apiLabels, envVars, &dynamic); len(warnings) != 0 {
+		t.Fatalf("warnings = %v", warnings)
+	}
+	router := dynamic.HTTP.Routers["api"]
+	if router == nil || router.Service != "api" || router.Middlewares[0] != "secure" {
+		t.Fatalf("router api = %+v", router)
+	}
+	if url := dynamic.HTTP.Services["api"].LoadBalancer.Servers[0].URL; url != "http://api:8080" {
+		t.Errorf("backend url = %s", url)
+	}
+
+	// The same router declared again, like by the variants of a released service, is no conflict
+	copyLabels := append(apiLabels[1:3:3], "traefik.http.routers.api.service=api")
+	if _, warnings := parseTraefikLabels("api-copy", copyLabels, envVars, &dynamic); len(warnings) != 0 {
+		t.Errorf("identical router reported as a conflict: %v", warnings)
+	}
+
+	webLabels := []string{
+		"traefik.http.routers.api.rule=Host(`web.localhost`)",
+		"traefik.http.services.api.loadbalancer.server.port=3000",
+	}
+	_, warnings := parseTraefikLabels("web", webLabels, envVars, &dynamic)
+	if len(warnings) != 2 || !strings.Contains(warnings[0], "Traefik service api of service web") || !strings.Contains(warnings[1], "router api of service web") {
+		t.Errorf("warnings = %v, want the conflicting service and router", warnings)
+	}
+	if dynamic.HTTP.Routers["api"].Rule != "Host(`api.localhost`)" || dynamic.HTTP.Services["api"].LoadBalancer.Servers[0].URL != "http://api:8080" {
+		t.Error("a conflicting definition replaced the first one")
+	}
+}
+
+func TestApplyTraefikFileProviderKeepsDockerSockOfOtherServices(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "services-config.yaml")
+	config := `common_services:
+  - name: traefik
+    prefix: "TRAEFIK_"
+traefik:
+  environments:
+    prod:
+      provider: file
+services: []
+`
+	if err := os.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dockerCompose := DockerComposeConfig{Services: map[string]DockerComposeService{
+		"traefik": {Volumes: []any{"/var/run/docker.sock:/var/run/docker.sock:ro", "./traefik/dynamic:/etc/traefik/dynamic:ro"}},
+		"agent":   {Volumes: []any{"/var/run/docker.sock:/var/run/docker.sock:ro"}},
+		"api": {
+			Labels: []any{"traefik.http.routers.api.rule=Host(`api.localhost`)", "traefik.http.services.api.loadbalancer.server.port=8080", "com.example.team=core"},
+		},
+	}}
+	dynamicDir := filepath.Join(dir, "traefik", "dynamic")
+
+	if err := applyTraefikFileProvider(&dockerCompose, nil, configFile, "prod", dynamicDir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if volumes := dockerCompose.Services["traefik"].Volumes.([]any); len(volumes) != 1 || volumes[0] != "./traefik/dynamic:/etc/traefik/dynamic:ro" {
+		t.Errorf("traefik volumes = %v, want the docker.sock mount removed", volumes)
+	}
+	if volumes := dockerCompose.Services["agent"].Volumes.([]any); len(volumes) != 1 {
+		t.Errorf("agent volumes = %v, want its docker.sock mount kept", volumes)
+	}
+	if labels := serviceLabels(dockerCompose.Services["api"]); len(labels) != 1 || labels[0] != "com.example.team=core" {
+		t.Errorf("api labels = %v, want only the labels unrelated to Traefik", labels)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dynamicDir, traefikRoutingFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var routing TraefikDynamicConfig
+	if err := yaml.Unmarshal(content, &routing); err != nil {
+		t.Fatal(err)
+	}
+	if router := routing.HTTP.Routers["api"]; router == nil || router.Service != "api" {
+		t.Errorf("routing.yml:\n%s", content)
+	}
+}
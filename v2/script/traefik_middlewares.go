@@ -0,0 +1,423 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// traefikMiddlewareName matches names usable in labels and file provider keys
+var traefikMiddlewareName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// traefikMiddlewareTypes lists the middleware types the catalog can declare
+var traefikMiddlewareTypes = []string{
+	"basicauth", "forwardauth", "ratelimit", "ipallowlist", "cors",
+	"headers", "compress", "stripprefix", "addprefix", "replacepathregex",
+}
+
+// traefikRouterRule matches the rule label of a router declared on a compose service
+var traefikRouterRule = regexp.MustCompile(`^traefik\.http\.routers\.([^.]+)\.rule=`)
+
+// findMiddleware looks up a middleware of the catalog by name
+func findMiddleware(config Config, name string) (MiddlewareConfig, bool) {
+	for _, middleware := range config.Middlewares {
+		if middleware.Name == name {
+			return middleware, true
+		}
+	}
+
+	return MiddlewareConfig{}, false
+}
+
+// validateMiddlewareConfig checks the catalog and the middlewares referenced by services
+func validateMiddlewareConfig(config Config) []string {
+	var problems []string
+
+	names := make(map[string]bool)
+	for _, middleware := range config.Middlewares {
+		if !traefikMiddlewareName.MatchString(middleware.Name) {
+			problems = append(problems, fmt.Sprintf("middleware name %q must be lowercase letters, digits and dashes", middleware.Name))
+		}
+		if names[middleware.Name] {
+			problems = append(problems, fmt.Sprintf("middleware %s is declared more than once", middleware.Name))
+		}
+		names[middleware.Name] = true
+
+		if !slices.Contains(traefikMiddlewareTypes, middleware.Type) {
+			problems = append(problems, fmt.Sprintf("middleware %s has unknown type %q (expected one of %s)", middleware.Name, middleware.Type, strings.Join(traefikMiddlewareTypes, ", ")))
+			continue
+		}
+
+		var missing string
+		switch middleware.Type {
+		case "basicauth":
+			if len(middleware.Users) == 0 {
+				missing = "users"
+			}
+			for _, user := range middleware.Users {
+				if strings.ContainsAny(user, ":, ") {
+					problems = append(problems, fmt.Sprintf("middleware %s has invalid user %q", middleware.Name, user))
+				}
+			}
+		case "forwardauth":
+			if middleware.Address == "" {
+				missing = "address"
+			}
+		case "ratelimit":
+			if middleware.Average <= 0 {
+				missing = "average"
+			}
+		case "ipallowlist":
+			if len(middleware.SourceRange) == 0 {
+				missing = "source_range"
+			}
+		case "cors":
+			if len(middleware.Origins) == 0 {
+				missing = "origins"
+			}
+		case "stripprefix":
+			if len(middleware.Prefixes) == 0 {
+				missing = "prefixes"
+			}
+		case "addprefix":
+			if middleware.Prefix == "" {
+				missing = "prefix"
+			}
+		case "replacepathregex":
+			if middleware.Regex == "" {
+				missing = "regex"
+			} else if _, err := regexp.Compile(middleware.Regex); err != nil {
+				problems = append(problems, fmt.Sprintf("middleware %s has an invalid regex: %v", middleware.Name, err))
+			}
+		}
+		if missing != "" {
+			problems = append(problems, fmt.Sprintf("middleware %s of type %s requires %s", middleware.Name, middleware.Type, missing))
+		}
+	}
+
+	for _, service := range getAllServiceConfigs(config) {
+		seen := make(map[string]bool)
+		for _, name := range service.Middlewares {
+			if !names[name] {
+				problems = append(problems, fmt.Sprintf("service %s uses undeclared middleware %s", service.Name, name))
+			}
+			if seen[name] {
+				problems = append(problems, fmt.Sprintf("service %s lists middleware %s more than once", service.Name, name))
+			}
+			seen[name] = true
+		}
+	}
+
+	return problems
+}
+
+// traefikMiddlewarePasswordName returns the consolidated variable holding the password of a basicauth user
+func traefikMiddlewarePasswordName(config Config, middleware MiddlewareConfig, user string) string {
+	prefix := "TRAEFIK_"
+	if traefikService, ok := getTraefikService(config); ok && traefikService.Prefix != "" {
+		prefix = traefikService.Prefix
+	}
+
+	name := strings.ToUpper(middleware.Name + "_" + user + "_PASSWORD")
+	return prefix + strings.NewReplacer("-", "_", ".", "_").Replace(name)
+}
+
+// traefikMiddlewareGeneratedVariables returns the passwords of the basicauth users guarding the given services
+func traefikMiddlewareGeneratedVariables(services []ServiceConfig, config Config, existing map[string]string) []GeneratedVariable {
+	used := make(map[string]bool)
+	for _, service := range services {
+		for _, name := range service.Middlewares {
+			used[name] = true
+		}
+	}
+
+	var variables []GeneratedVariable
+	for _, middleware := range config.Middlewares {
+		if middleware.Type != "basicauth" || !used[middleware.Name] {
+			continue
+		}
+		for _, user := range middleware.Users {
+			name := traefikMiddlewarePasswordName(config, middleware, user)
+			variables = append(variables, GeneratedVariable{Name: name, Value: existingOrNewSecret(existing, name)})
+		}
+	}
+
+	return variables
+}
+
+// traefikMiddlewareDefinition builds the Traefik dynamic configuration of a middleware, keyed like the file provider
+func traefikMiddlewareDefinition(config Config, middleware MiddlewareConfig, envVars map[string]string, previousUsers []string) (map[string]any, error) {
+	switch middleware.Type {
+	case "basicauth":
+		var users []string
+		for _, user := range middleware.Users {
+			name := traefikMiddlewarePasswordName(config, middleware, user)
+			password := envVars[name]
+			if password == "" {
+				return nil, fmt.Errorf("password %s of middleware %s is not set, run consolidate first", name, middleware.Name)
+			}
+			entry, err := htpasswdEntry(user, password, previousUsers)
+			if err != nil {
+				return nil, err
+			}
+			users = append(users, entry)
+		}
+		return map[string]any{"basicAuth": map[string]any{"users": users}}, nil
+
+	case "forwardauth":
+		options := map[string]any{"address": middleware.Address}
+		if middleware.TrustForwardHeader {
+			options["trustForwardHeader"] = true
+		}
+		if len(middleware.AuthResponseHeaders) > 0 {
+			options["authResponseHeaders"] = middleware.AuthResponseHeaders
+		}
+		return map[string]any{"forwardAuth": options}, nil
+
+	case "ratelimit":
+		options := map[string]any{"average": middleware.Average}
+		if middleware.Burst > 0 {
+			options["burst"] = middleware.Burst
+		}
+		if middleware.Period != "" {
+			options["period"] = middleware.Period
+		}
+		return map[string]any{"rateLimit": options}, nil
+
+	case "ipallowlist":
+		return map[string]any{"ipAllowList": map[string]any{"sourceRange": middleware.SourceRange}}, nil
+
+	case "cors":
+		options := map[string]any{
+			"accessControlAllowOriginList": middleware.Origins,
+			"accessControlAllowMethods":    middleware.Methods,
+			"addVaryHeader":                true,
+		}
+		if len(middleware.Methods) == 0 {
+			options["accessControlAllowMethods"] = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
+		}
+		if len(middleware.AllowHeaders) > 0 {
+			options["accessControlAllowHeaders"] = middleware.AllowHeaders
+		}
+		if middleware.AllowCredentials {
+			options["accessControlAllowCredentials"] = true
+		}
+		if middleware.MaxAge > 0 {
+			options["accessControlMaxAge"] = middleware.MaxAge
+		}
+		return map[string]any{"headers": options}, nil
+
+	case "headers":
+		// Defaults follow the secure-headers middleware of the v1 deployment
+		options := map[string]any{
+			"contentTypeNosniff":      true,
+			"customFrameOptionsValue": valueOrDefault(middleware.FrameOptions, "SAMEORIGIN"),
+			"contentSecurityPolicy":   valueOrDefault(middleware.ContentSecurityPolicy, "frame-ancestors 'self'"),
+			"referrerPolicy":          valueOrDefault(middleware.ReferrerPolicy, "strict-origin-when-cross-origin"),
+			"permissionsPolicy":       valueOrDefault(middleware.PermissionsPolicy, "camera=(), microphone=(), geolocation=(), payment=()"),
+		}
+		if middleware.STSSeconds > 0 {
+			options["stsSeconds"] = middleware.STSSeconds
+			options["stsIncludeSubdomains"] = true
+		}
+		if len(middleware.ResponseHeaders) > 0 {
+			options["customResponseHeaders"] = middleware.ResponseHeaders
+		}
+		return map[string]any{"headers": options}, nil
+
+	case "compress":
+		return map[string]any{"compress": map[string]any{}}, nil
+
+	case "stripprefix":
+		return map[string]any{"stripPrefix": map[string]any{"prefixes": middleware.Prefixes}}, nil
+
+	case "addprefix":
+		return map[string]any{"addPrefix": map[string]any{"prefix": middleware.Prefix}}, nil
+
+	case "replacepathregex":
+		return map[string]any{"replacePathRegex": map[string]any{"regex": middleware.Regex, "replacement": middleware.Replacement}}, nil
+	}
+
+	return nil, fmt.Errorf("middleware %s has unknown type %q", middleware.Name, middleware.Type)
+}
+
+// serviceLabels returns the labels of a compose service as a list of key=value strings
+func serviceLabels(service DockerComposeService) []string {
+	var labels []string
+
+	switch typed := service.Labels.(type) {
+	case []any:
+		for _, label := range typed {
+			labels = append(labels, fmt.Sprint(label))
+		}
+	case map[string]any:
+		keys := make([]string, 0, len(typed))
+		for key := range typed {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			labels = append(labels, fmt.Sprintf("%s=%v", key, typed[key]))
+		}
+	}
+
+	return labels
+}
+
+// setServiceLabels stores labels on a compose service in list form
+func setServiceLabels(service *DockerComposeService, labels []string) {
+	list := make([]any, 0, len(labels))
+	for _, label := range labels {
+		list = append(list, label)
+	}
+	service.Labels = list
+}
+
+// serviceRouters returns the routers declared by the labels of a compose service
+func serviceRouters(labels []string) []string {
+	var routers []string
+	for _, label := range labels {
+		if match := traefikRouterRule.FindStringSubmatch(label); match != nil && !slices.Contains(routers, match[1]) {
+			routers = append(routers, match[1])
+		}
+	}
+
+	return routers
+}
+
+// traefikMiddlewaresFile is the dynamic configuration file defining the middlewares of the catalog
+const traefikMiddlewaresFile = "middlewares.yml"
+
+// applyMiddlewares chains the catalog middlewares used by the compose services on the routers of every service,
+// in the order the service lists them, and returns their definitions. The middlewares are defined in the file
+// provider and referenced as <name>@file, so a router never depends on the labels of another container.
+func applyMiddlewares(dockerCompose *DockerComposeConfig, envVars map[string]string, configFile string, dynamicDir string) (map[string]map[string]any, error) {
+	config := getConfig(configFile)
+	definitions := make(map[string]map[string]any)
+	if len(config.Middlewares) == 0 {
+		return definitions, nil
+	}
+	if problems := validateMiddlewareConfig(config); len(problems) > 0 {
+		return nil, fmt.Errorf("invalid middleware configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	serviceNames := make([]string, 0, len(dockerCompose.Services))
+	for serviceName := range dockerCompose.Services {
+		serviceNames = append(serviceNames, serviceName)
+	}
+	sort.Strings(serviceNames)
+
+	previousUsers := previousHtpasswdEntries(dynamicDir)
+	for _, serviceName := range serviceNames {
+		serviceConfig := getServiceConfig(releaseBaseService(serviceName, configFile), configFile)
+		service := dockerCompose.Services[serviceName]
+		labels := serviceLabels(service)
+
+		// Drop catalog definitions left in the template, the file provider defines them
+		kept := labels[:0:0]
+		for _, label := range labels {
+			stale := false
+			for _, middleware := range config.Middlewares {
+				if strings.HasPrefix(label, "traefik.http.middlewares."+middleware.Name+".") {
+					stale = true
+				}
+			}
+			if !stale {
+				kept = append(kept, label)
+			}
+		}
+		labels = kept
+
+		routers := serviceRouters(labels)
+		if len(serviceConfig.Middlewares) > 0 && len(routers) == 0 {
+			fmt.Printf("Warning: service %s lists middlewares but declares no Traefik router\n", serviceName)
+		}
+		if len(serviceConfig.Middlewares) == 0 || len(routers) == 0 {
+			if len(labels) != len(serviceLabels(service)) {
+				setServiceLabels(&service, labels)
+				dockerCompose.Services[serviceName] = service
+			}
+			continue
+		}
+
+		for _, name := range serviceConfig.Middlewares {
+			if _, ok := definitions[name]; ok {
+				continue
+			}
+			middleware, _ := findMiddleware(config, name)
+			definition, err := traefikMiddlewareDefinition(config, middleware, envVars, previousUsers)
+			if err != nil {
+				return nil, err
+			}
+			definitions[name] = definition
+		}
+
+		// Keep middlewares chained by the template first and append the configured ones. A template reference
+		// to a catalog middleware through another provider is pointed at the file provider in place.
+		for _, router := range routers {
+			key := "traefik.http.routers." + router + ".middlewares="
+			chain := []string{}
+			index := -1
+			for i, label := range labels {
+				if strings.HasPrefix(label, key) {
+					index = i
+					for _, reference := range strings.Split(strings.TrimPrefix(label, key), ",") {
+						if reference = strings.TrimSpace(reference); reference != "" {
+							chain = append(chain, reference)
+						}
+					}
+				}
+			}
+			for i, reference := range chain {
+				if name, _, _ := strings.Cut(reference, "@"); slices.Contains(serviceConfig.Middlewares, name) {
+					chain[i] = name + "@file"
+				}
+			}
+			for _, name := range serviceConfig.Middlewares {
+				if !slices.Contains(chain, name+"@file") {
+					chain = append(chain, name+"@file")
+				}
+			}
+			if index >= 0 {
+				labels[index] = key + strings.Join(chain, ",")
+			} else {
+				labels = append(labels, key+strings.Join(chain, ","))
+			}
+		}
+
+		setServiceLabels(&service, labels)
+		dockerCompose.Services[serviceName] = service
+
+		fmt.Printf("  Chained middlewares %s on routers %s of service %s\n", strings.Join(serviceConfig.Middlewares, ", "), strings.Join(routers, ", "), serviceName)
+	}
+
+	return definitions, nil
+}
+
+// writeTraefikMiddlewares writes the definitions of the middlewares in use to the dynamic configuration, and
+// removes the file when no service uses one
+func writeTraefikMiddlewares(definitions map[string]map[string]any, dynamicDir string) error {
+	middlewaresFile := filepath.Join(dynamicDir, traefikMiddlewaresFile)
+	if len(definitions) == 0 {
+		if err := os.Remove(middlewaresFile); err == nil {
+			fmt.Printf("  Removed %s, no service uses a middleware of the catalog\n", middlewaresFile)
+		}
+		return nil
+	}
+
+	content, err := marshalYAML(TraefikDynamicConfig{HTTP: TraefikDynamicHTTP{Middlewares: definitions}})
+	if err != nil {
+		return err
+	}
+	header := "# Traefik middlewares of the catalog, generated by deployment update\n# DO NOT EDIT THIS FILE DIRECTLY - Edit the middlewares section of services-config.yaml instead\n\n"
+	if !writeGeneratedFile(middlewaresFile, append([]byte(header), content...), true) {
+		return fmt.Errorf("unable to write %s", middlewaresFile)
+	}
+	fmt.Printf("  Wrote %d middlewares to %s\n", len(definitions), middlewaresFile)
+
+	return nil
+}
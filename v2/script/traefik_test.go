@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHtpasswdEntryUsesBcrypt(t *testing.T) {
+	entry, err := htpasswdEntry("admin", "secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, hash, _ := strings.Cut(entry, ":")
+	if user != "admin" || !strings.HasPrefix(hash, "$2a$") {
+		t.Fatalf("entry = %q, want an admin:$2a$ bcrypt entry", entry)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte("secret")); err != nil {
+		t.Errorf("hash does not match the password: %v", err)
+	}
+
+	// Every new entry gets its own salt
+	other, _ := htpasswdEntry("admin", "secret", nil)
+	if other == entry {
+		t.Error("two hashes of the same password are equal, the salt is not random")
+	}
+}
+
+func TestHtpasswdEntryReusesPreviousHash(t *testing.T) {
+	dir := t.TempDir()
+	previous, _ := htpasswdEntry("admin", "secret", nil)
+	dashboard, err := renderTraefikDashboardConfig(TraefikSettings{DashboardDomain: "traefik.example.com"}, previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "dashboard.yml"), dashboard, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := previousHtpasswdEntries(dir)
+	if !slices.Equal(entries, []string{previous}) {
+		t.Fatalf("previous entries = %v, want %v", entries, []string{previous})
+	}
+
+	tests := []struct {
+		user, password string
+		reused         bool
+	}{
+		{"admin", "secret", true},
+		{"admin", "changed", false},
+		{"operator", "secret", false},
+	}
+	for _, test := range tests {
+		entry, err := htpasswdEntry(test.user, test.password, entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (entry == previous) != test.reused {
+			t.Errorf("htpasswdEntry(%s, %s) reused the previous hash = %v, want %v", test.user, test.password, entry == previous, test.reused)
+		}
+	}
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// secretNameHints are name fragments that mark a variable as secret when no schema says otherwise
+var secretNameHints = []string{"PASSWORD", "PASS", "SECRET", "TOKEN", "API_KEY", "PRIVATE_KEY", "SALT", "CREDENTIALS"}
+
+// reorderFlags moves flags in front of positional arguments so they can be given in any position
+func reorderFlags(flagSet *flag.FlagSet, args []string) []string {
+	var flags, positional []string
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "-" || !strings.HasPrefix(arg, "-") {
+			positional = append(positional, arg)
+			continue
+		}
+		if arg == "--" {
+			positional = append(positional, args[i+1:]...)
+			break
+		}
+
+		flags = append(flags, arg)
+		name := strings.TrimLeft(arg, "-")
+		if strings.Contains(name, "=") {
+			continue
+		}
+
+		// Flags that are not boolean take the next argument as their value
+		definition := flagSet.Lookup(name)
+		if definition == nil {
+			continue
+		}
+		if boolFlag, ok := definition.Value.(interface{ IsBoolFlag() bool }); ok && boolFlag.IsBoolFlag() {
+			continue
+		}
+		if i+1 < len(args) {
+			flags = append(flags, args[i+1])
+			i++
+		}
+	}
+
+	return append(flags, positional...)
+}
+
+// findVariableSchema returns the declared schema of a variable, if any
+func findVariableSchema(service ServiceConfig, key string) (VariableConfig, bool) {
+	key = strings.TrimPrefix(key, service.Prefix)
+	for _, variable := range service.Variables {
+		if strings.TrimPrefix(variable.Name, service.Prefix) == key {
+			return variable, true
+		}
+	}
+
+	return VariableConfig{}, false
+}
+
+// isSecretVariable reports whether a variable should be masked, from its schema or its name
+func isSecretVariable(service ServiceConfig, key string) bool {
+	if schema, ok := findVariableSchema(service, key); ok && schema.Secret {
+		return true
+	}
+
+	upperKey := strings.ToUpper(key)
+	for _, hint := range secretNameHints {
+		if strings.Contains(upperKey, hint) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// maskValue hides a secret value while still showing whether it is set
+func maskValue(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	return "********"
+}
+
+// consolidatedVariableName returns the name of a service variable in the consolidated .env file
+func consolidatedVariableName(service ServiceConfig, key string) string {
+	if strings.HasPrefix(key, service.Prefix) {
+		return key
+	}
+
+	return service.Prefix + key
+}
+
+// validateVariable checks a value against the declared schema of a variable
+func validateVariable(schema VariableConfig, value string) error {
+	if value == "" {
+		if schema.Required {
+			return fmt.Errorf("%s is required", schema.Name)
+		}
+		return nil
+	}
+
+	switch strings.ToLower(schema.Type) {
+	case "", "string":
+	case "int":
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("%s must be an integer", schema.Name)
+		}
+	case "port":
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("%s must be a port between 1 and 65535", schema.Name)
+		}
+	case "bool":
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("%s must be a boolean", schema.Name)
+		}
+	case "url":
+		parsed, err := url.Parse(value)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return fmt.Errorf("%s must be an absolute URL", schema.Name)
+		}
+	default:
+		return fmt.Errorf("%s has unknown type %q in schema", schema.Name, schema.Type)
+	}
+
+	if schema.Pattern != "" {
+		pattern, err := regexp.Compile(schema.Pattern)
+		if err != nil {
+			return fmt.Errorf("%s has invalid pattern in schema: %v", schema.Name, err)
+		}
+		if !pattern.MatchString(value) {
+			return fmt.Errorf("%s does not match pattern %s", schema.Name, schema.Pattern)
+		}
+	}
+
+	return nil
+}
+
+// serviceEnvFilePath returns the path of the source .env file of a service
+func serviceEnvFilePath(service ServiceConfig, serviceDir string) string {
+	envFile := service.EnvFile
+	if envFile == "" {
+		envFile = filepath.Join(service.Name, ".env")
+	}
+
+	return filepath.Join(serviceDir, envFile)
+}
+
+// lookupService returns the config of a service, failing when it is not declared
+func lookupService(config Config, serviceName string) (ServiceConfig, error) {
+	for _, service := range getAllServiceConfigs(config) {
+		if service.Name == serviceName {
+			return service, nil
+		}
+	}
+
+	return ServiceConfig{}, fmt.Errorf("service %s is not defined in the services config", serviceName)
+}
+
+// readValueFromStdin reads a variable value from standard input, prompting when attached to a terminal
+func readValueFromStdin(key string) (string, error) {
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Printf("Value for %s: ", key)
+		value, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		return strings.TrimRight(value, "\r\n"), nil
+	}
+
+	content, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// VarCommand runs the `deployment var` subcommands
+func VarCommand(args []string) {
+	if len(args) < 1 {
+		printVarUsage()
+		return
+	}
+
+	subcommand := args[0]
+	varCmd := flag.NewFlagSet("var "+subcommand, flag.ExitOnError)
+	configFile := varCmd.String("c", "services-config.yaml", "Path to services configuration file")
+	serviceDir := varCmd.String("dir", "", "Directory containing the services (default: current directory)")
+	showSecrets := varCmd.Bool("show-secrets", false, "Show secret values instead of masking them")
+	secret := varCmd.Bool("secret", false, "Treat the value as secret and record it in the variable schema")
+	force := varCmd.Bool("force", false, "Skip schema validation")
+	target := varCmd.String("to", "", "Move the variable to another service")
+	regenerate := varCmd.Bool("regen", false, "Re-run env consolidation after the change")
+	consolidatedEnvFile := varCmd.String("env", ".env", "Path to consolidated env file used with -regen")
+	templateFile := varCmd.String("t", "docker-compose.template.yml", "Path to template file used with -regen")
+	varCmd.Parse(reorderFlags(varCmd, args[1:]))
+	positional := varCmd.Args()
+
+	scriptDir, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("Error getting current directory: %v\n", err)
+		return
+	}
+	*configFile = resolveFilePath(*configFile, scriptDir, scriptDir)
+	*templateFile = resolveFilePath(*templateFile, scriptDir, scriptDir)
+	if *serviceDir == "" {
+		*serviceDir = scriptDir
+	} else {
+		*serviceDir = resolveFilePath(*serviceDir, scriptDir, scriptDir)
+	}
+	config := getConfig(*configFile)
+
+	changed := false
+	switch subcommand {
+	case "list":
+		err = listVariables(config, positional, *serviceDir, *showSecrets)
+	case "get":
+		if len(positional) != 2 {
+			err = fmt.Errorf("usage: deployment var get SERVICE KEY")
+			break
+		}
+		err = getVariable(config, positional[0], positional[1], *serviceDir)
+	case "set":
+		if len(positional) < 2 || len(positional) > 3 {
+			err = fmt.Errorf("usage: deployment var set SERVICE KEY [VALUE|-]")
+			break
+		}
+		value := "-"
+		if len(positional) == 3 {
+			value = positional[2]
+		}
+		err = setVariable(config, *configFile, positional[0], positional[1], value, *serviceDir, *secret, *force)
+		changed = err == nil
+	case "unset":
+		if len(positional) != 2 {
+			err = fmt.Errorf("usage: deployment var unset SERVICE KEY")
+			break
+		}
+		err = unsetVariable(config, positional[0], positional[1], *serviceDir, *force)
+		changed = err == nil
+	case "mv":
+		if len(positional) != 3 {
+			err = fmt.Errorf("usage: deployment var mv SERVICE KEY NEW_KEY [-to SERVICE]")
+			break
+		}
+		err = moveVariable(config, positional[0], positional[1], positional[2], *target, *serviceDir, *force)
+		changed = err == nil
+	case "grep":
+		if len(positional) != 1 {
+			err = fmt.Errorf("usage: deployment var grep PATTERN")
+			break
+		}
+		err = grepVariables(config, positional[0], *serviceDir, *showSecrets)
+	default:
+		fmt.Printf("Unknown var command: %s\n", subcommand)
+		printVarUsage()
+		return
+	}
+
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if changed && *regenerate {
+		fmt.Println("Regenerating consolidated env file...")
+		ConsolidateEnvFiles(*consolidatedEnvFile, true, *configFile, false, *serviceDir, *templateFile, "", "")
+	}
+}
+
+// listVariables prints the variables of one or all services with their consolidated names
+func listVariables(config Config, serviceNames []string, serviceDir string, showSecrets bool) error {
+	services := getAllServiceConfigs(config)
+	if len(serviceNames) > 0 {
+		services = nil
+		for _, serviceName := range serviceNames {
+			service, err := lookupService(config, serviceName)
+			if err != nil {
+				return err
+			}
+			services = append(services, service)
+		}
+	}
+
+	for _, service := range services {
+		envFile, err := loadEnvFile(serviceEnvFilePath(service, serviceDir))
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("# %s (%s)\n", service.Name, envFile.Path)
+		listed := make(map[string]bool)
+		for _, key := range envFile.Keys() {
+			value, _ := envFile.Get(key, "")
+			if !showSecrets && isSecretVariable(service, key) {
+				value = maskValue(value)
+			}
+			fmt.Printf("%-40s %-50s %s\n", key, consolidatedVariableName(service, key), value)
+			listed[strings.TrimPrefix(key, service.Prefix)] = true
+		}
+
+		// Declared but missing variables
+		for _, variable := range service.Variables {
+			if !listed[strings.TrimPrefix(variable.Name, service.Prefix)] && variable.Required {
+				fmt.Printf("%-40s %-50s (missing, required)\n", variable.Name, consolidatedVariableName(service, variable.Name))
+			}
+		}
+		fmt.Println()
+	}
+
+	return nil
+}
+
+// getVariable prints the raw value of a variable
+func getVariable(config Config, serviceName string, key string, serviceDir string) error {
+	service, err := lookupService(config, serviceName)
+	if err != nil {
+		return err
+	}
+
+	envFile, err := loadEnvFile(serviceEnvFilePath(service, serviceDir))
+	if err != nil {
+		return err
+	}
+
+	value, ok := envFile.Get(key, service.Prefix)
+	if !ok {
+		return fmt.Errorf("%s is not set for service %s", key, serviceName)
+	}
+
+	fmt.Println(value)
+	return nil
+}
+
+// setVariable updates or adds a variable in the service .env file
+func setVariable(config Config, configFile string, serviceName string, key string, value string, serviceDir string, secret bool, force bool) error {
+	service, err := lookupService(config, serviceName)
+	if err != nil {
+		return err
+	}
+
+	if !regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`).MatchString(key) {
+		return fmt.Errorf("invalid variable name %q", key)
+	}
+
+	if value == "-" {
+		value, err = readValueFromStdin(key)
+		if err != nil {
+			return fmt.Errorf("error reading value from stdin: %v", err)
+		}
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("multi-line values are not supported")
+	}
+
+	if schema, ok := findVariableSchema(service, key); ok && !force {
+		if err := validateVariable(schema, value); err != nil {
+			return err
+		}
+	}
+
+	envFile, err := loadEnvFile(serviceEnvFilePath(service, serviceDir))
+	if err != nil {
+		return err
+	}
+	envFile.Set(key, service.Prefix, value)
+	if err := envFile.Save(); err != nil {
+		return err
+	}
+
+	shownValue := value
+	if secret || isSecretVariable(service, key) {
+		shownValue = maskValue(value)
+	}
+	fmt.Printf("Set %s=%s in %s (consolidated as %s)\n", key, shownValue, envFile.Path, consolidatedVariableName(service, key))
+
+	if secret && !isSecretVariable(service, key) {
+		if err := declareSecretVariable(configFile, service, key); err != nil {
+			return fmt.Errorf("value saved, but marking %s as secret failed: %v", key, err)
+		}
+	}
+
+	return nil
+}
+
+// declareSecretVariable records a variable as secret in the schema of the service
+func declareSecretVariable(configFile string, service ServiceConfig, key string) error {
+	if _, ok := findVariableSchema(service, key); ok {
+		fmt.Printf("Note: %s is declared in the schema of %s without secret: true, update it by hand\n", key, service.Name)
+		return nil
+	}
+
+	configYAML, err := loadYAMLFile(configFile)
+	if err != nil {
+		return err
+	}
+
+	var item *yaml.Node
+	for _, section := range []string{"common_services", "services"} {
+		_, sequence := mappingEntry(configYAML.Root, section)
+		if _, found := sequenceItemByName(sequence, service.Name); found != nil {
+			item = found
+		}
+	}
+	if item == nil {
+		return fmt.Errorf("service %s not found in %s", service.Name, configFile)
+	}
+
+	indent := strings.Repeat(" ", item.Column-1)
+	_, variables := mappingEntry(item, "variables")
+	if variables != nil && variables.Kind == yaml.SequenceNode && len(variables.Content) > 0 {
+		itemIndent := strings.Repeat(" ", variables.Content[0].Column-3)
+		err = configYAML.InsertLines(nodeEndLine(variables)+1, []string{
+			fmt.Sprintf("%s- name: %s", itemIndent, key),
+			fmt.Sprintf("%s  secret: true", itemIndent),
+		})
+	} else if variables == nil {
+		err = configYAML.InsertLines(nodeEndLine(item)+1, []string{
+			indent + "variables:",
+			fmt.Sprintf("%s  - name: %s", indent, key),
+			fmt.Sprintf("%s    secret: true", indent),
+		})
+	} else {
+		return fmt.Errorf("variables of %s is not a list", service.Name)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := configYAML.Save(); err != nil {
+		return err
+	}
+	fmt.Printf("Declared %s as secret for %s in %s\n", key, service.Name, configFile)
+
+	return nil
+}
+
+// unsetVariable removes a variable from the service .env file
+func unsetVariable(config Config, serviceName string, key string, serviceDir string, force bool) error {
+	service, err := lookupService(config, serviceName)
+	if err != nil {
+		return err
+	}
+
+	if schema, ok := findVariableSchema(service, key); ok && schema.Required && !force {
+		return fmt.Errorf("%s is required by the schema of %s (use -force to remove it anyway)", key, serviceName)
+	}
+
+	envFile, err := loadEnvFile(serviceEnvFilePath(service, serviceDir))
+	if err != nil {
+		return err
+	}
+	if !envFile.Unset(key, service.Prefix) {
+		return fmt.Errorf("%s is not set for service %s", key, serviceName)
+	}
+	if err := envFile.Save(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed %s from %s\n", key, envFile.Path)
+	return nil
+}
+
+// moveVariable renames a variable, optionally moving it to the .env file of another service
+func moveVariable(config Config, serviceName string, key string, newKey string, targetService string, serviceDir string, force bool) error {
+	service, err := lookupService(config, serviceName)
+	if err != nil {
+		return err
+	}
+
+	envFile, err := loadEnvFile(serviceEnvFilePath(service, serviceDir))
+	if err != nil {
+		return err
+	}
+	value, ok := envFile.Get(key, service.Prefix)
+	if !ok {
+		return fmt.Errorf("%s is not set for service %s", key, serviceName)
+	}
+
+	if targetService == "" || targetService == serviceName {
+		if _, exists := envFile.Get(newKey, service.Prefix); exists {
+			return fmt.Errorf("%s is already set for service %s", newKey, serviceName)
+		}
+		if schema, ok := findVariableSchema(service, newKey); ok && !force {
+			if err := validateVariable(schema, value); err != nil {
+				return err
+			}
+		}
+
+		envFile.Rename(key, service.Prefix, newKey)
+		if err := envFile.Save(); err != nil {
+			return err
+		}
+		fmt.Printf("Renamed %s to %s in %s (consolidated as %s)\n", key, newKey, envFile.Path, consolidatedVariableName(service, newKey))
+		return nil
+	}
+
+	target, err := lookupService(config, targetService)
+	if err != nil {
+		return err
+	}
+	targetFile, err := loadEnvFile(serviceEnvFilePath(target, serviceDir))
+	if err != nil {
+		return err
+	}
+	if _, exists := targetFile.Get(newKey, target.Prefix); exists {
+		return fmt.Errorf("%s is already set for service %s", newKey, targetService)
+	}
+	if schema, ok := findVariableSchema(target, newKey); ok && !force {
+		if err := validateVariable(schema, value); err != nil {
+			return err
+		}
+	}
+
+	targetFile.Set(newKey, target.Prefix, value)
+	if err := targetFile.Save(); err != nil {
+		return err
+	}
+	envFile.Unset(key, service.Prefix)
+	if err := envFile.Save(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Moved %s from %s to %s as %s (consolidated as %s)\n", key, serviceName, targetService, newKey, consolidatedVariableName(target, newKey))
+	return nil
+}
+
+// grepVariables searches variable names, consolidated names and non-secret values of every service
+func grepVariables(config Config, pattern string, serviceDir string, showSecrets bool) error {
+	expression, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern: %v", err)
+	}
+
+	matches := 0
+	for _, service := range getAllServiceConfigs(config) {
+		envFile, err := loadEnvFile(serviceEnvFilePath(service, serviceDir))
+		if err != nil {
+			return err
+		}
+
+		for _, key := range envFile.Keys() {
+			value, _ := envFile.Get(key, "")
+			secret := isSecretVariable(service, key) && !showSecrets
+			consolidated := consolidatedVariableName(service, key)
+
+			if !expression.MatchString(key) && !expression.MatchString(consolidated) &&
+				(secret || !expression.MatchString(value)) {
+				continue
+			}
+
+			if secret {
+				value = maskValue(value)
+			}
+			fmt.Printf("%-40s %-40s %-50s %s\n", service.Name, key, consolidated, value)
+			matches++
+		}
+	}
+
+	if matches == 0 {
+		fmt.Println("No matching variables found")
+	}
+
+	return nil
+}
+
+func printVarUsage() {
+	fmt.Println("Usage:")
+	fmt.Println("  deployment var list [SERVICE...]          - List variables with their consolidated names")
+	fmt.Println("  deployment var get SERVICE KEY            - Print the value of a variable")
+	fmt.Println("  deployment var set SERVICE KEY [VALUE|-]  - Set a variable, reading the value from stdin when omitted or -")
+	fmt.Println("  deployment var unset SERVICE KEY          - Remove a variable")
+	fmt.Println("  deployment var mv SERVICE KEY NEW_KEY     - Rename a variable, or move it with -to SERVICE")
+	fmt.Println("  deployment var grep PATTERN               - Search variables of every service")
+	fmt.Println("\nOptions:")
+	fmt.Println("  -c string      Path to services configuration file (default: services-config.yaml)")
+	fmt.Println("  -dir string    Directory containing the services (default: current directory)")
+	fmt.Println("  -show-secrets  Show secret values instead of masking them")
+	fmt.Println("  -secret        Treat the value as secret and record it in the variable schema")
+	fmt.Println("  -force         Skip schema validation")
+	fmt.Println("  -to string     Move the variable to another service")
+	fmt.Println("  -regen         Re-run env consolidation after the change")
+	fmt.Println("  -env string    Path to consolidated env file used with -regen (default: .env)")
+	fmt.Println("  -t string      Path to template file used with -regen (default: docker-compose.template.yml)")
+}
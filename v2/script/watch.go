@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// WatchOptions configures `deployment watch`
+type WatchOptions struct {
+	ConfigFile          string
+	TemplateFile        string
+	ServiceDir          string
+	ConsolidatedEnvFile string
+	OutputFile          string
+	Only                string
+	Exclude             string
+	Environment         string
+	Interval            time.Duration
+	Debounce            time.Duration
+	Hook                string
+	Verbose             bool
+}
+
+// watchedFile describes why a file is watched
+type watchedFile struct {
+	kind    string
+	service string
+}
+
+// Watch regenerates the consolidated env and docker compose files whenever their sources change
+func Watch(options WatchOptions) {
+	scriptDir, err := os.Getwd()
+	if err != nil {
+		fmt.Printf("Error getting current directory: %v\n", err)
+		return
+	}
+
+	options.ConfigFile = resolveFilePath(options.ConfigFile, scriptDir, scriptDir)
+	options.TemplateFile = resolveFilePath(options.TemplateFile, scriptDir, scriptDir)
+	options.ConsolidatedEnvFile = resolveFilePath(options.ConsolidatedEnvFile, scriptDir, scriptDir)
+	if options.OutputFile == "" {
+		options.OutputFile = filepath.Join(scriptDir, "docker-compose.yml")
+	} else {
+		options.OutputFile = resolveFilePath(options.OutputFile, scriptDir, scriptDir)
+	}
+	// Generators get the service directory as given, only the watcher needs it resolved
+	watchDir := scriptDir
+	if options.ServiceDir != "" {
+		watchDir = resolveFilePath(options.ServiceDir, scriptDir, scriptDir)
+	}
+
+	files := watchedFiles(options, scriptDir, watchDir)
+	hashes := make(map[string]string)
+	for path := range files {
+		hashes[path] = fileHash(path)
+	}
+
+	fmt.Printf("Watching %d files (config, template, service .env files and the inputs of update), press Ctrl+C to stop\n", len(files))
+	regenerate(options, true, true, nil)
+
+	pending := make(map[string]watchedFile)
+	var lastChange time.Time
+
+	for {
+		time.Sleep(options.Interval)
+
+		for path, file := range files {
+			hash := fileHash(path)
+			if hash == hashes[path] {
+				continue
+			}
+			hashes[path] = hash
+			pending[path] = file
+			lastChange = time.Now()
+		}
+
+		if len(pending) == 0 || time.Since(lastChange) < options.Debounce {
+			continue
+		}
+
+		envChanged, composeChanged := false, false
+		var changedServices []string
+		for path, file := range pending {
+			relPath, _ := filepath.Rel(scriptDir, path)
+			fmt.Printf("[%s] Changed: %s\n", time.Now().Format("15:04:05"), relPath)
+
+			switch file.kind {
+			case "config":
+				envChanged, composeChanged = true, true
+			case "template", "compose":
+				composeChanged = true
+			case "env":
+				envChanged = true
+				changedServices = append(changedServices, file.service)
+			}
+		}
+		pending = make(map[string]watchedFile)
+
+		regenerate(options, envChanged, composeChanged, changedServices)
+
+		// The config may add or remove services, so refresh the watched files
+		files = watchedFiles(options, scriptDir, watchDir)
+		for path := range files {
+			if _, ok := hashes[path]; !ok {
+				hashes[path] = fileHash(path)
+			}
+		}
+	}
+}
+
+// watchedFiles returns the config, the template, the env_file of every configured service and the other files
+// update reads: the image lock, the release state behind the weighted services of traefik/dynamic and the
+// nats-server.conf whose presence adds its mount
+func watchedFiles(options WatchOptions, projectDir string, serviceDir string) map[string]watchedFile {
+	files := map[string]watchedFile{
+		options.ConfigFile:   {kind: "config"},
+		options.TemplateFile: {kind: "template"},
+	}
+
+	files[filepath.Join(projectDir, imageLockFile)] = watchedFile{kind: "compose"}
+	files[filepath.Join(projectDir, releaseStateFile)] = watchedFile{kind: "compose"}
+
+	config := getConfig(options.ConfigFile)
+	if natsService, ok := getNatsService(config); ok {
+		files[filepath.Join(filepath.Dir(options.OutputFile), natsService.Name, "nats-server.conf")] = watchedFile{kind: "compose"}
+	}
+	for _, service := range getAllServiceConfigs(config) {
+		if service.EnvFile == "" {
+			continue
+		}
+		files[getServiceEnvFile(service.Name, serviceDir, options.ConfigFile)] = watchedFile{kind: "env", service: service.Name}
+	}
+
+	return files
+}
+
+// fileHash returns a content hash of a file, or an empty string when it does not exist
+func fileHash(path string) string {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(content))
+}
+
+// regenerate re-runs the generators affected by a change and prints what changed in their output
+func regenerate(options WatchOptions, envChanged bool, composeChanged bool, changedServices []string) {
+	config := getConfig(options.ConfigFile)
+	previousEnv := readEnvVars(options.ConsolidatedEnvFile)
+	previousCompose := readComposeServices(options.OutputFile)
+
+	if envChanged {
+		captureOutput(options.Verbose, func() {
+			ConsolidateEnvFiles(options.ConsolidatedEnvFile, true, options.ConfigFile, false, options.ServiceDir, options.TemplateFile, options.Only, options.Exclude)
+		})
+	}
+	currentEnv := readEnvVars(options.ConsolidatedEnvFile)
+
+	// Compose only references variable names, so value changes do not require an update
+	if !composeChanged && !sameKeys(previousEnv, currentEnv) {
+		composeChanged = true
+	}
+	if composeChanged {
+		var err error
+		captureOutput(options.Verbose, func() {
+			err = UpdateDockerCompose(options.ConsolidatedEnvFile, options.OutputFile, true, options.TemplateFile, options.ServiceDir, options.ConfigFile, options.Only, options.Exclude, options.Environment, "")
+		})
+		// Restarting containers on the previous compose file would hide the failure
+		if err != nil {
+			fmt.Printf("  Error: %v\n", err)
+			fmt.Println("  Compose file not updated, skipping the hook")
+			return
+		}
+	}
+	currentCompose := readComposeServices(options.OutputFile)
+
+	affected := make(map[string]bool)
+	for _, line := range diffEnvVars(previousEnv, currentEnv, config) {
+		fmt.Println("  " + line.text)
+		if line.service != "" {
+			affected[line.service] = true
+		}
+	}
+	for _, line := range diffComposeServices(previousCompose, currentCompose) {
+		fmt.Println("  " + line.text)
+		affected[line.service] = true
+	}
+	for _, service := range changedServices {
+		affected[service] = true
+	}
+
+	var services []string
+	for service := range affected {
+		if _, ok := currentCompose[service]; ok {
+			services = append(services, service)
+		}
+	}
+	sort.Strings(services)
+
+	if len(services) == 0 {
+		fmt.Println("  No service affected")
+		return
+	}
+	fmt.Printf("  Affected services: %s\n", strings.Join(services, ", "))
+
+	if options.Hook != "" {
+		runWatchHook(options.Hook, services)
+	}
+}
+
+// captureOutput runs a generator, only forwarding its errors and warnings unless verbose. Policy violations are
+// printed with their severity in upper case, so the prefixes are matched in any case.
+func captureOutput(verbose bool, generate func()) {
+	if verbose {
+		generate()
+		return
+	}
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		generate()
+		return
+	}
+
+	stdout := os.Stdout
+	os.Stdout = writer
+	done := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if upper := strings.ToUpper(line); strings.HasPrefix(upper, "ERROR") || strings.HasPrefix(upper, "WARN") {
+				fmt.Fprintln(stdout, "  "+line)
+			}
+		}
+		io.Copy(io.Discard, reader)
+		close(done)
+	}()
+
+	generate()
+
+	os.Stdout = stdout
+	writer.Close()
+	<-done
+	reader.Close()
+}
+
+// readEnvVars parses a consolidated env file, returning an empty map when it is missing
+func readEnvVars(path string) map[string]string {
+	envVars := make(map[string]string)
+	if content, err := os.ReadFile(path); err == nil {
+		parseEnvFile(string(content), &envVars)
+	}
+
+	return envVars
+}
+
+// readComposeServices parses the services of a generated compose file
+func readComposeServices(path string) map[string]DockerComposeService {
+	var dockerCompose DockerComposeConfig
+	if content, err := os.ReadFile(path); err == nil {
+		yaml.Unmarshal(content, &dockerCompose)
+	}
+	if dockerCompose.Services == nil {
+		return map[string]DockerComposeService{}
+	}
+
+	return dockerCompose.Services
+}
+
+// sameKeys reports whether two variable maps define the same names
+func sameKeys(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key := range a {
+		if _, ok := b[key]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// diffLine is one line of the semantic diff, with the service it affects
+type diffLine struct {
+	service string
+	text    string
+}
+
+// serviceForVariable returns the service owning a consolidated variable, preferring the longest prefix
+func serviceForVariable(config Config, key string) ServiceConfig {
+	var owner ServiceConfig
+	for _, service := range getAllServiceConfigs(config) {
+		if service.Prefix != "" && strings.HasPrefix(key, service.Prefix) && len(service.Prefix) > len(owner.Prefix) {
+			owner = service
+		}
+	}
+
+	return owner
+}
+
+// diffEnvVars lists added, removed and changed consolidated variables, masking secrets
+func diffEnvVars(previous map[string]string, current map[string]string, config Config) []diffLine {
+	var keys []string
+	for key := range previous {
+		keys = append(keys, key)
+	}
+	for key := range current {
+		if _, ok := previous[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var lines []diffLine
+	for _, key := range keys {
+		service := serviceForVariable(config, key)
+		oldValue, hadOld := previous[key]
+		newValue, hasNew := current[key]
+		if isSecretVariable(service, key) {
+			oldValue, newValue = maskValue(oldValue), maskValue(newValue)
+		}
+
+		switch {
+		case !hadOld:
+			lines = append(lines, diffLine{service.Name, fmt.Sprintf("+ %s=%s", key, newValue)})
+		case !hasNew:
+			lines = append(lines, diffLine{service.Name, fmt.Sprintf("- %s", key)})
+		case previous[key] != current[key]:
+			lines = append(lines, diffLine{service.Name, fmt.Sprintf("~ %s: %s -> %s", key, oldValue, newValue)})
+		}
+	}
+
+	return lines
+}
+
+// diffComposeServices lists added and removed services, and the fields that changed in the others
+func diffComposeServices(previous map[string]DockerComposeService, current map[string]DockerComposeService) []diffLine {
+	var names []string
+	for name := range previous {
+		names = append(names, name)
+	}
+	for name := range current {
+		if _, ok := previous[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var lines []diffLine
+	for _, name := range names {
+		oldService, hadOld := previous[name]
+		newService, hasNew := current[name]
+
+		switch {
+		case !hadOld:
+			lines = append(lines, diffLine{name, fmt.Sprintf("+ service %s", name)})
+		case !hasNew:
+			lines = append(lines, diffLine{name, fmt.Sprintf("- service %s", name)})
+		default:
+			if fields := changedServiceFields(oldService, newService); len(fields) > 0 {
+				lines = append(lines, diffLine{name, fmt.Sprintf("~ service %s: %s", name, strings.Join(fields, ", "))})
+			}
+		}
+	}
+
+	return lines
+}
+
+// changedServiceFields returns the compose keys whose value differs between two versions of a service
+func changedServiceFields(previous DockerComposeService, current DockerComposeService) []string {
+	var fields []string
+	previousValue, currentValue := reflect.ValueOf(previous), reflect.ValueOf(current)
+	serviceType := previousValue.Type()
+
+	for i := 0; i < serviceType.NumField(); i++ {
+		name := strings.Split(serviceType.Field(i).Tag.Get("yaml"), ",")[0]
+		if name == "" {
+			continue
+		}
+		if !sameComposeValue(previousValue.Field(i).Interface(), currentValue.Field(i).Interface()) {
+			fields = append(fields, name)
+		}
+	}
+
+	for key, value := range current.ExtraFields {
+		if !sameComposeValue(previous.ExtraFields[key], value) {
+			fields = append(fields, key)
+		}
+	}
+	for key := range previous.ExtraFields {
+		if _, ok := current.ExtraFields[key]; !ok {
+			fields = append(fields, key)
+		}
+	}
+
+	return fields
+}
+
+// sameComposeValue compares two compose values, ignoring the order of string lists such as environment
+func sameComposeValue(previous any, current any) bool {
+	previousList, previousIsList := previous.([]any)
+	currentList, currentIsList := current.([]any)
+	if !previousIsList || !currentIsList {
+		return reflect.DeepEqual(previous, current)
+	}
+
+	sortedStrings := func(list []any) []string {
+		var items []string
+		for _, item := range list {
+			items = append(items, fmt.Sprint(item))
+		}
+		sort.Strings(items)
+		return items
+	}
+
+	return reflect.DeepEqual(sortedStrings(previousList), sortedStrings(currentList))
+}
+
+// runWatchHook runs the user hook, replacing {services} with the affected services
+func runWatchHook(hook string, services []string) {
+	command := strings.ReplaceAll(hook, "{services}", strings.Join(services, " "))
+	fmt.Printf("  Running hook: %s\n", command)
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "DEPLOYMENT_CHANGED_SERVICES="+strings.Join(services, " "))
+	if err := cmd.Run(); err != nil {
+		fmt.Printf("  Hook failed: %v\n", err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWatchedFilesFollowTheConfiguredEnvFiles(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "services-config.yaml")
+	config := `common_services:
+  - name: nats
+    env_file: nats/.env
+    prefix: "NATS_"
+services:
+  - name: api
+    env_file: config/api.env
+    prefix: "API_"
+  - name: worker
+    prefix: "WORKER_"
+`
+	if err := os.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	options := WatchOptions{
+		ConfigFile:   configFile,
+		TemplateFile: filepath.Join(dir, "docker-compose.template.yml"),
+		OutputFile:   filepath.Join(dir, "docker-compose.yml"),
+	}
+
+	want := map[string]watchedFile{
+		configFile:                                     {kind: "config"},
+		options.TemplateFile:                           {kind: "template"},
+		filepath.Join(dir, "images.lock"):              {kind: "compose"},
+		filepath.Join(dir, "releases.yaml"):            {kind: "compose"},
+		filepath.Join(dir, "nats", "nats-server.conf"): {kind: "compose"},
+		filepath.Join(dir, "nats", ".env"):             {kind: "env", service: "nats"},
+		filepath.Join(dir, "config", "api.env"):        {kind: "env", service: "api"},
+	}
+	if got := watchedFiles(options, dir, dir); !maps.Equal(got, want) {
+		t.Errorf("watchedFiles() = %v, want %v", got, want)
+	}
+}
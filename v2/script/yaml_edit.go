@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// YAMLFile holds the raw lines of a YAML file together with its parsed node tree.
+// Edits are spliced into the raw lines at positions found in the node tree, so
+// comments, blank lines and quoting of the untouched parts are kept as they are.
+type YAMLFile struct {
+	Path  string
+	Lines []string
+	Root  *yaml.Node
+}
+
+// loadYAMLFile reads and parses a YAML file for node-level editing
+func loadYAMLFile(path string) (*YAMLFile, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+
+	var document yaml.Node
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	if document.Kind != yaml.DocumentNode || len(document.Content) == 0 {
+		return nil, fmt.Errorf("%s does not contain a YAML document", path)
+	}
+
+	return &YAMLFile{
+		Path:  path,
+		Lines: strings.Split(strings.TrimRight(string(content), "\n"), "\n"),
+		Root:  document.Content[0],
+	}, nil
+}
+
+// reload parses the current lines again so node positions match the edited content
+func (f *YAMLFile) reload() error {
+	var document yaml.Node
+	if err := yaml.Unmarshal([]byte(f.String()), &document); err != nil {
+		return fmt.Errorf("edit of %s produced invalid YAML: %v", f.Path, err)
+	}
+	f.Root = document.Content[0]
+
+	return nil
+}
+
+// String returns the current content of the file
+func (f *YAMLFile) String() string {
+	return strings.Join(f.Lines, "\n") + "\n"
+}
+
+// Save validates and writes the edited file back to disk
+func (f *YAMLFile) Save() error {
+	if err := f.reload(); err != nil {
+		return err
+	}
+
+	return os.WriteFile(f.Path, []byte(f.String()), 0644)
+}
+
+// InsertLines inserts lines before the given 1-based line number
+func (f *YAMLFile) InsertLines(before int, lines []string) error {
+	index := min(max(before-1, 0), len(f.Lines))
+
+	updated := append([]string{}, f.Lines[:index]...)
+	updated = append(updated, lines...)
+	f.Lines = append(updated, f.Lines[index:]...)
+
+	return f.reload()
+}
+
+// RemoveLines removes the 1-based inclusive line range, collapsing the blank lines left around it
+func (f *YAMLFile) RemoveLines(start int, end int) error {
+	start = max(start, 1)
+	end = min(end, len(f.Lines))
+
+	updated := append([]string{}, f.Lines[:start-1]...)
+	rest := f.Lines[end:]
+	precededByBlank := len(updated) > 0 && strings.TrimSpace(updated[len(updated)-1]) == ""
+	// Removing the first entry under a key must not leave a blank line below the key
+	precededByKey := len(updated) > 0 && strings.HasSuffix(strings.TrimSpace(updated[len(updated)-1]), ":")
+	if len(rest) > 0 && strings.TrimSpace(rest[0]) == "" && (len(updated) == 0 || precededByBlank || precededByKey) {
+		rest = rest[1:]
+	} else if precededByBlank && (len(rest) == 0 || strings.HasPrefix(strings.TrimSpace(rest[0]), "#")) {
+		// Removing the last entry of a list, keep the trailing comment attached to the previous one
+		updated = updated[:len(updated)-1]
+	}
+	f.Lines = append(updated, rest...)
+
+	return f.reload()
+}
+
+// ReplaceScalar replaces the text of a single-line scalar node, keeping its quoting and the rest of the line
+func (f *YAMLFile) ReplaceScalar(node *yaml.Node, value string) error {
+	if node.Kind != yaml.ScalarNode || node.Line < 1 || node.Line > len(f.Lines) {
+		return fmt.Errorf("%s: cannot replace a non-scalar node", f.Path)
+	}
+	line := f.Lines[node.Line-1]
+	start := node.Column - 1
+	if start >= len(line) {
+		return fmt.Errorf("%s:%d: scalar not found on its line", f.Path, node.Line)
+	}
+
+	end := start + len(node.Value)
+	switch node.Style {
+	case yaml.DoubleQuotedStyle, yaml.SingleQuotedStyle:
+		closing := strings.IndexByte(line[start+1:], line[start])
+		if closing < 0 {
+			return fmt.Errorf("%s:%d: multi-line quoted scalars are not supported", f.Path, node.Line)
+		}
+		end = start + closing + 2
+		value = string(line[start]) + value + string(line[start])
+	case yaml.LiteralStyle, yaml.FoldedStyle:
+		return fmt.Errorf("%s:%d: block scalars are not supported", f.Path, node.Line)
+	}
+	if end > len(line) || (node.Style == 0 && line[start:end] != node.Value) {
+		return fmt.Errorf("%s:%d: scalar %q not found on its line", f.Path, node.Line, node.Value)
+	}
+	f.Lines[node.Line-1] = line[:start] + value + line[end:]
+
+	return f.reload()
+}
+
+// mappingEntry returns the key and value nodes of a key in a mapping node
+func mappingEntry(mapping *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if mapping == nil || mapping.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i], mapping.Content[i+1]
+		}
+	}
+
+	return nil, nil
+}
+
+// nodeEndLine returns the last line used by a node and all of its children
+func nodeEndLine(node *yaml.Node) int {
+	end := node.Line
+	for _, child := range node.Content {
+		end = max(end, nodeEndLine(child))
+	}
+
+	return end
+}
+
+// commentBlockEnd returns the last line of the comment lines indented by at least indent columns that directly
+// follow line end, such as the commented-out examples of an entry, or end when there are none
+func (f *YAMLFile) commentBlockEnd(end int, indent int) int {
+	for end < len(f.Lines) {
+		line := f.Lines[end]
+		trimmed := strings.TrimLeft(line, " ")
+		if !strings.HasPrefix(trimmed, "#") || len(line)-len(trimmed) < indent {
+			break
+		}
+		end++
+	}
+
+	return end
+}
+
+// sequenceItemByName finds the mapping item of a sequence whose name field matches
+func sequenceItemByName(sequence *yaml.Node, name string) (int, *yaml.Node) {
+	if sequence == nil || sequence.Kind != yaml.SequenceNode {
+		return -1, nil
+	}
+
+	for i, item := range sequence.Content {
+		if _, value := mappingEntry(item, "name"); value != nil && value.Value == name {
+			return i, item
+		}
+	}
+
+	return -1, nil
+}
+
+// indentLines prefixes every non-empty line with the given indentation
+func indentLines(lines []string, indent string) []string {
+	indented := make([]string, len(lines))
+	for i, line := range lines {
+		if line != "" {
+			indented[i] = indent + line
+		}
+	}
+
+	return indented
+}
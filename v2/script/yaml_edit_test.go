@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testYAMLFile writes content to a temporary file and loads it for editing
+func testYAMLFile(t *testing.T, content string) *YAMLFile {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := loadYAMLFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+const testServicesConfig = `# Services
+services:
+  - name: api
+    prefix: "API_"
+    # metrics:
+    #   port: PORT
+
+  - name: crawler
+    prefix: "CRAWLER_"
+    # nats:
+    #   publish: [crawler.results]
+  # Add more services here as needed
+`
+
+func TestRemoveLinesCollapsesBlankLines(t *testing.T) {
+	file := testYAMLFile(t, testServicesConfig)
+	_, services := mappingEntry(file.Root, "services")
+	_, item := sequenceItemByName(services, "api")
+	if item == nil {
+		t.Fatal("service api not found")
+	}
+
+	if err := file.RemoveLines(item.Line, file.commentBlockEnd(nodeEndLine(item), item.Column-1)); err != nil {
+		t.Fatal(err)
+	}
+	want := `# Services
+services:
+  - name: crawler
+    prefix: "CRAWLER_"
+    # nats:
+    #   publish: [crawler.results]
+  # Add more services here as needed
+`
+	if got := file.String(); got != want {
+		t.Errorf("after removing api:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRemoveLastEntryKeepsTrailingComment(t *testing.T) {
+	file := testYAMLFile(t, testServicesConfig)
+	_, services := mappingEntry(file.Root, "services")
+	_, item := sequenceItemByName(services, "crawler")
+
+	end := file.commentBlockEnd(nodeEndLine(item), item.Column-1)
+	if got := file.Lines[end-1]; got != "    #   publish: [crawler.results]" {
+		t.Errorf("comment block of crawler ends on %q", got)
+	}
+	if err := file.RemoveLines(item.Line, end); err != nil {
+		t.Fatal(err)
+	}
+	if got := file.String(); !strings.HasSuffix(got, "    #   port: PORT\n  # Add more services here as needed\n") {
+		t.Errorf("after removing crawler:\n%s", got)
+	}
+	if strings.Contains(file.String(), "nats:") {
+		t.Error("the commented-out nats example of crawler was left behind")
+	}
+}
+
+func TestInsertLinesReparses(t *testing.T) {
+	file := testYAMLFile(t, testServicesConfig)
+	_, services := mappingEntry(file.Root, "services")
+	_, item := sequenceItemByName(services, "api")
+
+	if err := file.InsertLines(nodeEndLine(item)+1, indentLines([]string{"groups: [core]", "", "domain: api.local"}, "    ")); err != nil {
+		t.Fatal(err)
+	}
+	_, services = mappingEntry(file.Root, "services")
+	_, item = sequenceItemByName(services, "api")
+	if _, domain := mappingEntry(item, "domain"); domain == nil || domain.Value != "api.local" {
+		t.Fatalf("inserted domain not parsed:\n%s", file.String())
+	}
+	if file.Lines[nodeEndLine(item)-2] != "" {
+		t.Error("indentLines indented an empty line")
+	}
+
+	if err := file.InsertLines(3, []string{"  - name: [broken"}); err == nil {
+		t.Error("inserting invalid YAML did not fail")
+	}
+}
+
+func TestReplaceScalarKeepsQuoting(t *testing.T) {
+	file := testYAMLFile(t, "image: postgres:17.4 # pinned\ntag: \"1.0\"\nname: 'api'\nscript: |\n  run\n")
+
+	for key, value := range map[string]string{"image": "postgres:17.5", "tag": "1.1", "name": "web"} {
+		_, node := mappingEntry(file.Root, key)
+		if err := file.ReplaceScalar(node, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := "image: postgres:17.5 # pinned\ntag: \"1.1\"\nname: 'web'\nscript: |\n  run\n"
+	if got := file.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	_, script := mappingEntry(file.Root, "script")
+	if err := file.ReplaceScalar(script, "stop"); err == nil {
+		t.Error("replacing a block scalar did not fail")
+	}
+}
+
+func TestLoadYAMLFileErrors(t *testing.T) {
+	if _, err := loadYAMLFile(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("loading a missing file did not fail")
+	}
+	path := filepath.Join(t.TempDir(), "empty.yaml")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadYAMLFile(path); err == nil {
+		t.Error("loading an empty file did not fail")
+	}
+}